@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/akalpaki/todo/internal/todo"
+	"github.com/akalpaki/todo/internal/user"
+)
+
+// commands are run instead of the server when one of them is named after the flags.
+var commands = map[string]func(ctx context.Context, pool *pgxpool.Pool, args []string) error{
+	"import": runImport,
+	"export": runExport,
+}
+
+func runCommand(connStr string, args []string) {
+	command, ok := commands[args[0]]
+	if !ok {
+		log.Fatalf("main: unknown command %q, run with -h for help", args[0])
+	}
+
+	pool := connectToDB(connStr)
+	err := command(context.Background(), pool, args[1:])
+	pool.Close()
+	if err != nil {
+		log.Fatalf("%s: %s", args[0], err.Error())
+	}
+}
+
+// runImport adds the tasks of a file to one of the user's todo lists, or to a new one, and prints what was imported.
+func runImport(ctx context.Context, pool *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	email := fs.String("user", "", "email of the user the tasks are imported for")
+	listID := fs.String("list", "", "id of the todo list the tasks are added to, a new list is created if empty")
+	name := fs.String("name", "", "name of the new todo list, defaults to the name of the file")
+	format := fs.String("format", "todotxt", "format of the file, one of "+formatNames())
+	dryRun := fs.Bool("dry_run", false, "only report what would be imported")
+	fs.Parse(args)
+
+	f, ok := todo.FileFormats[*format]
+	if !ok {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected the path of a single file, or - for the standard input")
+	}
+	path := fs.Arg(0)
+
+	if *listID == "" && *name == "" {
+		if path == "-" {
+			return fmt.Errorf("the new todo list needs a name")
+		}
+		*name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	userID, err := commandUser(ctx, pool, *email)
+	if err != nil {
+		return err
+	}
+	repository := todo.NewRepository(pool)
+	if *listID != "" {
+		if err := checkList(ctx, repository, *listID, userID); err != nil {
+			return err
+		}
+	}
+
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	result, err := repository.Import(ctx, userID, *listID, *name, f.NewReader(in), *dryRun)
+	if err != nil {
+		return err
+	}
+	out := json.NewEncoder(os.Stdout)
+	out.SetIndent("", "  ")
+	return out.Encode(result)
+}
+
+// runExport writes the tasks of one of the user's todo lists to a file, or to the standard output.
+func runExport(ctx context.Context, pool *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	email := fs.String("user", "", "email of the user the todo list belongs to")
+	listID := fs.String("list", "", "id of the todo list to export")
+	format := fs.String("format", "todotxt", "format of the file, one of "+formatNames())
+	output := fs.String("o", "-", "path of the file written, or - for the standard output")
+	fs.Parse(args)
+
+	f, ok := todo.FileFormats[*format]
+	if !ok {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if *listID == "" {
+		return fmt.Errorf("the todo list to export is required")
+	}
+
+	userID, err := commandUser(ctx, pool, *email)
+	if err != nil {
+		return err
+	}
+	repository := todo.NewRepository(pool)
+	if err := checkList(ctx, repository, *listID, userID); err != nil {
+		return err
+	}
+
+	tasks, err := repository.ExportTasks(ctx, *listID)
+	if err != nil {
+		return err
+	}
+
+	if *output == "-" {
+		return f.Write(os.Stdout, tasks)
+	}
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := f.Write(file, tasks); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// commandUser looks up the id of the user a command runs for, the changes made being recorded in the history as theirs.
+func commandUser(ctx context.Context, pool *pgxpool.Pool, email string) (string, error) {
+	if email == "" {
+		return "", fmt.Errorf("the email of the user is required")
+	}
+	u, err := user.NewRepository(pool).GetByEmail(ctx, email)
+	if err != nil {
+		return "", fmt.Errorf("user %s: %w", email, err)
+	}
+	return u.ID, nil
+}
+
+// checkList makes sure the todo list exists and belongs to the user.
+func checkList(ctx context.Context, repository *todo.Repository, todoID, userID string) error {
+	list, err := repository.GetByID(ctx, userID, todoID)
+	if err != nil {
+		return fmt.Errorf("todo list %s: %w", todoID, err)
+	}
+	if list.AuthorID != userID {
+		return fmt.Errorf("todo list %s does not belong to the user", todoID)
+	}
+	return nil
+}
+
+func formatNames() string {
+	names := make([]string, 0, len(todo.FileFormats))
+	for name := range todo.FileFormats {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
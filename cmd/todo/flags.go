@@ -15,6 +15,10 @@ const (
 	defaulLogLevel     = -4 // debug level in log/slog
 	defualtTokenExpiry = 30 * time.Minute
 	defaultConnStr     = "host=todo_db user=postgres password=postgres dbname=postgres sslmode=disable"
+	defaultRetention   = 30 * 24 * time.Hour
+	defaultHistory     = 90 * 24 * time.Hour
+	defaultIdempotency = 24 * time.Hour
+	defaultMailFrom    = "todo@localhost"
 )
 
 var (
@@ -26,6 +30,13 @@ var (
 	loggerOutput   string
 	secret         string
 	tokenExpiry    time.Duration
+	trashRetention time.Duration
+	history        time.Duration
+	idempotency    time.Duration
+	smtpAddr       string
+	smtpUsername   string
+	smtpPassword   string
+	mailFrom       string
 	h              bool
 )
 
@@ -37,6 +48,13 @@ func init() {
 	flag.StringVar(&loggerOutput, "log_output", lookupEnvString("LOG_OUTPUT", os.Stdout.Name()), "path to the logger's output file")
 	flag.StringVar(&secret, "secret", lookupEnvString("JWT_SECRET_KEY", "secret"), "jwt signing key")
 	flag.DurationVar(&tokenExpiry, "token_exp", lookupEnvDuration("TOKEN_EXPIRY", defualtTokenExpiry), "expiration time of jwt tokens")
+	flag.DurationVar(&trashRetention, "trash_retention", lookupEnvDuration("TRASH_RETENTION", defaultRetention), "how long deleted items are kept in the trash")
+	flag.DurationVar(&history, "history_retention", lookupEnvDuration("HISTORY_RETENTION", defaultHistory), "how long revisions can be reverted to")
+	flag.DurationVar(&idempotency, "idempotency_window", lookupEnvDuration("IDEMPOTENCY_WINDOW", defaultIdempotency), "how long responses to idempotency keys are kept")
+	flag.StringVar(&smtpAddr, "smtp_addr", lookupEnvString("SMTP_ADDR", ""), "host:port of the smtp server emails are sent through, emails are only logged if empty")
+	flag.StringVar(&smtpUsername, "smtp_username", lookupEnvString("SMTP_USERNAME", ""), "smtp username")
+	flag.StringVar(&smtpPassword, "smtp_password", lookupEnvString("SMTP_PASSWORD", ""), "smtp password")
+	flag.StringVar(&mailFrom, "mail_from", lookupEnvString("MAIL_FROM", defaultMailFrom), "sender address of emails")
 	flag.BoolVar(&h, "h", false, "prints help text")
 
 	flag.Parse()
@@ -63,6 +81,21 @@ func loadConfig() *config.Config {
 			secret,
 			tokenExpiry,
 		),
+		config.WithTrashOptions(
+			trashRetention,
+		),
+		config.WithHistoryOptions(
+			history,
+		),
+		config.WithIdempotencyOptions(
+			idempotency,
+		),
+		config.WithMailOptions(
+			smtpAddr,
+			smtpUsername,
+			smtpPassword,
+			mailFrom,
+		),
 	)
 }
 
@@ -120,6 +153,39 @@ func help() {
 		ATTENTION: this should be formatted as a string that can be parsed by time.ParseDuration (https://pkg.go.dev/time#ParseDuration)
 		default :  30 minutes
 	--conn_str : database connection string
+	--trash_retention : how long deleted todo lists and tasks are kept in the trash before being purged
+		ATTENTION: this should be formatted as a string that can be parsed by time.ParseDuration (https://pkg.go.dev/time#ParseDuration)
+		default :  720 hours (30 days)
+	--history_retention : how long a todo list can be reverted to one of its revisions, which stay in its history afterwards
+		ATTENTION: this should be formatted as a string that can be parsed by time.ParseDuration (https://pkg.go.dev/time#ParseDuration)
+		default :  2160 hours (90 days)
+	--idempotency_window : how long the response to a request with an Idempotency-Key is replayed to its retries
+		ATTENTION: this should be formatted as a string that can be parsed by time.ParseDuration (https://pkg.go.dev/time#ParseDuration)
+		default :  24 hours
+	--smtp_addr : host:port of the smtp server emails are sent through
+		default :  none, emails are only logged
+	--smtp_username : smtp username, if the server requires authentication
+	--smtp_password : smtp password
+	--mail_from : sender address of emails
+		default :  todo@localhost
+
+	Instead of running the server, the following commands can be given after the flags:
+	import [options] FILE : adds the tasks of FILE, or of the standard input if FILE is -, to a todo list
+		--user : email of the user the tasks are imported for
+		--list : id of the todo list the tasks are added to
+			default :  none, a new todo list is created
+		--name : name of the new todo list
+			default :  the name of FILE without its extension
+		--format : format of FILE, one of csv, markdown, todotxt
+			default :  todotxt
+		--dry_run : only prints what would be imported
+	export [options] : writes the tasks of a todo list, subtasks right after their parent
+		--user : email of the user the todo list belongs to
+		--list : id of the todo list
+		--format : format of the file written, one of csv, markdown, todotxt
+			default :  todotxt
+		-o : path of the file written
+			default :  the standard output
 	`
 	fmt.Println(text)
 	os.Exit(0)
@@ -2,30 +2,114 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	// time zones of users are loaded even where the system has no time zone database
+	_ "time/tzdata"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 
 	"github.com/akalpaki/todo/internal/app"
+	"github.com/akalpaki/todo/internal/notification"
+	"github.com/akalpaki/todo/internal/todo"
+	"github.com/akalpaki/todo/internal/webhook"
+	"github.com/akalpaki/todo/pkg/jobs"
+	"github.com/akalpaki/todo/pkg/mail"
+	"github.com/akalpaki/todo/pkg/outbox"
 )
 
+// shutdownTimeout is how long in-flight requests are given to complete on shutdown.
+const shutdownTimeout = 15 * time.Second
+
 func main() {
 	cfg := loadConfig()
+	if flag.NArg() > 0 {
+		runCommand(cfg.ConnStr, flag.Args())
+		return
+	}
 	log.Println("Config: ", cfg)
 	pool := initDatabase(cfg.ConnStr)
 	logger := initLogger(cfg.LogLevel, cfg.LoggerOutput)
 
-	app := app.New(cfg, logger, pool)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	broker := todo.NewBroker(pool, logger)
+	go broker.Run(ctx)
+
+	app := app.New(cfg, logger, pool, broker)
+
+	webhookRepo := webhook.NewRepository(pool)
+	notificationRepo := notification.NewRepository(pool)
+	events := outbox.NewDispatcher(pool, logger)
+	events.Subscribe("webhooks", webhookRepo.Enqueue)
+	events.Subscribe("notifications", notificationRepo.Notify)
+	go events.Run(ctx)
+	go webhook.NewDispatcher(webhookRepo, webhook.NewClient(), logger).Run(ctx)
+
+	var mailer mail.Mailer = mail.NewLogMailer(logger)
+	if cfg.SMTPAddr != "" {
+		mailer = mail.NewSMTPMailer(cfg.SMTPAddr, cfg.MailFrom, cfg.SMTPUsername, cfg.SMTPPassword)
+	}
+	notifier := notification.NewNotifier(notificationRepo, logger,
+		notification.NewInAppChannel(notificationRepo),
+		notification.NewEmailChannel(mailer),
+		notification.NewWebhookChannel(webhook.NewClient()),
+	)
+	digester := notification.NewDigester(notificationRepo, mailer, logger)
+
+	queue := jobs.NewQueue(pool, logger)
+	queue.Register(todo.PurgeTrashJob, todo.PurgeTrashHandler(logger, todo.NewRepository(pool), cfg.TrashRetention), jobs.Options{})
+	queue.Register(todo.CompactHistoryJob, todo.CompactHistoryHandler(logger, todo.NewRepository(pool), cfg.HistoryRetention), jobs.Options{})
+	queue.Register(notification.RemindJob, notifier.HandleRemind, jobs.Options{})
+	queue.Register(notification.DigestJob, digester.HandleDigest, jobs.Options{})
+	if err := queue.Schedule("purge_trash", "@hourly", todo.PurgeTrashJob, nil); err != nil {
+		log.Fatalf("main: scheduling jobs: %s", err.Error())
+	}
+	if err := queue.Schedule("compact_history", "@daily", todo.CompactHistoryJob, nil); err != nil {
+		log.Fatalf("main: scheduling jobs: %s", err.Error())
+	}
+	if err := queue.Schedule("remind", "* * * * *", notification.RemindJob, nil); err != nil {
+		log.Fatalf("main: scheduling jobs: %s", err.Error())
+	}
+	if err := queue.Schedule("digest", "* * * * *", notification.DigestJob, nil); err != nil {
+		log.Fatalf("main: scheduling jobs: %s", err.Error())
+	}
+	queueDone := make(chan struct{})
+	go func() {
+		queue.Run(ctx)
+		close(queueDone)
+	}()
+
 	httpSrv := http.Server{
 		Addr:    ":8000",
 		Handler: app,
 	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpSrv.Shutdown(shutdownCtx); err != nil {
+			log.Println("main: shutting down server: ", err)
+		}
+	}()
 
 	log.Println("server running at port ", cfg.ListenAddr)
-	log.Fatal(httpSrv.ListenAndServe())
+	if err := httpSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+
+	// let the running jobs finish before the pool goes away
+	<-queueDone
+	pool.Close()
+	log.Println("server stopped")
 }
 
 func initDatabase(connStr string) *pgxpool.Pool {
@@ -79,6 +163,394 @@ func setupTables(conn *pgxpool.Pool) error {
 				REFERENCES todos(id)
 				ON DELETE CASCADE
 	);
+	CREATE TABLE IF NOT EXISTS tags (
+		id VARCHAR(21) PRIMARY KEY,
+		user_id VARCHAR(21) NOT NULL,
+		name TEXT NOT NULL,
+		color VARCHAR(7) NOT NULL,
+		UNIQUE (user_id, name),
+		CONSTRAINT user_id
+			FOREIGN KEY(user_id)
+				REFERENCES users(id)
+				ON DELETE CASCADE
+	);
+	CREATE TABLE IF NOT EXISTS todo_tags (
+		todo_id VARCHAR(21) NOT NULL REFERENCES todos(id) ON DELETE CASCADE,
+		tag_id VARCHAR(21) NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+		PRIMARY KEY (todo_id, tag_id)
+	);
+	CREATE TABLE IF NOT EXISTS task_tags (
+		task_id VARCHAR(21) NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+		tag_id VARCHAR(21) NOT NULL REFERENCES tags(id) ON DELETE CASCADE,
+		PRIMARY KEY (task_id, tag_id)
+	);
+	ALTER TABLE tasks
+		ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 0,
+		ADD COLUMN IF NOT EXISTS due_at TIMESTAMPTZ;
+	CREATE TABLE IF NOT EXISTS task_focus (
+		task_id VARCHAR(21) NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+		user_id VARCHAR(21) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		PRIMARY KEY (task_id, user_id)
+	);
+	ALTER TABLE tasks
+		ADD COLUMN IF NOT EXISTS parent_id VARCHAR(21) REFERENCES tasks(id) ON DELETE CASCADE,
+		ADD COLUMN IF NOT EXISTS auto_complete BOOLEAN NOT NULL DEFAULT FALSE;
+	CREATE INDEX IF NOT EXISTS tasks_parent_id_idx ON tasks (parent_id);
+	CREATE TABLE IF NOT EXISTS task_dependencies (
+		task_id VARCHAR(21) NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+		depends_on_id VARCHAR(21) NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+		PRIMARY KEY (task_id, depends_on_id),
+		CHECK (task_id <> depends_on_id)
+	);
+	ALTER TABLE tasks ADD COLUMN IF NOT EXISTS rank TEXT COLLATE "C";
+	UPDATE tasks SET rank = lpad(to_hex(COALESCE(task_order, 0)), 8, '0') || 'V' WHERE rank IS NULL;
+	ALTER TABLE tasks ALTER COLUMN rank SET NOT NULL;
+	ALTER TABLE todos
+		ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+		ADD COLUMN IF NOT EXISTS archived_at TIMESTAMPTZ;
+	ALTER TABLE tasks ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS todos_deleted_at_idx ON todos (deleted_at) WHERE deleted_at IS NOT NULL;
+	CREATE INDEX IF NOT EXISTS tasks_deleted_at_idx ON tasks (deleted_at) WHERE deleted_at IS NOT NULL;
+	CREATE TABLE IF NOT EXISTS todo_revisions (
+		id BIGSERIAL PRIMARY KEY,
+		todo_id VARCHAR(21) NOT NULL REFERENCES todos(id) ON DELETE CASCADE,
+		actor_id VARCHAR(21) REFERENCES users(id) ON DELETE SET NULL,
+		action TEXT NOT NULL,
+		changes JSONB NOT NULL,
+		snapshot JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS todo_revisions_todo_id_idx ON todo_revisions (todo_id, id);
+	ALTER TABLE todos ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+	ALTER TABLE tasks ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+	-- bump_version moves a todo or a task to its next version whenever one of its columns changes,
+	-- and marks it as changed by the current transaction for delta sync.
+	CREATE OR REPLACE FUNCTION bump_version() RETURNS trigger AS $$
+	BEGIN
+		IF NEW.version = OLD.version THEN
+			NEW.version := OLD.version + 1;
+		END IF;
+		NEW.sync_xid := pg_current_xact_id();
+		RETURN NEW;
+	END $$ LANGUAGE plpgsql;
+	-- touch_todo bumps the version of the todo list a changed task or todo tag belongs to.
+	CREATE OR REPLACE FUNCTION touch_todo() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP <> 'DELETE' THEN
+			UPDATE todos SET version = version + 1 WHERE id = NEW.todo_id;
+		END IF;
+		IF TG_OP = 'DELETE' OR (TG_OP = 'UPDATE' AND OLD.todo_id <> NEW.todo_id) THEN
+			UPDATE todos SET version = version + 1 WHERE id = OLD.todo_id;
+		END IF;
+		RETURN NULL;
+	END $$ LANGUAGE plpgsql;
+	-- touch_task bumps the version of the task a changed tag, dependency or focus entry belongs to.
+	CREATE OR REPLACE FUNCTION touch_task() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			UPDATE tasks SET version = version + 1 WHERE id = OLD.task_id;
+		ELSE
+			UPDATE tasks SET version = version + 1 WHERE id = NEW.task_id;
+		END IF;
+		RETURN NULL;
+	END $$ LANGUAGE plpgsql;
+	-- touch_tagged bumps the versions of the todo lists and tasks carrying a changed tag, which is part of them.
+	CREATE OR REPLACE FUNCTION touch_tagged() RETURNS trigger AS $$
+	BEGIN
+		UPDATE todos SET version = version + 1 WHERE id IN (SELECT todo_id FROM todo_tags WHERE tag_id = NEW.id);
+		UPDATE tasks SET version = version + 1 WHERE id IN (SELECT task_id FROM task_tags WHERE tag_id = NEW.id);
+		RETURN NULL;
+	END $$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS todos_version ON todos;
+	CREATE TRIGGER todos_version BEFORE UPDATE ON todos
+		FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION bump_version();
+	DROP TRIGGER IF EXISTS tasks_version ON tasks;
+	CREATE TRIGGER tasks_version BEFORE UPDATE ON tasks
+		FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION bump_version();
+	DROP TRIGGER IF EXISTS tasks_touch_todo ON tasks;
+	CREATE TRIGGER tasks_touch_todo AFTER INSERT OR DELETE ON tasks
+		FOR EACH ROW EXECUTE FUNCTION touch_todo();
+	DROP TRIGGER IF EXISTS tasks_update_touch_todo ON tasks;
+	CREATE TRIGGER tasks_update_touch_todo AFTER UPDATE ON tasks
+		FOR EACH ROW WHEN (OLD.version <> NEW.version) EXECUTE FUNCTION touch_todo();
+	DROP TRIGGER IF EXISTS todo_tags_touch_todo ON todo_tags;
+	CREATE TRIGGER todo_tags_touch_todo AFTER INSERT OR DELETE ON todo_tags
+		FOR EACH ROW EXECUTE FUNCTION touch_todo();
+	DROP TRIGGER IF EXISTS task_tags_touch_task ON task_tags;
+	CREATE TRIGGER task_tags_touch_task AFTER INSERT OR DELETE ON task_tags
+		FOR EACH ROW EXECUTE FUNCTION touch_task();
+	DROP TRIGGER IF EXISTS task_dependencies_touch_task ON task_dependencies;
+	CREATE TRIGGER task_dependencies_touch_task AFTER INSERT OR DELETE ON task_dependencies
+		FOR EACH ROW EXECUTE FUNCTION touch_task();
+	DROP TRIGGER IF EXISTS task_focus_touch_task ON task_focus;
+	CREATE TRIGGER task_focus_touch_task AFTER INSERT OR DELETE ON task_focus
+		FOR EACH ROW EXECUTE FUNCTION touch_task();
+	DROP TRIGGER IF EXISTS tags_touch_tagged ON tags;
+	CREATE TRIGGER tags_touch_tagged AFTER UPDATE ON tags
+		FOR EACH ROW WHEN (OLD.* IS DISTINCT FROM NEW.*) EXECUTE FUNCTION touch_tagged();
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id VARCHAR(21) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		key TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status INT,
+		header JSONB,
+		body BYTEA,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (user_id, key)
+	);
+	CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+	ALTER TABLE todos ADD COLUMN IF NOT EXISTS sync_xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+	ALTER TABLE tasks ADD COLUMN IF NOT EXISTS sync_xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+	CREATE INDEX IF NOT EXISTS todos_author_id_sync_xid_idx ON todos (author_id, sync_xid);
+	CREATE INDEX IF NOT EXISTS tasks_todo_id_sync_xid_idx ON tasks (todo_id, sync_xid);
+	ALTER TABLE todo_revisions ADD COLUMN IF NOT EXISTS sync_xid xid8 NOT NULL DEFAULT pg_current_xact_id();
+	CREATE INDEX IF NOT EXISTS todo_revisions_sync_xid_idx ON todo_revisions (sync_xid, id);
+	CREATE TABLE IF NOT EXISTS sync_tombstones (
+		entity TEXT NOT NULL,
+		id VARCHAR(21) NOT NULL,
+		todo_id VARCHAR(21) NOT NULL,
+		user_id VARCHAR(21) NOT NULL,
+		sync_xid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+		deleted_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (entity, id)
+	);
+	CREATE INDEX IF NOT EXISTS sync_tombstones_user_id_idx ON sync_tombstones (user_id, sync_xid);
+	CREATE TABLE IF NOT EXISTS sync_horizon (
+		id BOOLEAN PRIMARY KEY DEFAULT TRUE CHECK (id),
+		xid xid8 NOT NULL
+	);
+	-- record_tombstone remembers a todo list or task deleted for good, so that delta sync clients learn about it.
+	-- Tasks deleted along with their list are covered by the list's tombstone.
+	CREATE OR REPLACE FUNCTION record_tombstone() RETURNS trigger AS $$
+	BEGIN
+		IF TG_TABLE_NAME = 'todos' THEN
+			INSERT INTO sync_tombstones (entity, id, todo_id, user_id) VALUES ('todo', OLD.id, OLD.id, OLD.author_id)
+			ON CONFLICT (entity, id, user_id) DO UPDATE SET sync_xid = EXCLUDED.sync_xid, deleted_at = EXCLUDED.deleted_at;
+		ELSE
+			INSERT INTO sync_tombstones (entity, id, todo_id, user_id)
+			SELECT 'task', OLD.id, OLD.todo_id, author_id FROM todos WHERE id = OLD.todo_id
+			ON CONFLICT (entity, id, user_id) DO UPDATE
+				SET todo_id = EXCLUDED.todo_id, sync_xid = EXCLUDED.sync_xid, deleted_at = EXCLUDED.deleted_at;
+		END IF;
+		RETURN NULL;
+	END $$ LANGUAGE plpgsql;
+	-- clear_tombstone forgets the tombstone of a task recreated by reverting its list.
+	CREATE OR REPLACE FUNCTION clear_tombstone() RETURNS trigger AS $$
+	BEGIN
+		DELETE FROM sync_tombstones WHERE entity = 'task' AND id = NEW.id;
+		RETURN NULL;
+	END $$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS todos_tombstone ON todos;
+	CREATE TRIGGER todos_tombstone AFTER DELETE ON todos
+		FOR EACH ROW EXECUTE FUNCTION record_tombstone();
+	DROP TRIGGER IF EXISTS tasks_tombstone ON tasks;
+	CREATE TRIGGER tasks_tombstone AFTER DELETE ON tasks
+		FOR EACH ROW EXECUTE FUNCTION record_tombstone();
+	DROP TRIGGER IF EXISTS tasks_clear_tombstone ON tasks;
+	CREATE TRIGGER tasks_clear_tombstone AFTER INSERT ON tasks
+		FOR EACH ROW EXECUTE FUNCTION clear_tombstone();
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id VARCHAR(21) PRIMARY KEY,
+		user_id VARCHAR(21) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		url TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		events TEXT[] NOT NULL,
+		active BOOLEAN NOT NULL DEFAULT TRUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS webhooks_user_id_idx ON webhooks (user_id);
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id BIGSERIAL PRIMARY KEY,
+		webhook_id VARCHAR(21) NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+		event_type TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		delivered_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, id);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+	CREATE TABLE IF NOT EXISTS webhook_attempts (
+		id BIGSERIAL PRIMARY KEY,
+		delivery_id BIGINT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+		status_code INT,
+		error TEXT,
+		duration_ms INT NOT NULL,
+		attempted_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS webhook_attempts_delivery_id_idx ON webhook_attempts (delivery_id, id);
+	CREATE TABLE IF NOT EXISTS outbox_events (
+		id BIGSERIAL PRIMARY KEY,
+		type TEXT NOT NULL,
+		aggregate_id VARCHAR(21) NOT NULL,
+		user_id VARCHAR(21) NOT NULL,
+		payload JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		delivered_to TEXT[] NOT NULL DEFAULT '{}',
+		attempts INT NOT NULL DEFAULT 0,
+		next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		last_error TEXT,
+		dispatched_at TIMESTAMPTZ
+	);
+	CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (id) WHERE dispatched_at IS NULL;
+	CREATE INDEX IF NOT EXISTS outbox_events_dispatched_at_idx ON outbox_events (dispatched_at);
+	-- webhook deliveries are queued from the outbox, once per event
+	DROP INDEX IF EXISTS todo_revisions_webhooks_pending_idx;
+	ALTER TABLE todo_revisions DROP COLUMN IF EXISTS webhooks_pending;
+	ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS event_id BIGINT;
+	CREATE UNIQUE INDEX IF NOT EXISTS webhook_deliveries_event_idx ON webhook_deliveries (webhook_id, event_id, event_type);
+	CREATE TABLE IF NOT EXISTS jobs (
+		id BIGSERIAL PRIMARY KEY,
+		kind TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		run_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS jobs_kind_run_at_idx ON jobs (kind, run_at);
+	CREATE TABLE IF NOT EXISTS jobs_dead (
+		id BIGINT PRIMARY KEY,
+		kind TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		attempts INT NOT NULL,
+		last_error TEXT,
+		created_at TIMESTAMPTZ NOT NULL,
+		failed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE TABLE IF NOT EXISTS job_schedules (
+		name TEXT PRIMARY KEY,
+		spec TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		payload JSONB NOT NULL,
+		next_run_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE TABLE IF NOT EXISTS notification_settings (
+		user_id VARCHAR(21) PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		time_zone TEXT NOT NULL DEFAULT 'UTC',
+		quiet_start TEXT,
+		quiet_end TEXT,
+		channels TEXT[] NOT NULL,
+		webhook_url TEXT
+	);
+	CREATE TABLE IF NOT EXISTS reminders (
+		id VARCHAR(21) PRIMARY KEY,
+		task_id VARCHAR(21) NOT NULL REFERENCES tasks(id) ON DELETE CASCADE,
+		user_id VARCHAR(21) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		remind_at TIMESTAMPTZ NOT NULL,
+		next_attempt_at TIMESTAMPTZ NOT NULL,
+		attempts INT NOT NULL DEFAULT 0,
+		last_error TEXT,
+		sent_at TIMESTAMPTZ,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	CREATE INDEX IF NOT EXISTS reminders_user_id_idx ON reminders (user_id, remind_at);
+	CREATE INDEX IF NOT EXISTS reminders_due_idx ON reminders (next_attempt_at) WHERE sent_at IS NULL;
+	CREATE TABLE IF NOT EXISTS reminder_deliveries (
+		reminder_id VARCHAR(21) NOT NULL REFERENCES reminders(id) ON DELETE CASCADE,
+		channel TEXT NOT NULL,
+		delivered_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (reminder_id, channel)
+	);
+	CREATE TABLE IF NOT EXISTS notifications (
+		id BIGSERIAL PRIMARY KEY,
+		user_id VARCHAR(21) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		type TEXT NOT NULL,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL,
+		todo_id VARCHAR(21),
+		task_id VARCHAR(21),
+		key TEXT NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		read_at TIMESTAMPTZ,
+		UNIQUE (user_id, key)
+	);
+	CREATE INDEX IF NOT EXISTS notifications_user_id_idx ON notifications (user_id, id);
+	ALTER TABLE notification_settings
+		ADD COLUMN IF NOT EXISTS digest TEXT NOT NULL DEFAULT 'off',
+		ADD COLUMN IF NOT EXISTS digest_at TEXT NOT NULL DEFAULT '08:00',
+		ADD COLUMN IF NOT EXISTS digest_next_at TIMESTAMPTZ;
+	CREATE INDEX IF NOT EXISTS notification_settings_digest_idx ON notification_settings (digest_next_at) WHERE digest <> 'off';
+	ALTER TABLE tasks ADD COLUMN IF NOT EXISTS completed_at TIMESTAMPTZ;
+	-- track_completion remembers when a task was last marked as done, for the digests.
+	CREATE OR REPLACE FUNCTION track_completion() RETURNS trigger AS $$
+	BEGIN
+		IF NOT COALESCE(NEW.done, FALSE) THEN
+			NEW.completed_at := NULL;
+		ELSIF TG_OP = 'UPDATE' AND NOT COALESCE(OLD.done, FALSE) THEN
+			NEW.completed_at := now();
+		ELSIF TG_OP = 'INSERT' AND NEW.completed_at IS NULL THEN
+			NEW.completed_at := now();
+		END IF;
+		RETURN NEW;
+	END $$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS tasks_completion ON tasks;
+	CREATE TRIGGER tasks_completion BEFORE INSERT OR UPDATE OF done ON tasks
+		FOR EACH ROW EXECUTE FUNCTION track_completion();
+	ALTER TABLE tasks ADD COLUMN IF NOT EXISTS recurrence TEXT;
+	CREATE TABLE IF NOT EXISTS calendar_feeds (
+		user_id VARCHAR(21) PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+		token_hash TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	-- dav_resources keeps the resource names and UIDs CalDAV clients chose for the tasks they created, each name going
+	-- to a single task of the list it was chosen in. Rows outlive their task until its tombstone is purged, so that
+	-- sync-collection reports the deletion under the right name.
+	CREATE TABLE IF NOT EXISTS dav_resources (
+		task_id VARCHAR(21) PRIMARY KEY,
+		todo_id VARCHAR(21) NOT NULL,
+		name TEXT NOT NULL,
+		uid TEXT,
+		UNIQUE (todo_id, name)
+	);
+	ALTER TABLE dav_resources ADD COLUMN IF NOT EXISTS todo_id VARCHAR(21);
+	UPDATE dav_resources d SET todo_id = t.todo_id FROM tasks t WHERE d.todo_id IS NULL AND t.id = d.task_id;
+	UPDATE dav_resources d SET todo_id = s.todo_id FROM sync_tombstones s
+		WHERE d.todo_id IS NULL AND s.entity = 'task' AND s.id = d.task_id;
+	DELETE FROM dav_resources WHERE todo_id IS NULL;
+	-- of the tasks which were given the same name, the first one keeps it
+	DELETE FROM dav_resources d USING dav_resources o
+		WHERE o.todo_id = d.todo_id AND o.name = d.name AND o.task_id < d.task_id;
+	ALTER TABLE dav_resources ALTER COLUMN todo_id SET NOT NULL;
+	CREATE UNIQUE INDEX IF NOT EXISTS dav_resources_todo_id_name_key ON dav_resources (todo_id, name);
+	-- tasks which existed before creation times were recorded are taken as created when the column was added
+	ALTER TABLE tasks ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+	-- todo_members are the users a todo list is shared with, who can read and change it like its author.
+	CREATE TABLE IF NOT EXISTS todo_members (
+		todo_id VARCHAR(21) NOT NULL REFERENCES todos(id) ON DELETE CASCADE,
+		user_id VARCHAR(21) NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		sync_xid xid8 NOT NULL DEFAULT pg_current_xact_id(),
+		PRIMARY KEY (todo_id, user_id)
+	);
+	CREATE INDEX IF NOT EXISTS todo_members_user_id_idx ON todo_members (user_id);
+	-- todo_access holds who can read and change each todo list: its author and its members.
+	CREATE OR REPLACE VIEW todo_access AS
+		SELECT id AS todo_id, author_id AS user_id FROM todos
+		UNION ALL
+		SELECT todo_id, user_id FROM todo_members;
+	-- a todo list gone for good gets a tombstone for its author and for each of its members
+	ALTER TABLE sync_tombstones DROP CONSTRAINT IF EXISTS sync_tombstones_pkey;
+	CREATE UNIQUE INDEX IF NOT EXISTS sync_tombstones_entity_id_user_id_key ON sync_tombstones (entity, id, user_id);
+	-- track_membership gives a member who loses a todo list, along with its tasks, a tombstone for it,
+	-- and forgets it when the list is shared with them again.
+	CREATE OR REPLACE FUNCTION track_membership() RETURNS trigger AS $$
+	BEGIN
+		IF TG_OP = 'DELETE' THEN
+			INSERT INTO sync_tombstones (entity, id, todo_id, user_id) VALUES ('todo', OLD.todo_id, OLD.todo_id, OLD.user_id)
+			ON CONFLICT (entity, id, user_id) DO UPDATE SET sync_xid = EXCLUDED.sync_xid, deleted_at = EXCLUDED.deleted_at;
+		ELSE
+			DELETE FROM sync_tombstones WHERE entity = 'todo' AND id = NEW.todo_id AND user_id = NEW.user_id;
+		END IF;
+		RETURN NULL;
+	END $$ LANGUAGE plpgsql;
+	DROP TRIGGER IF EXISTS todo_members_tombstone ON todo_members;
+	CREATE TRIGGER todo_members_tombstone AFTER INSERT OR DELETE ON todo_members
+		FOR EACH ROW EXECUTE FUNCTION track_membership();
+	-- the snapshots of old revisions are dropped by the history compaction job
+	ALTER TABLE todo_revisions ALTER COLUMN snapshot DROP NOT NULL;
 	`
 	_, err := conn.Exec(context.TODO(), q)
 	if err != nil {
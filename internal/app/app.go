@@ -8,22 +8,53 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
+	"github.com/akalpaki/todo/internal/calendar"
+	"github.com/akalpaki/todo/internal/notification"
+	"github.com/akalpaki/todo/internal/tag"
 	"github.com/akalpaki/todo/internal/todo"
 	"github.com/akalpaki/todo/internal/user"
+	"github.com/akalpaki/todo/internal/webhook"
+	"github.com/akalpaki/todo/pkg/web"
 )
 
 func New(
 	cfg *config.Config,
 	logger *slog.Logger,
 	dbPool *pgxpool.Pool,
+	broker *todo.Broker,
 ) http.Handler {
 	server := http.NewServeMux()
 
 	userRepo := user.NewRepository(dbPool)
 	todoRepo := todo.NewRepository(dbPool)
+	tagRepo := tag.NewRepository(dbPool)
+	webhookRepo := webhook.NewRepository(dbPool)
+	notificationRepo := notification.NewRepository(dbPool)
+	calendarRepo := calendar.NewRepository(dbPool)
+	idempotency := web.NewIdempotencyStore(dbPool, cfg.IdempotencyWindow)
 
 	server.Handle("/v1/user/", http.StripPrefix("/v1/user", user.Routes(logger, userRepo)))
-	server.Handle("/v1/todo/", http.StripPrefix("/v1/todo", todo.Routes(logger, todoRepo)))
+	server.Handle("/v1/todo/", http.StripPrefix("/v1/todo", todo.Routes(logger, todoRepo, broker, idempotency)))
+	server.Handle("/v1/tag/", http.StripPrefix("/v1/tag", tag.Routes(logger, tagRepo, idempotency)))
+	server.Handle("/v2/user/", http.StripPrefix("/v2/user", user.Routes(logger, userRepo)))
+	server.Handle("/v2/todo/", http.StripPrefix("/v2/todo", todo.RoutesV2(logger, todoRepo, broker, idempotency)))
+	server.Handle("/v2/tag/", http.StripPrefix("/v2/tag", tag.Routes(logger, tagRepo, idempotency)))
+	server.Handle("/v1/webhook/", http.StripPrefix("/v1/webhook", webhook.Routes(logger, webhookRepo, idempotency)))
+	server.Handle("/v2/webhook/", http.StripPrefix("/v2/webhook", webhook.Routes(logger, webhookRepo, idempotency)))
+	server.Handle("/v1/notifications/", http.StripPrefix("/v1/notifications", notification.Routes(logger, notificationRepo)))
+	server.Handle("/v2/notifications/", http.StripPrefix("/v2/notifications", notification.Routes(logger, notificationRepo)))
+	server.Handle("/v1/reminders/", http.StripPrefix("/v1/reminders", notification.ReminderRoutes(logger, notificationRepo, idempotency)))
+	server.Handle("/v2/reminders/", http.StripPrefix("/v2/reminders", notification.ReminderRoutes(logger, notificationRepo, idempotency)))
+	server.Handle("/v1/calendar/", http.StripPrefix("/v1/calendar", calendar.Routes(logger, calendarRepo, idempotency)))
+	server.Handle("/v2/calendar/", http.StripPrefix("/v2/calendar", calendar.Routes(logger, calendarRepo, idempotency)))
+	// CalDAV clients discover the server through the well-known URL, and authenticate with the user's email and password.
+	server.Handle("/dav/", http.StripPrefix("/dav", todo.CalDAVRoutes(logger, todoRepo, userRepo.Authenticate, "/dav")))
+	server.Handle("/.well-known/caldav", http.RedirectHandler("/dav/", http.StatusMovedPermanently))
+	// Delta sync spans every todo list of the user, so it lives outside of the todo API.
+	server.HandleFunc("GET /v1/sync", web.Access(web.Auth(todo.HandleGetChanges(logger, todoRepo)), logger))
+	server.HandleFunc("POST /v1/sync", web.Access(web.Auth(web.Idempotent(todo.HandlePushChanges(logger, todoRepo), idempotency, logger)), logger))
+	server.HandleFunc("GET /v2/sync", web.Access(web.Auth(todo.HandleGetChanges(logger, todoRepo)), logger))
+	server.HandleFunc("POST /v2/sync", web.Access(web.Auth(web.Idempotent(todo.HandlePushChanges(logger, todoRepo), idempotency, logger)), logger))
 	// Monitoring implementation is done for experimental puproses. This route should probably not allow unauthorized access!
 	server.Handle("/prometheus", promhttp.Handler())
 
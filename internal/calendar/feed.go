@@ -0,0 +1,68 @@
+package calendar
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/akalpaki/todo/pkg/ical"
+)
+
+const (
+	prodID = "-//akalpaki//todo//EN"
+	// refreshInterval is how often calendar apps are asked to poll the feed.
+	refreshInterval = "PT15M"
+	// uidDomain makes the UIDs of tasks globally unique, as iCalendar requires.
+	uidDomain = "@todo"
+)
+
+// writeFeed writes tasks as an iCalendar object, either as VTODO or as VEVENT entries depending on kind.
+// Events have no completion status, so completed tasks are marked in their summary instead.
+func writeFeed(w io.Writer, tasks []feedTask, kind string, now time.Time) error {
+	cal := ical.NewWriter(w)
+	cal.Begin("VCALENDAR")
+	cal.Prop("VERSION", "2.0")
+	cal.Prop("PRODID", prodID)
+	cal.Prop("CALSCALE", "GREGORIAN")
+	cal.Text("X-WR-CALNAME", "Tasks")
+	cal.Prop("REFRESH-INTERVAL", refreshInterval, "VALUE=DURATION")
+	cal.Prop("X-PUBLISHED-TTL", refreshInterval)
+
+	for _, t := range tasks {
+		switch kind {
+		case KindEvent:
+			cal.Begin("VEVENT")
+			cal.Text("UID", t.ID+uidDomain)
+			cal.Time("DTSTAMP", now)
+			cal.Prop("SEQUENCE", strconv.FormatInt(t.Version, 10))
+			cal.Text("CATEGORIES", t.TodoName)
+			if t.Recurrence != "" {
+				cal.Prop("RRULE", t.Recurrence)
+			}
+			summary := t.Content
+			if t.Done {
+				summary = "✓ " + summary
+			}
+			cal.Text("SUMMARY", summary)
+			cal.Time("DTSTART", t.DueAt)
+			cal.Prop("TRANSP", "TRANSPARENT")
+			cal.End("VEVENT")
+		default:
+			due := t.DueAt
+			cal.Todo(ical.Todo{
+				UID:         t.ID + uidDomain,
+				Summary:     t.Content,
+				Categories:  []string{t.TodoName},
+				Due:         &due,
+				Priority:    t.Priority.ICalPriority(),
+				Completed:   t.Done,
+				CompletedAt: t.CompletedAt,
+				Recurrence:  t.Recurrence,
+				Sequence:    t.Version,
+			}, now)
+		}
+	}
+
+	cal.End("VCALENDAR")
+	return cal.Err()
+}
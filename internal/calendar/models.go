@@ -0,0 +1,34 @@
+package calendar
+
+import (
+	"time"
+
+	"github.com/akalpaki/todo/internal/todo"
+)
+
+// Kinds of entries a feed exports tasks as.
+const (
+	KindTodo  = "todo"
+	KindEvent = "event"
+)
+
+// Feed is the calendar subscription of a user, a secret URL calendar apps poll for the user's tasks.
+// Token is only ever returned when the feed is created.
+type Feed struct {
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// feedTask is a task with a due date, as exported to calendars.
+type feedTask struct {
+	ID          string
+	TodoName    string
+	Content     string
+	Done        bool
+	Priority    todo.Priority
+	DueAt       time.Time
+	Recurrence  string
+	CompletedAt *time.Time
+	Version     int64
+}
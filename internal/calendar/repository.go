@@ -0,0 +1,99 @@
+package calendar
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+var (
+	errNotFound    = errors.New("not found")
+	errInvalidKind = errors.New("invalid kind")
+)
+
+type Repository struct {
+	pool *pgxpool.Pool
+}
+
+func NewRepository(pool *pgxpool.Pool) *Repository {
+	return &Repository{
+		pool: pool,
+	}
+}
+
+// CreateFeed gives the user a feed with a new random token, replacing the previous one, whose URL stops working.
+// Only a hash of the token is stored.
+func (r *Repository) CreateFeed(ctx context.Context, userID string) (Feed, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Feed{}, fmt.Errorf("calendar_repo generating token: %w", err)
+	}
+	feed := Feed{Token: base64.RawURLEncoding.EncodeToString(secret)}
+
+	if err := r.pool.QueryRow(ctx, upsertFeedQuery, userID, hashToken(feed.Token)).Scan(&feed.CreatedAt); err != nil {
+		return Feed{}, fmt.Errorf("calendar_repo upsert feed: %w", err)
+	}
+	return feed, nil
+}
+
+func (r *Repository) DeleteFeed(ctx context.Context, userID string) error {
+	if _, err := r.pool.Exec(ctx, deleteFeedQuery, userID); err != nil {
+		return fmt.Errorf("calendar_repo delete feed: %w", err)
+	}
+	return nil
+}
+
+// FeedUser returns the user whose feed has the token, or errNotFound.
+func (r *Repository) FeedUser(ctx context.Context, token string) (string, error) {
+	var userID string
+	if err := r.pool.QueryRow(ctx, selectFeedUserQuery, hashToken(token)).Scan(&userID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", errNotFound
+		}
+		return "", fmt.Errorf("calendar_repo get feed: %w", err)
+	}
+	return userID, nil
+}
+
+// Fingerprint returns a value which changes whenever the feed of the user does.
+func (r *Repository) Fingerprint(ctx context.Context, userID string) (string, error) {
+	var fingerprint string
+	if err := r.pool.QueryRow(ctx, selectFingerprintQuery, userID).Scan(&fingerprint); err != nil {
+		return "", fmt.Errorf("calendar_repo fingerprint feed: %w", err)
+	}
+	return fingerprint, nil
+}
+
+// feedTasks returns the tasks with a due date of the user's lists, leaving out the ones in the trash or in archived lists.
+func (r *Repository) feedTasks(ctx context.Context, userID string) ([]feedTask, error) {
+	rows, err := r.pool.Query(ctx, selectFeedTasksQuery, userID)
+	if err != nil {
+		return nil, fmt.Errorf("calendar_repo select tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []feedTask
+	for rows.Next() {
+		var t feedTask
+		if err := rows.Scan(&t.ID, &t.TodoName, &t.Content, &t.Done, &t.Priority, &t.DueAt, &t.Recurrence, &t.CompletedAt, &t.Version); err != nil {
+			return nil, fmt.Errorf("calendar_repo scan task: %w", err)
+		}
+		tasks = append(tasks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("calendar_repo select tasks: %w", err)
+	}
+	return tasks, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,154 @@
+package calendar
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/akalpaki/todo/pkg/ical"
+	"github.com/akalpaki/todo/pkg/web"
+)
+
+// Routes returns the calendar API. Creating a feed can be retried safely with an Idempotency-Key.
+func Routes(logger *slog.Logger, repository *Repository, idempotency web.IdempotencyStore) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /feed", web.Access(web.Auth(web.Idempotent(HandleCreateFeed(logger, repository), idempotency, logger)), logger))
+	mux.HandleFunc("DELETE /feed", web.Access(web.Auth(HandleDeleteFeed(logger, repository)), logger))
+	// calendar apps cannot send a token, so the feed is authenticated by the secret in its URL instead, which must
+	// not end up in the logs
+	mux.HandleFunc("GET /feed/{file}", web.AccessRedacted(HandleFeed(logger, repository), logger, "file"))
+
+	return mux
+}
+
+// HandleCreateFeed gives the caller a feed URL, replacing the previous one.
+func HandleCreateFeed(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		feed, err := repository.CreateFeed(ctx, userID)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to create feed", err)
+			return
+		}
+		feed.URL = feedURL(r, feed.Token)
+
+		if err := web.WriteJSON(w, r, http.StatusCreated, feed); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleDeleteFeed revokes the feed of the caller.
+func HandleDeleteFeed(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		if err := repository.DeleteFeed(ctx, userID); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to delete feed", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleFeed serves the feed named by its "<token>.ics" file name, with the tasks as VTODO entries, or as VEVENT
+// entries with ?kind=event. The feed carries an ETag, so polling with If-None-Match is answered with a 304 Not Modified
+// until a list of the user changes.
+func HandleFeed(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		token, ok := strings.CutSuffix(r.PathValue("file"), ".ics")
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "feed not found", errNotFound)
+			return
+		}
+
+		kind := r.URL.Query().Get("kind")
+		if kind == "" {
+			kind = KindTodo
+		}
+		if kind != KindTodo && kind != KindEvent {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid kind", errInvalidKind)
+			return
+		}
+
+		userID, err := repository.FeedUser(ctx, token)
+		if err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "feed not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve feed", err)
+				return
+			}
+		}
+
+		fingerprint, err := repository.Fingerprint(ctx, userID)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve feed", err)
+			return
+		}
+		etag := `"` + fingerprint + `"`
+		if web.NotModified(r, etag) {
+			web.WriteNotModified(w, etag)
+			return
+		}
+
+		tasks, err := repository.feedTasks(ctx, userID)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
+			return
+		}
+
+		var body bytes.Buffer
+		if err := writeFeed(&body, tasks, kind, time.Now()); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", ical.ContentType)
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusOK)
+		if _, err := body.WriteTo(w); err != nil {
+			logger.Error("failed to write feed", "error", err)
+		}
+	}
+}
+
+// feedURL returns the URL of the feed with the token, next to the URL the request was made to.
+func feedURL(r *http.Request, token string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	path := r.URL.Path
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		// the path of the request before the API prefix was stripped
+		path = u.Path
+	}
+	return scheme + "://" + r.Host + strings.TrimSuffix(path, "/") + "/" + token + ".ics"
+}
@@ -0,0 +1,21 @@
+package calendar
+
+const (
+	upsertFeedQuery = `
+	INSERT INTO calendar_feeds (user_id, token_hash) VALUES ($1, $2)
+	ON CONFLICT (user_id) DO UPDATE SET token_hash = EXCLUDED.token_hash, created_at = now()
+	RETURNING created_at`
+	deleteFeedQuery     = "DELETE FROM calendar_feeds WHERE user_id = $1"
+	selectFeedUserQuery = "SELECT user_id FROM calendar_feeds WHERE token_hash = $1"
+	// selectFingerprintQuery sums up the versions of the user's lists, which change along with any of their tasks,
+	// so that the feed is only rendered again when something changed.
+	selectFingerprintQuery = `
+	SELECT COALESCE(md5(string_agg(id || ':' || version, ',' ORDER BY id)), md5(''))
+	FROM todos WHERE id IN (SELECT todo_id FROM todo_access WHERE user_id = $1)`
+	selectFeedTasksQuery = `
+	SELECT t.id, td.name, COALESCE(t.content, ''), COALESCE(t.done, FALSE), t.priority, t.due_at, COALESCE(t.recurrence, ''), t.completed_at, t.version
+	FROM tasks t JOIN todos td ON td.id = t.todo_id
+	WHERE td.id IN (SELECT todo_id FROM todo_access WHERE user_id = $1) AND t.due_at IS NOT NULL
+		AND t.deleted_at IS NULL AND td.deleted_at IS NULL AND td.archived_at IS NULL
+	ORDER BY t.due_at, t.id`
+)
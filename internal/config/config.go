@@ -1,6 +1,7 @@
 package config
 
 import (
+	"fmt"
 	"log/slog"
 	"slices"
 	"time"
@@ -20,6 +21,35 @@ type Config struct {
 	Secret       string
 	ConnStr      string
 	TokenExpiry  time.Duration
+	// TrashRetention is how long deleted todo lists and tasks stay in the trash before being purged.
+	TrashRetention time.Duration
+	// HistoryRetention is how long the snapshots of revisions are kept, for todo lists to be reverted to them.
+	HistoryRetention time.Duration
+	// IdempotencyWindow is how long the response to an Idempotency-Key is kept for retries.
+	IdempotencyWindow time.Duration
+	// SMTPAddr is the host:port of the SMTP server emails are sent through. Emails are only logged when it is empty.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+	// MailFrom is the sender address of emails.
+	MailFrom string
+}
+
+// redacted replaces the values of secret settings when the configuration is printed.
+const redacted = "[redacted]"
+
+// String prints the configuration with its secrets, the JWT secret, the database connection string, which holds the
+// database password, and the SMTP password, redacted.
+func (c *Config) String() string {
+	// plain has the fields of Config but not its methods, so that printing it does not call String again
+	type plain Config
+	p := plain(*c)
+	for _, secret := range []*string{&p.Secret, &p.ConnStr, &p.SMTPPassword} {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	return fmt.Sprintf("%+v", p)
 }
 
 func New(opts ...option) *Config {
@@ -55,3 +85,30 @@ func WithJWTOptions(secret string, tokenExpiry time.Duration) option {
 		c.TokenExpiry = tokenExpiry
 	}
 }
+
+func WithTrashOptions(retention time.Duration) option {
+	return func(c *Config) {
+		c.TrashRetention = retention
+	}
+}
+
+func WithHistoryOptions(retention time.Duration) option {
+	return func(c *Config) {
+		c.HistoryRetention = retention
+	}
+}
+
+func WithIdempotencyOptions(window time.Duration) option {
+	return func(c *Config) {
+		c.IdempotencyWindow = window
+	}
+}
+
+func WithMailOptions(smtpAddr, smtpUsername, smtpPassword, mailFrom string) option {
+	return func(c *Config) {
+		c.SMTPAddr = smtpAddr
+		c.SMTPUsername = smtpUsername
+		c.SMTPPassword = smtpPassword
+		c.MailFrom = mailFrom
+	}
+}
@@ -0,0 +1,137 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/akalpaki/todo/internal/todo"
+	"github.com/akalpaki/todo/pkg/outbox"
+)
+
+// activityVerbs is how the kinds of todo events read in notifications.
+var activityVerbs = map[string]string{
+	todo.EventCreated: "added",
+	todo.EventUpdated: "updated",
+	todo.EventDeleted: "deleted",
+}
+
+// Notify is the outbox subscriber filling the inbox of users with the changes made by someone else to the todo lists and
+// tasks they own or are members of, and with the lists shared with them. Changes a user made are left out of their inbox,
+// as are all of them for users who turned the in-app channel off.
+func (r *Repository) Notify(ctx context.Context, e outbox.Event) error {
+	if entity, _, _ := strings.Cut(e.Type, "."); e.Type != todo.EventShared && entity != todo.EntityTodo && entity != todo.EntityTask {
+		return nil
+	}
+	var event todo.Event
+	if err := e.Decode(&event); err != nil {
+		return fmt.Errorf("notification_repo: %w", err)
+	}
+	if e.UserID == "" || event.ActorID == nil {
+		return nil
+	}
+
+	// the author of the list, whom the event belongs to, hears of every change along with the users who were members of
+	// the list by then; a list being shared is only news to the member it is shared with
+	recipients := []string{e.UserID}
+	if e.Type != todo.EventShared {
+		rows, err := r.pool.Query(ctx, selectMemberIDsQuery, event.TodoID, e.CreatedAt)
+		if err != nil {
+			return fmt.Errorf("notification_repo select members: %w", err)
+		}
+		members, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return fmt.Errorf("notification_repo scan members: %w", err)
+		}
+		recipients = append(recipients, members...)
+	}
+
+	var actor, todoName, content *string
+	row := r.pool.QueryRow(ctx, selectActivityQuery, *event.ActorID, event.TodoID, event.EntityID)
+	if err := row.Scan(&actor, &todoName, &content); err != nil {
+		return fmt.Errorf("notification_repo select activity: %w", err)
+	}
+	m := activityMessage(event, actor, todoName, content)
+	m.Key = "activity:" + strconv.FormatInt(e.ID, 10)
+
+	for _, userID := range recipients {
+		if userID == *event.ActorID {
+			continue
+		}
+		settings, err := r.GetSettings(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(settings.Channels, ChannelInApp) {
+			continue
+		}
+		if err := r.insertNotification(ctx, userID, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activityMessage writes the notification of a change made by someone else. Any of actor, todoName and content is nil
+// when it is gone by now, in which case the last known one is taken from the changes where possible.
+func activityMessage(e todo.Event, actor, todoName, content *string) Message {
+	entity, kind, _ := strings.Cut(e.Type, ".")
+	who := "Someone"
+	if actor != nil {
+		who = *actor
+	}
+
+	m := Message{
+		Type:   e.Type,
+		TodoID: &e.TodoID,
+	}
+	if e.Type == todo.EventShared {
+		m.Title = fmt.Sprintf("%s shared a list with you", who)
+		m.Body = lastKnown(todoName, e, "name")
+		return m
+	}
+	verb := activityVerbs[kind]
+	if entity == todo.EntityTask && kind == todo.EventUpdated && completes(e) {
+		m.Type, verb = TypeTaskCompleted, "completed"
+	}
+
+	list := lastKnown(todoName, e, "name")
+	if entity == todo.EntityTodo {
+		m.Title = fmt.Sprintf("%s %s your list", who, verb)
+		m.Body = list
+		return m
+	}
+	m.TaskID = &e.EntityID
+	m.Title = fmt.Sprintf("%s %s a task", who, verb)
+	m.Body = fmt.Sprintf("%s\nin %s", lastKnown(content, e, "content"), list)
+	return m
+}
+
+// completes reports whether a task event marks the task as done.
+func completes(e todo.Event) bool {
+	return slices.ContainsFunc(e.Changes, func(c todo.Change) bool { return c.Field == "done" && c.New == true })
+}
+
+// lastKnown returns current if set, or otherwise the value of field in the entity created or removed by the event.
+func lastKnown(current *string, e todo.Event, field string) string {
+	if current != nil {
+		return *current
+	}
+	for _, c := range e.Changes {
+		if c.Field != "" || c.ID != e.EntityID {
+			continue
+		}
+		for _, v := range []any{c.Old, c.New} {
+			if entity, ok := v.(map[string]any); ok {
+				if s, ok := entity[field].(string); ok {
+					return s
+				}
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/akalpaki/todo/pkg/mail"
+)
+
+// webhookTimeout is how long a notification webhook has to answer.
+const webhookTimeout = 10 * time.Second
+
+var errNoWebhookURL = errors.New("no webhook url set")
+
+// Channel delivers messages to users one way. A channel may be handed the same message again after a failure,
+// or if the server stops right after delivering it.
+type Channel interface {
+	// Name is the name users choose the channel by in their settings.
+	Name() string
+	Send(ctx context.Context, to Recipient, m Message) error
+}
+
+// InAppChannel delivers messages to the in-app inbox. A message is added to the inbox only once, however many
+// times it is sent.
+type InAppChannel struct {
+	repository *Repository
+}
+
+func NewInAppChannel(repository *Repository) *InAppChannel {
+	return &InAppChannel{repository: repository}
+}
+
+func (c *InAppChannel) Name() string { return ChannelInApp }
+
+func (c *InAppChannel) Send(ctx context.Context, to Recipient, m Message) error {
+	return c.repository.insertNotification(ctx, to.UserID, m)
+}
+
+// EmailChannel delivers messages by email, to the address users registered with.
+type EmailChannel struct {
+	mailer mail.Mailer
+}
+
+func NewEmailChannel(mailer mail.Mailer) *EmailChannel {
+	return &EmailChannel{mailer: mailer}
+}
+
+func (c *EmailChannel) Name() string { return ChannelEmail }
+
+func (c *EmailChannel) Send(ctx context.Context, to Recipient, m Message) error {
+	return c.mailer.Send(ctx, mail.Message{To: to.Email, Subject: m.Title, Text: m.Body})
+}
+
+// WebhookChannel delivers messages by POSTing them as JSON to the webhook URL in the user's settings. Since users
+// choose that URL, the client should be one restricted to public addresses, such as webhook.NewClient.
+type WebhookChannel struct {
+	client *http.Client
+}
+
+func NewWebhookChannel(client *http.Client) *WebhookChannel {
+	return &WebhookChannel{client: client}
+}
+
+func (c *WebhookChannel) Name() string { return ChannelWebhook }
+
+func (c *WebhookChannel) Send(ctx context.Context, to Recipient, m Message) error {
+	if to.Settings.WebhookURL == nil {
+		return errNoWebhookURL
+	}
+	body, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("notification encode message: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, *to.Settings.WebhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook answered with status %d", res.StatusCode)
+	}
+	return nil
+}
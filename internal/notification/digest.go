@@ -0,0 +1,216 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log/slog"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/akalpaki/todo/pkg/jobs"
+	"github.com/akalpaki/todo/pkg/mail"
+)
+
+// DigestJob is the kind of the job sending the digests which are due.
+const DigestJob = "notification.digest"
+
+const (
+	// digestBatch is how many digests are claimed at once.
+	digestBatch = 50
+	// digestLease is how long claimed digests are left alone by the other digesters, and so how long a digest which
+	// failed to send waits to be retried.
+	digestLease = 15 * time.Minute
+	// digestItems is how many tasks a section of a digest lists at most.
+	digestItems = 25
+	// digestDateLayout and digestTimeLayout are how dates and times are written in digests.
+	digestDateLayout = "Monday, 2 January"
+	digestTimeLayout = "15:04"
+)
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("digest").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif">
+<h2>Your {{.Period}} digest for {{.Date}}</h2>
+{{range .Sections}}<h3>{{.Title}}</h3>
+<ul>
+{{range .Tasks}}<li>{{.Content}} <small>{{.List}}{{with .When}} &middot; {{.}}{{end}}</small></li>
+{{end}}{{with .More}}<li>and {{.}} more</li>
+{{end}}</ul>
+{{end}}</body>
+</html>
+`))
+
+var digestText = texttemplate.Must(texttemplate.New("digest").Parse(`Your {{.Period}} digest for {{.Date}}
+{{range .Sections}}
+{{.Title}}
+{{range .Tasks}}- {{.Content}} ({{.List}}{{with .When}}, {{.}}{{end}})
+{{end}}{{with .More}}- and {{.}} more
+{{end}}{{end}}`))
+
+// digestTask is a task which makes it into a digest.
+type digestTask struct {
+	ID          string
+	TodoID      string
+	TodoName    string
+	Content     string
+	Done        bool
+	DueAt       *time.Time
+	CompletedAt *time.Time
+}
+
+// digest is what the digest templates are rendered with.
+type digest struct {
+	Period   string
+	Date     string
+	Sections []digestSection
+}
+
+// digestSection lists up to digestItems tasks, More being how many more there are.
+type digestSection struct {
+	Title string
+	Tasks []digestItem
+	More  int
+}
+
+type digestItem struct {
+	Content string
+	List    string
+	When    string
+}
+
+func (s *digestSection) add(item digestItem) {
+	if len(s.Tasks) == digestItems {
+		s.More++
+		return
+	}
+	s.Tasks = append(s.Tasks, item)
+}
+
+// Digester emails the users who opted in a summary of their tasks, daily or weekly, at the time of their choice in their
+// time zone: the overdue tasks, the ones due today and the ones completed since the previous digest. Digests with
+// nothing to tell are not sent.
+type Digester struct {
+	repository *Repository
+	mailer     mail.Mailer
+	logger     *slog.Logger
+}
+
+func NewDigester(repository *Repository, mailer mail.Mailer, logger *slog.Logger) *Digester {
+	return &Digester{
+		repository: repository,
+		mailer:     mailer,
+		logger:     logger,
+	}
+}
+
+// HandleDigest is the handler of DigestJob.
+func (d *Digester) HandleDigest(ctx context.Context, _ jobs.Job) error {
+	return d.SendDueDigests(ctx)
+}
+
+// SendDueDigests sends every digest which is due. A digest which fails to send is retried once its lease runs out.
+func (d *Digester) SendDueDigests(ctx context.Context) error {
+	for {
+		due, err := d.repository.claimDigests(ctx, digestBatch, digestLease)
+		if err != nil {
+			return err
+		}
+
+		for _, dd := range due {
+			if err := d.send(ctx, dd, time.Now()); err != nil {
+				d.logger.Error("failed to send digest", "user_id", dd.UserID, "error", err)
+			}
+		}
+
+		if len(due) < digestBatch {
+			return nil
+		}
+	}
+}
+
+// send sends the digest of a user as of now, and schedules the next one.
+func (d *Digester) send(ctx context.Context, dd dueDigest, now time.Time) error {
+	next, ok := dd.nextDigest(now)
+	if !ok {
+		return errors.New("no digest to schedule")
+	}
+
+	loc := dd.location()
+	local := now.In(loc)
+	today := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, loc)
+	tomorrow := today.AddDate(0, 0, 1)
+	since := local.AddDate(0, 0, -1)
+	if dd.Digest == DigestWeekly {
+		since = local.AddDate(0, 0, -7)
+	}
+
+	tasks, err := d.repository.digestTasks(ctx, dd.UserID, tomorrow, since)
+	if err != nil {
+		return err
+	}
+
+	if len(tasks) > 0 {
+		m, err := digestMessage(dd, tasks, today)
+		if err != nil {
+			return err
+		}
+		if err := d.mailer.Send(ctx, m); err != nil {
+			return fmt.Errorf("notification send digest: %w", err)
+		}
+	}
+
+	return d.repository.digestSent(ctx, dd.UserID, next)
+}
+
+// digestMessage renders the digest of a user out of their tasks, with dates and times in the user's time zone.
+func digestMessage(dd dueDigest, tasks []digestTask, today time.Time) (mail.Message, error) {
+	loc := dd.location()
+	overdue := digestSection{Title: "Overdue"}
+	dueToday := digestSection{Title: "Due today"}
+	completed := digestSection{Title: "Recently completed"}
+	for _, t := range tasks {
+		item := digestItem{Content: t.Content, List: t.TodoName}
+		switch {
+		case t.Done:
+			if t.CompletedAt != nil {
+				item.When = "done " + t.CompletedAt.In(loc).Format(digestDateLayout)
+			}
+			completed.add(item)
+		case t.DueAt != nil && t.DueAt.Before(today):
+			item.When = "due " + t.DueAt.In(loc).Format(digestDateLayout)
+			overdue.add(item)
+		case t.DueAt != nil:
+			item.When = "due at " + t.DueAt.In(loc).Format(digestTimeLayout)
+			dueToday.add(item)
+		}
+	}
+
+	data := digest{
+		Period: dd.Digest,
+		Date:   today.Format(digestDateLayout),
+	}
+	for _, s := range []digestSection{overdue, dueToday, completed} {
+		if len(s.Tasks) > 0 {
+			data.Sections = append(data.Sections, s)
+		}
+	}
+
+	var html, text bytes.Buffer
+	if err := digestHTML.Execute(&html, data); err != nil {
+		return mail.Message{}, fmt.Errorf("notification render digest: %w", err)
+	}
+	if err := digestText.Execute(&text, data); err != nil {
+		return mail.Message{}, fmt.Errorf("notification render digest: %w", err)
+	}
+
+	return mail.Message{
+		To:      dd.email,
+		Subject: fmt.Sprintf("Your %s digest for %s", dd.Digest, data.Date),
+		Text:    strings.TrimSpace(text.String()) + "\n",
+		HTML:    html.String(),
+	}, nil
+}
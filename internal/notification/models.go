@@ -0,0 +1,245 @@
+package notification
+
+import (
+	"net/url"
+	"slices"
+	"time"
+)
+
+// Channels notifications are delivered through.
+const (
+	ChannelInApp   = "inapp"
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+)
+
+// Channels holds every channel a user can choose.
+var Channels = []string{ChannelInApp, ChannelEmail, ChannelWebhook}
+
+// Types of notification. Changes made by someone else to the todo lists of a user are of the type of their
+// event, such as "task.created", or TypeTaskCompleted when a task was marked as done. TypeShared tells a user a
+// list was shared with them.
+const (
+	TypeReminder      = "reminder"
+	TypeTaskCompleted = "task.completed"
+	TypeShared        = "member.added"
+)
+
+// Digests a user can choose. Weekly digests go out on Mondays.
+const (
+	DigestOff    = "off"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// quietHoursLayout is the format of the bounds of quiet hours and of the time of digests, in the user's time zone.
+const quietHoursLayout = "15:04"
+
+// defaultDigestAt is when digests go out unless the user chose another time.
+const defaultDigestAt = "08:00"
+
+// Settings are how a user wants to be notified. Users who never changed them get defaultSettings.
+type Settings struct {
+	UserID string `json:"user_id"`
+	// TimeZone is an IANA time zone name, such as "Europe/Athens", which quiet hours and times in notifications are in.
+	TimeZone string `json:"time_zone"`
+	// QuietStart and QuietEnd bound the quiet hours, "HH:MM" in TimeZone, during which only the in-app
+	// channel is used. The other channels get the notifications once the quiet hours are over.
+	QuietStart *string  `json:"quiet_start"`
+	QuietEnd   *string  `json:"quiet_end"`
+	Channels   []string `json:"channels"`
+	// WebhookURL is where notifications are POSTed through the webhook channel.
+	WebhookURL *string `json:"webhook_url"`
+	// Digest is how often a summary of the user's tasks is emailed, at DigestAt ("HH:MM" in TimeZone).
+	Digest   string `json:"digest"`
+	DigestAt string `json:"digest_at"`
+}
+
+func defaultSettings(userID string) Settings {
+	return Settings{
+		UserID:   userID,
+		TimeZone: "UTC",
+		Channels: []string{ChannelInApp, ChannelEmail},
+		Digest:   DigestOff,
+		DigestAt: defaultDigestAt,
+	}
+}
+
+// location returns the time zone of the settings, falling back to UTC.
+func (s Settings) location() *time.Location {
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// quietUntil reports whether t is within the quiet hours, and if so when they end.
+func (s Settings) quietUntil(t time.Time) (time.Time, bool) {
+	if s.QuietStart == nil || s.QuietEnd == nil {
+		return time.Time{}, false
+	}
+	start, errStart := time.Parse(quietHoursLayout, *s.QuietStart)
+	end, errEnd := time.Parse(quietHoursLayout, *s.QuietEnd)
+	if errStart != nil || errEnd != nil || start.Equal(end) {
+		return time.Time{}, false
+	}
+
+	local := t.In(s.location())
+	minutes := func(c time.Time) int { return c.Hour()*60 + c.Minute() }
+	now, from, to := minutes(local), minutes(start), minutes(end)
+
+	var quiet bool
+	if from < to {
+		quiet = now >= from && now < to
+	} else {
+		// the quiet hours span midnight
+		quiet = now >= from || now < to
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+
+	until := time.Date(local.Year(), local.Month(), local.Day(), end.Hour(), end.Minute(), 0, 0, local.Location())
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return until, true
+}
+
+// nextDigest returns when the first digest after t is due, or false if the user gets no digests.
+func (s Settings) nextDigest(t time.Time) (time.Time, bool) {
+	at, err := time.Parse(quietHoursLayout, s.DigestAt)
+	if err != nil || (s.Digest != DigestDaily && s.Digest != DigestWeekly) {
+		return time.Time{}, false
+	}
+
+	local := t.In(s.location())
+	next := time.Date(local.Year(), local.Month(), local.Day(), at.Hour(), at.Minute(), 0, 0, local.Location())
+	for !next.After(local) || (s.Digest == DigestWeekly && next.Weekday() != time.Monday) {
+		next = time.Date(next.Year(), next.Month(), next.Day()+1, at.Hour(), at.Minute(), 0, 0, next.Location())
+	}
+	return next, true
+}
+
+// SettingsRequest replaces the notification settings of the caller.
+// Requests should always be validated with the Valid method before being accepted.
+type SettingsRequest struct {
+	TimeZone   string   `json:"time_zone"`
+	QuietStart *string  `json:"quiet_start"`
+	QuietEnd   *string  `json:"quiet_end"`
+	Channels   []string `json:"channels"`
+	WebhookURL *string  `json:"webhook_url"`
+	// Digest defaults to DigestOff and DigestAt to 08:00.
+	Digest   string `json:"digest"`
+	DigestAt string `json:"digest_at"`
+}
+
+func (r SettingsRequest) Valid() bool {
+	if r.Digest != "" && r.Digest != DigestOff && r.Digest != DigestDaily && r.Digest != DigestWeekly {
+		return false
+	}
+	if r.DigestAt != "" {
+		if _, err := time.Parse(quietHoursLayout, r.DigestAt); err != nil {
+			return false
+		}
+	}
+	if _, err := time.LoadLocation(r.TimeZone); err != nil || r.TimeZone == "" {
+		return false
+	}
+	if (r.QuietStart == nil) != (r.QuietEnd == nil) {
+		return false
+	}
+	if r.QuietStart != nil {
+		if _, err := time.Parse(quietHoursLayout, *r.QuietStart); err != nil {
+			return false
+		}
+		if _, err := time.Parse(quietHoursLayout, *r.QuietEnd); err != nil {
+			return false
+		}
+	}
+	if r.Channels == nil {
+		return false
+	}
+	for _, c := range r.Channels {
+		if !slices.Contains(Channels, c) {
+			return false
+		}
+	}
+	if r.WebhookURL != nil {
+		u, err := url.Parse(*r.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return false
+		}
+	}
+	return !slices.Contains(r.Channels, ChannelWebhook) || r.WebhookURL != nil
+}
+
+// Reminder pokes a user about a task at RemindAt.
+type Reminder struct {
+	ID       string    `json:"id"`
+	TaskID   string    `json:"task_id"`
+	TodoID   string    `json:"todo_id"`
+	UserID   string    `json:"user_id"`
+	RemindAt time.Time `json:"remind_at"`
+	// SentAt is when the reminder went out through every channel of the user, or was dropped because its
+	// task was done or deleted by then.
+	SentAt    *time.Time `json:"sent_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ReminderRequest creates a reminder on a task.
+// Requests should always be validated with the Valid method before being accepted.
+type ReminderRequest struct {
+	TaskID   string    `json:"task_id"`
+	RemindAt time.Time `json:"remind_at"`
+}
+
+func (r ReminderRequest) Valid() bool {
+	return r.TaskID != "" && !r.RemindAt.IsZero()
+}
+
+// RescheduleRequest moves a reminder to another time. The task of a reminder cannot change.
+type RescheduleRequest struct {
+	RemindAt time.Time `json:"remind_at"`
+}
+
+func (r RescheduleRequest) Valid() bool {
+	return !r.RemindAt.IsZero()
+}
+
+// Notification is an entry of the in-app inbox of a user.
+type Notification struct {
+	ID        int64      `json:"id"`
+	UserID    string     `json:"user_id"`
+	Type      string     `json:"type"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	TodoID    *string    `json:"todo_id"`
+	TaskID    *string    `json:"task_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at"`
+}
+
+// UnreadCount is how many notifications in the inbox of a user are still unread.
+type UnreadCount struct {
+	Unread int `json:"unread"`
+}
+
+// Message is a notification on its way to a user, as handed to the channels.
+type Message struct {
+	// Key identifies the message, so that channels can tell when they are handed the same one twice.
+	Key    string  `json:"key"`
+	Type   string  `json:"type"`
+	Title  string  `json:"title"`
+	Body   string  `json:"body"`
+	TodoID *string `json:"todo_id"`
+	TaskID *string `json:"task_id"`
+}
+
+// Recipient is who a message is for, and how they want to be notified.
+type Recipient struct {
+	UserID   string
+	Email    string
+	Settings Settings
+}
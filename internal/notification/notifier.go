@@ -0,0 +1,165 @@
+package notification
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/akalpaki/todo/pkg/jobs"
+)
+
+// RemindJob is the kind of the job sending the reminders which are due.
+const RemindJob = "notification.remind"
+
+const (
+	// remindBatch is how many reminders are claimed at once.
+	remindBatch = 50
+	// remindLease is how long claimed reminders are left alone by the other notifiers.
+	remindLease = 5 * time.Minute
+	// maxAttempts is how many times a reminder failing on some channel is attempted before it is given up on.
+	maxAttempts = 5
+	// baseBackoff and maxBackoff bound the delay before retrying a reminder, which doubles with every attempt.
+	baseBackoff = time.Minute
+	maxBackoff  = time.Hour
+	// dueLayout is how the due date of a task is written in reminders.
+	dueLayout = "Mon, 02 Jan 2006 15:04 MST"
+)
+
+// Notifier sends the reminders which are due through the channels each user has chosen. A reminder is recorded
+// as delivered on every channel it went through, so it never goes through a channel twice, and is retried on the
+// channels which failed. During the user's quiet hours only the in-app channel is used, and the others wait for
+// the quiet hours to end.
+type Notifier struct {
+	repository *Repository
+	logger     *slog.Logger
+	channels   map[string]Channel
+}
+
+func NewNotifier(repository *Repository, logger *slog.Logger, channels ...Channel) *Notifier {
+	n := &Notifier{
+		repository: repository,
+		logger:     logger,
+		channels:   make(map[string]Channel),
+	}
+	for _, c := range channels {
+		n.channels[c.Name()] = c
+	}
+	return n
+}
+
+// HandleRemind is the handler of RemindJob.
+func (n *Notifier) HandleRemind(ctx context.Context, _ jobs.Job) error {
+	return n.SendDueReminders(ctx)
+}
+
+// SendDueReminders sends every reminder which is due.
+func (n *Notifier) SendDueReminders(ctx context.Context) error {
+	for {
+		due, err := n.repository.claimReminders(ctx, remindBatch, remindLease)
+		if err != nil {
+			return err
+		}
+
+		settings := make(map[string]Settings)
+		for _, d := range due {
+			s, ok := settings[d.UserID]
+			if !ok {
+				if s, err = n.repository.GetSettings(ctx, d.UserID); err != nil {
+					return err
+				}
+				settings[d.UserID] = s
+			}
+			if err := n.remind(ctx, d, s); err != nil {
+				return err
+			}
+		}
+
+		if len(due) < remindBatch {
+			return nil
+		}
+	}
+}
+
+// remind sends a claimed reminder through the channels of the user it has not gone through yet, and records the outcome.
+func (n *Notifier) remind(ctx context.Context, d dueReminder, settings Settings) error {
+	if d.dropped {
+		return n.repository.reminderSent(ctx, d.ID, nil)
+	}
+
+	to := Recipient{UserID: d.UserID, Email: d.email, Settings: settings}
+	m := reminderMessage(d, settings)
+	now := time.Now()
+	quietUntil, quiet := settings.quietUntil(now)
+
+	var (
+		held    bool
+		sendErr error
+	)
+	for _, name := range settings.Channels {
+		if slices.Contains(d.delivered, name) {
+			continue
+		}
+		channel, ok := n.channels[name]
+		if !ok {
+			n.logger.Warn("notification channel not available", "channel", name, "reminder_id", d.ID)
+			continue
+		}
+		if quiet && name != ChannelInApp {
+			held = true
+			continue
+		}
+
+		if err := channel.Send(ctx, to, m); err != nil {
+			n.logger.Error("failed to send reminder", "channel", name, "reminder_id", d.ID, "error", err)
+			if sendErr == nil {
+				sendErr = fmt.Errorf("%s: %w", name, err)
+			}
+			continue
+		}
+		if err := n.repository.recordDelivery(ctx, d.ID, name); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case sendErr != nil && d.attempts+1 >= maxAttempts:
+		msg := sendErr.Error()
+		return n.repository.reminderSent(ctx, d.ID, &msg)
+	case sendErr != nil:
+		msg := sendErr.Error()
+		return n.repository.reminderPending(ctx, d.ID, now.Add(backoff(d.attempts+1)), true, &msg)
+	case held:
+		return n.repository.reminderPending(ctx, d.ID, quietUntil, false, nil)
+	default:
+		return n.repository.reminderSent(ctx, d.ID, nil)
+	}
+}
+
+// reminderMessage writes the message of a reminder, with times in the user's time zone.
+func reminderMessage(d dueReminder, settings Settings) Message {
+	body := fmt.Sprintf("%s\nin %s", d.content, d.todoName)
+	if d.dueAt != nil {
+		body += "\ndue " + d.dueAt.In(settings.location()).Format(dueLayout)
+	}
+	return Message{
+		// a rescheduled reminder is a new message
+		Key:    "reminder:" + d.ID + ":" + strconv.FormatInt(d.RemindAt.Unix(), 10),
+		Type:   TypeReminder,
+		Title:  "Reminder: " + d.content,
+		Body:   body,
+		TodoID: &d.TodoID,
+		TaskID: &d.TaskID,
+	}
+}
+
+// backoff returns how long to wait before the attempt following the given number of failed ones.
+func backoff(failed int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < failed && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
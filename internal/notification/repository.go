@@ -0,0 +1,368 @@
+package notification
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/noquark/nanoid"
+
+	"github.com/akalpaki/todo/pkg/db"
+)
+
+var (
+	errNotFound     = errors.New("not found")
+	errTaskNotFound = errors.New("task not found")
+)
+
+type Repository struct {
+	pool *pgxpool.Pool
+}
+
+func NewRepository(pool *pgxpool.Pool) *Repository {
+	return &Repository{
+		pool: pool,
+	}
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|            SETTINGS            |
+//|++++++++++++++++++++++++++++++++|
+
+// GetSettings returns the notification settings of the user, or the default ones if the user never changed them.
+func (r *Repository) GetSettings(ctx context.Context, userID string) (Settings, error) {
+	var s Settings
+	if err := scanSettings(r.pool.QueryRow(ctx, selectSettingsQuery, userID), &s); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return defaultSettings(userID), nil
+		}
+		return Settings{}, fmt.Errorf("notification_repo get settings: %w", err)
+	}
+	return s, nil
+}
+
+// PutSettings replaces the notification settings of the user, and schedules the next digest.
+func (r *Repository) PutSettings(ctx context.Context, userID string, data SettingsRequest) (Settings, error) {
+	s := Settings{
+		UserID:     userID,
+		TimeZone:   data.TimeZone,
+		QuietStart: data.QuietStart,
+		QuietEnd:   data.QuietEnd,
+		Channels:   data.Channels,
+		WebhookURL: data.WebhookURL,
+		Digest:     cmp.Or(data.Digest, DigestOff),
+		DigestAt:   cmp.Or(data.DigestAt, defaultDigestAt),
+	}
+	var digestNextAt *time.Time
+	if next, ok := s.nextDigest(time.Now()); ok {
+		digestNextAt = &next
+	}
+	if _, err := r.pool.Exec(ctx, upsertSettingsQuery, s.UserID, s.TimeZone, s.QuietStart, s.QuietEnd, s.Channels, s.WebhookURL, s.Digest, s.DigestAt, digestNextAt); err != nil {
+		return Settings{}, fmt.Errorf("notification_repo put settings: %w", err)
+	}
+	return s, nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|           REMINDERS            |
+//|++++++++++++++++++++++++++++++++|
+
+// CreateReminder sets a reminder for the user on a task of one of the user's lists. errTaskNotFound is returned
+// when there is no such task.
+func (r *Repository) CreateReminder(ctx context.Context, userID string, data ReminderRequest) (Reminder, error) {
+	id, err := nanoid.New(21)
+	if err != nil {
+		return Reminder{}, fmt.Errorf("notification_repo generating id: %w", err)
+	}
+
+	if err := r.pool.QueryRow(ctx, insertReminderQuery, id, data.TaskID, userID, data.RemindAt).Scan(&id); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Reminder{}, errTaskNotFound
+		}
+		return Reminder{}, fmt.Errorf("notification_repo insert reminder: %w", err)
+	}
+	return r.GetReminder(ctx, id)
+}
+
+func (r *Repository) GetReminder(ctx context.Context, id string) (Reminder, error) {
+	var rem Reminder
+	if err := scanReminder(r.pool.QueryRow(ctx, selectReminderQuery, id), &rem); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Reminder{}, errNotFound
+		}
+		return Reminder{}, fmt.Errorf("notification_repo get reminder: %w", err)
+	}
+	return rem, nil
+}
+
+// GetReminders returns a page of the user's reminders, soonest first, along with the total number of reminders the user has.
+func (r *Repository) GetReminders(ctx context.Context, userID string, limit, page int) ([]Reminder, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countRemindersQuery, userID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("notification_repo count reminders: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectRemindersQuery, userID, limit, db.CalculateOffset(page, limit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("notification_repo select reminders: %w", err)
+	}
+	defer rows.Close()
+
+	reminders := make([]Reminder, 0)
+	for rows.Next() {
+		var rem Reminder
+		if err := scanReminder(rows, &rem); err != nil {
+			return nil, 0, fmt.Errorf("notification_repo scan reminder: %w", err)
+		}
+		reminders = append(reminders, rem)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("notification_repo select reminders: %w", err)
+	}
+
+	return reminders, total, nil
+}
+
+// RescheduleReminder moves a reminder to remindAt. It is sent again on every channel, even if it was sent already.
+func (r *Repository) RescheduleReminder(ctx context.Context, id string, remindAt time.Time) error {
+	if _, err := r.pool.Exec(ctx, rescheduleReminderQuery, id, remindAt); err != nil {
+		return fmt.Errorf("notification_repo reschedule reminder: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) DeleteReminder(ctx context.Context, id string) error {
+	if _, err := r.pool.Exec(ctx, deleteReminderQuery, id); err != nil {
+		return fmt.Errorf("notification_repo delete reminder: %w", err)
+	}
+	return nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|             INBOX              |
+//|++++++++++++++++++++++++++++++++|
+
+func (r *Repository) GetNotification(ctx context.Context, id int64) (Notification, error) {
+	var n Notification
+	if err := scanNotification(r.pool.QueryRow(ctx, selectNotificationQuery, id), &n); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Notification{}, errNotFound
+		}
+		return Notification{}, fmt.Errorf("notification_repo get notification: %w", err)
+	}
+	return n, nil
+}
+
+// GetNotifications returns a page of the inbox of the user, newest first, along with the total number of notifications
+// in it. When unread is true only the unread notifications are returned and counted.
+func (r *Repository) GetNotifications(ctx context.Context, userID string, unread bool, limit, page int) ([]Notification, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countNotificationsQuery, userID, unread).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("notification_repo count notifications: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectNotificationsQuery, userID, unread, limit, db.CalculateOffset(page, limit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("notification_repo select notifications: %w", err)
+	}
+	defer rows.Close()
+
+	notifications := make([]Notification, 0)
+	for rows.Next() {
+		var n Notification
+		if err := scanNotification(rows, &n); err != nil {
+			return nil, 0, fmt.Errorf("notification_repo scan notification: %w", err)
+		}
+		notifications = append(notifications, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("notification_repo select notifications: %w", err)
+	}
+
+	return notifications, total, nil
+}
+
+func (r *Repository) UnreadCount(ctx context.Context, userID string) (int, error) {
+	var unread int
+	if err := r.pool.QueryRow(ctx, countNotificationsQuery, userID, true).Scan(&unread); err != nil {
+		return 0, fmt.Errorf("notification_repo count unread: %w", err)
+	}
+	return unread, nil
+}
+
+// MarkRead marks a notification as read. A notification read already keeps the time it was first read at.
+func (r *Repository) MarkRead(ctx context.Context, id int64) error {
+	if _, err := r.pool.Exec(ctx, markReadQuery, id); err != nil {
+		return fmt.Errorf("notification_repo mark read: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) MarkUnread(ctx context.Context, id int64) error {
+	if _, err := r.pool.Exec(ctx, markUnreadQuery, id); err != nil {
+		return fmt.Errorf("notification_repo mark unread: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) MarkAllRead(ctx context.Context, userID string) error {
+	if _, err := r.pool.Exec(ctx, markAllReadQuery, userID); err != nil {
+		return fmt.Errorf("notification_repo mark all read: %w", err)
+	}
+	return nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|            DELIVERY            |
+//|++++++++++++++++++++++++++++++++|
+
+// dueReminder is a reminder claimed by a notifier, along with what it takes to send it.
+type dueReminder struct {
+	Reminder
+	attempts int
+	content  string
+	dueAt    *time.Time
+	// dropped is true when the task is done, or either the task or its list is in the trash.
+	dropped  bool
+	todoName string
+	email    string
+	// delivered holds the channels the reminder has already gone through.
+	delivered []string
+}
+
+// claimReminders leases up to limit due reminders for the length of lease.
+func (r *Repository) claimReminders(ctx context.Context, limit int, lease time.Duration) ([]dueReminder, error) {
+	rows, err := r.pool.Query(ctx, claimRemindersQuery, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("notification_repo claim reminders: %w", err)
+	}
+	defer rows.Close()
+
+	var due []dueReminder
+	for rows.Next() {
+		var d dueReminder
+		if err := rows.Scan(&d.ID, &d.TaskID, &d.UserID, &d.RemindAt, &d.attempts, &d.TodoID, &d.content, &d.dueAt, &d.dropped, &d.todoName, &d.email, &d.delivered); err != nil {
+			return nil, fmt.Errorf("notification_repo scan reminder: %w", err)
+		}
+		due = append(due, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("notification_repo claim reminders: %w", err)
+	}
+	return due, nil
+}
+
+// recordDelivery remembers that a reminder went through a channel, so that it is never sent through it again.
+func (r *Repository) recordDelivery(ctx context.Context, reminderID, channel string) error {
+	if _, err := r.pool.Exec(ctx, insertReminderDeliveryQuery, reminderID, channel); err != nil {
+		return fmt.Errorf("notification_repo insert delivery: %w", err)
+	}
+	return nil
+}
+
+// reminderSent completes a reminder. lastError is set when the reminder was given up on.
+func (r *Repository) reminderSent(ctx context.Context, id string, lastError *string) error {
+	if _, err := r.pool.Exec(ctx, reminderSentQuery, id, lastError); err != nil {
+		return fmt.Errorf("notification_repo update reminder: %w", err)
+	}
+	return nil
+}
+
+// reminderPending makes a reminder due again at next, for the channels it has not gone through yet.
+// failed tells whether this counts as a failed attempt.
+func (r *Repository) reminderPending(ctx context.Context, id string, next time.Time, failed bool, lastError *string) error {
+	attempts := 0
+	if failed {
+		attempts = 1
+	}
+	if _, err := r.pool.Exec(ctx, reminderPendingQuery, id, attempts, next, lastError); err != nil {
+		return fmt.Errorf("notification_repo update reminder: %w", err)
+	}
+	return nil
+}
+
+// dueDigest is a digest claimed by a digester, along with the settings and email of its user.
+type dueDigest struct {
+	Settings
+	email string
+}
+
+// claimDigests leases up to limit due digests for the length of lease.
+func (r *Repository) claimDigests(ctx context.Context, limit int, lease time.Duration) ([]dueDigest, error) {
+	rows, err := r.pool.Query(ctx, claimDigestsQuery, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("notification_repo claim digests: %w", err)
+	}
+	defer rows.Close()
+
+	var due []dueDigest
+	for rows.Next() {
+		var d dueDigest
+		if err := rows.Scan(&d.UserID, &d.TimeZone, &d.QuietStart, &d.QuietEnd, &d.Channels, &d.WebhookURL, &d.Digest, &d.DigestAt, &d.email); err != nil {
+			return nil, fmt.Errorf("notification_repo scan digest: %w", err)
+		}
+		due = append(due, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("notification_repo claim digests: %w", err)
+	}
+	return due, nil
+}
+
+// digestSent schedules the next digest of the user at next.
+func (r *Repository) digestSent(ctx context.Context, userID string, next time.Time) error {
+	if _, err := r.pool.Exec(ctx, digestSentQuery, userID, next); err != nil {
+		return fmt.Errorf("notification_repo update digest: %w", err)
+	}
+	return nil
+}
+
+// digestTasks returns the tasks of the user which are not done and due before dueBefore, and the ones completed since
+// completedSince, soonest due first.
+func (r *Repository) digestTasks(ctx context.Context, userID string, dueBefore, completedSince time.Time) ([]digestTask, error) {
+	rows, err := r.pool.Query(ctx, selectDigestTasksQuery, userID, dueBefore, completedSince)
+	if err != nil {
+		return nil, fmt.Errorf("notification_repo select digest tasks: %w", err)
+	}
+	defer rows.Close()
+
+	var tasks []digestTask
+	for rows.Next() {
+		var t digestTask
+		if err := rows.Scan(&t.ID, &t.TodoID, &t.TodoName, &t.Content, &t.Done, &t.DueAt, &t.CompletedAt); err != nil {
+			return nil, fmt.Errorf("notification_repo scan digest task: %w", err)
+		}
+		tasks = append(tasks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("notification_repo select digest tasks: %w", err)
+	}
+	return tasks, nil
+}
+
+// insertNotification adds a message to the inbox of the user, unless a message with the same key is already there.
+func (r *Repository) insertNotification(ctx context.Context, userID string, m Message) error {
+	if _, err := r.pool.Exec(ctx, insertNotificationQuery, userID, m.Type, m.Title, m.Body, m.TodoID, m.TaskID, m.Key); err != nil {
+		return fmt.Errorf("notification_repo insert notification: %w", err)
+	}
+	return nil
+}
+
+// scanReminder scans a row selected with reminderColumns into rem.
+func scanReminder(row pgx.Row, rem *Reminder) error {
+	return row.Scan(&rem.ID, &rem.TaskID, &rem.TodoID, &rem.UserID, &rem.RemindAt, &rem.SentAt, &rem.CreatedAt)
+}
+
+// scanNotification scans a row selected with notificationColumns into n.
+func scanNotification(row pgx.Row, n *Notification) error {
+	return row.Scan(&n.ID, &n.UserID, &n.Type, &n.Title, &n.Body, &n.TodoID, &n.TaskID, &n.CreatedAt, &n.ReadAt)
+}
+
+// scanSettings scans a row selected with settingsColumns into s.
+func scanSettings(row pgx.Row, s *Settings) error {
+	return row.Scan(&s.UserID, &s.TimeZone, &s.QuietStart, &s.QuietEnd, &s.Channels, &s.WebhookURL, &s.Digest, &s.DigestAt)
+}
@@ -0,0 +1,398 @@
+package notification
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/akalpaki/todo/pkg/web"
+)
+
+// Routes returns the notification API: the inbox of the caller and how the caller wants to be notified.
+func Routes(logger *slog.Logger, repository *Repository) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /", web.Access(web.Auth(HandleGetNotifications(logger, repository)), logger))
+	mux.HandleFunc("GET /unread-count", web.Access(web.Auth(HandleUnreadCount(logger, repository)), logger))
+	mux.HandleFunc("PUT /read", web.Access(web.Auth(HandleMarkAllRead(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}/read", web.Access(web.Auth(HandleMarkRead(logger, repository)), logger))
+	mux.HandleFunc("DELETE /{id}/read", web.Access(web.Auth(HandleMarkUnread(logger, repository)), logger))
+
+	mux.HandleFunc("GET /settings", web.Access(web.Auth(HandleGetSettings(logger, repository)), logger))
+	mux.HandleFunc("PUT /settings", web.Access(web.Auth(HandlePutSettings(logger, repository)), logger))
+
+	return mux
+}
+
+// ReminderRoutes returns the reminder API. Creating a reminder can be retried safely with an Idempotency-Key.
+func ReminderRoutes(logger *slog.Logger, repository *Repository, idempotency web.IdempotencyStore) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /", web.Access(web.Auth(web.Idempotent(HandleCreateReminder(logger, repository), idempotency, logger)), logger))
+	mux.HandleFunc("GET /", web.Access(web.Auth(HandleGetReminders(logger, repository)), logger))
+	mux.HandleFunc("GET /{id}", web.Access(web.Auth(HandleGetReminder(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}", web.Access(web.Auth(HandleRescheduleReminder(logger, repository)), logger))
+	mux.HandleFunc("DELETE /{id}", web.Access(web.Auth(HandleDeleteReminder(logger, repository)), logger))
+
+	return mux
+}
+
+// HandleGetNotifications returns a page of the inbox of the caller, newest first. With ?unread=true only the
+// unread notifications are returned.
+func HandleGetNotifications(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 50
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+		unread, _ := strconv.ParseBool(r.URL.Query().Get("unread"))
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		notifications, total, err := repository.GetNotifications(ctx, userID, unread, limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve notifications", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(notifications, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleUnreadCount(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		unread, err := repository.UnreadCount(ctx, userID)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to count notifications", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, UnreadCount{Unread: unread}); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleMarkAllRead(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		if err := repository.MarkAllRead(ctx, userID); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to mark notifications as read", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleMarkRead(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		n, ok := ownedNotification(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.MarkRead(ctx, n.ID); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to mark notification as read", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleMarkUnread(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		n, ok := ownedNotification(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.MarkUnread(ctx, n.ID); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to mark notification as unread", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleGetSettings(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		settings, err := repository.GetSettings(ctx, userID)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve settings", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, settings); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandlePutSettings replaces the notification settings of the caller.
+func HandlePutSettings(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		data, err := web.ReadJSON[SettingsRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		settings, err := repository.PutSettings(ctx, userID, data)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update settings", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, settings); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleCreateReminder sets a reminder on a task of one of the caller's lists.
+func HandleCreateReminder(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		data, err := web.ReadJSON[ReminderRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		reminder, err := repository.CreateReminder(ctx, userID, data)
+		if err != nil {
+			switch err {
+			case errTaskNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to create reminder", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusCreated, reminder); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleGetReminders(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 50
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		reminders, total, err := repository.GetReminders(ctx, userID, limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve reminders", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(reminders, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleGetReminder(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reminder, ok := ownedReminder(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, reminder); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleRescheduleReminder moves a reminder to another time, after which it is sent again even if it was sent already.
+func HandleRescheduleReminder(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		reminder, ok := ownedReminder(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		data, err := web.ReadJSON[RescheduleRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		if err := repository.RescheduleReminder(ctx, reminder.ID, data.RemindAt); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to reschedule reminder", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleDeleteReminder(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		reminder, ok := ownedReminder(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.DeleteReminder(ctx, reminder.ID); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to delete reminder", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// ownedReminder loads the reminder named by the id path value and makes sure it belongs to the caller.
+// When it returns false an error response has already been written.
+func ownedReminder(logger *slog.Logger, w http.ResponseWriter, r *http.Request, repository *Repository) (Reminder, bool) {
+	ctx := r.Context()
+	userID, ok := ctx.Value(web.UserID).(string)
+	if !ok {
+		web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+		return Reminder{}, false
+	}
+
+	reminder, err := repository.GetReminder(ctx, r.PathValue("id"))
+	if err != nil {
+		switch err {
+		case errNotFound:
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "reminder not found", err)
+			return Reminder{}, false
+		default:
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve reminder", err)
+			return Reminder{}, false
+		}
+	}
+
+	if userID != reminder.UserID {
+		web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", web.ErrInvalidUserID)
+		return Reminder{}, false
+	}
+
+	return reminder, true
+}
+
+// ownedNotification loads the notification named by the id path value and makes sure it is in the inbox of the caller.
+// When it returns false an error response has already been written.
+func ownedNotification(logger *slog.Logger, w http.ResponseWriter, r *http.Request, repository *Repository) (Notification, bool) {
+	ctx := r.Context()
+	userID, ok := ctx.Value(web.UserID).(string)
+	if !ok {
+		web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+		return Notification{}, false
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		web.ErrorResponse(logger, w, r, http.StatusNotFound, "notification not found", errNotFound)
+		return Notification{}, false
+	}
+
+	n, err := repository.GetNotification(ctx, id)
+	if err != nil {
+		switch err {
+		case errNotFound:
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "notification not found", err)
+			return Notification{}, false
+		default:
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve notification", err)
+			return Notification{}, false
+		}
+	}
+
+	if userID != n.UserID {
+		web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", web.ErrInvalidUserID)
+		return Notification{}, false
+	}
+
+	return n, true
+}
@@ -0,0 +1,92 @@
+package notification
+
+const (
+	settingsColumns     = "user_id, time_zone, quiet_start, quiet_end, channels, webhook_url, digest, digest_at"
+	selectSettingsQuery = "SELECT " + settingsColumns + " FROM notification_settings WHERE user_id = $1"
+	upsertSettingsQuery = `
+	INSERT INTO notification_settings (user_id, time_zone, quiet_start, quiet_end, channels, webhook_url, digest, digest_at, digest_next_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	ON CONFLICT (user_id) DO UPDATE SET time_zone = EXCLUDED.time_zone, quiet_start = EXCLUDED.quiet_start,
+		quiet_end = EXCLUDED.quiet_end, channels = EXCLUDED.channels, webhook_url = EXCLUDED.webhook_url,
+		digest = EXCLUDED.digest, digest_at = EXCLUDED.digest_at, digest_next_at = EXCLUDED.digest_next_at`
+	reminderColumns = "r.id, r.task_id, t.todo_id, r.user_id, r.remind_at, r.sent_at, r.created_at"
+	// insertReminderQuery only creates the reminder if the task is in a list the user owns or is a member of, and neither
+	// is in the trash.
+	insertReminderQuery = `
+	INSERT INTO reminders (id, task_id, user_id, remind_at, next_attempt_at)
+	SELECT $1, t.id, $3, $4, $4 FROM tasks t JOIN todos td ON td.id = t.todo_id
+	WHERE t.id = $2 AND td.id IN (SELECT todo_id FROM todo_access WHERE user_id = $3)
+		AND t.deleted_at IS NULL AND td.deleted_at IS NULL
+	RETURNING id`
+	selectReminderQuery  = "SELECT " + reminderColumns + " FROM reminders r JOIN tasks t ON t.id = r.task_id WHERE r.id = $1"
+	selectRemindersQuery = "SELECT " + reminderColumns + " FROM reminders r JOIN tasks t ON t.id = r.task_id WHERE r.user_id = $1 ORDER BY r.remind_at, r.id LIMIT $2 OFFSET $3"
+	countRemindersQuery  = "SELECT COUNT(*) FROM reminders WHERE user_id = $1"
+	// rescheduleReminderQuery makes a reminder due again at $2, on every channel.
+	rescheduleReminderQuery = `
+	WITH cleared AS (DELETE FROM reminder_deliveries WHERE reminder_id = $1)
+	UPDATE reminders SET remind_at = $2, next_attempt_at = $2, sent_at = NULL, attempts = 0, last_error = NULL WHERE id = $1`
+	deleteReminderQuery = "DELETE FROM reminders WHERE id = $1"
+	// claimRemindersQuery leases the due reminders to a single notifier, along with what it takes to send them:
+	// they are not due again until the lease of $2 seconds runs out.
+	claimRemindersQuery = `
+	WITH claimed AS (
+		UPDATE reminders SET next_attempt_at = now() + $2::float8 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM reminders
+			WHERE sent_at IS NULL AND next_attempt_at <= now()
+			ORDER BY next_attempt_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, task_id, user_id, remind_at, attempts
+	)
+	SELECT c.id, c.task_id, c.user_id, c.remind_at, c.attempts, t.todo_id, t.content, t.due_at,
+		t.done OR t.deleted_at IS NOT NULL OR td.deleted_at IS NOT NULL, td.name, u.email,
+		COALESCE((SELECT array_agg(d.channel) FROM reminder_deliveries d WHERE d.reminder_id = c.id), '{}')
+	FROM claimed c
+	JOIN tasks t ON t.id = c.task_id
+	JOIN todos td ON td.id = t.todo_id
+	JOIN users u ON u.id = c.user_id`
+	insertReminderDeliveryQuery = "INSERT INTO reminder_deliveries (reminder_id, channel) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	reminderSentQuery           = "UPDATE reminders SET sent_at = now(), last_error = $2 WHERE id = $1"
+	reminderPendingQuery        = "UPDATE reminders SET attempts = attempts + $2, next_attempt_at = $3, last_error = $4 WHERE id = $1"
+	insertNotificationQuery     = `
+	INSERT INTO notifications (user_id, type, title, body, todo_id, task_id, key) VALUES ($1, $2, $3, $4, $5, $6, $7)
+	ON CONFLICT (user_id, key) DO NOTHING`
+	notificationColumns     = "id, user_id, type, title, body, todo_id, task_id, created_at, read_at"
+	selectNotificationQuery = "SELECT " + notificationColumns + " FROM notifications WHERE id = $1"
+	// selectNotificationsQuery only returns the unread notifications when $2 is true.
+	selectNotificationsQuery = "SELECT " + notificationColumns + " FROM notifications WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL) ORDER BY id DESC LIMIT $3 OFFSET $4"
+	countNotificationsQuery  = "SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND (NOT $2 OR read_at IS NULL)"
+	markReadQuery            = "UPDATE notifications SET read_at = COALESCE(read_at, now()) WHERE id = $1"
+	markUnreadQuery          = "UPDATE notifications SET read_at = NULL WHERE id = $1"
+	markAllReadQuery         = "UPDATE notifications SET read_at = now() WHERE user_id = $1 AND read_at IS NULL"
+	// selectMemberIDsQuery returns the users who were members of a todo list by $2, the time of an event.
+	selectMemberIDsQuery = "SELECT user_id FROM todo_members WHERE todo_id = $1 AND created_at <= $2"
+	// selectActivityQuery returns the email of the actor of an event, and the names of the todo list and task it is about,
+	// any of which may be gone by now.
+	selectActivityQuery = "SELECT (SELECT email FROM users WHERE id = $1), (SELECT name FROM todos WHERE id = $2), (SELECT content FROM tasks WHERE id = $3)"
+	// claimDigestsQuery leases the due digests to a single digester, along with the email of their user: they are not due
+	// again until the lease of $2 seconds runs out.
+	claimDigestsQuery = `
+	WITH claimed AS (
+		UPDATE notification_settings SET digest_next_at = now() + $2::float8 * interval '1 second'
+		WHERE user_id IN (
+			SELECT user_id FROM notification_settings
+			WHERE digest <> 'off' AND digest_next_at <= now()
+			ORDER BY digest_next_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING ` + settingsColumns + `
+	)
+	SELECT c.*, u.email FROM claimed c JOIN users u ON u.id = c.user_id`
+	digestSentQuery = "UPDATE notification_settings SET digest_next_at = $2 WHERE user_id = $1"
+	// selectDigestTasksQuery returns the tasks of the lists the user owns or is a member of which are not done and due
+	// before $2, and the ones completed since $3, leaving out the ones in the trash or in archived lists.
+	selectDigestTasksQuery = `
+	SELECT t.id, t.todo_id, td.name, COALESCE(t.content, ''), COALESCE(t.done, FALSE), t.due_at, t.completed_at
+	FROM tasks t JOIN todos td ON td.id = t.todo_id
+	WHERE td.id IN (SELECT todo_id FROM todo_access WHERE user_id = $1)
+		AND t.deleted_at IS NULL AND td.deleted_at IS NULL AND td.archived_at IS NULL
+		AND ((NOT COALESCE(t.done, FALSE) AND t.due_at < $2) OR (t.done AND t.completed_at >= $3))
+	ORDER BY t.due_at NULLS LAST, t.completed_at, t.id`
+)
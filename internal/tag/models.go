@@ -0,0 +1,35 @@
+package tag
+
+import "regexp"
+
+// DefaultColor is the color of the tags created without one.
+const DefaultColor = "#808080"
+
+var colorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Tag is the model that represents a user-scoped label which can be attached to todo lists and tasks.
+type Tag struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	Color  string `json:"color"`
+}
+
+// Summary is a tag together with the number of todo lists and tasks it is attached to.
+type Summary struct {
+	Tag
+	TodoCount int `json:"todo_count"`
+	TaskCount int `json:"task_count"`
+}
+
+// TagRequest is the model containing the information required to create and update a tag.
+// Requests should always be validated with the Valid method before being accepted.
+type TagRequest struct {
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+// Valid reports whether the request has a name and, if given, a color in the #rrggbb format.
+func (r TagRequest) Valid() bool {
+	return r.Name != "" && (r.Color == "" || colorPattern.MatchString(r.Color))
+}
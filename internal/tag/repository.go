@@ -0,0 +1,124 @@
+package tag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/noquark/nanoid"
+
+	"github.com/akalpaki/todo/pkg/db"
+)
+
+const uniqueViolation = "23505"
+
+var (
+	errNotFound      = errors.New("not found")
+	errDuplicateName = errors.New("a tag with this name already exists")
+)
+
+type Repository struct {
+	pool *pgxpool.Pool
+}
+
+func NewRepository(pool *pgxpool.Pool) *Repository {
+	return &Repository{
+		pool: pool,
+	}
+}
+
+func (r *Repository) Create(ctx context.Context, userID string, data TagRequest) (Tag, error) {
+	id, err := nanoid.New(21)
+	if err != nil {
+		return Tag{}, fmt.Errorf("tag_repo generating id: %w", err)
+	}
+
+	t := Tag{
+		ID:     id,
+		UserID: userID,
+		Name:   data.Name,
+		Color:  data.Color,
+	}
+	if t.Color == "" {
+		t.Color = DefaultColor
+	}
+
+	if _, err := r.pool.Exec(ctx, insertTagQuery, t.ID, t.UserID, t.Name, t.Color); err != nil {
+		if isUniqueViolation(err) {
+			return Tag{}, errDuplicateName
+		}
+		return Tag{}, fmt.Errorf("tag_repo insert tag: %w", err)
+	}
+
+	return t, nil
+}
+
+func (r *Repository) GetByID(ctx context.Context, id string) (Tag, error) {
+	var t Tag
+
+	row := r.pool.QueryRow(ctx, selectTagQuery, id)
+	if err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Color); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Tag{}, errNotFound
+		}
+		return Tag{}, fmt.Errorf("tag_repo get tag: %w", err)
+	}
+
+	return t, nil
+}
+
+// GetByUserID returns a page of the user's tags, each with the number of todo lists and tasks using it,
+// along with the total number of tags the user owns.
+func (r *Repository) GetByUserID(ctx context.Context, userID string, limit, page int) ([]Summary, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countTagsByUserIDQuery, userID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("tag_repo count tags: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectTagsByUserIDQuery, userID, limit, db.CalculateOffset(page, limit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("tag_repo select tags: %w", err)
+	}
+	defer rows.Close()
+
+	tags := make([]Summary, 0)
+	for rows.Next() {
+		var s Summary
+		if err := rows.Scan(&s.ID, &s.UserID, &s.Name, &s.Color, &s.TodoCount, &s.TaskCount); err != nil {
+			return nil, 0, fmt.Errorf("tag_repo scan tag: %w", err)
+		}
+		tags = append(tags, s)
+	}
+
+	return tags, total, nil
+}
+
+func (r *Repository) Update(ctx context.Context, id string, update TagRequest) error {
+	color := update.Color
+	if color == "" {
+		color = DefaultColor
+	}
+
+	if _, err := r.pool.Exec(ctx, updateTagQuery, update.Name, color, id); err != nil {
+		if isUniqueViolation(err) {
+			return errDuplicateName
+		}
+		return fmt.Errorf("tag_repo update tag: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) Delete(ctx context.Context, id string) error {
+	if _, err := r.pool.Exec(ctx, deleteTagQuery, id); err != nil {
+		return fmt.Errorf("tag_repo delete tag: %w", err)
+	}
+	return nil
+}
+
+func isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && pgErr.Code == uniqueViolation
+}
@@ -0,0 +1,181 @@
+package tag
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/akalpaki/todo/pkg/web"
+)
+
+// Routes returns the tag API. Creating a tag can be retried safely with an Idempotency-Key.
+func Routes(logger *slog.Logger, repository *Repository, idempotency web.IdempotencyStore) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("POST /", web.Access(web.Auth(web.Idempotent(HandleCreate(logger, repository), idempotency, logger)), logger))
+	mux.HandleFunc("GET /", web.Access(web.Auth(HandleGetForUser(logger, repository)), logger))
+	mux.HandleFunc("GET /{id}", web.Access(web.Auth(HandleGetByID(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}", web.Access(web.Auth(HandleUpdate(logger, repository)), logger))
+	mux.HandleFunc("DELETE /{id}", web.Access(web.Auth(HandleDelete(logger, repository)), logger))
+
+	return mux
+}
+
+func HandleCreate(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		data, err := web.ReadJSON[TagRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		tag, err := repository.Create(ctx, userID, data)
+		if err != nil {
+			switch err {
+			case errDuplicateName:
+				web.ErrorResponse(logger, w, r, http.StatusConflict, "a tag with this name already exists", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to create tag", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusCreated, tag); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetForUser lists the caller's tags along with how many todo lists and tasks use each of them.
+func HandleGetForUser(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 50
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		tags, total, err := repository.GetByUserID(ctx, userID, limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tags", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(tags, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleGetByID(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tag, ok := ownedTag(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, tag); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleUpdate(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		tag, ok := ownedTag(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		update, err := web.ReadJSON[TagRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		if err := repository.Update(ctx, tag.ID, update); err != nil {
+			switch err {
+			case errDuplicateName:
+				web.ErrorResponse(logger, w, r, http.StatusConflict, "a tag with this name already exists", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update tag", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleDelete(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		tag, ok := ownedTag(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.Delete(ctx, tag.ID); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to delete tag", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// ownedTag loads the tag named by the id path value and makes sure it belongs to the caller.
+// When it returns false an error response has already been written.
+func ownedTag(logger *slog.Logger, w http.ResponseWriter, r *http.Request, repository *Repository) (Tag, bool) {
+	ctx := r.Context()
+	userID, ok := ctx.Value(web.UserID).(string)
+	if !ok {
+		web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+		return Tag{}, false
+	}
+
+	tag, err := repository.GetByID(ctx, r.PathValue("id"))
+	if err != nil {
+		switch err {
+		case errNotFound:
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "tag not found", err)
+			return Tag{}, false
+		default:
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tag", err)
+			return Tag{}, false
+		}
+	}
+
+	if userID != tag.UserID {
+		web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", web.ErrInvalidUserID)
+		return Tag{}, false
+	}
+
+	return tag, true
+}
@@ -0,0 +1,19 @@
+package tag
+
+const (
+	insertTagQuery          = "INSERT INTO tags (id, user_id, name, color) VALUES ($1, $2, $3, $4)"
+	selectTagQuery          = "SELECT id, user_id, name, color FROM tags WHERE id = $1"
+	selectTagsByUserIDQuery = `
+	SELECT t.id, t.user_id, t.name, t.color,
+		(SELECT COUNT(*) FROM todo_tags tt JOIN todos td ON td.id = tt.todo_id
+			WHERE tt.tag_id = t.id AND td.deleted_at IS NULL),
+		(SELECT COUNT(*) FROM task_tags tt JOIN tasks ts ON ts.id = tt.task_id JOIN todos td ON td.id = ts.todo_id
+			WHERE tt.tag_id = t.id AND ts.deleted_at IS NULL AND td.deleted_at IS NULL)
+	FROM tags t
+	WHERE t.user_id = $1
+	ORDER BY t.name
+	LIMIT $2 OFFSET $3`
+	countTagsByUserIDQuery = "SELECT COUNT(*) FROM tags WHERE user_id = $1"
+	updateTagQuery         = "UPDATE tags SET name = $1, color = $2 WHERE id = $3"
+	deleteTagQuery         = "DELETE FROM tags WHERE id = $1"
+)
@@ -4,36 +4,58 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/akalpaki/todo/internal/calendar"
+	"github.com/akalpaki/todo/internal/notification"
+	"github.com/akalpaki/todo/internal/tag"
 	"github.com/akalpaki/todo/internal/todo"
 	"github.com/akalpaki/todo/internal/user"
+	"github.com/akalpaki/todo/internal/webhook"
+	"github.com/akalpaki/todo/pkg/ical"
+	"github.com/akalpaki/todo/pkg/jobs"
+	"github.com/akalpaki/todo/pkg/mail"
+	"github.com/akalpaki/todo/pkg/outbox"
+	"github.com/akalpaki/todo/pkg/rank"
+	"github.com/akalpaki/todo/pkg/todotxt"
 	"github.com/akalpaki/todo/pkg/web"
+	"github.com/akalpaki/todo/pkg/ws"
 )
 
 // used to test handling of bcrypt's limitation of password length
 const reallyLongPassword = "abcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabcabc"
 
 var (
-	userRepo *user.Repository
-	todoRepo *todo.Repository
-	dbPool   *pgxpool.Pool
-	logger   *slog.Logger
+	userRepo    *user.Repository
+	todoRepo    *todo.Repository
+	tagRepo     *tag.Repository
+	webhookRepo *webhook.Repository
+	dbPool      *pgxpool.Pool
+	logger      *slog.Logger
 )
 
 func TestMain(m *testing.M) {
 	logger, dbPool = Setup()
 	userRepo = user.NewRepository(dbPool)
 	todoRepo = todo.NewRepository(dbPool)
+	tagRepo = tag.NewRepository(dbPool)
+	webhookRepo = webhook.NewRepository(dbPool)
 	m.Run()
 	CleanupDB(dbPool)
 	dbPool.Close()
@@ -434,3 +456,2404 @@ func TestUpdate(t *testing.T) {
 
 	}
 }
+
+func TestGetForUserV2(t *testing.T) {
+	tc := []struct {
+		name               string
+		userID             string
+		expectedTotal      int
+		expectedStatusCode int
+	}{
+		{
+			name:               "user successfully retrieves a page of his todo lists",
+			userID:             "test2",
+			expectedTotal:      1,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "user has no todos stored",
+			userID:             "test3",
+			expectedTotal:      0,
+			expectedStatusCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", http.MethodGet, "", nil, nil)
+		ctx := context.WithValue(req.Context(), web.UserID, tt.userID)
+		todo.HandleGetForUserV2(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Result().StatusCode != tt.expectedStatusCode {
+			t.Fatalf("test_getbyuser_v2: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Result().StatusCode)
+		}
+
+		var page web.Page[todo.Todo]
+		if err := json.Unmarshal(rc.Body.Bytes(), &page); err != nil {
+			t.Fatalf("test_getbyuser_v2: case %s: failed to unmarshall response, error=%s", tt.name, err.Error())
+		}
+		if page.Items == nil || len(page.Items) != tt.expectedTotal || page.Pagination.Total != tt.expectedTotal {
+			t.Fatalf("test_getbyuser_v2: case %s: expectedTotal=%d, actualResult=%v", tt.name, tt.expectedTotal, page)
+		}
+	}
+}
+
+func TestCreateTag(t *testing.T) {
+	tc := []struct {
+		name               string
+		userID             string
+		data               tag.TagRequest
+		expectedStatusCode int
+		expectedError      string
+	}{
+		{
+			name:               "successfully create a tag",
+			userID:             "test1",
+			data:               tag.TagRequest{Name: "@home", Color: "#00ff00"},
+			expectedStatusCode: http.StatusCreated,
+		},
+		{
+			name:               "tag name already used by the user",
+			userID:             "test1",
+			data:               tag.TagRequest{Name: "@home"},
+			expectedStatusCode: http.StatusConflict,
+			expectedError:      "httperror:conflict: a tag with this name already exists",
+		},
+		{
+			name:               "same tag name for another user",
+			userID:             "test2",
+			data:               tag.TagRequest{Name: "@home"},
+			expectedStatusCode: http.StatusCreated,
+		},
+		{
+			name:               "invalid color",
+			userID:             "test1",
+			data:               tag.TagRequest{Name: "urgent", Color: "red"},
+			expectedStatusCode: http.StatusBadRequest,
+			expectedError:      "httperror:badrequest: invalid data or malformed json",
+		},
+	}
+
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", http.MethodPost, "", nil, tt.data)
+		ctx := context.WithValue(req.Context(), web.UserID, tt.userID)
+		tag.HandleCreate(logger, tagRepo).ServeHTTP(rc, req.WithContext(ctx))
+
+		if tt.expectedStatusCode != rc.Code {
+			t.Fatalf("test_create_tag: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+		if tt.expectedError != "" {
+			var actualError string
+			if err := json.Unmarshal(rc.Body.Bytes(), &actualError); err != nil {
+				t.Fatalf("test_create_tag: case %s: failed to unmarshall response, error=%s", tt.name, err.Error())
+			}
+			if tt.expectedError != actualError {
+				t.Fatalf("test_create_tag: case %s: expectedError=%v, actualError=%v", tt.name, tt.expectedError, actualError)
+			}
+		} else {
+			var tg tag.Tag
+			if err := json.Unmarshal(rc.Body.Bytes(), &tg); err != nil {
+				t.Fatalf("test_create_tag: case %s: failed to unmarshall response, error=%s", tt.name, err.Error())
+			}
+			if tg.Name != tt.data.Name || tg.UserID != tt.userID || tg.Color == "" {
+				t.Fatalf("test_create_tag: case %s: expectedResult=%v, actualResult=%v", tt.name, tt.data, tg)
+			}
+		}
+	}
+}
+
+func TestSubtaskRollUp(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test2")
+
+	if err := todoRepo.CreateTask(ctx, "test2", todo.Task{TodoID: "todo2", Content: "parent", AutoComplete: true}); err != nil {
+		t.Fatalf("test_subtask_rollup: failed to create parent, error=%s", err.Error())
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test2", "todo2", todo.Filter{})
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("test_subtask_rollup: failed to retrieve parent, tasks=%v, error=%v", tasks, err)
+	}
+	parent := tasks[0]
+
+	if err := todoRepo.CreateTask(ctx, "test2", todo.Task{TodoID: "todo2", Content: "child", ParentID: &parent.ID}); err != nil {
+		t.Fatalf("test_subtask_rollup: failed to create child, error=%s", err.Error())
+	}
+	parent, err = todoRepo.GetTask(ctx, "test2", "todo2", parent.ID)
+	if err != nil || len(parent.Subtasks) != 1 || parent.Done || parent.Progress != 0 {
+		t.Fatalf("test_subtask_rollup: expected an open parent with one subtask, actualResult=%v, error=%v", parent, err)
+	}
+
+	child := parent.Subtasks[0]
+	child.Done = true
+	if err := todoRepo.UpdateTask(ctx, "test2", child.TodoID, child, nil); err != nil {
+		t.Fatalf("test_subtask_rollup: failed to complete child, error=%s", err.Error())
+	}
+	parent, err = todoRepo.GetTask(ctx, "test2", "todo2", parent.ID)
+	if err != nil || !parent.Done || parent.Progress != 100 {
+		t.Fatalf("test_subtask_rollup: expected the parent to be completed, actualResult=%v, error=%v", parent, err)
+	}
+
+	rc := httptest.NewRecorder()
+	req := TestRequest(t, "move task under its own subtask", "/", http.MethodPut, "", nil, todo.MoveRequest{ParentID: &child.ID})
+	req.SetPathValue("id", "todo2")
+	req.SetPathValue("task_id", parent.ID)
+	todo.HandleMoveTask(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusBadRequest {
+		t.Fatalf("test_subtask_rollup: expectedStatusCode=%d, actualStatusCode=%d", http.StatusBadRequest, rc.Code)
+	}
+}
+
+func TestDependencyCycle(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+
+	for _, content := range []string{"design", "build"} {
+		if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: "todo1", Content: content}); err != nil {
+			t.Fatalf("test_dependency_cycle: failed to create task, error=%s", err.Error())
+		}
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test1", "todo1", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_dependency_cycle: failed to retrieve tasks, error=%s", err.Error())
+	}
+	ids := make(map[string]string)
+	for _, task := range tasks {
+		ids[task.Content] = task.ID
+	}
+
+	tc := []struct {
+		name               string
+		taskID             string
+		dependsOnID        string
+		expectedStatusCode int
+	}{
+		{
+			name:               "build depends on design",
+			taskID:             ids["build"],
+			dependsOnID:        ids["design"],
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name:               "design depends on build closes a cycle",
+			taskID:             ids["design"],
+			dependsOnID:        ids["build"],
+			expectedStatusCode: http.StatusConflict,
+		},
+		{
+			name:               "task depends on a task of another list",
+			taskID:             ids["design"],
+			dependsOnID:        "task1_of_nowhere",
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", http.MethodPut, "", nil, nil)
+		req.SetPathValue("id", "todo1")
+		req.SetPathValue("task_id", tt.taskID)
+		req.SetPathValue("depends_on_id", tt.dependsOnID)
+		todo.HandleAddDependency(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Code != tt.expectedStatusCode {
+			t.Fatalf("test_dependency_cycle: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+	}
+
+	build, err := todoRepo.GetTask(ctx, "test1", "todo1", ids["build"])
+	if err != nil || !build.Blocked {
+		t.Fatalf("test_dependency_cycle: expected build to be blocked, actualResult=%v, error=%v", build, err)
+	}
+}
+
+func TestRankBetween(t *testing.T) {
+	tc := []struct {
+		name  string
+		lower string
+		upper string
+		fails bool
+	}{
+		{name: "first key", lower: "", upper: ""},
+		{name: "append", lower: "V", upper: ""},
+		{name: "prepend", lower: "", upper: "V"},
+		{name: "adjacent digits", lower: "V", upper: "W"},
+		{name: "prefix of the upper bound", lower: "V", upper: "V1"},
+		{name: "legacy keys", lower: "00000000V", upper: "00000001V"},
+		{name: "equal bounds", lower: "V", upper: "V", fails: true},
+		{name: "reversed bounds", lower: "W", upper: "V", fails: true},
+	}
+
+	for _, tt := range tc {
+		key, err := rank.Between(tt.lower, tt.upper)
+		if tt.fails {
+			if err == nil {
+				t.Fatalf("test_rank_between: case %s: expected an error, actualResult=%s", tt.name, key)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test_rank_between: case %s: error=%s", tt.name, err.Error())
+		}
+		if key <= tt.lower || (tt.upper != "" && key >= tt.upper) {
+			t.Fatalf("test_rank_between: case %s: %q is not between %q and %q", tt.name, key, tt.lower, tt.upper)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+	high := todo.PriorityHigh
+
+	tc := []struct {
+		name              string
+		data              todo.BatchRequest
+		expectedCommitted bool
+		expectedStatuses  []string
+	}{
+		{
+			name: "atomic batch with a missing task is rolled back",
+			data: todo.BatchRequest{
+				Mode: todo.BatchAtomic,
+				Operations: []todo.BatchOperation{
+					{Op: todo.BatchOpSetPriority, TaskID: "task1", Priority: &high},
+					{Op: todo.BatchOpComplete, TaskID: "nonexistent"},
+					{Op: todo.BatchOpUncomplete, TaskID: "task1"},
+				},
+			},
+			expectedCommitted: false,
+			expectedStatuses:  []string{todo.BatchStatusRolledBack, todo.BatchStatusFailed, todo.BatchStatusSkipped},
+		},
+		{
+			name: "best effort batch with a missing task is committed",
+			data: todo.BatchRequest{
+				Mode: todo.BatchBestEffort,
+				Operations: []todo.BatchOperation{
+					{Op: todo.BatchOpSetPriority, TaskID: "task1", Priority: &high},
+					{Op: todo.BatchOpComplete, TaskID: "nonexistent"},
+					{Op: todo.BatchOpComplete, TaskID: "task1"},
+				},
+			},
+			expectedCommitted: true,
+			expectedStatuses:  []string{todo.BatchStatusOK, todo.BatchStatusFailed, todo.BatchStatusOK},
+		},
+	}
+
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", http.MethodPost, "", nil, tt.data)
+		req.SetPathValue("id", "todo1")
+		todo.HandleBatch(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Code != http.StatusOK {
+			t.Fatalf("test_batch: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, http.StatusOK, rc.Code)
+		}
+
+		var result todo.BatchResult
+		if err := json.Unmarshal(rc.Body.Bytes(), &result); err != nil {
+			t.Fatalf("test_batch: case %s: failed to unmarshall response, error=%s", tt.name, err.Error())
+		}
+		if result.Committed != tt.expectedCommitted || len(result.Results) != len(tt.expectedStatuses) {
+			t.Fatalf("test_batch: case %s: expectedCommitted=%v, actualResult=%v", tt.name, tt.expectedCommitted, result)
+		}
+		for i, status := range tt.expectedStatuses {
+			if result.Results[i].Status != status {
+				t.Fatalf("test_batch: case %s: operation %d: expectedStatus=%s, actualStatus=%s", tt.name, i, status, result.Results[i].Status)
+			}
+		}
+	}
+}
+
+func TestTrashAndRestore(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test2")
+
+	if err := todoRepo.CreateTask(ctx, "test2", todo.Task{TodoID: "todo2", Content: "trashed parent"}); err != nil {
+		t.Fatalf("test_trash_and_restore: failed to create parent, error=%s", err.Error())
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test2", "todo2", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_trash_and_restore: failed to retrieve tasks, error=%s", err.Error())
+	}
+	parent := tasks[len(tasks)-1]
+	if err := todoRepo.CreateTask(ctx, "test2", todo.Task{TodoID: "todo2", Content: "trashed child", ParentID: &parent.ID}); err != nil {
+		t.Fatalf("test_trash_and_restore: failed to create child, error=%s", err.Error())
+	}
+
+	if err := todoRepo.DeleteTask(ctx, "test2", "todo2", parent.ID, nil); err != nil {
+		t.Fatalf("test_trash_and_restore: failed to delete task, error=%s", err.Error())
+	}
+	if _, err := todoRepo.GetTask(ctx, "test2", "todo2", parent.ID); err == nil {
+		t.Fatalf("test_trash_and_restore: expected the trashed task to be hidden")
+	}
+	trash, total, err := todoRepo.GetTrash(ctx, "test2", 10, 1)
+	if err != nil || total != 1 || trash[0].ID != parent.ID || trash[0].Type != todo.TrashTypeTask {
+		t.Fatalf("test_trash_and_restore: expected only the parent in the trash, actualResult=%v, error=%v", trash, err)
+	}
+
+	if err := todoRepo.RestoreTask(ctx, "test2", "todo2", parent.ID); err != nil {
+		t.Fatalf("test_trash_and_restore: failed to restore task, error=%s", err.Error())
+	}
+	parent, err = todoRepo.GetTask(ctx, "test2", "todo2", parent.ID)
+	if err != nil || len(parent.Subtasks) != 1 {
+		t.Fatalf("test_trash_and_restore: expected the parent back with its subtask, actualResult=%v, error=%v", parent, err)
+	}
+
+	tc := []struct {
+		name               string
+		handler            http.HandlerFunc
+		expectedStatusCode int
+	}{
+		{name: "delete todo", handler: todo.HandleDelete(logger, todoRepo), expectedStatusCode: http.StatusOK},
+		{name: "get trashed todo", handler: todo.HandleGetByID(logger, todoRepo), expectedStatusCode: http.StatusNotFound},
+		{name: "restore todo", handler: todo.HandleRestore(logger, todoRepo), expectedStatusCode: http.StatusOK},
+		{name: "get restored todo", handler: todo.HandleGetByID(logger, todoRepo), expectedStatusCode: http.StatusOK},
+		{name: "restore todo twice", handler: todo.HandleRestore(logger, todoRepo), expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", http.MethodPost, "", nil, nil)
+		req.SetPathValue("id", "todo2")
+		tt.handler.ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Code != tt.expectedStatusCode {
+			t.Fatalf("test_trash_and_restore: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+	}
+
+	// deleting what is not there, or archiving a trashed list, changes nothing and fails
+	if err := todoRepo.DeleteTask(ctx, "test2", "todo2", "missing", nil); err == nil {
+		t.Fatalf("test_trash_and_restore: case delete missing task: expected an error")
+	}
+	if err := todoRepo.DeleteTodo(ctx, "test2", "missing", nil); err == nil {
+		t.Fatalf("test_trash_and_restore: case delete missing todo: expected an error")
+	}
+	if err := todoRepo.DeleteTodo(ctx, "test2", "todo2", nil); err != nil {
+		t.Fatalf("test_trash_and_restore: failed to delete todo, error=%s", err.Error())
+	}
+	if err := todoRepo.SetArchived(ctx, "test2", "todo2", true); err == nil {
+		t.Fatalf("test_trash_and_restore: case archive trashed todo: expected an error")
+	}
+	if err := todoRepo.RestoreTodo(ctx, "test2", "todo2"); err != nil {
+		t.Fatalf("test_trash_and_restore: failed to restore todo, error=%s", err.Error())
+	}
+	if list, err := todoRepo.GetByID(ctx, "test2", "todo2"); err != nil || list.ArchivedAt != nil {
+		t.Fatalf("test_trash_and_restore: case archive trashed todo: expected the list to be left active, actualResult=%+v, error=%v", list, err)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: "todo1", Content: "before rename"}); err != nil {
+		t.Fatalf("test_history: failed to create task, error=%s", err.Error())
+	}
+	before, err := todoRepo.GetByID(ctx, "test1", "todo1")
+	if err != nil {
+		t.Fatalf("test_history: failed to retrieve todo, error=%s", err.Error())
+	}
+	revisions, _, err := todoRepo.GetHistory(ctx, "todo1", 1, 1)
+	if err != nil || len(revisions) != 1 || revisions[0].Action != todo.ActionTaskCreated {
+		t.Fatalf("test_history: expected the task creation to be recorded, actualResult=%v, error=%v", revisions, err)
+	}
+	checkpoint := revisions[0].ID
+
+	if err := todoRepo.Update(ctx, "test1", "todo1", todo.TodoRequest{Name: "renamed"}, nil); err != nil {
+		t.Fatalf("test_history: failed to update todo, error=%s", err.Error())
+	}
+	revisions, _, err = todoRepo.GetHistory(ctx, "todo1", 1, 1)
+	if err != nil || len(revisions) != 1 || len(revisions[0].Changes) != 1 {
+		t.Fatalf("test_history: expected a single change to be recorded, actualResult=%v, error=%v", revisions, err)
+	}
+	change := revisions[0].Changes[0]
+	if change.Field != "name" || change.Old != before.Name || change.New != "renamed" || revisions[0].ActorID == nil || *revisions[0].ActorID != "test1" {
+		t.Fatalf("test_history: expected the rename by test1, actualResult=%v", revisions[0])
+	}
+
+	// only the edited task is recorded, along with nothing of the other tasks of the list
+	i := slices.IndexFunc(before.Tasks, func(task todo.Task) bool { return task.Content == "before rename" })
+	if i < 0 {
+		t.Fatalf("test_history: created task not found")
+	}
+	task := before.Tasks[i]
+	task.Content = "edited"
+	if err := todoRepo.UpdateTask(ctx, "test1", "todo2", task, nil); err == nil {
+		t.Fatalf("test_history: expected updating the task through another list to fail")
+	}
+	if err := todoRepo.UpdateTask(ctx, "test1", task.TodoID, task, nil); err != nil {
+		t.Fatalf("test_history: failed to update task, error=%s", err.Error())
+	}
+	revisions, _, err = todoRepo.GetHistory(ctx, "todo1", 1, 1)
+	if err != nil || len(revisions) != 1 || len(revisions[0].Changes) != 1 {
+		t.Fatalf("test_history: expected a single change to be recorded, actualResult=%v, error=%v", revisions, err)
+	}
+	if change := revisions[0].Changes[0]; change.ID != task.ID || change.Field != "content" || change.New != "edited" {
+		t.Fatalf("test_history: expected the edit of the task, actualResult=%v", revisions[0])
+	}
+
+	rc := httptest.NewRecorder()
+	req := TestRequest(t, "restore revision", "/", http.MethodPost, "", nil, nil)
+	req.SetPathValue("id", "todo1")
+	req.SetPathValue("revision_id", strconv.FormatInt(checkpoint, 10))
+	todo.HandleRevert(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusOK {
+		t.Fatalf("test_history: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+
+	after, err := todoRepo.GetByID(ctx, "test1", "todo1")
+	if err != nil || after.Name != before.Name || len(after.Tasks) != len(before.Tasks) {
+		t.Fatalf("test_history: expected the list to be restored, expectedResult=%v, actualResult=%v, error=%v", before, after, err)
+	}
+
+	// compacted revisions stay in the history, but only the last one can still be reverted to
+	if compacted, err := todoRepo.CompactHistory(ctx, time.Now().Add(time.Minute)); err != nil || compacted == 0 {
+		t.Fatalf("test_history: expected revisions to be compacted, actualResult=%d, error=%v", compacted, err)
+	}
+	revisions, total, err := todoRepo.GetHistory(ctx, "todo1", 1, 1)
+	if err != nil || total < 4 {
+		t.Fatalf("test_history: expected the compacted revisions to be kept, actualTotal=%d, error=%v", total, err)
+	}
+	tc := []struct {
+		name               string
+		revisionID         int64
+		expectedStatusCode int
+	}{
+		{name: "revert to compacted revision", revisionID: checkpoint, expectedStatusCode: http.StatusGone},
+		{name: "revert to last revision", revisionID: revisions[0].ID, expectedStatusCode: http.StatusOK},
+	}
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", http.MethodPost, "", nil, nil)
+		req.SetPathValue("id", "todo1")
+		req.SetPathValue("revision_id", strconv.FormatInt(tt.revisionID, 10))
+		todo.HandleRevert(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Code != tt.expectedStatusCode {
+			t.Fatalf("test_history: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test2")
+
+	rc := httptest.NewRecorder()
+	req := TestRequest(t, "get todo", "/", http.MethodGet, "", nil, nil)
+	req.SetPathValue("id", "todo2")
+	todo.HandleGetByID(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+	etag := rc.Header().Get("ETag")
+	if rc.Code != http.StatusOK || etag == "" {
+		t.Fatalf("test_conditional_requests: expected an ETag, actualStatusCode=%d, actualETag=%q", rc.Code, etag)
+	}
+
+	update := todo.TodoRequest{AuthorID: "test2", Name: "renamed conditionally", Tasks: []todo.Task{}}
+	tc := []struct {
+		name               string
+		method             string
+		header             string
+		value              string
+		handler            http.HandlerFunc
+		expectedStatusCode int
+	}{
+		{name: "unchanged todo", method: http.MethodGet, header: "If-None-Match", value: etag, handler: todo.HandleGetByID(logger, todoRepo), expectedStatusCode: http.StatusNotModified},
+		{name: "stale update", method: http.MethodPut, header: "If-Match", value: `"0"`, handler: todo.HandleUpdate(logger, todoRepo), expectedStatusCode: http.StatusPreconditionFailed},
+		{name: "weak tag never matches", method: http.MethodPut, header: "If-Match", value: "W/" + etag, handler: todo.HandleUpdate(logger, todoRepo), expectedStatusCode: http.StatusPreconditionFailed},
+		{name: "current update", method: http.MethodPut, header: "If-Match", value: etag, handler: todo.HandleUpdate(logger, todoRepo), expectedStatusCode: http.StatusOK},
+		{name: "modified todo", method: http.MethodGet, header: "If-None-Match", value: etag, handler: todo.HandleGetByID(logger, todoRepo), expectedStatusCode: http.StatusOK},
+		{name: "delete with the old version", method: http.MethodDelete, header: "If-Match", value: etag, handler: todo.HandleDelete(logger, todoRepo), expectedStatusCode: http.StatusPreconditionFailed},
+	}
+
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", tt.method, "", nil, update)
+		req.SetPathValue("id", "todo2")
+		req.Header.Set(tt.header, tt.value)
+		tt.handler.ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Code != tt.expectedStatusCode {
+			t.Fatalf("test_conditional_requests: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+	}
+
+	if err := todoRepo.Update(ctx, "test2", "missing", todo.TodoRequest{Name: "renamed"}, nil); err == nil {
+		t.Fatalf("test_conditional_requests: expected renaming a missing list to fail")
+	}
+}
+
+func TestTaskETag(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: "todo1", Content: "tagged parent"}); err != nil {
+		t.Fatalf("test_task_etag: failed to create parent, error=%s", err.Error())
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test1", "todo1", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_task_etag: failed to retrieve tasks, error=%s", err.Error())
+	}
+	i := slices.IndexFunc(tasks, func(t todo.Task) bool { return t.Content == "tagged parent" })
+	if i < 0 {
+		t.Fatalf("test_task_etag: expected the parent to be created, actualResult=%v", tasks)
+	}
+	parent := tasks[i]
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: "todo1", Content: "child", ParentID: &parent.ID}); err != nil {
+		t.Fatalf("test_task_etag: failed to create child, error=%s", err.Error())
+	}
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, "get task", "/", http.MethodGet, "", nil, nil)
+		req.SetPathValue("id", "todo1")
+		req.SetPathValue("task_id", parent.ID)
+		req.Header.Set("If-None-Match", etag)
+		todo.HandleGetTask(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		return rc
+	}
+
+	rc := get("")
+	etag := rc.Header().Get("ETag")
+	if rc.Code != http.StatusOK || etag == "" {
+		t.Fatalf("test_task_etag: expected an ETag, actualStatusCode=%d, actualETag=%q", rc.Code, etag)
+	}
+	if rc := get(etag); rc.Code != http.StatusNotModified {
+		t.Fatalf("test_task_etag: case unchanged task: expectedStatusCode=%d, actualStatusCode=%d", http.StatusNotModified, rc.Code)
+	}
+
+	// completing the subtask changes the progress of the task without changing the task itself
+	parent, err = todoRepo.GetTask(ctx, "test1", "todo1", parent.ID)
+	if err != nil || len(parent.Subtasks) != 1 {
+		t.Fatalf("test_task_etag: expected one subtask, actualResult=%v, error=%v", parent, err)
+	}
+	child := parent.Subtasks[0]
+	child.Done = true
+	if err := todoRepo.UpdateTask(ctx, "test1", child.TodoID, child, nil); err != nil {
+		t.Fatalf("test_task_etag: failed to complete child, error=%s", err.Error())
+	}
+	rc = get(etag)
+	if rc.Code != http.StatusOK {
+		t.Fatalf("test_task_etag: case changed subtask: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+	etag = rc.Header().Get("ETag")
+
+	// renaming a tag changes every task carrying it
+	tg, err := tagRepo.Create(ctx, "test1", tag.TagRequest{Name: "etag"})
+	if err != nil {
+		t.Fatalf("test_task_etag: failed to create tag, error=%s", err.Error())
+	}
+	if err := todoRepo.AttachTaskTag(ctx, child.ID, tg.ID, "test1"); err != nil {
+		t.Fatalf("test_task_etag: failed to tag child, error=%s", err.Error())
+	}
+	etag = get("").Header().Get("ETag")
+	if err := tagRepo.Update(ctx, tg.ID, tag.TagRequest{Name: "renamed etag"}); err != nil {
+		t.Fatalf("test_task_etag: failed to rename tag, error=%s", err.Error())
+	}
+	if rc := get(etag); rc.Code != http.StatusOK {
+		t.Fatalf("test_task_etag: case renamed tag: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+
+	// the ETag of the task is still good for a conditional write
+	etag = get("").Header().Get("ETag")
+	rc = httptest.NewRecorder()
+	req := TestRequest(t, "conditional patch", "/", http.MethodPatch, "", nil, json.RawMessage(`{"content":"patched parent"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("If-Match", etag)
+	req.SetPathValue("id", "todo1")
+	req.SetPathValue("task_id", parent.ID)
+	todo.HandlePatchTask(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusOK {
+		t.Fatalf("test_task_etag: case conditional patch: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+
+	tc := []struct {
+		name               string
+		contentType        string
+		patch              string
+		expectedStatusCode int
+	}{
+		{name: "merge patch", contentType: "application/merge-patch+json", patch: `{"content":"patched","priority":"high","due_at":null}`, expectedStatusCode: http.StatusOK},
+		{name: "json patch", contentType: "application/json-patch+json", patch: `[{"op":"test","path":"/content","value":"patched"},{"op":"replace","path":"/done","value":true}]`, expectedStatusCode: http.StatusOK},
+		{name: "failed test", contentType: "application/json-patch+json", patch: `[{"op":"test","path":"/content","value":"stale"},{"op":"replace","path":"/content","value":"lost"}]`, expectedStatusCode: http.StatusConflict},
+		{name: "missing path", contentType: "application/json-patch+json", patch: `[{"op":"remove","path":"/missing"}]`, expectedStatusCode: http.StatusUnprocessableEntity},
+		{name: "read-only field", contentType: "application/merge-patch+json", patch: `{"version":1}`, expectedStatusCode: http.StatusUnprocessableEntity},
+		{name: "empty content", contentType: "application/merge-patch+json", patch: `{"content":""}`, expectedStatusCode: http.StatusUnprocessableEntity},
+		{name: "unknown operation", contentType: "application/json-patch+json", patch: `[{"op":"rename","path":"/content"}]`, expectedStatusCode: http.StatusBadRequest},
+		{name: "plain json", contentType: "application/json", patch: `{"content":"lost"}`, expectedStatusCode: http.StatusUnsupportedMediaType},
+	}
+
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", http.MethodPatch, "", nil, json.RawMessage(tt.patch))
+		req.Header.Set("Content-Type", tt.contentType)
+		req.SetPathValue("id", "todo1")
+		req.SetPathValue("task_id", "task1")
+		todo.HandlePatchTask(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Code != tt.expectedStatusCode {
+			t.Fatalf("test_patch: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+	}
+
+	task, err := todoRepo.GetTask(ctx, "test1", "todo1", "task1")
+	if err != nil || task.Content != "patched" || !task.Done || task.Priority != todo.PriorityHigh || task.DueAt != nil {
+		t.Fatalf("test_patch: expected only the successful patches to be applied, actualResult=%v, error=%v", task, err)
+	}
+}
+
+func TestOpenTasks(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test2")
+
+	now := time.Now().UTC().Truncate(time.Second)
+	sooner, later := now.Add(24*time.Hour), now.Add(48*time.Hour)
+	list, err := todoRepo.Create(ctx, todo.TodoRequest{AuthorID: "test2", Name: "priorities", Tasks: []todo.Task{
+		{Content: "later", Priority: todo.PriorityHigh, DueAt: &later},
+		{Content: "undated", Priority: todo.PriorityHigh},
+		{Content: "sooner", Priority: todo.PriorityHigh, DueAt: &sooner},
+		{Content: "urgent", Priority: todo.PriorityUrgent},
+		{Content: "low", Priority: todo.PriorityLow},
+		{Content: "done", Priority: todo.PriorityUrgent, Done: true},
+	}})
+	if err != nil {
+		t.Fatalf("test_open_tasks: failed to create todo, error=%s", err.Error())
+	}
+	ids := make(map[string]string)
+	for _, task := range list.Tasks {
+		ids[task.Content] = task.ID
+	}
+
+	tc := []struct {
+		name               string
+		content            string
+		method             string
+		userID             string
+		expectedStatusCode int
+	}{
+		{name: "focus later", content: "later", method: http.MethodPut, userID: "test2", expectedStatusCode: http.StatusOK},
+		{name: "focus undated", content: "undated", method: http.MethodPut, userID: "test2", expectedStatusCode: http.StatusOK},
+		{name: "focus sooner", content: "sooner", method: http.MethodPut, userID: "test2", expectedStatusCode: http.StatusOK},
+		{name: "focus urgent", content: "urgent", method: http.MethodPut, userID: "test2", expectedStatusCode: http.StatusOK},
+		{name: "focus low", content: "low", method: http.MethodPut, userID: "test2", expectedStatusCode: http.StatusOK},
+		{name: "focus done", content: "done", method: http.MethodPut, userID: "test2", expectedStatusCode: http.StatusOK},
+		{name: "unfocus low", content: "low", method: http.MethodDelete, userID: "test2", expectedStatusCode: http.StatusOK},
+		{name: "focus another user's task", content: "low", method: http.MethodPut, userID: "test1", expectedStatusCode: http.StatusForbidden},
+	}
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", tt.method, "", nil, nil)
+		req.SetPathValue("id", list.ID)
+		req.SetPathValue("task_id", ids[tt.content])
+		todo.HandleSetMyDay(logger, todoRepo, tt.method == http.MethodPut).ServeHTTP(rc, req.WithContext(context.WithValue(ctx, web.UserID, tt.userID)))
+		if rc.Code != tt.expectedStatusCode {
+			t.Fatalf("test_open_tasks: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+	}
+
+	// the open tasks on My Day come most urgent first, then soonest due, undated ones last
+	rc := httptest.NewRecorder()
+	req := TestRequest(t, "my day", "/", http.MethodGet, "", map[string]string{"my_day": "true"}, nil)
+	todo.HandleGetOpenTasks(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+	var page web.Page[todo.Task]
+	if err := json.NewDecoder(rc.Body).Decode(&page); err != nil || rc.Code != http.StatusOK {
+		t.Fatalf("test_open_tasks: case my day: expectedStatusCode=%d, actualStatusCode=%d, error=%v", http.StatusOK, rc.Code, err)
+	}
+	var order []string
+	for _, task := range page.Items {
+		if !task.MyDay {
+			t.Fatalf("test_open_tasks: case my day: expected only tasks on My Day, actualResult=%v", task)
+		}
+		order = append(order, task.Content)
+	}
+	if expected := []string{"urgent", "sooner", "later", "undated"}; !slices.Equal(order, expected) {
+		t.Fatalf("test_open_tasks: case my day: expectedResult=%v, actualResult=%v", expected, order)
+	}
+
+	// My Day belongs to each user
+	task, err := todoRepo.GetTask(ctx, "test2", list.ID, ids["urgent"])
+	if err != nil || !task.MyDay {
+		t.Fatalf("test_open_tasks: expected the task to be on My Day, actualResult=%v, error=%v", task, err)
+	}
+	if task, err = todoRepo.GetTask(ctx, "test1", list.ID, ids["urgent"]); err != nil || task.MyDay {
+		t.Fatalf("test_open_tasks: expected the task not to be on the My Day of another user, actualResult=%v, error=%v", task, err)
+	}
+
+	// updating a task keeps the fields left out, and null clears a due date
+	updates := []struct {
+		content string
+		body    string
+	}{
+		{content: "urgent", body: `{"content":"urgent, renamed"}`},
+		{content: "sooner", body: `{"content":"sooner","due_at":null}`},
+	}
+	for _, u := range updates {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, "update "+u.content, "/", http.MethodPut, "", nil, json.RawMessage(u.body))
+		req.SetPathValue("id", list.ID)
+		req.SetPathValue("task_id", ids[u.content])
+		todo.HandleUpdateTask(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Code != http.StatusOK {
+			t.Fatalf("test_open_tasks: case update %s: expectedStatusCode=%d, actualStatusCode=%d", u.content, http.StatusOK, rc.Code)
+		}
+	}
+	task, err = todoRepo.GetTask(ctx, "test2", list.ID, ids["urgent"])
+	if err != nil || task.Content != "urgent, renamed" || task.Priority != todo.PriorityUrgent || !task.MyDay {
+		t.Fatalf("test_open_tasks: expected the priority to be kept, actualResult=%v, error=%v", task, err)
+	}
+	task, err = todoRepo.GetTask(ctx, "test2", list.ID, ids["sooner"])
+	if err != nil || task.Priority != todo.PriorityHigh || task.DueAt != nil {
+		t.Fatalf("test_open_tasks: expected the due date to be cleared, actualResult=%v, error=%v", task, err)
+	}
+}
+
+func TestIdempotency(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test2")
+	handler := web.Idempotent(todo.HandleCreate(logger, todoRepo), web.NewIdempotencyStore(dbPool, time.Hour), logger)
+
+	create := todo.TodoRequest{AuthorID: "test2", Name: "created once", Tasks: []todo.Task{}}
+	tc := []struct {
+		name               string
+		data               todo.TodoRequest
+		expectedStatusCode int
+		expectedReplayed   bool
+	}{
+		{name: "first request", data: create, expectedStatusCode: http.StatusCreated},
+		{name: "retry", data: create, expectedStatusCode: http.StatusCreated, expectedReplayed: true},
+		{name: "different payload", data: todo.TodoRequest{AuthorID: "test2", Name: "created twice", Tasks: []todo.Task{}}, expectedStatusCode: http.StatusUnprocessableEntity},
+	}
+
+	var first string
+	for _, tt := range tc {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", http.MethodPost, "", nil, tt.data)
+		req.Header.Set(web.IdempotencyKeyHeader, "create-todo")
+		handler.ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Code != tt.expectedStatusCode {
+			t.Fatalf("test_idempotency: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+		if replayed := rc.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.expectedReplayed {
+			t.Fatalf("test_idempotency: case %s: expectedReplayed=%t, actualReplayed=%t", tt.name, tt.expectedReplayed, replayed)
+		}
+		if first == "" {
+			first = rc.Body.String()
+		} else if tt.expectedReplayed && rc.Body.String() != first {
+			t.Fatalf("test_idempotency: case %s: expectedResult=%s, actualResult=%s", tt.name, first, rc.Body.String())
+		}
+	}
+
+	todos, _, err := todoRepo.GetByUserID(ctx, "test2", todo.Filter{}, 100, 1)
+	if err != nil {
+		t.Fatalf("test_idempotency: failed to retrieve todos, error=%s", err.Error())
+	}
+	created := 0
+	for _, td := range todos {
+		if td.Name == create.Name {
+			created++
+		}
+	}
+	if created != 1 {
+		t.Fatalf("test_idempotency: expected the todo to be created once, actualCount=%d", created)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+
+	stream := func(name string, handler http.HandlerFunc, lastEventID string) string {
+		streamCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+		defer cancel()
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, name, "/", http.MethodGet, "", nil, nil)
+		req.SetPathValue("id", "todo1")
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		handler.ServeHTTP(rc, req.WithContext(streamCtx))
+		if rc.Code != http.StatusOK {
+			t.Fatalf("test_events: case %s: expectedStatusCode=%d, actualStatusCode=%d", name, http.StatusOK, rc.Code)
+		}
+		return rc.Body.String()
+	}
+	// cursor returns the last event id sent by a stream
+	cursor := func(name, body string) string {
+		i := strings.LastIndex(body, "id: ")
+		if i < 0 {
+			t.Fatalf("test_events: case %s: expected an event id, actualResult=%s", name, body)
+		}
+		id, _, _ := strings.Cut(body[i+len("id: "):], "\n")
+		return id
+	}
+
+	userEvents := todo.HandleUserEvents(logger, todoRepo, todo.NewBroker(dbPool, logger))
+	start := cursor("start", stream("start", userEvents, ""))
+
+	// a revision recorded first but committed last must still be streamed
+	tx, err := dbPool.Begin(ctx)
+	if err != nil {
+		t.Fatalf("test_events: failed to begin tx, error=%s", err.Error())
+	}
+	defer tx.Rollback(ctx)
+	rename := []todo.Change{{Entity: todo.EntityTodo, ID: "todo1", Field: "name", Old: "before", New: "after"}}
+	if _, err := tx.Exec(ctx, `
+	INSERT INTO todo_revisions (todo_id, action, changes, snapshot)
+	SELECT todo_id, $1::text, $2::jsonb, snapshot FROM todo_revisions WHERE todo_id = 'todo1' ORDER BY id DESC LIMIT 1`, todo.ActionTodoUpdated, rename); err != nil {
+		t.Fatalf("test_events: failed to record revision, error=%s", err.Error())
+	}
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: "todo1", Content: "streamed"}); err != nil {
+		t.Fatalf("test_events: failed to create task, error=%s", err.Error())
+	}
+
+	tc := []struct {
+		name           string
+		handler        http.HandlerFunc
+		expectedResult string
+	}{
+		{name: "todo stream", handler: todo.HandleTodoEvents(logger, todoRepo, todo.NewBroker(dbPool, logger)), expectedResult: "event: task.created"},
+		{name: "user stream", handler: userEvents, expectedResult: "event: task.created"},
+	}
+	for _, tt := range tc {
+		if body := stream(tt.name, tt.handler, start); !strings.Contains(body, tt.expectedResult) || strings.Contains(body, "event: todo.updated") {
+			t.Fatalf("test_events: case %s: expectedResult=%s, actualResult=%s", tt.name, tt.expectedResult, body)
+		}
+	}
+	resume := cursor("resume", stream("resume", userEvents, start))
+
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("test_events: failed to commit, error=%s", err.Error())
+	}
+	if body := stream("late commit", userEvents, resume); !strings.Contains(body, "event: todo.updated") {
+		t.Fatalf("test_events: case late commit: expectedResult=%s, actualResult=%s", "event: todo.updated", body)
+	}
+}
+
+func TestSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := todo.NewBroker(dbPool, logger)
+	go broker.Run(ctx)
+	// the broker is listening once its own announcements come back
+	probe := todo.Presence{TodoID: "probe", UserID: "test1", SessionID: "probe", State: todo.PresenceViewing}
+	for i := 0; len(broker.PresenceOf(probe.TodoID)) == 0; i++ {
+		if i == 100 {
+			t.Fatalf("test_sync: broker is not listening")
+		}
+		if err := broker.Announce(ctx, probe); err != nil {
+			t.Fatalf("test_sync: failed to announce presence, error=%s", err.Error())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	srv := httptest.NewServer(todo.HandleSync(logger, todoRepo, broker))
+	defer srv.Close()
+
+	header := http.Header{"x-jwt-token": []string{TestToken(t, "sync", "test1")}}
+	conn, err := ws.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), header)
+	if err != nil {
+		t.Fatalf("test_sync: failed to connect, error=%s", err.Error())
+	}
+	defer conn.Close(ws.CloseNormal, "")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	tc := []struct {
+		name         string
+		request      todo.SyncRequest
+		expectedType string
+		expectedCode int
+	}{
+		{name: "subscribe", request: todo.SyncRequest{Type: todo.SyncSubscribe, ID: "1", TodoID: "todo1"}, expectedType: todo.SyncAck},
+		{name: "subscribe to another user's todo", request: todo.SyncRequest{Type: todo.SyncSubscribe, ID: "2", TodoID: "todo2"}, expectedType: todo.SyncError, expectedCode: http.StatusForbidden},
+		{name: "edit", request: todo.SyncRequest{Type: todo.SyncPresence, ID: "3", TodoID: "todo1", State: todo.PresenceEditing, TaskID: "task1"}, expectedType: todo.SyncAck},
+		{name: "stale update", request: todo.SyncRequest{Type: todo.SyncMutate, ID: "4", TodoID: "todo1", TaskID: "task1", Op: todo.SyncOpUpdateTask, Task: &todo.Task{Content: "stale"}, IfMatch: new(int64)}, expectedType: todo.SyncError, expectedCode: http.StatusPreconditionFailed},
+		{name: "create", request: todo.SyncRequest{Type: todo.SyncMutate, ID: "5", TodoID: "todo1", Op: todo.SyncOpCreateTask, Task: &todo.Task{Content: "synced"}}, expectedType: todo.SyncAck},
+	}
+
+	for _, tt := range tc {
+		data, _ := json.Marshal(tt.request)
+		if err := conn.WriteMessage(data); err != nil {
+			t.Fatalf("test_sync: case %s: failed to send, error=%s", tt.name, err.Error())
+		}
+		reply := readSync(t, conn, func(msg todo.SyncMessage) bool { return msg.ID == tt.request.ID })
+		if reply.Type != tt.expectedType || reply.Code != tt.expectedCode {
+			t.Fatalf("test_sync: case %s: expectedType=%s, expectedCode=%d, actualResult=%v", tt.name, tt.expectedType, tt.expectedCode, reply)
+		}
+	}
+
+	readSync(t, conn, func(msg todo.SyncMessage) bool {
+		event, _ := msg.Data.(map[string]any)
+		return msg.Type == todo.SyncEvent && event["type"] == "task.created"
+	})
+
+	// an update only changes the fields it sends
+	tasks, err := todoRepo.GetTasks(ctx, "test1", "todo1", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_sync: failed to retrieve tasks, error=%s", err.Error())
+	}
+	i := slices.IndexFunc(tasks, func(task todo.Task) bool { return task.Content == "synced" })
+	if i < 0 {
+		t.Fatalf("test_sync: synced task not found")
+	}
+	partial := fmt.Sprintf(`{"type": %q, "id": "6", "todo_id": "todo1", "task_id": %q, "op": %q, "task": {"done": true}}`, todo.SyncMutate, tasks[i].ID, todo.SyncOpUpdateTask)
+	if err := conn.WriteMessage([]byte(partial)); err != nil {
+		t.Fatalf("test_sync: case partial update: failed to send, error=%s", err.Error())
+	}
+	if reply := readSync(t, conn, func(msg todo.SyncMessage) bool { return msg.ID == "6" }); reply.Type != todo.SyncAck {
+		t.Fatalf("test_sync: case partial update: expectedType=%s, actualResult=%v", todo.SyncAck, reply)
+	}
+	task, err := todoRepo.GetTask(ctx, "test1", "todo1", tasks[i].ID)
+	if err != nil || !task.Done || task.Content != "synced" {
+		t.Fatalf("test_sync: case partial update: expected the task done with its content kept, actualResult=%+v, error=%v", task, err)
+	}
+}
+
+// readSync reads sync messages until one matches.
+func readSync(t *testing.T, conn *ws.Conn, match func(todo.SyncMessage) bool) todo.SyncMessage {
+	t.Helper()
+	for {
+		data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("test_sync: failed to read, error=%s", err.Error())
+		}
+		var msg todo.SyncMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("test_sync: malformed message, error=%s", err.Error())
+		}
+		if match(msg) {
+			return msg
+		}
+	}
+}
+
+func TestDeltaSync(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test2")
+
+	getChanges := func(name, since string) (int, todo.SyncChanges) {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, name, "/", http.MethodGet, "", map[string]string{"since": since}, nil)
+		todo.HandleGetChanges(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		var changes todo.SyncChanges
+		if rc.Code == http.StatusOK {
+			if err := json.NewDecoder(rc.Body).Decode(&changes); err != nil {
+				t.Fatalf("test_delta_sync: case %s: failed to decode changes, error=%s", name, err.Error())
+			}
+		}
+		return rc.Code, changes
+	}
+
+	code, full := getChanges("full sync", "")
+	if code != http.StatusOK || full.Token == "" || !slices.ContainsFunc(full.Todos, func(td todo.Todo) bool { return td.ID == "todo2" }) {
+		t.Fatalf("test_delta_sync: case full sync: expectedStatusCode=%d, actualStatusCode=%d, actualResult=%+v", http.StatusOK, code, full)
+	}
+	if code, _ := getChanges("invalid token", "yesterday"); code != http.StatusBadRequest {
+		t.Fatalf("test_delta_sync: case invalid token: expectedStatusCode=%d, actualStatusCode=%d", http.StatusBadRequest, code)
+	}
+
+	stale := int64(-1)
+	push := todo.PushRequest{Mutations: []todo.Mutation{
+		{ClientID: "new-list", Op: todo.MutationCreateTodo, Name: "offline list"},
+		{ClientID: "new-task", Op: todo.MutationCreateTask, TodoID: "new-list", Task: &todo.Task{Content: "offline task"}},
+		{ClientID: "stale-rename", Op: todo.MutationUpdateTodo, TodoID: "todo2", Name: "renamed offline", BaseVersion: &stale},
+		{ClientID: "gone", Op: todo.MutationDeleteTask, TodoID: "todo2", TaskID: "missing"},
+		{ClientID: "foreign", Op: todo.MutationCreateTask, TodoID: "todo1", Task: &todo.Task{Content: "not mine"}},
+	}}
+	expectedStatuses := []string{todo.MutationApplied, todo.MutationApplied, todo.MutationConflict, todo.MutationApplied, todo.MutationConflict}
+
+	rc := httptest.NewRecorder()
+	req := TestRequest(t, "push", "/", http.MethodPost, "", nil, push)
+	todo.HandlePushChanges(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusOK {
+		t.Fatalf("test_delta_sync: case push: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+	var result todo.PushResult
+	if err := json.NewDecoder(rc.Body).Decode(&result); err != nil {
+		t.Fatalf("test_delta_sync: case push: failed to decode result, error=%s", err.Error())
+	}
+	for i, res := range result.Results {
+		if res.Status != expectedStatuses[i] {
+			t.Fatalf("test_delta_sync: case push %s: expectedStatus=%s, actualStatus=%s", res.ClientID, expectedStatuses[i], res.Status)
+		}
+	}
+	if conflict := result.Results[2]; conflict.Todo == nil || conflict.Todo.Name == "renamed offline" {
+		t.Fatalf("test_delta_sync: case push stale-rename: expected the server's list, actualResult=%+v", conflict.Todo)
+	}
+	newList, newTask := result.Results[0].ID, result.Results[1].ID
+	if result.Results[1].Task == nil || result.Results[1].Task.TodoID != newList {
+		t.Fatalf("test_delta_sync: case push new-task: expectedTodoID=%s, actualResult=%+v", newList, result.Results[1].Task)
+	}
+
+	// an update_task only changes the fields it sends
+	partial := map[string]any{"mutations": []map[string]any{
+		{"client_id": "complete", "op": todo.MutationUpdateTask, "todo_id": newList, "task_id": newTask, "task": map[string]any{"done": true}},
+		{"client_id": "blank", "op": todo.MutationUpdateTask, "todo_id": newList, "task_id": newTask, "task": map[string]any{"content": ""}},
+	}}
+	rc = httptest.NewRecorder()
+	req = TestRequest(t, "push partial update", "/", http.MethodPost, "", nil, partial)
+	todo.HandlePushChanges(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusOK {
+		t.Fatalf("test_delta_sync: case push partial update: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+	result = todo.PushResult{}
+	if err := json.NewDecoder(rc.Body).Decode(&result); err != nil {
+		t.Fatalf("test_delta_sync: case push partial update: failed to decode result, error=%s", err.Error())
+	}
+	if complete := result.Results[0]; complete.Status != todo.MutationApplied || complete.Task == nil || !complete.Task.Done || complete.Task.Content != "offline task" {
+		t.Fatalf("test_delta_sync: case push complete: expected the task done with its content kept, actualResult=%+v", complete)
+	}
+	if blank := result.Results[1]; blank.Status != todo.MutationRejected {
+		t.Fatalf("test_delta_sync: case push blank: expectedStatus=%s, actualStatus=%s", todo.MutationRejected, blank.Status)
+	}
+
+	if err := todoRepo.DeleteTask(ctx, "test2", newList, newTask, nil); err != nil {
+		t.Fatalf("test_delta_sync: failed to delete task, error=%s", err.Error())
+	}
+	code, delta := getChanges("delta sync", full.Token)
+	if code != http.StatusOK {
+		t.Fatalf("test_delta_sync: case delta sync: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, code)
+	}
+	if !slices.ContainsFunc(delta.Todos, func(td todo.Todo) bool { return td.ID == newList }) {
+		t.Fatalf("test_delta_sync: case delta sync: expected the created list, actualResult=%+v", delta.Todos)
+	}
+	if !slices.ContainsFunc(delta.Deleted, func(d todo.Tombstone) bool { return d.Entity == todo.EntityTask && d.ID == newTask }) {
+		t.Fatalf("test_delta_sync: case delta sync: expected the deleted task, actualResult=%+v", delta.Deleted)
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+
+	var (
+		mu       sync.Mutex
+		received []*http.Request
+		bodies   [][]byte
+		status   = http.StatusOK
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r)
+		bodies = append(bodies, body)
+		w.WriteHeader(status)
+	}))
+	defer receiver.Close()
+
+	rc := httptest.NewRecorder()
+	req := TestRequest(t, "create webhook", "/", http.MethodPost, "", nil, webhook.WebhookRequest{URL: receiver.URL, Events: []string{webhook.EventTaskCompleted}})
+	webhook.HandleCreate(logger, webhookRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusCreated {
+		t.Fatalf("test_webhooks: case create webhook: expectedStatusCode=%d, actualStatusCode=%d", http.StatusCreated, rc.Code)
+	}
+	var hook webhook.Webhook
+	if err := json.NewDecoder(rc.Body).Decode(&hook); err != nil || hook.Secret == "" {
+		t.Fatalf("test_webhooks: case create webhook: expected a secret, actualResult=%+v, error=%v", hook, err)
+	}
+
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: "todo1", Content: "hooked"}); err != nil {
+		t.Fatalf("test_webhooks: failed to create task, error=%s", err.Error())
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test1", "todo1", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_webhooks: failed to retrieve tasks, error=%s", err.Error())
+	}
+	i := slices.IndexFunc(tasks, func(task todo.Task) bool { return task.Content == "hooked" })
+	if i < 0 {
+		t.Fatalf("test_webhooks: created task not found")
+	}
+	task := tasks[i]
+	task.Done = true
+	if err := todoRepo.UpdateTask(ctx, "test1", task.TodoID, task, nil); err != nil {
+		t.Fatalf("test_webhooks: failed to complete task, error=%s", err.Error())
+	}
+
+	// deliveredFor dispatches until the completion of the task has been delivered, and returns its delivery id
+	events := outbox.NewDispatcher(dbPool, logger)
+	events.Subscribe("webhooks", webhookRepo.Enqueue)
+	dispatcher := webhook.NewDispatcher(webhookRepo, receiver.Client(), logger)
+	deliveredFor := func(name string, after int) string {
+		for attempt := 0; attempt < 10; attempt++ {
+			if err := events.Dispatch(ctx); err != nil {
+				t.Fatalf("test_webhooks: case %s: failed to dispatch events, error=%s", name, err.Error())
+			}
+			if err := dispatcher.Dispatch(ctx); err != nil {
+				t.Fatalf("test_webhooks: case %s: failed to dispatch, error=%s", name, err.Error())
+			}
+			mu.Lock()
+			for j := after; j < len(received); j++ {
+				var payload webhook.Payload
+				if err := json.Unmarshal(bodies[j], &payload); err != nil {
+					t.Fatalf("test_webhooks: case %s: failed to decode payload, error=%s", name, err.Error())
+				}
+				if payload.Event.EntityID != task.ID {
+					continue
+				}
+				signature := received[j].Header.Get(webhook.SignatureHeader)
+				ts, err := strconv.ParseInt(strings.TrimPrefix(strings.Split(signature, ",")[0], "t="), 10, 64)
+				if err != nil || webhook.Sign(hook.Secret, time.Unix(ts, 0), bodies[j]) != signature {
+					t.Fatalf("test_webhooks: case %s: invalid signature, actualSignature=%s", name, signature)
+				}
+				if event := received[j].Header.Get(webhook.EventHeader); event != webhook.EventTaskCompleted {
+					t.Fatalf("test_webhooks: case %s: expectedEvent=%s, actualEvent=%s", name, webhook.EventTaskCompleted, event)
+				}
+				mu.Unlock()
+				return received[j].Header.Get(webhook.DeliveryHeader)
+			}
+			mu.Unlock()
+		}
+		t.Fatalf("test_webhooks: case %s: the completion was not delivered", name)
+		return ""
+	}
+	deliveryID := deliveredFor("delivery", 0)
+
+	// a failed redelivery stays pending, and is logged
+	mu.Lock()
+	status = http.StatusInternalServerError
+	after := len(received)
+	mu.Unlock()
+	rc = httptest.NewRecorder()
+	req = TestRequest(t, "redeliver", "/", http.MethodPost, "", nil, nil)
+	req.SetPathValue("id", hook.ID)
+	req.SetPathValue("delivery_id", deliveryID)
+	webhook.HandleRedeliver(logger, webhookRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusAccepted {
+		t.Fatalf("test_webhooks: case redeliver: expectedStatusCode=%d, actualStatusCode=%d", http.StatusAccepted, rc.Code)
+	}
+	if redelivered := deliveredFor("redelivery", after); redelivered != deliveryID {
+		t.Fatalf("test_webhooks: case redelivery: expectedDeliveryID=%s, actualDeliveryID=%s", deliveryID, redelivered)
+	}
+
+	id, _ := strconv.ParseInt(deliveryID, 10, 64)
+	delivery, err := webhookRepo.GetDelivery(ctx, hook.ID, id)
+	if err != nil {
+		t.Fatalf("test_webhooks: failed to retrieve delivery, error=%s", err.Error())
+	}
+	if delivery.Status != webhook.StatusPending || len(delivery.Log) != 2 || *delivery.Log[1].StatusCode != http.StatusInternalServerError {
+		t.Fatalf("test_webhooks: case redelivery: expected a pending delivery with 2 attempts, actualResult=%+v", delivery)
+	}
+
+	// the client webhooks are sent with in production never reaches the server's own network
+	if res, err := webhook.NewClient().Get(receiver.URL); err == nil {
+		res.Body.Close()
+		t.Fatalf("test_webhooks: case loopback address: expected the connection to be refused, actualStatusCode=%d", res.StatusCode)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+
+	u, err := userRepo.Register(ctx, user.UserRequest{Email: "outbox@test.com", Password: "test123"})
+	if err != nil {
+		t.Fatalf("test_outbox: failed to register user, error=%s", err.Error())
+	}
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: "todo1", Content: "outboxed"}); err != nil {
+		t.Fatalf("test_outbox: failed to create task, error=%s", err.Error())
+	}
+
+	var registered, created []outbox.Event
+	failures := 1
+	events := outbox.NewDispatcher(dbPool, logger)
+	events.Subscribe("registrations", func(ctx context.Context, e outbox.Event) error {
+		if e.Type == user.EventRegistered && e.AggregateID == u.ID {
+			registered = append(registered, e)
+		}
+		return nil
+	})
+	events.Subscribe("tasks", func(ctx context.Context, e outbox.Event) error {
+		if e.Type != todo.EntityTask+"."+todo.EventCreated || !strings.Contains(string(e.Payload), `"outboxed"`) {
+			return nil
+		}
+		if failures > 0 {
+			failures--
+			return errors.New("unavailable")
+		}
+		created = append(created, e)
+		return nil
+	})
+
+	if err := events.Dispatch(ctx); err != nil {
+		t.Fatalf("test_outbox: failed to dispatch, error=%s", err.Error())
+	}
+	var payload user.Registered
+	if len(registered) != 1 || registered[0].Decode(&payload) != nil || payload.Email != "outbox@test.com" || registered[0].UserID != u.ID {
+		t.Fatalf("test_outbox: case registration: expected a single registration event, actualResult=%+v", registered)
+	}
+	if len(created) != 0 {
+		t.Fatalf("test_outbox: case failed handler: expected no delivery, actualResult=%+v", created)
+	}
+
+	// the failed event is retried for the subscriber which failed only
+	if _, err := dbPool.Exec(ctx, "UPDATE outbox_events SET next_attempt_at = now() WHERE dispatched_at IS NULL"); err != nil {
+		t.Fatalf("test_outbox: failed to make the retry due, error=%s", err.Error())
+	}
+	if err := events.Dispatch(ctx); err != nil {
+		t.Fatalf("test_outbox: failed to dispatch, error=%s", err.Error())
+	}
+	if len(registered) != 1 {
+		t.Fatalf("test_outbox: case retry: expected the registration not to be delivered again, actualResult=%+v", registered)
+	}
+	if len(created) != 1 || created[0].UserID != "test1" {
+		t.Fatalf("test_outbox: case retry: expected the task creation to be delivered, actualResult=%+v", created)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	ctx := context.Background()
+
+	schedules := []struct {
+		name     string
+		spec     string
+		after    time.Time
+		expected time.Time
+	}{
+		{
+			name:     "every quarter of an hour",
+			spec:     "*/15 * * * *",
+			after:    time.Date(2024, 3, 1, 10, 7, 30, 0, time.UTC),
+			expected: time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC),
+		},
+		{
+			name:     "weekdays at nine",
+			spec:     "0 9 * * 1-5",
+			after:    time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC),
+			expected: time.Date(2024, 3, 4, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "monthly",
+			spec:     "@monthly",
+			after:    time.Date(2024, 12, 15, 0, 0, 0, 0, time.UTC),
+			expected: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "interval",
+			spec:     "@every 90m",
+			after:    time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+			expected: time.Date(2024, 3, 1, 11, 30, 0, 0, time.UTC),
+		},
+	}
+	for _, tt := range schedules {
+		schedule, err := jobs.ParseSchedule(tt.spec)
+		if err != nil {
+			t.Fatalf("test_jobs: case %s: failed to parse schedule, error=%s", tt.name, err.Error())
+		}
+		if next := schedule.Next(tt.after); !next.Equal(tt.expected) {
+			t.Fatalf("test_jobs: case %s: expectedNext=%s, actualNext=%s", tt.name, tt.expected, next)
+		}
+	}
+	for _, spec := range []string{"61 * * * *", "* * *", "@every 1ms", "0 0 31 2 *"} {
+		if err := jobs.NewQueue(dbPool, logger).Schedule("invalid", spec, "test.ok", nil); err == nil {
+			t.Fatalf("test_jobs: case invalid schedule: expected %q to be rejected", spec)
+		}
+	}
+
+	var (
+		mu  sync.Mutex
+		ran []string
+	)
+	queue := jobs.NewQueue(dbPool, logger)
+	queue.Register("test.ok", func(ctx context.Context, j jobs.Job) error {
+		var name string
+		if err := j.Decode(&name); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ran = append(ran, name)
+		return nil
+	}, jobs.Options{Concurrency: 2})
+	queue.Register("test.failing", func(ctx context.Context, j jobs.Job) error {
+		return errors.New("always failing")
+	}, jobs.Options{MaxAttempts: 2})
+	if err := queue.Schedule("test", "@every 1h", "test.ok", "scheduled"); err != nil {
+		t.Fatalf("test_jobs: failed to schedule, error=%s", err.Error())
+	}
+
+	if _, err := jobs.Enqueue(ctx, dbPool, "test.ok", "now", time.Time{}); err != nil {
+		t.Fatalf("test_jobs: failed to enqueue, error=%s", err.Error())
+	}
+	if _, err := jobs.Enqueue(ctx, dbPool, "test.ok", "later", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("test_jobs: failed to enqueue, error=%s", err.Error())
+	}
+	failing, err := jobs.Enqueue(ctx, dbPool, "test.failing", nil, time.Time{})
+	if err != nil {
+		t.Fatalf("test_jobs: failed to enqueue, error=%s", err.Error())
+	}
+
+	if err := queue.Work(ctx); err != nil {
+		t.Fatalf("test_jobs: failed to work, error=%s", err.Error())
+	}
+	if !slices.Equal(ran, []string{"now"}) {
+		t.Fatalf("test_jobs: case delayed job: expected only the due job to run, actualResult=%v", ran)
+	}
+
+	// the failed job, and the schedule, become due
+	if _, err := dbPool.Exec(ctx, "UPDATE jobs SET run_at = now() WHERE id = $1", failing); err != nil {
+		t.Fatalf("test_jobs: failed to make the retry due, error=%s", err.Error())
+	}
+	if _, err := dbPool.Exec(ctx, "UPDATE job_schedules SET next_run_at = now() WHERE name = 'test'"); err != nil {
+		t.Fatalf("test_jobs: failed to make the schedule due, error=%s", err.Error())
+	}
+	if err := queue.Work(ctx); err != nil {
+		t.Fatalf("test_jobs: failed to work, error=%s", err.Error())
+	}
+	if !slices.Equal(ran, []string{"now", "scheduled"}) {
+		t.Fatalf("test_jobs: case schedule: expected the scheduled job to run, actualResult=%v", ran)
+	}
+
+	var (
+		attempts  int
+		lastError string
+	)
+	if err := dbPool.QueryRow(ctx, "SELECT attempts, last_error FROM jobs_dead WHERE id = $1", failing).Scan(&attempts, &lastError); err != nil {
+		t.Fatalf("test_jobs: case dead letter: expected the failed job to be dead, error=%s", err.Error())
+	}
+	if attempts != 2 || lastError != "always failing" {
+		t.Fatalf("test_jobs: case dead letter: expectedAttempts=2, actualAttempts=%d, actualError=%s", attempts, lastError)
+	}
+}
+
+func TestReminders(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+	notificationRepo := notification.NewRepository(dbPool)
+
+	var (
+		mu       sync.Mutex
+		received []notification.Message
+	)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m notification.Message
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, m)
+	}))
+	defer receiver.Close()
+
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: "todo1", Content: "remind me"}); err != nil {
+		t.Fatalf("test_reminders: failed to create task, error=%s", err.Error())
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test1", "todo1", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_reminders: failed to retrieve tasks, error=%s", err.Error())
+	}
+	i := slices.IndexFunc(tasks, func(task todo.Task) bool { return task.Content == "remind me" })
+	if i < 0 {
+		t.Fatalf("test_reminders: created task not found")
+	}
+	task := tasks[i]
+
+	rc := httptest.NewRecorder()
+	req := TestRequest(t, "reminder on a task of another user", "/", http.MethodPost, "", nil, notification.ReminderRequest{TaskID: task.ID, RemindAt: time.Now()})
+	notification.HandleCreateReminder(logger, notificationRepo).ServeHTTP(rc, req.WithContext(context.WithValue(context.Background(), web.UserID, "test2")))
+	if rc.Code != http.StatusNotFound {
+		t.Fatalf("test_reminders: case reminder on a task of another user: expectedStatusCode=%d, actualStatusCode=%d", http.StatusNotFound, rc.Code)
+	}
+
+	webhookURL := receiver.URL
+	settings := notification.SettingsRequest{
+		TimeZone:   "Europe/Athens",
+		Channels:   []string{notification.ChannelInApp, notification.ChannelWebhook},
+		WebhookURL: &webhookURL,
+	}
+	rc = httptest.NewRecorder()
+	req = TestRequest(t, "put settings", "/settings", http.MethodPut, "", nil, settings)
+	notification.HandlePutSettings(logger, notificationRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusOK {
+		t.Fatalf("test_reminders: case put settings: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+
+	rc = httptest.NewRecorder()
+	req = TestRequest(t, "create reminder", "/", http.MethodPost, "", nil, notification.ReminderRequest{TaskID: task.ID, RemindAt: time.Now().Add(-time.Minute)})
+	notification.HandleCreateReminder(logger, notificationRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusCreated {
+		t.Fatalf("test_reminders: case create reminder: expectedStatusCode=%d, actualStatusCode=%d", http.StatusCreated, rc.Code)
+	}
+	var reminder notification.Reminder
+	if err := json.NewDecoder(rc.Body).Decode(&reminder); err != nil || reminder.TodoID != "todo1" {
+		t.Fatalf("test_reminders: case create reminder: expectedTodoID=todo1, actualResult=%+v, error=%v", reminder, err)
+	}
+
+	notifier := notification.NewNotifier(notificationRepo, logger,
+		notification.NewInAppChannel(notificationRepo),
+		notification.NewWebhookChannel(receiver.Client()),
+	)
+	// sent returns how many times the reminder went to the inbox and to the webhook, and whether it is complete
+	sent := func(name string) (int, int, bool) {
+		if err := notifier.SendDueReminders(ctx); err != nil {
+			t.Fatalf("test_reminders: case %s: failed to send reminders, error=%s", name, err.Error())
+		}
+		var inbox int
+		if err := dbPool.QueryRow(ctx, "SELECT COUNT(*) FROM notifications WHERE user_id = 'test1' AND task_id = $1", task.ID).Scan(&inbox); err != nil {
+			t.Fatalf("test_reminders: case %s: failed to count notifications, error=%s", name, err.Error())
+		}
+		var sentAt *time.Time
+		if err := dbPool.QueryRow(ctx, "SELECT sent_at FROM reminders WHERE id = $1", reminder.ID).Scan(&sentAt); err != nil {
+			t.Fatalf("test_reminders: case %s: failed to retrieve reminder, error=%s", name, err.Error())
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		hooked := 0
+		for _, m := range received {
+			if m.TaskID != nil && *m.TaskID == task.ID {
+				hooked++
+			}
+		}
+		return inbox, hooked, sentAt != nil
+	}
+
+	if inbox, hooked, done := sent("due reminder"); inbox != 1 || hooked != 1 || !done {
+		t.Fatalf("test_reminders: case due reminder: expectedInbox=1, expectedWebhook=1, expectedSent=true, actualInbox=%d, actualWebhook=%d, actualSent=%t", inbox, hooked, done)
+	}
+
+	// even once due again, a reminder never goes through a channel twice
+	if _, err := dbPool.Exec(ctx, "UPDATE reminders SET sent_at = NULL, next_attempt_at = now() WHERE id = $1", reminder.ID); err != nil {
+		t.Fatalf("test_reminders: failed to make the reminder due again, error=%s", err.Error())
+	}
+	if inbox, hooked, _ := sent("no duplicates"); inbox != 1 || hooked != 1 {
+		t.Fatalf("test_reminders: case no duplicates: expectedInbox=1, expectedWebhook=1, actualInbox=%d, actualWebhook=%d", inbox, hooked)
+	}
+
+	// during quiet hours the rescheduled reminder only goes to the inbox
+	now := time.Now().In(time.UTC)
+	quietStart, quietEnd := now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04")
+	settings.TimeZone = "UTC"
+	settings.QuietStart, settings.QuietEnd = &quietStart, &quietEnd
+	if _, err := notificationRepo.PutSettings(ctx, "test1", settings); err != nil {
+		t.Fatalf("test_reminders: failed to put settings, error=%s", err.Error())
+	}
+	rc = httptest.NewRecorder()
+	req = TestRequest(t, "reschedule reminder", "/"+reminder.ID, http.MethodPut, "", nil, notification.RescheduleRequest{RemindAt: time.Now().Add(-time.Second)})
+	req.SetPathValue("id", reminder.ID)
+	notification.HandleRescheduleReminder(logger, notificationRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusOK {
+		t.Fatalf("test_reminders: case reschedule reminder: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+	if inbox, hooked, done := sent("quiet hours"); inbox != 2 || hooked != 1 || done {
+		t.Fatalf("test_reminders: case quiet hours: expectedInbox=2, expectedWebhook=1, expectedSent=false, actualInbox=%d, actualWebhook=%d, actualSent=%t", inbox, hooked, done)
+	}
+	var next time.Time
+	if err := dbPool.QueryRow(ctx, "SELECT next_attempt_at FROM reminders WHERE id = $1", reminder.ID).Scan(&next); err != nil {
+		t.Fatalf("test_reminders: failed to retrieve reminder, error=%s", err.Error())
+	}
+	if next.Before(now.Add(time.Hour - time.Minute)) {
+		t.Fatalf("test_reminders: case quiet hours: expected the webhook to wait for the quiet hours to end, actualNext=%s", next)
+	}
+}
+
+func TestInbox(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+	otherCtx := context.WithValue(context.Background(), web.UserID, "test2")
+	notificationRepo := notification.NewRepository(dbPool)
+
+	list, err := todoRepo.Create(ctx, todo.TodoRequest{AuthorID: "test1", Name: "shared", Tasks: []todo.Task{}})
+	if err != nil {
+		t.Fatalf("test_inbox: failed to create todo, error=%s", err.Error())
+	}
+
+	type request struct {
+		name               string
+		handler            http.HandlerFunc
+		method             string
+		ctx                context.Context
+		pathValues         map[string]string
+		query              map[string]string
+		data               any
+		expectedStatusCode int
+	}
+	serve := func(tt request) *httptest.ResponseRecorder {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", tt.method, "", tt.query, tt.data)
+		for k, v := range tt.pathValues {
+			req.SetPathValue(k, v)
+		}
+		tt.handler.ServeHTTP(rc, req.WithContext(tt.ctx))
+		if rc.Code != tt.expectedStatusCode {
+			t.Fatalf("test_inbox: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+		return rc
+	}
+
+	// the tasks of a list can only be changed by its author and its members
+	for _, tt := range []request{
+		{name: "update task of another user", handler: todo.HandleUpdateTask(logger, todoRepo), method: http.MethodPut, ctx: otherCtx,
+			pathValues: map[string]string{"id": "todo1", "task_id": "task1"}, data: map[string]any{"done": true}, expectedStatusCode: http.StatusForbidden},
+		{name: "delete task of another user", handler: todo.HandleDeleteTask(logger, todoRepo), method: http.MethodDelete, ctx: otherCtx,
+			pathValues: map[string]string{"id": "todo1", "task_id": "task1"}, expectedStatusCode: http.StatusForbidden},
+		{name: "share as another user", handler: todo.HandleAddMember(logger, todoRepo), method: http.MethodPut, ctx: otherCtx,
+			pathValues: map[string]string{"id": list.ID, "user_id": "test2"}, expectedStatusCode: http.StatusForbidden},
+		{name: "share with the author", handler: todo.HandleAddMember(logger, todoRepo), method: http.MethodPut, ctx: ctx,
+			pathValues: map[string]string{"id": list.ID, "user_id": "test1"}, expectedStatusCode: http.StatusBadRequest},
+		{name: "share with unknown user", handler: todo.HandleAddMember(logger, todoRepo), method: http.MethodPut, ctx: ctx,
+			pathValues: map[string]string{"id": list.ID, "user_id": "unknown"}, expectedStatusCode: http.StatusNotFound},
+		{name: "share", handler: todo.HandleAddMember(logger, todoRepo), method: http.MethodPut, ctx: ctx,
+			pathValues: map[string]string{"id": list.ID, "user_id": "test2"}, expectedStatusCode: http.StatusOK},
+		{name: "share again", handler: todo.HandleAddMember(logger, todoRepo), method: http.MethodPut, ctx: ctx,
+			pathValues: map[string]string{"id": list.ID, "user_id": "test2"}, expectedStatusCode: http.StatusOK},
+	} {
+		serve(tt)
+	}
+
+	rc := serve(request{name: "members", handler: todo.HandleGetMembers(logger, todoRepo), method: http.MethodGet, ctx: otherCtx,
+		pathValues: map[string]string{"id": list.ID}, expectedStatusCode: http.StatusOK})
+	var members []todo.Member
+	if err := json.NewDecoder(rc.Body).Decode(&members); err != nil || len(members) != 1 || members[0].UserID != "test2" {
+		t.Fatalf("test_inbox: case members: expected test2 to be the only member, actualResult=%+v, error=%v", members, err)
+	}
+
+	// the author adds a task, which the member completes
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: list.ID, Content: "inbox"}); err != nil {
+		t.Fatalf("test_inbox: failed to create task, error=%s", err.Error())
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test1", list.ID, todo.Filter{})
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("test_inbox: failed to retrieve the created task, actualResult=%v, error=%v", tasks, err)
+	}
+	task := tasks[0]
+	serve(request{name: "complete task as member", handler: todo.HandleUpdateTask(logger, todoRepo), method: http.MethodPut, ctx: otherCtx,
+		pathValues: map[string]string{"id": list.ID, "task_id": task.ID}, data: map[string]any{"done": true}, expectedStatusCode: http.StatusOK})
+
+	events := outbox.NewDispatcher(dbPool, logger)
+	events.Subscribe("notifications", notificationRepo.Notify)
+	for range 2 {
+		if _, err := dbPool.Exec(ctx, "UPDATE outbox_events SET dispatched_at = NULL, delivered_to = '{}', next_attempt_at = now() WHERE aggregate_id = ANY($1)", []string{task.ID, list.ID}); err != nil {
+			t.Fatalf("test_inbox: failed to make the events due, error=%s", err.Error())
+		}
+		if err := events.Dispatch(ctx); err != nil {
+			t.Fatalf("test_inbox: failed to dispatch events, error=%s", err.Error())
+		}
+	}
+
+	inbox := func(name string, ctx context.Context) []notification.Notification {
+		rc := serve(request{name: name, handler: notification.HandleGetNotifications(logger, notificationRepo), method: http.MethodGet, ctx: ctx,
+			query: map[string]string{"unread": "true"}, expectedStatusCode: http.StatusOK})
+		var page web.Page[notification.Notification]
+		if err := json.NewDecoder(rc.Body).Decode(&page); err != nil {
+			t.Fatalf("test_inbox: case %s: failed to decode response, error=%s", name, err.Error())
+		}
+		var received []notification.Notification
+		for _, n := range page.Items {
+			if n.TodoID != nil && *n.TodoID == list.ID {
+				received = append(received, n)
+			}
+		}
+		return received
+	}
+
+	// the member is told about the list being shared and the task being added, but not about completing it
+	var types []string
+	for _, n := range inbox("member notifications", otherCtx) {
+		types = append(types, n.Type)
+	}
+	if expected := []string{"task.created", notification.TypeShared}; !slices.Equal(types, expected) {
+		t.Fatalf("test_inbox: case member notifications: expectedResult=%v, actualResult=%v", expected, types)
+	}
+
+	// the creation of the task by its owner is left out, and redelivered events are not added twice
+	received := inbox("unread notifications", ctx)
+	if len(received) != 1 || received[0].Type != notification.TypeTaskCompleted || !strings.Contains(received[0].Body, "inbox") {
+		t.Fatalf("test_inbox: case unread notifications: expected a single completion, actualResult=%+v", received)
+	}
+	n := received[0]
+
+	unreadCount := func(name string) int {
+		rc := serve(request{name: name, handler: notification.HandleUnreadCount(logger, notificationRepo), method: http.MethodGet, ctx: ctx,
+			expectedStatusCode: http.StatusOK})
+		var count notification.UnreadCount
+		if err := json.NewDecoder(rc.Body).Decode(&count); err != nil {
+			t.Fatalf("test_inbox: case %s: failed to decode response, error=%s", name, err.Error())
+		}
+		return count.Unread
+	}
+	before := unreadCount("unread count")
+	if before < 1 {
+		t.Fatalf("test_inbox: case unread count: expectedUnread>=1, actualUnread=%d", before)
+	}
+
+	id := strconv.FormatInt(n.ID, 10)
+	serve(request{name: "mark read of another user", handler: notification.HandleMarkRead(logger, notificationRepo), method: http.MethodPut, ctx: otherCtx,
+		pathValues: map[string]string{"id": id}, expectedStatusCode: http.StatusForbidden})
+	serve(request{name: "mark read", handler: notification.HandleMarkRead(logger, notificationRepo), method: http.MethodPut, ctx: ctx,
+		pathValues: map[string]string{"id": id}, expectedStatusCode: http.StatusOK})
+	if after := unreadCount("mark read"); after != before-1 {
+		t.Fatalf("test_inbox: case mark read: expectedUnread=%d, actualUnread=%d", before-1, after)
+	}
+
+	serve(request{name: "mark all read", handler: notification.HandleMarkAllRead(logger, notificationRepo), method: http.MethodPut, ctx: ctx,
+		expectedStatusCode: http.StatusOK})
+	if after := unreadCount("mark all read"); after != 0 {
+		t.Fatalf("test_inbox: case mark all read: expectedUnread=0, actualUnread=%d", after)
+	}
+
+	// a member who leaves the list can no longer change it
+	for _, tt := range []request{
+		{name: "leave", handler: todo.HandleRemoveMember(logger, todoRepo), method: http.MethodDelete, ctx: otherCtx,
+			pathValues: map[string]string{"id": list.ID, "user_id": "test2"}, expectedStatusCode: http.StatusOK},
+		{name: "update task after leaving", handler: todo.HandleUpdateTask(logger, todoRepo), method: http.MethodPut, ctx: otherCtx,
+			pathValues: map[string]string{"id": list.ID, "task_id": task.ID}, data: map[string]any{"done": false}, expectedStatusCode: http.StatusForbidden},
+	} {
+		serve(tt)
+	}
+}
+
+func TestSharedList(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+	memberCtx := context.WithValue(context.Background(), web.UserID, "test2")
+
+	list, err := todoRepo.Create(ctx, todo.TodoRequest{AuthorID: "test1", Name: "shared access", Tasks: []todo.Task{}})
+	if err != nil {
+		t.Fatalf("test_shared_list: failed to create todo, error=%s", err.Error())
+	}
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: list.ID, Content: "before sharing"}); err != nil {
+		t.Fatalf("test_shared_list: failed to create task, error=%s", err.Error())
+	}
+
+	changes := func(name, since string) todo.SyncChanges {
+		changes, err := todoRepo.GetChanges(memberCtx, "test2", since)
+		if err != nil {
+			t.Fatalf("test_shared_list: case %s: failed to get changes, error=%s", name, err.Error())
+		}
+		return changes
+	}
+	hasList := func(changes todo.SyncChanges) bool {
+		return slices.ContainsFunc(changes.Todos, func(td todo.Todo) bool { return td.ID == list.ID })
+	}
+	before := changes("before sharing", "")
+	if hasList(before) {
+		t.Fatalf("test_shared_list: case before sharing: expected the list to be left out, actualResult=%+v", before.Todos)
+	}
+
+	if err := todoRepo.AddMember(ctx, "test1", list.ID, "test2"); err != nil {
+		t.Fatalf("test_shared_list: failed to share todo, error=%s", err.Error())
+	}
+
+	// the list comes in full in the member's next delta sync, however long ago it last changed
+	shared := changes("shared", before.Token)
+	if !hasList(shared) || !slices.ContainsFunc(shared.Tasks, func(task todo.Task) bool { return task.TodoID == list.ID && task.Content == "before sharing" }) {
+		t.Fatalf("test_shared_list: case shared: expected the list and its task, actualResult=%+v", shared)
+	}
+
+	stream := func(name, lastEventID string) string {
+		streamCtx, cancel := context.WithTimeout(memberCtx, 200*time.Millisecond)
+		defer cancel()
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, name, "/", http.MethodGet, "", nil, nil)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		todo.HandleUserEvents(logger, todoRepo, todo.NewBroker(dbPool, logger)).ServeHTTP(rc, req.WithContext(streamCtx))
+		if rc.Code != http.StatusOK {
+			t.Fatalf("test_shared_list: case %s: expectedStatusCode=%d, actualStatusCode=%d", name, http.StatusOK, rc.Code)
+		}
+		return rc.Body.String()
+	}
+	body := stream("stream", "")
+	i := strings.LastIndex(body, "id: ")
+	if i < 0 {
+		t.Fatalf("test_shared_list: case stream: expected an event id, actualResult=%s", body)
+	}
+	cursor, _, _ := strings.Cut(body[i+len("id: "):], "\n")
+
+	// the member pushes a task to the list, which shows up in the stream of all their lists
+	push := todo.PushRequest{Mutations: []todo.Mutation{
+		{ClientID: "pushed", Op: todo.MutationCreateTask, TodoID: list.ID, Task: &todo.Task{Content: "pushed by member"}},
+	}}
+	if result := todoRepo.Push(memberCtx, "test2", push); result.Results[0].Status != todo.MutationApplied {
+		t.Fatalf("test_shared_list: case push: expectedStatus=%s, actualResult=%+v", todo.MutationApplied, result.Results[0])
+	}
+	if body := stream("stream after push", cursor); !strings.Contains(body, "event: task.created") {
+		t.Fatalf("test_shared_list: case stream after push: expectedResult=%s, actualResult=%s", "event: task.created", body)
+	}
+
+	broker := todo.NewBroker(dbPool, logger)
+	brokerCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go broker.Run(brokerCtx)
+	probe := todo.Presence{TodoID: "probe-shared", UserID: "test2", SessionID: "probe", State: todo.PresenceViewing}
+	for i := 0; len(broker.PresenceOf(probe.TodoID)) == 0; i++ {
+		if i == 100 {
+			t.Fatalf("test_shared_list: broker is not listening")
+		}
+		if err := broker.Announce(brokerCtx, probe); err != nil {
+			t.Fatalf("test_shared_list: failed to announce presence, error=%s", err.Error())
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	srv := httptest.NewServer(todo.HandleSync(logger, todoRepo, broker))
+	defer srv.Close()
+	conn, err := ws.Dial(brokerCtx, "ws"+strings.TrimPrefix(srv.URL, "http"), http.Header{"x-jwt-token": []string{TestToken(t, "shared sync", "test2")}})
+	if err != nil {
+		t.Fatalf("test_shared_list: failed to connect, error=%s", err.Error())
+	}
+	defer conn.Close(ws.CloseNormal, "")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, request := range []todo.SyncRequest{
+		{Type: todo.SyncSubscribe, ID: "1", TodoID: list.ID},
+		{Type: todo.SyncMutate, ID: "2", TodoID: list.ID, Op: todo.SyncOpCreateTask, Task: &todo.Task{Content: "synced by member"}},
+	} {
+		data, _ := json.Marshal(request)
+		if err := conn.WriteMessage(data); err != nil {
+			t.Fatalf("test_shared_list: case sync %s: failed to send, error=%s", request.Type, err.Error())
+		}
+		if reply := readSync(t, conn, func(msg todo.SyncMessage) bool { return msg.ID == request.ID }); reply.Type != todo.SyncAck {
+			t.Fatalf("test_shared_list: case sync %s: expectedType=%s, actualResult=%v", request.Type, todo.SyncAck, reply)
+		}
+	}
+	readSync(t, conn, func(msg todo.SyncMessage) bool {
+		event, _ := msg.Data.(map[string]any)
+		return msg.Type == todo.SyncEvent && event["type"] == "task.created"
+	})
+
+	// the list is one of the member's calendars
+	dav := http.StripPrefix("/dav", todo.CalDAVRoutes(logger, todoRepo, userRepo.Authenticate, "/dav"))
+	req := httptest.NewRequest("PROPFIND", "/dav/calendars/test2/"+list.ID+"/", nil)
+	req.SetBasicAuth("test2@test.com", "test2")
+	rc := httptest.NewRecorder()
+	dav.ServeHTTP(rc, req)
+	if rc.Code != http.StatusMultiStatus {
+		t.Fatalf("test_shared_list: case caldav: expectedStatusCode=%d, actualStatusCode=%d, actualBody=%s", http.StatusMultiStatus, rc.Code, rc.Body.String())
+	}
+
+	// the member trashes the list and restores it
+	for _, tt := range []struct {
+		name               string
+		handler            http.HandlerFunc
+		expectedStatusCode int
+	}{
+		{name: "delete todo", handler: todo.HandleDelete(logger, todoRepo), expectedStatusCode: http.StatusOK},
+		{name: "restore todo", handler: todo.HandleRestore(logger, todoRepo), expectedStatusCode: http.StatusOK},
+		{name: "get restored todo", handler: todo.HandleGetByID(logger, todoRepo), expectedStatusCode: http.StatusOK},
+	} {
+		if tt.name == "restore todo" {
+			trash, _, err := todoRepo.GetTrash(memberCtx, "test2", 10, 1)
+			if err != nil || !slices.ContainsFunc(trash, func(item todo.TrashItem) bool { return item.ID == list.ID }) {
+				t.Fatalf("test_shared_list: case trash: expected the list in the trash, actualResult=%+v, error=%v", trash, err)
+			}
+		}
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, tt.name, "/", http.MethodPost, "", nil, nil)
+		req.SetPathValue("id", list.ID)
+		tt.handler.ServeHTTP(rc, req.WithContext(memberCtx))
+		if rc.Code != tt.expectedStatusCode {
+			t.Fatalf("test_shared_list: case %s: expectedStatusCode=%d, actualStatusCode=%d", tt.name, tt.expectedStatusCode, rc.Code)
+		}
+	}
+
+	// a member who leaves the list gets a tombstone for it
+	token := changes("before leaving", "").Token
+	if err := todoRepo.RemoveMember(ctx, list.ID, "test2"); err != nil {
+		t.Fatalf("test_shared_list: failed to remove member, error=%s", err.Error())
+	}
+	left := changes("left", token)
+	if !slices.ContainsFunc(left.Deleted, func(d todo.Tombstone) bool { return d.Entity == todo.EntityTodo && d.ID == list.ID }) {
+		t.Fatalf("test_shared_list: case left: expected the list's tombstone, actualResult=%+v", left.Deleted)
+	}
+}
+
+// testMailer keeps the emails sent through it.
+type testMailer struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func TestDigest(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test2")
+	notificationRepo := notification.NewRepository(dbPool)
+
+	now := time.Now()
+	overdue, later := now.AddDate(0, 0, -2), now.AddDate(0, 0, 3)
+	for _, task := range []todo.Task{
+		{TodoID: "todo2", Content: "digest overdue", DueAt: &overdue},
+		{TodoID: "todo2", Content: "digest today", DueAt: &now},
+		{TodoID: "todo2", Content: "digest later", DueAt: &later},
+		{TodoID: "todo2", Content: "digest <done>"},
+	} {
+		if err := todoRepo.CreateTask(ctx, "test2", task); err != nil {
+			t.Fatalf("test_digest: failed to create task, error=%s", err.Error())
+		}
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test2", "todo2", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_digest: failed to retrieve tasks, error=%s", err.Error())
+	}
+	i := slices.IndexFunc(tasks, func(task todo.Task) bool { return task.Content == "digest <done>" })
+	if i < 0 {
+		t.Fatalf("test_digest: created task not found")
+	}
+	done := tasks[i]
+	done.Done = true
+	if err := todoRepo.UpdateTask(ctx, "test2", done.TodoID, done, nil); err != nil {
+		t.Fatalf("test_digest: failed to complete task, error=%s", err.Error())
+	}
+
+	// the lists of another user only show up once they are shared
+	ownerCtx := context.WithValue(context.Background(), web.UserID, "test1")
+	shared, err := todoRepo.Create(ownerCtx, todo.TodoRequest{AuthorID: "test1", Name: "digest shared", Tasks: []todo.Task{
+		{Content: "digest shared", DueAt: &overdue},
+	}})
+	if err != nil {
+		t.Fatalf("test_digest: failed to create todo, error=%s", err.Error())
+	}
+	if err := todoRepo.AddMember(ownerCtx, "test1", shared.ID, "test2"); err != nil {
+		t.Fatalf("test_digest: failed to share todo, error=%s", err.Error())
+	}
+	if err := todoRepo.CreateTask(ownerCtx, "test1", todo.Task{TodoID: "todo1", Content: "digest not shared", DueAt: &overdue}); err != nil {
+		t.Fatalf("test_digest: failed to create task, error=%s", err.Error())
+	}
+
+	rc := httptest.NewRecorder()
+	req := TestRequest(t, "opt in", "/settings", http.MethodPut, "", nil, notification.SettingsRequest{
+		TimeZone: "UTC",
+		Channels: []string{notification.ChannelInApp},
+		Digest:   notification.DigestDaily,
+	})
+	notification.HandlePutSettings(logger, notificationRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusOK {
+		t.Fatalf("test_digest: case opt in: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+	var settings notification.Settings
+	if err := json.NewDecoder(rc.Body).Decode(&settings); err != nil || settings.Digest != notification.DigestDaily || settings.DigestAt != "08:00" {
+		t.Fatalf("test_digest: case opt in: expected a daily digest at 08:00, actualResult=%+v, error=%v", settings, err)
+	}
+
+	mailer := &testMailer{}
+	digester := notification.NewDigester(notificationRepo, mailer, logger)
+	if err := digester.SendDueDigests(ctx); err != nil {
+		t.Fatalf("test_digest: failed to send digests, error=%s", err.Error())
+	}
+	if len(mailer.sent) != 0 {
+		t.Fatalf("test_digest: case not due: expected no digest, actualResult=%+v", mailer.sent)
+	}
+
+	if _, err := dbPool.Exec(ctx, "UPDATE notification_settings SET digest_next_at = now() - interval '1 minute' WHERE user_id = 'test2'"); err != nil {
+		t.Fatalf("test_digest: failed to make the digest due, error=%s", err.Error())
+	}
+	for range 2 {
+		if err := digester.SendDueDigests(ctx); err != nil {
+			t.Fatalf("test_digest: failed to send digests, error=%s", err.Error())
+		}
+	}
+	if len(mailer.sent) != 1 {
+		t.Fatalf("test_digest: case due: expected a single digest, actualResult=%+v", mailer.sent)
+	}
+	m := mailer.sent[0]
+	if m.To != "test2@test.com" {
+		t.Fatalf("test_digest: case due: expectedTo=test2@test.com, actualTo=%s", m.To)
+	}
+	for _, expected := range []string{"Overdue\n", "- digest overdue (", "- digest shared (", "Due today\n", "- digest today (", "Recently completed\n", "- digest <done> ("} {
+		if !strings.Contains(m.Text, expected) {
+			t.Fatalf("test_digest: case text: expected %q in the digest, actualText=%s", expected, m.Text)
+		}
+	}
+	if strings.Contains(m.Text, "digest later") {
+		t.Fatalf("test_digest: case text: expected tasks due later to be left out, actualText=%s", m.Text)
+	}
+	if strings.Contains(m.Text, "digest not shared") {
+		t.Fatalf("test_digest: case text: expected the lists of other users to be left out, actualText=%s", m.Text)
+	}
+	if !strings.Contains(m.HTML, "digest &lt;done&gt;") {
+		t.Fatalf("test_digest: case html: expected the content to be escaped, actualHTML=%s", m.HTML)
+	}
+
+	var next time.Time
+	if err := dbPool.QueryRow(ctx, "SELECT digest_next_at FROM notification_settings WHERE user_id = 'test2'").Scan(&next); err != nil {
+		t.Fatalf("test_digest: failed to retrieve settings, error=%s", err.Error())
+	}
+	if !next.After(now) || next.UTC().Hour() != 8 || next.UTC().Minute() != 0 {
+		t.Fatalf("test_digest: case next digest: expected the next 08:00, actualNext=%s", next)
+	}
+}
+
+func TestCalendarFeed(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+	calendarRepo := calendar.NewRepository(dbPool)
+
+	invalid := "FREQ=SOMETIMES"
+	if (todo.Task{Content: "recurring", Recurrence: &invalid}).Valid() {
+		t.Fatalf("test_calendar_feed: case invalid recurrence: expected %q to be rejected", invalid)
+	}
+
+	due := time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)
+	recurrence := "FREQ=WEEKLY;BYDAY=MO"
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: "todo1", Content: "calendar, weekly", DueAt: &due, Recurrence: &recurrence}); err != nil {
+		t.Fatalf("test_calendar_feed: failed to create task, error=%s", err.Error())
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test1", "todo1", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_calendar_feed: failed to retrieve tasks, error=%s", err.Error())
+	}
+	i := slices.IndexFunc(tasks, func(task todo.Task) bool { return task.Content == "calendar, weekly" })
+	if i < 0 || tasks[i].Recurrence == nil || *tasks[i].Recurrence != recurrence {
+		t.Fatalf("test_calendar_feed: expected the task with its recurrence, actualResult=%+v", tasks)
+	}
+	task := tasks[i]
+
+	rc := httptest.NewRecorder()
+	req := TestRequest(t, "create feed", "/feed", http.MethodPost, "", nil, nil)
+	calendar.HandleCreateFeed(logger, calendarRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusCreated {
+		t.Fatalf("test_calendar_feed: case create feed: expectedStatusCode=%d, actualStatusCode=%d", http.StatusCreated, rc.Code)
+	}
+	var feed calendar.Feed
+	if err := json.NewDecoder(rc.Body).Decode(&feed); err != nil || feed.Token == "" || !strings.HasSuffix(feed.URL, "/feed/"+feed.Token+".ics") {
+		t.Fatalf("test_calendar_feed: case create feed: expected a token and its URL, actualResult=%+v, error=%v", feed, err)
+	}
+
+	// get fetches the feed of the token, conditionally when etag is set
+	get := func(name, token, kind, etag string) *httptest.ResponseRecorder {
+		rc := httptest.NewRecorder()
+		var query map[string]string
+		if kind != "" {
+			query = map[string]string{"kind": kind}
+		}
+		req := TestRequest(t, name, "/feed/"+token+".ics", http.MethodGet, "", query, nil)
+		req.SetPathValue("file", token+".ics")
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		calendar.HandleFeed(logger, calendarRepo).ServeHTTP(rc, req)
+		return rc
+	}
+
+	rc = get("feed", feed.Token, "", "")
+	if rc.Code != http.StatusOK || rc.Header().Get("Content-Type") != ical.ContentType {
+		t.Fatalf("test_calendar_feed: case feed: expectedStatusCode=%d, actualStatusCode=%d, actualContentType=%s", http.StatusOK, rc.Code, rc.Header().Get("Content-Type"))
+	}
+	body := rc.Body.String()
+	for _, expected := range []string{"BEGIN:VTODO\r\nUID:" + task.ID + "@todo\r\n", "SUMMARY:calendar\\, weekly\r\n", "DUE:20300107T090000Z\r\n", "RRULE:" + recurrence + "\r\n", "STATUS:NEEDS-ACTION\r\n"} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("test_calendar_feed: case feed: expected %q in the feed, actualBody=%s", expected, body)
+		}
+	}
+	etag := rc.Header().Get("ETag")
+
+	if rc := get("not modified", feed.Token, "", etag); rc.Code != http.StatusNotModified {
+		t.Fatalf("test_calendar_feed: case not modified: expectedStatusCode=%d, actualStatusCode=%d", http.StatusNotModified, rc.Code)
+	}
+
+	task.Done = true
+	if err := todoRepo.UpdateTask(ctx, "test1", task.TodoID, task, nil); err != nil {
+		t.Fatalf("test_calendar_feed: failed to complete task, error=%s", err.Error())
+	}
+	rc = get("modified", feed.Token, "", etag)
+	if rc.Code != http.StatusOK || !strings.Contains(rc.Body.String(), "STATUS:COMPLETED\r\n") {
+		t.Fatalf("test_calendar_feed: case modified: expectedStatusCode=%d, actualStatusCode=%d, actualBody=%s", http.StatusOK, rc.Code, rc.Body.String())
+	}
+
+	rc = get("events", feed.Token, calendar.KindEvent, "")
+	if rc.Code != http.StatusOK || !strings.Contains(rc.Body.String(), "BEGIN:VEVENT\r\nUID:"+task.ID+"@todo\r\n") {
+		t.Fatalf("test_calendar_feed: case events: expectedStatusCode=%d, actualStatusCode=%d, actualBody=%s", http.StatusOK, rc.Code, rc.Body.String())
+	}
+
+	if rc := get("unknown token", "unknown", "", ""); rc.Code != http.StatusNotFound {
+		t.Fatalf("test_calendar_feed: case unknown token: expectedStatusCode=%d, actualStatusCode=%d", http.StatusNotFound, rc.Code)
+	}
+
+	// the token is a secret, and is left out of the access log
+	var logs bytes.Buffer
+	rc = httptest.NewRecorder()
+	req = TestRequest(t, "logged feed", "/feed/"+feed.Token+".ics", http.MethodGet, "", nil, nil)
+	calendar.Routes(slog.New(slog.NewTextHandler(&logs, nil)), calendarRepo, nil).ServeHTTP(rc, req)
+	if rc.Code != http.StatusOK || !strings.Contains(logs.String(), "/feed/[redacted]") || strings.Contains(logs.String(), feed.Token) {
+		t.Fatalf("test_calendar_feed: case logged feed: expected the token to be redacted, actualStatusCode=%d, actualLogs=%s", rc.Code, logs.String())
+	}
+
+	rc = httptest.NewRecorder()
+	req = TestRequest(t, "delete feed", "/feed", http.MethodDelete, "", nil, nil)
+	calendar.HandleDeleteFeed(logger, calendarRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusOK {
+		t.Fatalf("test_calendar_feed: case delete feed: expectedStatusCode=%d, actualStatusCode=%d", http.StatusOK, rc.Code)
+	}
+	if rc := get("deleted feed", feed.Token, "", ""); rc.Code != http.StatusNotFound {
+		t.Fatalf("test_calendar_feed: case deleted feed: expectedStatusCode=%d, actualStatusCode=%d", http.StatusNotFound, rc.Code)
+	}
+}
+
+// davMultistatus is the part of a multistatus response TestCalDAV looks at.
+type davMultistatus struct {
+	Responses []davResponse `xml:"response"`
+	SyncToken string        `xml:"sync-token"`
+}
+
+type davResponse struct {
+	Href     string `xml:"href"`
+	Status   string `xml:"status"`
+	Propstat []struct {
+		Prop struct {
+			ETag string `xml:"getetag"`
+			Data string `xml:"calendar-data"`
+		} `xml:"prop"`
+		Status string `xml:"status"`
+	} `xml:"propstat"`
+}
+
+func TestCalDAV(t *testing.T) {
+	server := http.StripPrefix("/dav", todo.CalDAVRoutes(logger, todoRepo, userRepo.Authenticate, "/dav"))
+
+	// do makes a request to the CalDAV server as test1, or anonymously when password is empty
+	do := func(method, path, password, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/dav"+path, strings.NewReader(body))
+		if password != "" {
+			req.SetBasicAuth("test1@test.com", password)
+		}
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rc := httptest.NewRecorder()
+		server.ServeHTTP(rc, req)
+		return rc
+	}
+	report := func(name, body string) davMultistatus {
+		rc := do("REPORT", "/calendars/test1/todo1/", "test1", body, map[string]string{"Depth": "1"})
+		if rc.Code != http.StatusMultiStatus {
+			t.Fatalf("test_caldav: case %s: expectedStatusCode=%d, actualStatusCode=%d, actualBody=%s", name, http.StatusMultiStatus, rc.Code, rc.Body.String())
+		}
+		var ms davMultistatus
+		if err := xml.Unmarshal(rc.Body.Bytes(), &ms); err != nil {
+			t.Fatalf("test_caldav: case %s: failed to decode multistatus, error=%s", name, err.Error())
+		}
+		return ms
+	}
+	syncCollection := func(name, token string) davMultistatus {
+		return report(name, `<d:sync-collection xmlns:d="DAV:"><d:sync-token>`+token+`</d:sync-token><d:sync-level>1</d:sync-level><d:prop><d:getetag/></d:prop></d:sync-collection>`)
+	}
+	const href = "/dav/calendars/test1/todo1/client-1.ics"
+
+	if rc := do(http.MethodOptions, "/", "", "", nil); !strings.Contains(rc.Header().Get("DAV"), "calendar-access") {
+		t.Fatalf("test_caldav: case options: expected calendar-access in the DAV header, actualHeader=%q", rc.Header().Get("DAV"))
+	}
+	if rc := do("PROPFIND", "/calendars/test1/", "", "", nil); rc.Code != http.StatusUnauthorized {
+		t.Fatalf("test_caldav: case no credentials: expectedStatusCode=%d, actualStatusCode=%d", http.StatusUnauthorized, rc.Code)
+	}
+	if rc := do("PROPFIND", "/calendars/test1/", "wrong", "", nil); rc.Code != http.StatusUnauthorized {
+		t.Fatalf("test_caldav: case wrong password: expectedStatusCode=%d, actualStatusCode=%d", http.StatusUnauthorized, rc.Code)
+	}
+	if rc := do("PROPFIND", "/calendars/test2/todo2/", "test1", "", nil); rc.Code != http.StatusForbidden {
+		t.Fatalf("test_caldav: case another user: expectedStatusCode=%d, actualStatusCode=%d", http.StatusForbidden, rc.Code)
+	}
+
+	rc := do("PROPFIND", "/calendars/test1/", "test1", "", map[string]string{"Depth": "1"})
+	if rc.Code != http.StatusMultiStatus || !strings.Contains(rc.Body.String(), "<d:href>/dav/calendars/test1/todo1/</d:href>") ||
+		!strings.Contains(rc.Body.String(), `<c:comp name="VTODO"/>`) {
+		t.Fatalf("test_caldav: case calendar home: expected todo1 as a VTODO calendar, actualStatusCode=%d, actualBody=%s", rc.Code, rc.Body.String())
+	}
+
+	initial := syncCollection("initial sync", "")
+	if initial.SyncToken == "" {
+		t.Fatalf("test_caldav: case initial sync: expected a sync token")
+	}
+
+	vtodo := func(status string) string {
+		return "BEGIN:VCALENDAR\r\nVERSION:2.0\r\nPRODID:-//test//EN\r\nBEGIN:VTODO\r\nUID:client-1\r\nSUMMARY:caldav\\, task\r\n" +
+			"DUE;TZID=Europe/Athens:20300107T110000\r\nPRIORITY:1\r\nSTATUS:" + status + "\r\nEND:VTODO\r\nEND:VCALENDAR\r\n"
+	}
+	calendarType := map[string]string{"Content-Type": "text/calendar; charset=utf-8", "If-None-Match": "*"}
+	rc = do(http.MethodPut, "/calendars/test1/todo1/client-1.ics", "test1", vtodo("NEEDS-ACTION"), calendarType)
+	if rc.Code != http.StatusCreated || rc.Header().Get("ETag") == "" {
+		t.Fatalf("test_caldav: case create: expectedStatusCode=%d, actualStatusCode=%d, actualBody=%s", http.StatusCreated, rc.Code, rc.Body.String())
+	}
+	etag := rc.Header().Get("ETag")
+	if rc := do(http.MethodPut, "/calendars/test1/todo1/client-1.ics", "test1", vtodo("NEEDS-ACTION"), calendarType); rc.Code != http.StatusPreconditionFailed {
+		t.Fatalf("test_caldav: case create existing: expectedStatusCode=%d, actualStatusCode=%d", http.StatusPreconditionFailed, rc.Code)
+	}
+
+	tasks, err := todoRepo.GetTasks(context.Background(), "test1", "todo1", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_caldav: failed to retrieve tasks, error=%s", err.Error())
+	}
+	i := slices.IndexFunc(tasks, func(task todo.Task) bool { return task.Content == "caldav, task" })
+	if i < 0 || tasks[i].Priority != todo.PriorityUrgent || tasks[i].DueAt == nil || !tasks[i].DueAt.Equal(time.Date(2030, 1, 7, 9, 0, 0, 0, time.UTC)) ||
+		web.ETag(tasks[i].Version) != etag {
+		t.Fatalf("test_caldav: case create: expected the task with its priority, due date and version, actualResult=%+v", tasks)
+	}
+
+	rc = do(http.MethodGet, "/calendars/test1/todo1/client-1.ics", "test1", "", nil)
+	if rc.Code != http.StatusOK || rc.Header().Get("ETag") != etag || !strings.Contains(rc.Body.String(), "UID:client-1\r\n") ||
+		!strings.Contains(rc.Body.String(), "DUE:20300107T090000Z\r\n") {
+		t.Fatalf("test_caldav: case get: expectedStatusCode=%d, actualStatusCode=%d, actualBody=%s", http.StatusOK, rc.Code, rc.Body.String())
+	}
+
+	ms := syncCollection("sync", initial.SyncToken)
+	if !slices.ContainsFunc(ms.Responses, func(res davResponse) bool {
+		return res.Href == href && len(res.Propstat) > 0 && res.Propstat[0].Prop.ETag == etag
+	}) {
+		t.Fatalf("test_caldav: case sync: expected the new resource with its etag, actualResult=%+v", ms)
+	}
+	token := ms.SyncToken
+
+	stale := map[string]string{"Content-Type": "text/calendar", "If-Match": `"0"`}
+	if rc := do(http.MethodPut, "/calendars/test1/todo1/client-1.ics", "test1", vtodo("COMPLETED"), stale); rc.Code != http.StatusPreconditionFailed {
+		t.Fatalf("test_caldav: case stale update: expectedStatusCode=%d, actualStatusCode=%d", http.StatusPreconditionFailed, rc.Code)
+	}
+	rc = do(http.MethodPut, "/calendars/test1/todo1/client-1.ics", "test1", vtodo("COMPLETED"), map[string]string{"Content-Type": "text/calendar", "If-Match": etag})
+	if rc.Code != http.StatusNoContent || rc.Header().Get("ETag") == etag {
+		t.Fatalf("test_caldav: case complete: expectedStatusCode=%d, actualStatusCode=%d, actualBody=%s", http.StatusNoContent, rc.Code, rc.Body.String())
+	}
+	etag = rc.Header().Get("ETag")
+
+	ms = report("multiget", `<c:calendar-multiget xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav"><d:prop><d:getetag/><c:calendar-data/></d:prop>`+
+		`<d:href>`+href+`</d:href><d:href>/dav/calendars/test1/todo1/missing.ics</d:href></c:calendar-multiget>`)
+	if len(ms.Responses) != 2 || ms.Responses[0].Href != href || !strings.Contains(ms.Responses[0].Propstat[0].Prop.Data, "STATUS:COMPLETED") ||
+		!strings.Contains(ms.Responses[1].Status, "404") {
+		t.Fatalf("test_caldav: case multiget: expected the completed resource and a missing one, actualResult=%+v", ms)
+	}
+
+	ms = report("query", `<c:calendar-query xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav"><d:prop><d:getetag/></d:prop>`+
+		`<c:filter><c:comp-filter name="VCALENDAR"><c:comp-filter name="VEVENT"/></c:comp-filter></c:filter></c:calendar-query>`)
+	if len(ms.Responses) != 0 {
+		t.Fatalf("test_caldav: case query events: expected no resources, actualResult=%+v", ms)
+	}
+
+	if rc := do(http.MethodDelete, "/calendars/test1/todo1/client-1.ics", "test1", "", map[string]string{"If-Match": etag}); rc.Code != http.StatusNoContent {
+		t.Fatalf("test_caldav: case delete: expectedStatusCode=%d, actualStatusCode=%d", http.StatusNoContent, rc.Code)
+	}
+	ms = syncCollection("sync deletion", token)
+	i = slices.IndexFunc(ms.Responses, func(res davResponse) bool {
+		return res.Href == href
+	})
+	if i < 0 || !strings.Contains(ms.Responses[i].Status, "404") {
+		t.Fatalf("test_caldav: case sync deletion: expected the resource to be reported as removed, actualResult=%+v", ms)
+	}
+
+	if rc := do("REPORT", "/calendars/test1/todo1/", "test1", `<d:sync-collection xmlns:d="DAV:"><d:sync-token>invalid</d:sync-token><d:prop/></d:sync-collection>`, nil); rc.Code != http.StatusForbidden {
+		t.Fatalf("test_caldav: case invalid sync token: expectedStatusCode=%d, actualStatusCode=%d", http.StatusForbidden, rc.Code)
+	}
+
+	// the name of a deleted resource can be given to a new one
+	if rc := do(http.MethodPut, "/calendars/test1/todo1/client-1.ics", "test1", vtodo("NEEDS-ACTION"), calendarType); rc.Code != http.StatusCreated {
+		t.Fatalf("test_caldav: case recreate: expectedStatusCode=%d, actualStatusCode=%d, actualBody=%s", http.StatusCreated, rc.Code, rc.Body.String())
+	}
+
+	// a client retrying the creation of a resource ends up with a single task
+	retried := strings.ReplaceAll(strings.ReplaceAll(vtodo("NEEDS-ACTION"), "client-1", "client-2"), "caldav\\, task", "retried")
+	var wg sync.WaitGroup
+	codes := make([]int, 4)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = do(http.MethodPut, "/calendars/test1/todo1/client-2.ics", "test1", retried, map[string]string{"Content-Type": "text/calendar"}).Code
+		}()
+	}
+	wg.Wait()
+	if slices.ContainsFunc(codes, func(code int) bool { return code != http.StatusCreated && code != http.StatusNoContent }) {
+		t.Fatalf("test_caldav: case retried creation: expected every request to succeed, actualStatusCodes=%v", codes)
+	}
+	tasks, err = todoRepo.GetTasks(context.Background(), "test1", "todo1", todo.Filter{})
+	if err != nil {
+		t.Fatalf("test_caldav: failed to retrieve tasks, error=%s", err.Error())
+	}
+	if n := len(slices.DeleteFunc(tasks, func(task todo.Task) bool { return task.Content != "retried" })); n != 1 {
+		t.Fatalf("test_caldav: case retried creation: expected a single task, actualCount=%d", n)
+	}
+
+	// credentials are checked on every request, so a changed password locks out the old one at once
+	u, err := userRepo.Register(context.Background(), user.UserRequest{Email: "caldav@test.com", Password: "before"})
+	if err != nil {
+		t.Fatalf("test_caldav: failed to register user, error=%s", err.Error())
+	}
+	propfind := func(password string) int {
+		req := httptest.NewRequest("PROPFIND", "/dav/calendars/"+u.ID+"/", nil)
+		req.SetBasicAuth(u.Email, password)
+		rc := httptest.NewRecorder()
+		server.ServeHTTP(rc, req)
+		return rc.Code
+	}
+	if code := propfind("before"); code != http.StatusMultiStatus {
+		t.Fatalf("test_caldav: case before password change: expectedStatusCode=%d, actualStatusCode=%d", http.StatusMultiStatus, code)
+	}
+	if _, err := dbPool.Exec(context.Background(), "UPDATE users SET password = (SELECT password FROM users WHERE id = 'test2') WHERE id = $1", u.ID); err != nil {
+		t.Fatalf("test_caldav: failed to change password, error=%s", err.Error())
+	}
+	if code := propfind("before"); code != http.StatusUnauthorized {
+		t.Fatalf("test_caldav: case old password: expectedStatusCode=%d, actualStatusCode=%d", http.StatusUnauthorized, code)
+	}
+	if code := propfind("test2"); code != http.StatusMultiStatus {
+		t.Fatalf("test_caldav: case new password: expectedStatusCode=%d, actualStatusCode=%d", http.StatusMultiStatus, code)
+	}
+}
+
+func TestTodoTxt(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+	file := "(A) 2024-01-02 Buy seeds +garden due:2024-03-01\n" +
+		"x 2024-02-10 2024-01-05 Water plants @errands pri:B\n" +
+		"\n" +
+		"Fix fence due:someday\n" +
+		"Rake leaves\n"
+
+	// importFile posts the file to the import endpoint, into the list todoID or into a new one when it is empty
+	importFile := func(name, todoID string, query map[string]string) (*httptest.ResponseRecorder, todo.ImportResult) {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, name, "/import", http.MethodPost, "", query, nil)
+		req.Body = io.NopCloser(strings.NewReader(file))
+		req.Header.Set("Content-Type", "text/plain")
+		req.SetPathValue("id", todoID)
+		todo.HandleImport(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		var result todo.ImportResult
+		if rc.Code == http.StatusOK || rc.Code == http.StatusCreated {
+			if err := json.NewDecoder(rc.Body).Decode(&result); err != nil {
+				t.Fatalf("test_todotxt: case %s: failed to decode result, error=%s", name, err.Error())
+			}
+		}
+		return rc, result
+	}
+
+	rc, result := importFile("dry run", "", map[string]string{"format": "todotxt", "name": "garden", "dry_run": "true"})
+	if rc.Code != http.StatusOK || !result.DryRun || result.TodoID != "" || result.Created != 3 || len(result.Tasks) != 3 {
+		t.Fatalf("test_todotxt: case dry run: expectedStatusCode=%d, actualStatusCode=%d, actualResult=%+v", http.StatusOK, rc.Code, result)
+	}
+	if len(result.Skipped) != 1 || result.Skipped[0].Line != 4 {
+		t.Fatalf("test_todotxt: case dry run: expected line 4 to be skipped, actualSkipped=%+v", result.Skipped)
+	}
+	if !slices.Contains(result.NewTags, "garden") || !slices.Contains(result.NewTags, "@errands") {
+		t.Fatalf("test_todotxt: case dry run: expected the tags to be reported as new, actualNewTags=%v", result.NewTags)
+	}
+	tags, _, err := tagRepo.GetByUserID(ctx, "test1", 100, 1)
+	if err != nil || slices.ContainsFunc(tags, func(s tag.Summary) bool { return s.Name == "garden" }) {
+		t.Fatalf("test_todotxt: case dry run: expected no tag to be created, actualTags=%+v, error=%v", tags, err)
+	}
+
+	if rc, _ := importFile("unknown format", "", map[string]string{"format": "docx", "name": "garden"}); rc.Code != http.StatusBadRequest {
+		t.Fatalf("test_todotxt: case unknown format: expectedStatusCode=%d, actualStatusCode=%d", http.StatusBadRequest, rc.Code)
+	}
+
+	rc, result = importFile("import", "", map[string]string{"format": "todotxt", "name": "garden"})
+	if rc.Code != http.StatusCreated || result.DryRun || result.TodoID == "" || result.Created != 3 || len(result.Tasks) != 0 {
+		t.Fatalf("test_todotxt: case import: expectedStatusCode=%d, actualStatusCode=%d, actualResult=%+v", http.StatusCreated, rc.Code, result)
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test1", result.TodoID, todo.Filter{})
+	if err != nil || len(tasks) != 3 {
+		t.Fatalf("test_todotxt: case import: expected 3 tasks, actualResult=%+v, error=%v", tasks, err)
+	}
+	due := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	if tasks[0].Content != "Buy seeds" || tasks[0].Priority != todo.PriorityUrgent || tasks[0].DueAt == nil || !tasks[0].DueAt.Equal(due) ||
+		len(tasks[0].Tags) != 1 || tasks[0].Tags[0].Name != "garden" {
+		t.Fatalf("test_todotxt: case import: unexpected first task, actualResult=%+v", tasks[0])
+	}
+	if !tasks[1].Done || tasks[1].Priority != todo.PriorityHigh || len(tasks[1].Tags) != 1 || tasks[1].Tags[0].Name != "@errands" {
+		t.Fatalf("test_todotxt: case import: unexpected second task, actualResult=%+v", tasks[1])
+	}
+
+	rc, second := importFile("import into list", result.TodoID, map[string]string{"format": "todotxt"})
+	if rc.Code != http.StatusOK || second.TodoID != result.TodoID || second.Created != 3 || len(second.NewTags) != 0 {
+		t.Fatalf("test_todotxt: case import into list: expectedStatusCode=%d, actualStatusCode=%d, actualResult=%+v", http.StatusOK, rc.Code, second)
+	}
+
+	rc = httptest.NewRecorder()
+	req := TestRequest(t, "export", "/"+result.TodoID+"/export", http.MethodGet, "", map[string]string{"format": "todotxt"}, nil)
+	req.SetPathValue("id", result.TodoID)
+	todo.HandleExport(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+	if rc.Code != http.StatusOK || rc.Header().Get("Content-Type") != todotxt.ContentType {
+		t.Fatalf("test_todotxt: case export: expectedStatusCode=%d, actualStatusCode=%d, actualContentType=%s", http.StatusOK, rc.Code, rc.Header().Get("Content-Type"))
+	}
+	lines := strings.Split(strings.TrimSuffix(rc.Body.String(), "\n"), "\n")
+	if len(lines) != 6 || lines[0] != "(A) 2024-01-02 Buy seeds +garden due:2024-03-01" ||
+		lines[1] != "x 2024-02-10 2024-01-05 Water plants @errands pri:B" || !strings.HasSuffix(lines[2], " Rake leaves") {
+		t.Fatalf("test_todotxt: case export: unexpected file, actualBody=%s", rc.Body.String())
+	}
+
+	// a line too long to be read is skipped like any other invalid line
+	file = "Sow beans\n" + strings.Repeat("long ", todotxt.MaxLineLength/5+1) + "\nHarvest\n"
+	rc, result = importFile("long line", "", map[string]string{"format": "todotxt", "name": "long", "dry_run": "true"})
+	if rc.Code != http.StatusOK || result.Created != 2 || len(result.Skipped) != 1 || result.Skipped[0].Line != 2 {
+		t.Fatalf("test_todotxt: case long line: expected line 2 to be skipped, actualStatusCode=%d, actualResult=%+v", rc.Code, result)
+	}
+
+	// descriptions which would read as a marker, a priority or a date are escaped, and read back the same
+	for _, description := range []string{"x marks the spot", "(A) list", "2024-05-05 meeting", `\escaped`} {
+		line := todotxt.Task{Description: description}.String()
+		if parsed := todotxt.Parse(line); parsed.Description != description || parsed.Done || parsed.Priority != 0 || parsed.CreatedAt != nil {
+			t.Fatalf("test_todotxt: case escaped description: expected %q to read back the same, actualLine=%q, actualResult=%+v", description, line, parsed)
+		}
+	}
+}
+
+func TestCSVAndMarkdown(t *testing.T) {
+	ctx := context.WithValue(context.Background(), web.UserID, "test1")
+
+	// importFile posts the file to the import endpoint, into the list todoID or into a new one when it is empty
+	importFile := func(name, todoID, file string, query map[string]string) (*httptest.ResponseRecorder, todo.ImportResult) {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, name, "/import", http.MethodPost, "", query, nil)
+		req.Body = io.NopCloser(strings.NewReader(file))
+		req.SetPathValue("id", todoID)
+		todo.HandleImport(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		var result todo.ImportResult
+		if rc.Code == http.StatusOK || rc.Code == http.StatusCreated {
+			if err := json.NewDecoder(rc.Body).Decode(&result); err != nil {
+				t.Fatalf("test_csv_and_markdown: case %s: failed to decode result, error=%s", name, err.Error())
+			}
+		}
+		return rc, result
+	}
+	// export downloads the list in the format
+	export := func(name, todoID, format string) string {
+		rc := httptest.NewRecorder()
+		req := TestRequest(t, name, "/"+todoID+"/export", http.MethodGet, "", map[string]string{"format": format}, nil)
+		req.SetPathValue("id", todoID)
+		todo.HandleExport(logger, todoRepo).ServeHTTP(rc, req.WithContext(ctx))
+		if rc.Code != http.StatusOK {
+			t.Fatalf("test_csv_and_markdown: case %s: expectedStatusCode=%d, actualStatusCode=%d", name, http.StatusOK, rc.Code)
+		}
+		return rc.Body.String()
+	}
+
+	checklist := "# Release\n\n" +
+		"- [ ] write notes\n" +
+		"  - [x] collect changes\n" +
+		"- [X] tag version\n" +
+		"- [ ]\n" +
+		"```\n- [ ] not a task\n```\n"
+	rc, result := importFile("import markdown", "", checklist, map[string]string{"format": "markdown", "name": "release"})
+	if rc.Code != http.StatusCreated || result.Created != 3 || len(result.Skipped) != 1 || result.Skipped[0].Line != 6 {
+		t.Fatalf("test_csv_and_markdown: case import markdown: expectedStatusCode=%d, actualStatusCode=%d, actualResult=%+v", http.StatusCreated, rc.Code, result)
+	}
+	tasks, err := todoRepo.GetTasks(ctx, "test1", result.TodoID, todo.Filter{})
+	if err != nil || len(tasks) != 2 || tasks[0].Content != "write notes" || tasks[0].Done || len(tasks[0].Subtasks) != 1 ||
+		!tasks[0].Subtasks[0].Done || tasks[1].Content != "tag version" || !tasks[1].Done {
+		t.Fatalf("test_csv_and_markdown: case import markdown: unexpected tasks, actualResult=%+v, error=%v", tasks, err)
+	}
+
+	expected := "- [ ] write notes\n  - [x] collect changes\n- [x] tag version\n"
+	if body := export("export markdown", result.TodoID, "markdown"); body != expected {
+		t.Fatalf("test_csv_and_markdown: case export markdown: expectedBody=%q, actualBody=%q", expected, body)
+	}
+
+	sheet := "Task,Done,Priority,Due_at,Tags\n" +
+		"publish,no,high,2030-01-02,\"release, web\"\n" +
+		"announce,yes,,,\n" +
+		"celebrate,,someday,,\n"
+	rc, second := importFile("import csv", result.TodoID, sheet, map[string]string{"format": "csv"})
+	if rc.Code != http.StatusOK || second.Created != 2 || len(second.Skipped) != 1 || second.Skipped[0].Line != 4 {
+		t.Fatalf("test_csv_and_markdown: case import csv: expectedStatusCode=%d, actualStatusCode=%d, actualResult=%+v", http.StatusOK, rc.Code, second)
+	}
+
+	if err := todoRepo.CreateTask(ctx, "test1", todo.Task{TodoID: result.TodoID, Content: "=HYPERLINK(\"http://example.com\")"}); err != nil {
+		t.Fatalf("test_csv_and_markdown: failed to create task, error=%s", err.Error())
+	}
+
+	file := export("export csv", result.TodoID, "csv")
+	lines := strings.Split(strings.TrimSuffix(file, "\n"), "\n")
+	if len(lines) != 7 || lines[0] != "content,done,priority,due_at,created_at,completed_at,tags,depth" ||
+		!strings.HasPrefix(lines[1], "write notes,false,none,,") || !strings.HasPrefix(lines[2], "collect changes,true,") ||
+		!strings.HasSuffix(lines[2], ",1") || !strings.HasPrefix(lines[4], "publish,false,high,2030-01-02T00:00:00Z,") ||
+		!strings.HasSuffix(lines[4], `,"release,web",0`) || !strings.HasPrefix(lines[5], "announce,true,none,,") ||
+		!strings.HasPrefix(lines[6], `"'=HYPERLINK(""http://example.com"")",`) {
+		t.Fatalf("test_csv_and_markdown: case export csv: unexpected file, actualLines=%q", lines)
+	}
+
+	// an exported file imports back the same, subtasks and formulas included
+	rc, copied := importFile("reimport csv", "", file, map[string]string{"format": "csv", "name": "copy"})
+	if rc.Code != http.StatusCreated || copied.Created != 6 || copied.SkippedCount != 0 {
+		t.Fatalf("test_csv_and_markdown: case reimport csv: expectedStatusCode=%d, actualStatusCode=%d, actualResult=%+v", http.StatusCreated, rc.Code, copied)
+	}
+	tasks, err = todoRepo.GetTasks(ctx, "test1", copied.TodoID, todo.Filter{})
+	if err != nil || len(tasks) != 5 || len(tasks[0].Subtasks) != 1 || tasks[0].Subtasks[0].Content != "collect changes" ||
+		tasks[4].Content != "=HYPERLINK(\"http://example.com\")" {
+		t.Fatalf("test_csv_and_markdown: case reimport csv: unexpected tasks, actualResult=%+v, error=%v", tasks, err)
+	}
+
+	// a dry run lists only the first tasks of a large file
+	rc, preview := importFile("large dry run", "", strings.Repeat("- [ ] item\n", 150), map[string]string{"format": "markdown", "name": "large", "dry_run": "true"})
+	if rc.Code != http.StatusOK || preview.Created != 150 || len(preview.Tasks) != 100 {
+		t.Fatalf("test_csv_and_markdown: case large dry run: expected 150 tasks with 100 listed, actualStatusCode=%d, actualCreated=%d, actualListed=%d", rc.Code, preview.Created, len(preview.Tasks))
+	}
+}
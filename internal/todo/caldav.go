@@ -0,0 +1,701 @@
+package todo
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/akalpaki/todo/pkg/dav"
+	"github.com/akalpaki/todo/pkg/ical"
+	"github.com/akalpaki/todo/pkg/web"
+)
+
+const (
+	// davRealm is the realm CalDAV clients are asked for credentials for.
+	davRealm  = "todo"
+	davProdID = "-//akalpaki//todo//EN"
+	// davUIDDomain makes the UIDs of tasks not created through CalDAV globally unique, as iCalendar requires.
+	davUIDDomain = "@todo"
+	// davSyncTokenPrefix turns delta sync tokens into the URIs sync-collection expects.
+	davSyncTokenPrefix = "urn:x-todo:sync:"
+	davContentType     = "text/calendar; charset=utf-8; component=vtodo"
+)
+
+// Properties of the CalDAV resources.
+var (
+	davResourceType       = xml.Name{Space: dav.NS, Local: "resourcetype"}
+	davDisplayName        = xml.Name{Space: dav.NS, Local: "displayname"}
+	davPrincipal          = xml.Name{Space: dav.NS, Local: "current-user-principal"}
+	davPrincipalURL       = xml.Name{Space: dav.NS, Local: "principal-URL"}
+	davOwner              = xml.Name{Space: dav.NS, Local: "owner"}
+	davPrivileges         = xml.Name{Space: dav.NS, Local: "current-user-privilege-set"}
+	davReports            = xml.Name{Space: dav.NS, Local: "supported-report-set"}
+	davSyncToken          = xml.Name{Space: dav.NS, Local: "sync-token"}
+	davETag               = xml.Name{Space: dav.NS, Local: "getetag"}
+	davContentTypeProp    = xml.Name{Space: dav.NS, Local: "getcontenttype"}
+	davCalendarHome       = xml.Name{Space: dav.CalDAVNS, Local: "calendar-home-set"}
+	davCalendarComponents = xml.Name{Space: dav.CalDAVNS, Local: "supported-calendar-component-set"}
+	davCalendarData       = xml.Name{Space: dav.CalDAVNS, Local: "calendar-data"}
+	davCTag               = xml.Name{Space: dav.CalendarServerNS, Local: "getctag"}
+)
+
+// Reports and preconditions.
+var (
+	davCalendarQuery    = xml.Name{Space: dav.CalDAVNS, Local: "calendar-query"}
+	davCalendarMultiget = xml.Name{Space: dav.CalDAVNS, Local: "calendar-multiget"}
+	davSyncCollection   = xml.Name{Space: dav.NS, Local: "sync-collection"}
+	davValidSyncToken   = xml.Name{Space: dav.NS, Local: "valid-sync-token"}
+	davSupportedReport  = xml.Name{Space: dav.NS, Local: "supported-report"}
+	davSupportedComp    = xml.Name{Space: dav.CalDAVNS, Local: "supported-calendar-component"}
+)
+
+// davCalendar is a todo list, as a CalDAV calendar. Its version is the calendar's ctag.
+type davCalendar struct {
+	ID      string
+	Name    string
+	Version int64
+}
+
+// davResource is a task, as the VTODO resource of a CalDAV calendar. Name is the last segment of its URL and UID the
+// UID of its VTODO. ParentUID is the UID of its parent task, if any. Deleted marks the resources sync-collection
+// reports as removed, which only carry a Name.
+type davResource struct {
+	Task
+	Name        string
+	UID         string
+	ParentUID   *string
+	CompletedAt *time.Time
+	Deleted     bool
+}
+
+// davHrefs builds the URLs of the CalDAV resources under root, the path CalDAVRoutes is mounted at.
+type davHrefs string
+
+func (h davHrefs) principal(userID string) string {
+	return string(h) + "/principals/" + url.PathEscape(userID) + "/"
+}
+
+func (h davHrefs) home(userID string) string {
+	return string(h) + "/calendars/" + url.PathEscape(userID) + "/"
+}
+
+func (h davHrefs) calendar(userID, todoID string) string {
+	return h.home(userID) + url.PathEscape(todoID) + "/"
+}
+
+func (h davHrefs) resource(userID, todoID, name string) string {
+	return h.calendar(userID, todoID) + url.PathEscape(name)
+}
+
+// CalDAVRoutes returns the CalDAV server, which exposes the active todo lists of a user as calendars and their tasks
+// as VTODO resources, to be mounted at root. Calendar apps cannot get a token, so they authenticate with the email and
+// password of the user over HTTP Basic authentication instead.
+//
+// The principal of a user is at /principals/{user}/, and their calendars at /calendars/{user}/{todo_id}/.
+func CalDAVRoutes(logger *slog.Logger, repository *Repository, authenticate web.Authenticator, root string) http.Handler {
+	mux := http.NewServeMux()
+	auth := web.BasicAuth(authenticate, davRealm)
+	hrefs := davHrefs(strings.TrimSuffix(root, "/"))
+
+	mux.HandleFunc("OPTIONS /", web.Access(HandleDAVOptions(), logger))
+	mux.HandleFunc("PROPFIND /{$}", web.Access(auth(HandleDAVRoot(logger, hrefs)), logger))
+	mux.HandleFunc("PROPFIND /principals/{user}/{$}", web.Access(auth(HandleDAVPrincipal(logger, hrefs)), logger))
+	mux.HandleFunc("PROPFIND /calendars/{user}/{$}", web.Access(auth(HandleDAVHome(logger, repository, hrefs)), logger))
+	mux.HandleFunc("PROPFIND /calendars/{user}/{todo_id}/{$}", web.Access(auth(HandleDAVCalendar(logger, repository, hrefs)), logger))
+	mux.HandleFunc("REPORT /calendars/{user}/{todo_id}/{$}", web.Access(auth(HandleDAVReport(logger, repository, hrefs)), logger))
+	mux.HandleFunc("PROPFIND /calendars/{user}/{todo_id}/{name}", web.Access(auth(HandleDAVResource(logger, repository, hrefs)), logger))
+	mux.HandleFunc("GET /calendars/{user}/{todo_id}/{name}", web.Access(auth(HandleDAVGet(logger, repository)), logger))
+	mux.HandleFunc("PUT /calendars/{user}/{todo_id}/{name}", web.Access(auth(HandleDAVPut(logger, repository)), logger))
+	mux.HandleFunc("DELETE /calendars/{user}/{todo_id}/{name}", web.Access(auth(HandleDAVDelete(logger, repository)), logger))
+
+	return mux
+}
+
+// HandleDAVOptions advertises the DAV features supported by the server.
+func HandleDAVOptions() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("DAV", "1, 3, calendar-access")
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// HandleDAVRoot answers the PROPFIND clients start the discovery of the principal of the user with.
+func HandleDAVRoot(logger *slog.Logger, hrefs davHrefs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		req, ok := readDAVRequest(logger, w, r)
+		if !ok {
+			return
+		}
+
+		props := []dav.Property{
+			dav.Empty(davResourceType, xml.Name{Space: dav.NS, Local: "collection"}),
+			dav.Href(davPrincipal, hrefs.principal(userID)),
+		}
+		writeMultistatus(logger, w, dav.Multistatus{Responses: []dav.Response{dav.Select(string(hrefs)+"/", props, req)}})
+	}
+}
+
+// HandleDAVPrincipal describes the principal of the user, pointing to their calendars.
+func HandleDAVPrincipal(logger *slog.Logger, hrefs davHrefs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := davUser(logger, w, r)
+		if !ok {
+			return
+		}
+
+		req, ok := readDAVRequest(logger, w, r)
+		if !ok {
+			return
+		}
+
+		props := []dav.Property{
+			dav.Empty(davResourceType, xml.Name{Space: dav.NS, Local: "principal"}),
+			dav.Href(davPrincipal, hrefs.principal(userID)),
+			dav.Href(davPrincipalURL, hrefs.principal(userID)),
+			dav.Href(davCalendarHome, hrefs.home(userID)),
+		}
+		writeMultistatus(logger, w, dav.Multistatus{Responses: []dav.Response{dav.Select(hrefs.principal(userID), props, req)}})
+	}
+}
+
+// HandleDAVHome describes the calendar home of the user and, at depth 1, the calendars in it.
+func HandleDAVHome(logger *slog.Logger, repository *Repository, hrefs davHrefs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := davUser(logger, w, r)
+		if !ok {
+			return
+		}
+
+		req, ok := readDAVRequest(logger, w, r)
+		if !ok {
+			return
+		}
+
+		props := []dav.Property{
+			dav.Empty(davResourceType, xml.Name{Space: dav.NS, Local: "collection"}),
+			dav.Href(davPrincipal, hrefs.principal(userID)),
+			dav.Href(davOwner, hrefs.principal(userID)),
+		}
+		ms := dav.Multistatus{Responses: []dav.Response{dav.Select(hrefs.home(userID), props, req)}}
+
+		if dav.Depth(r) > 0 {
+			calendars, err := repository.davCalendars(r.Context(), userID, "")
+			if err != nil {
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve calendars", err)
+				return
+			}
+			token, err := repository.davSyncToken(r.Context())
+			if err != nil {
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve sync token", err)
+				return
+			}
+			for _, c := range calendars {
+				ms.Responses = append(ms.Responses, dav.Select(hrefs.calendar(userID, c.ID), calendarProps(hrefs, userID, c, token), req))
+			}
+		}
+
+		writeMultistatus(logger, w, ms)
+	}
+}
+
+// HandleDAVCalendar describes a calendar and, at depth 1, the resources in it.
+func HandleDAVCalendar(logger *slog.Logger, repository *Repository, hrefs davHrefs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, cal, ok := ownedCalendar(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		req, ok := readDAVRequest(logger, w, r)
+		if !ok {
+			return
+		}
+
+		token, err := repository.davSyncToken(r.Context())
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve sync token", err)
+			return
+		}
+
+		ms := dav.Multistatus{Responses: []dav.Response{dav.Select(hrefs.calendar(userID, cal.ID), calendarProps(hrefs, userID, cal, token), req)}}
+
+		if dav.Depth(r) > 0 {
+			resources, err := repository.davResources(r.Context(), cal.ID, nil)
+			if err != nil {
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
+				return
+			}
+			ms.Responses = append(ms.Responses, resourceResponses(hrefs, userID, cal.ID, resources, req)...)
+		}
+
+		writeMultistatus(logger, w, ms)
+	}
+}
+
+// HandleDAVResource describes a single resource.
+func HandleDAVResource(logger *slog.Logger, repository *Repository, hrefs davHrefs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, cal, res, ok := ownedResource(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		req, ok := readDAVRequest(logger, w, r)
+		if !ok {
+			return
+		}
+
+		writeMultistatus(logger, w, dav.Multistatus{Responses: resourceResponses(hrefs, userID, cal.ID, []davResource{res}, req)})
+	}
+}
+
+// HandleDAVReport answers the calendar-query, calendar-multiget and sync-collection reports on a calendar.
+// calendar-query only filters on the component asked for, so time ranges return every task.
+func HandleDAVReport(logger *slog.Logger, repository *Repository, hrefs davHrefs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, cal, ok := ownedCalendar(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		req, ok := readDAVRequest(logger, w, r)
+		if !ok {
+			return
+		}
+
+		var ms dav.Multistatus
+		switch req.XMLName {
+		case davCalendarQuery:
+			if !queriesTodos(req) {
+				break
+			}
+			resources, err := repository.davResources(ctx, cal.ID, nil)
+			if err != nil {
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
+				return
+			}
+			ms.Responses = resourceResponses(hrefs, userID, cal.ID, resources, req)
+		case davCalendarMultiget:
+			names := make([]string, 0, len(req.Hrefs))
+			for _, href := range req.Hrefs {
+				if name, ok := resourceName(hrefs.calendar(userID, cal.ID), href); ok {
+					names = append(names, name)
+				}
+			}
+			resources, err := repository.davResources(ctx, cal.ID, names)
+			if err != nil {
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
+				return
+			}
+			ms.Responses = resourceResponses(hrefs, userID, cal.ID, resources, req)
+			for _, href := range req.Hrefs {
+				name, ok := resourceName(hrefs.calendar(userID, cal.ID), href)
+				if !ok || !slices.ContainsFunc(resources, func(res davResource) bool { return res.Name == name }) {
+					ms.Responses = append(ms.Responses, dav.Response{Href: href, Status: http.StatusNotFound})
+				}
+			}
+		case davSyncCollection:
+			since := ""
+			if req.SyncToken != "" {
+				token, ok := strings.CutPrefix(req.SyncToken, davSyncTokenPrefix)
+				if !ok {
+					writeDAVError(logger, w, http.StatusForbidden, davValidSyncToken)
+					return
+				}
+				since = token
+			}
+			resources, token, err := repository.davChanges(ctx, cal.ID, since)
+			if err != nil {
+				switch err {
+				case errInvalidSyncToken, errSyncTokenExpired:
+					writeDAVError(logger, w, http.StatusForbidden, davValidSyncToken)
+					return
+				default:
+					web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve changes", err)
+					return
+				}
+			}
+			ms.Responses = resourceResponses(hrefs, userID, cal.ID, resources, req)
+			ms.SyncToken = davSyncTokenPrefix + token
+		default:
+			writeDAVError(logger, w, http.StatusForbidden, davSupportedReport)
+			return
+		}
+
+		writeMultistatus(logger, w, ms)
+	}
+}
+
+// HandleDAVGet returns the iCalendar object of a resource.
+func HandleDAVGet(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, _, res, ok := ownedResource(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		etag := web.ETag(res.Version)
+		if web.NotModified(r, etag) {
+			web.WriteNotModified(w, etag)
+			return
+		}
+
+		var body bytes.Buffer
+		if err := writeDAVResource(&body, res, time.Now()); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", davContentType)
+		w.Header().Set("ETag", etag)
+		w.WriteHeader(http.StatusOK)
+		if _, err := body.WriteTo(w); err != nil {
+			logger.Error("failed to write resource", "error", err)
+		}
+	}
+}
+
+// HandleDAVPut creates or updates the task of a resource out of the VTODO in the request. The summary, status,
+// due date, priority and recurrence rule of the VTODO are kept; its parent, given by RELATED-TO, only when the task is
+// created. If-Match makes the update conditional on the ETag of the resource, and If-None-Match: * only creates it.
+func HandleDAVPut(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, cal, ok := ownedCalendar(logger, w, r, repository)
+		if !ok {
+			return
+		}
+		name := r.PathValue("name")
+
+		if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "text/calendar" {
+			web.ErrorResponse(logger, w, r, http.StatusUnsupportedMediaType, "the content type must be text/calendar", err)
+			return
+		}
+
+		object, err := ical.Parse(r.Body)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid icalendar data", err)
+			return
+		}
+		component, ok := object.Find("VTODO")
+		if !ok {
+			writeDAVError(logger, w, http.StatusForbidden, davSupportedComp)
+			return
+		}
+		vtodo, err := ical.ParseTodo(component)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid icalendar data", err)
+			return
+		}
+
+		existing, err := repository.davResource(ctx, cal.ID, name)
+		created := errors.Is(err, errNotFound)
+		if err != nil && !created {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve task", err)
+			return
+		}
+
+		if created {
+			if r.Header.Get("If-Match") != "" {
+				web.ErrorResponse(logger, w, r, http.StatusPreconditionFailed, "the task does not exist", errNotFound)
+				return
+			}
+			task := applyVTODO(Task{TodoID: cal.ID}, vtodo)
+			if !task.Valid() {
+				web.ErrorResponse(logger, w, r, http.StatusBadRequest, "the task needs a summary", ical.ErrInvalid)
+				return
+			}
+			err := repository.createDAVResource(ctx, userID, task, name, vtodo.UID, vtodo.RelatedTo)
+			switch {
+			case errors.Is(err, errDAVResourceExists):
+				// another request created the resource in the meantime, and this one updates it instead
+				if existing, err = repository.davResource(ctx, cal.ID, name); err != nil {
+					web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve task", err)
+					return
+				}
+				created = false
+			case err != nil:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to create task", err)
+				return
+			}
+		}
+		if !created {
+			if r.Header.Get("If-None-Match") == "*" {
+				web.ErrorResponse(logger, w, r, http.StatusPreconditionFailed, "the task already exists", errVersionMismatch)
+				return
+			}
+			task := applyVTODO(existing.Task, vtodo)
+			if !task.Valid() {
+				web.ErrorResponse(logger, w, r, http.StatusBadRequest, "the task needs a summary", ical.ErrInvalid)
+				return
+			}
+			if err := repository.UpdateTask(ctx, userID, task.TodoID, task, web.IfMatch(r)); err != nil {
+				switch err {
+				case errNotFound:
+					web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+					return
+				case errVersionMismatch:
+					web.ErrorResponse(logger, w, r, http.StatusPreconditionFailed, "the task has changed", err)
+					return
+				default:
+					web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update task", err)
+					return
+				}
+			}
+		}
+
+		res, err := repository.davResource(ctx, cal.ID, name)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve task", err)
+			return
+		}
+		w.Header().Set("ETag", web.ETag(res.Version))
+		if created {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HandleDAVDelete moves the task of a resource, along with its subtasks, to the trash. If-Match makes the deletion
+// conditional on the ETag of the resource.
+func HandleDAVDelete(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, cal, res, ok := ownedResource(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.DeleteTask(r.Context(), userID, cal.ID, res.ID, web.IfMatch(r)); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+				return
+			case errVersionMismatch:
+				web.ErrorResponse(logger, w, r, http.StatusPreconditionFailed, "the task has changed", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to delete task", err)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// davUser returns the caller, making sure the user path value names them.
+// When it returns false an error response has already been written.
+func davUser(logger *slog.Logger, w http.ResponseWriter, r *http.Request) (string, bool) {
+	userID, ok := r.Context().Value(web.UserID).(string)
+	if !ok {
+		web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+		return "", false
+	}
+	if r.PathValue("user") != userID {
+		web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", web.ErrInvalidUserID)
+		return "", false
+	}
+	return userID, true
+}
+
+// ownedCalendar loads the calendar of the todo list named by the todo_id path value, among the caller's.
+// When it returns false an error response has already been written.
+func ownedCalendar(logger *slog.Logger, w http.ResponseWriter, r *http.Request, repository *Repository) (string, davCalendar, bool) {
+	userID, ok := davUser(logger, w, r)
+	if !ok {
+		return "", davCalendar{}, false
+	}
+
+	cal, err := repository.davCalendar(r.Context(), userID, r.PathValue("todo_id"))
+	if err != nil {
+		switch err {
+		case errNotFound:
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "calendar not found", err)
+			return "", davCalendar{}, false
+		default:
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve calendar", err)
+			return "", davCalendar{}, false
+		}
+	}
+	return userID, cal, true
+}
+
+// ownedResource loads the resource named by the name path value, in a calendar of the caller.
+// When it returns false an error response has already been written.
+func ownedResource(logger *slog.Logger, w http.ResponseWriter, r *http.Request, repository *Repository) (string, davCalendar, davResource, bool) {
+	userID, cal, ok := ownedCalendar(logger, w, r, repository)
+	if !ok {
+		return "", davCalendar{}, davResource{}, false
+	}
+
+	res, err := repository.davResource(r.Context(), cal.ID, r.PathValue("name"))
+	if err != nil {
+		switch err {
+		case errNotFound:
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+			return "", davCalendar{}, davResource{}, false
+		default:
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve task", err)
+			return "", davCalendar{}, davResource{}, false
+		}
+	}
+	return userID, cal, res, true
+}
+
+// readDAVRequest reads the body of a PROPFIND or REPORT request.
+// When it returns false an error response has already been written.
+func readDAVRequest(logger *slog.Logger, w http.ResponseWriter, r *http.Request) (dav.Request, bool) {
+	req, err := dav.ReadRequest(r)
+	if err != nil {
+		web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid xml body", err)
+		return dav.Request{}, false
+	}
+	return req, true
+}
+
+func writeMultistatus(logger *slog.Logger, w http.ResponseWriter, ms dav.Multistatus) {
+	if err := ms.Write(w); err != nil {
+		logger.Error("failed to write multistatus", "error", err)
+	}
+}
+
+func writeDAVError(logger *slog.Logger, w http.ResponseWriter, status int, condition xml.Name) {
+	if err := dav.WriteError(w, status, condition); err != nil {
+		logger.Error("failed to write dav error", "error", err)
+	}
+}
+
+// calendarProps returns the properties of a calendar, token being the current sync token.
+func calendarProps(hrefs davHrefs, userID string, cal davCalendar, token string) []dav.Property {
+	return []dav.Property{
+		dav.Empty(davResourceType, xml.Name{Space: dav.NS, Local: "collection"}, xml.Name{Space: dav.CalDAVNS, Local: "calendar"}),
+		dav.Text(davDisplayName, cal.Name),
+		dav.Href(davPrincipal, hrefs.principal(userID)),
+		dav.Href(davOwner, hrefs.principal(userID)),
+		{Name: davCalendarComponents, Value: `<c:comp name="VTODO"/>`},
+		{Name: davReports, Value: `<d:supported-report><d:report><c:calendar-query/></d:report></d:supported-report>` +
+			`<d:supported-report><d:report><c:calendar-multiget/></d:report></d:supported-report>` +
+			`<d:supported-report><d:report><d:sync-collection/></d:report></d:supported-report>`},
+		{Name: davPrivileges, Value: `<d:privilege><d:read/></d:privilege><d:privilege><d:write/></d:privilege>` +
+			`<d:privilege><d:write-content/></d:privilege><d:privilege><d:bind/></d:privilege><d:privilege><d:unbind/></d:privilege>`},
+		dav.Text(davETag, web.ETag(cal.Version)),
+		dav.Text(davCTag, web.ETag(cal.Version)),
+		dav.Text(davSyncToken, davSyncTokenPrefix+token),
+	}
+}
+
+// resourceResponses returns the responses for resources of a calendar, with their iCalendar objects when asked for.
+// Deleted resources are reported as gone.
+func resourceResponses(hrefs davHrefs, userID, todoID string, resources []davResource, req dav.Request) []dav.Response {
+	now := time.Now()
+	responses := make([]dav.Response, 0, len(resources))
+	for _, res := range resources {
+		href := hrefs.resource(userID, todoID, res.Name)
+		if res.Deleted {
+			responses = append(responses, dav.Response{Href: href, Status: http.StatusNotFound})
+			continue
+		}
+
+		props := []dav.Property{
+			dav.Empty(davResourceType),
+			dav.Text(davETag, web.ETag(res.Version)),
+			dav.Text(davContentTypeProp, davContentType),
+		}
+		// calendar-data is left out of allprop, as it is the whole resource
+		if req.Prop.Contains(davCalendarData) {
+			var data strings.Builder
+			if err := writeDAVResource(&data, res, now); err == nil {
+				props = append(props, dav.Text(davCalendarData, data.String()))
+			}
+		}
+		responses = append(responses, dav.Select(href, props, req))
+	}
+	return responses
+}
+
+// writeDAVResource writes the iCalendar object of a resource.
+func writeDAVResource(w io.Writer, res davResource, now time.Time) error {
+	cal := ical.NewWriter(w)
+	cal.Begin("VCALENDAR")
+	cal.Prop("VERSION", "2.0")
+	cal.Prop("PRODID", davProdID)
+
+	vtodo := ical.Todo{
+		UID:         res.UID,
+		Summary:     res.Content,
+		Due:         res.DueAt,
+		Priority:    res.Priority.ICalPriority(),
+		Completed:   res.Done,
+		CompletedAt: res.CompletedAt,
+		Sequence:    res.Version,
+	}
+	if res.Recurrence != nil {
+		vtodo.Recurrence = *res.Recurrence
+	}
+	if res.ParentUID != nil {
+		vtodo.RelatedTo = *res.ParentUID
+	}
+	cal.Todo(vtodo, now)
+
+	cal.End("VCALENDAR")
+	return cal.Err()
+}
+
+// applyVTODO returns task with the fields a VTODO carries overwritten by it.
+func applyVTODO(task Task, vtodo ical.Todo) Task {
+	task.Content = vtodo.Summary
+	task.Done = vtodo.Completed
+	task.Priority = PriorityFromICal(vtodo.Priority)
+	task.DueAt = vtodo.Due
+	task.Recurrence = nil
+	if vtodo.Recurrence != "" {
+		task.Recurrence = &vtodo.Recurrence
+	}
+	return task
+}
+
+// queriesTodos reports whether a calendar-query asks for to-dos, rather than only for other components.
+func queriesTodos(req dav.Request) bool {
+	if req.Filter == nil || len(req.Filter.Comp.Comps) == 0 {
+		return true
+	}
+	for _, c := range req.Filter.Comp.Comps {
+		if strings.EqualFold(c.Name, "VTODO") {
+			return true
+		}
+	}
+	return false
+}
+
+// resourceName returns the name of the resource an href of a multiget points to, provided it is in the calendar.
+func resourceName(calendarHref, href string) (string, bool) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", false
+	}
+	if path.Dir(u.Path)+"/" != calendarHref {
+		return "", false
+	}
+	return path.Base(u.Path), true
+}
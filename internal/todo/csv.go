@@ -0,0 +1,202 @@
+package todo
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvColumns are the columns of exported CSV files, which imported files can have in any order.
+var csvColumns = []string{"content", "done", "priority", "due_at", "created_at", "completed_at", "tags", "depth"}
+
+// formulaPrefixes are the characters spreadsheets take a cell starting with as a formula. Exported cells starting
+// with one of them, or with a quote, are escaped by a quote, which spreadsheets read as the start of a text cell and
+// which is dropped on import.
+const formulaPrefixes = "=+-@\t\r'"
+
+// CSV is the comma-separated values format of spreadsheets: a header naming the columns, then one task per row.
+// Imported files need a content column, which can also be called task or title, and can leave out the other ones or
+// add more, which are ignored; a file without a header is read one task per row out of its first column. Done is
+// true, yes, x or 1, dates are RFC 3339 times or plain dates, read as midnight UTC, tags are separated by commas, and
+// depth is how deep a task is nested under the tasks before it.
+var CSV = FileFormat{
+	ContentType: "text/csv; charset=utf-8",
+	Extension:   ".csv",
+	NewReader:   newCSVReader,
+	Write:       writeCSV,
+}
+
+type csvReader struct {
+	r *csv.Reader
+	// columns maps the names of the columns to their index. It is nil until the first row has been read.
+	columns map[string]int
+}
+
+func newCSVReader(r io.Reader) ImportReader {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.LazyQuotes = true
+	cr.ReuseRecord = true
+	return &csvReader{r: cr}
+}
+
+func (r *csvReader) Next() (FileTask, error) {
+	record, err := r.r.Read()
+	var parseErr *csv.ParseError
+	if errors.As(err, &parseErr) {
+		return FileTask{}, SkippedLine{Line: parseErr.StartLine, Reason: parseErr.Err.Error()}
+	}
+	if err != nil {
+		return FileTask{}, err
+	}
+
+	if r.columns == nil {
+		if r.columns = csvHeader(record); r.columns != nil {
+			return r.Next()
+		}
+		r.columns = map[string]int{"content": 0}
+	}
+
+	line, _ := r.r.FieldPos(0)
+	task := FileTask{Line: line, Content: r.field(record, "content"), Tags: make([]string, 0)}
+	switch strings.ToLower(r.field(record, "done")) {
+	case "true", "yes", "x", "1":
+		task.Done = true
+	}
+	if priority := strings.ToLower(r.field(record, "priority")); priority != "" {
+		i := slices.Index(priorityNames, priority)
+		if i < 0 {
+			return FileTask{}, SkippedLine{Line: line, Reason: fmt.Sprintf("invalid priority %q", priority)}
+		}
+		task.Priority = Priority(i)
+	}
+	if task.DueAt, err = r.timeField(record, "due_at", line); err != nil {
+		return FileTask{}, err
+	}
+	if task.CreatedAt, err = r.timeField(record, "created_at", line); err != nil {
+		return FileTask{}, err
+	}
+	if task.CompletedAt, err = r.timeField(record, "completed_at", line); err != nil {
+		return FileTask{}, err
+	}
+	for _, name := range strings.Split(r.field(record, "tags"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			task.Tags = append(task.Tags, name)
+		}
+	}
+	if depth := r.field(record, "depth"); depth != "" {
+		if task.Depth, err = strconv.Atoi(depth); err != nil {
+			return FileTask{}, SkippedLine{Line: line, Reason: fmt.Sprintf("invalid depth %q", depth)}
+		}
+	}
+	return task, nil
+}
+
+// field returns the value of the record in the named column, or an empty string when there is no such column.
+func (r *csvReader) field(record []string, column string) string {
+	i, ok := r.columns[column]
+	if !ok || i >= len(record) {
+		return ""
+	}
+	return unescapeCell(strings.TrimSpace(record[i]))
+}
+
+// timeField returns the time in the named column of the record, or a SkippedLine when it is not a valid time.
+func (r *csvReader) timeField(record []string, column string, line int) (*time.Time, error) {
+	value := r.field(record, column)
+	t, err := parseFileTime(value)
+	if err != nil {
+		return nil, SkippedLine{Line: line, Reason: fmt.Sprintf("invalid %s %q", column, value)}
+	}
+	return t, nil
+}
+
+// csvHeader returns the columns named by the first row of a file, or nil when it names no content column and so is
+// not a header.
+func csvHeader(record []string) map[string]int {
+	columns := make(map[string]int)
+	for i, name := range record {
+		// spreadsheets tend to start their files with a byte order mark
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		if name == "task" || name == "title" {
+			name = "content"
+		}
+		if _, ok := columns[name]; !ok {
+			columns[name] = i
+		}
+	}
+	if _, ok := columns["content"]; !ok {
+		return nil
+	}
+	return columns
+}
+
+// parseFileTime reads an RFC 3339 time or a plain date, which is read as midnight UTC. An empty value is no time.
+func parseFileTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if t, err = time.Parse(time.DateOnly, value); err != nil {
+			return nil, err
+		}
+	}
+	return &t, nil
+}
+
+func writeCSV(w io.Writer, tasks []FileTask) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(csvColumns); err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		record := []string{
+			t.Content,
+			strconv.FormatBool(t.Done),
+			t.Priority.String(),
+			formatFileTime(t.DueAt),
+			formatFileTime(t.CreatedAt),
+			formatFileTime(t.CompletedAt),
+			strings.Join(t.Tags, ","),
+			strconv.Itoa(t.Depth),
+		}
+		for i := range record {
+			record[i] = escapeCell(record[i])
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// escapeCell escapes a cell a spreadsheet would otherwise take as a formula.
+func escapeCell(value string) string {
+	if value != "" && strings.IndexByte(formulaPrefixes, value[0]) >= 0 {
+		return "'" + value
+	}
+	return value
+}
+
+// unescapeCell drops the quote escapeCell adds.
+func unescapeCell(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.IndexByte(formulaPrefixes, value[1]) >= 0 {
+		return value[1:]
+	}
+	return value
+}
+
+// formatFileTime writes a time as RFC 3339 in UTC, or as an empty value when there is no time.
+func formatFileTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
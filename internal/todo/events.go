@@ -0,0 +1,322 @@
+package todo
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// revisionsChannel is the Postgres notification channel every recorded revision is announced on.
+	revisionsChannel = "todo_revisions"
+	// presenceChannel is the Postgres notification channel presence changes are announced on.
+	presenceChannel = "todo_presence"
+	// presenceTTL is how long a presence is kept without being announced again.
+	presenceTTL = 90 * time.Second
+	// presenceSweepInterval is how often expired presences are dropped.
+	presenceSweepInterval = 30 * time.Second
+	// listenRetryDelay is how long the broker waits before listening again after losing its connection.
+	listenRetryDelay = 5 * time.Second
+	// subscriptionBuffer is how many revisions a subscriber can fall behind before it is dropped.
+	subscriptionBuffer = 64
+)
+
+// revisionNotification is the payload of a notification on revisionsChannel.
+// UserIDs are the users who can access the todo list: its author and its members.
+type revisionNotification struct {
+	ID      int64    `json:"id"`
+	TodoID  string   `json:"todo_id"`
+	UserIDs []string `json:"user_ids"`
+}
+
+// Subscription receives the revisions of either a single todo list or of every list a user can access.
+// Its Revisions channel is closed when the subscriber falls too far behind or the broker loses track
+// of revisions, after which the subscriber has to catch up from the history. The subscribers of a
+// single list also receive who is present on it whenever that changes.
+type Subscription struct {
+	todoID    string
+	userID    string
+	Revisions <-chan Revision
+	Presence  <-chan []Presence
+	revisions chan Revision
+	presence  chan []Presence
+}
+
+func (s *Subscription) matches(n revisionNotification) bool {
+	if s.todoID != "" {
+		return s.todoID == n.TodoID
+	}
+	return slices.Contains(n.UserIDs, s.userID)
+}
+
+// Broker fans out the revisions recorded by any server replica to the subscribers connected to this one.
+// Revisions are announced with Postgres NOTIFY when they are committed, and the broker LISTENs for them.
+type Broker struct {
+	pool   *pgxpool.Pool
+	logger *slog.Logger
+
+	mu          sync.Mutex
+	subscribers map[*Subscription]struct{}
+	// presence holds the presences of every todo list by session id.
+	presence map[string]map[string]Presence
+}
+
+func NewBroker(pool *pgxpool.Pool, logger *slog.Logger) *Broker {
+	return &Broker{
+		pool:        pool,
+		logger:      logger,
+		subscribers: make(map[*Subscription]struct{}),
+		presence:    make(map[string]map[string]Presence),
+	}
+}
+
+// Subscribe starts receiving the revisions of the todo list, or of every list the user can access when todoID is
+// empty.
+func (b *Broker) Subscribe(todoID, userID string) *Subscription {
+	revisions := make(chan Revision, subscriptionBuffer)
+	presence := make(chan []Presence, 1)
+	s := &Subscription{todoID: todoID, userID: userID, Revisions: revisions, Presence: presence, revisions: revisions, presence: presence}
+
+	b.mu.Lock()
+	b.subscribers[s] = struct{}{}
+	b.mu.Unlock()
+	return s
+}
+
+// Unsubscribe stops the subscription and closes its channel.
+func (b *Broker) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.drop(s)
+}
+
+// drop removes a subscriber. The caller must hold b.mu.
+func (b *Broker) drop(s *Subscription) {
+	if _, ok := b.subscribers[s]; ok {
+		delete(b.subscribers, s)
+		close(s.revisions)
+	}
+}
+
+// Run listens for revisions until ctx is cancelled. Whenever the connection is lost every subscriber is dropped,
+// since revisions may have been missed in the meantime.
+func (b *Broker) Run(ctx context.Context) {
+	go b.sweepPresence(ctx)
+
+	for {
+		err := b.listen(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		b.logger.Error("stopped listening for revisions", "error", err)
+
+		b.mu.Lock()
+		for s := range b.subscribers {
+			b.drop(s)
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(listenRetryDelay):
+		}
+	}
+}
+
+func (b *Broker) listen(ctx context.Context) error {
+	conn, err := b.pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire connection: %w", err)
+	}
+	defer func() {
+		conn.Exec(context.Background(), "UNLISTEN *")
+		conn.Release()
+	}()
+
+	if _, err := conn.Exec(ctx, "LISTEN "+revisionsChannel+"; LISTEN "+presenceChannel); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+
+	for {
+		n, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return fmt.Errorf("wait for notification: %w", err)
+		}
+		switch n.Channel {
+		case revisionsChannel:
+			b.dispatch(ctx, n.Payload)
+		case presenceChannel:
+			b.updatePresence(n.Payload)
+		}
+	}
+}
+
+// dispatch loads the announced revision and passes it to the interested subscribers.
+// Subscribers which cannot keep up are dropped instead of holding up the others.
+func (b *Broker) dispatch(ctx context.Context, payload string) {
+	var n revisionNotification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		b.logger.Error("invalid revision notification", "payload", payload, "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	interested := false
+	for s := range b.subscribers {
+		if s.matches(n) {
+			interested = true
+			break
+		}
+	}
+	b.mu.Unlock()
+	if !interested {
+		return
+	}
+
+	var rev Revision
+	if err := scanRevision(b.pool.QueryRow(ctx, selectRevisionQuery, n.ID), &rev); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			b.logger.Error("failed to load revision", "id", n.ID, "error", err)
+		}
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		if !s.matches(n) {
+			continue
+		}
+		select {
+		case s.revisions <- rev:
+		default:
+			b.drop(s)
+		}
+	}
+}
+
+// Announce lets every replica know about a change of presence. Presences which are not announced again
+// within presenceTTL expire.
+func (b *Broker) Announce(ctx context.Context, p Presence) error {
+	p.UpdatedAt = time.Now()
+	payload, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("encode presence: %w", err)
+	}
+	if _, err := b.pool.Exec(ctx, notifyPresenceQuery, presenceChannel, string(payload)); err != nil {
+		return fmt.Errorf("notify presence: %w", err)
+	}
+	return nil
+}
+
+// PresenceOf returns who is present on the todo list.
+func (b *Broker) PresenceOf(todoID string) []Presence {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.presenceOf(todoID)
+}
+
+// presenceOf lists the presences of a todo list by user and session. The caller must hold b.mu.
+func (b *Broker) presenceOf(todoID string) []Presence {
+	list := make([]Presence, 0, len(b.presence[todoID]))
+	for _, p := range b.presence[todoID] {
+		list = append(list, p)
+	}
+	slices.SortFunc(list, func(a, b Presence) int {
+		return cmp.Or(cmp.Compare(a.UserID, b.UserID), cmp.Compare(a.SessionID, b.SessionID))
+	})
+	return list
+}
+
+func (b *Broker) updatePresence(payload string) {
+	var p Presence
+	if err := json.Unmarshal([]byte(payload), &p); err != nil {
+		b.logger.Error("invalid presence notification", "payload", payload, "error", err)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if p.State == PresenceLeft {
+		delete(b.presence[p.TodoID], p.SessionID)
+		if len(b.presence[p.TodoID]) == 0 {
+			delete(b.presence, p.TodoID)
+		}
+	} else {
+		if b.presence[p.TodoID] == nil {
+			b.presence[p.TodoID] = make(map[string]Presence)
+		}
+		prev, ok := b.presence[p.TodoID][p.SessionID]
+		b.presence[p.TodoID][p.SessionID] = p
+		// announcements which only keep a presence alive change nothing for the subscribers
+		if ok && prev.State == p.State && equalTaskID(prev.TaskID, p.TaskID) {
+			return
+		}
+	}
+	b.publishPresence(p.TodoID)
+}
+
+// publishPresence passes the current presences of a todo list to its subscribers, replacing any
+// they have not received yet. The caller must hold b.mu.
+func (b *Broker) publishPresence(todoID string) {
+	list := b.presenceOf(todoID)
+	for s := range b.subscribers {
+		if s.todoID != todoID {
+			continue
+		}
+		select {
+		case <-s.presence:
+		default:
+		}
+		s.presence <- list
+	}
+}
+
+// sweepPresence drops the presences which have not been announced again in time, eg. because the replica
+// holding their connection went away.
+func (b *Broker) sweepPresence(ctx context.Context) {
+	ticker := time.NewTicker(presenceSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		expired := time.Now().Add(-presenceTTL)
+		b.mu.Lock()
+		for todoID, sessions := range b.presence {
+			changed := false
+			for id, p := range sessions {
+				if p.UpdatedAt.Before(expired) {
+					delete(sessions, id)
+					changed = true
+				}
+			}
+			if len(sessions) == 0 {
+				delete(b.presence, todoID)
+			}
+			if changed {
+				b.publishPresence(todoID)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+func equalTaskID(a, b *string) bool {
+	return a == nil && b == nil || a != nil && b != nil && *a == *b
+}
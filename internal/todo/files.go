@@ -0,0 +1,122 @@
+package todo
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/akalpaki/todo/pkg/web"
+)
+
+// maxImportSize is the largest file accepted by the import endpoints.
+const maxImportSize = 32 << 20
+
+var errUnknownFormat = errors.New("unknown file format")
+
+// FileFormat converts between tasks and one of the plain file formats todo lists are imported from and exported to.
+type FileFormat struct {
+	ContentType string
+	// Extension is appended to the name of a list to name the file it is exported to.
+	Extension string
+	NewReader func(r io.Reader) ImportReader
+	Write     func(w io.Writer, tasks []FileTask) error
+}
+
+// FileFormats holds the supported file formats by the name they are asked for with.
+var FileFormats = map[string]FileFormat{
+	"csv":      CSV,
+	"markdown": Markdown,
+	"todotxt":  TodoTxt,
+}
+
+// HandleExport writes the tasks of a todo list as a file in the format named by the format query parameter.
+func HandleExport(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format, ok := FileFormats[r.URL.Query().Get("format")]
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "unknown file format", errUnknownFormat)
+			return
+		}
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		tasks, err := repository.ExportTasks(r.Context(), todo.ID)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", format.ContentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": todo.Name + format.Extension}))
+		w.WriteHeader(http.StatusOK)
+		if err := format.Write(w, tasks); err != nil {
+			logger.Error("failed to write export", "error", err)
+		}
+	}
+}
+
+// HandleImport reads the request body as a file in the format named by the format query parameter, and appends its
+// tasks to the todo list named by the id path value or, without one, to a new list named by the name query parameter.
+// With dry_run=true nothing is written, and the response reports what the import would create.
+func HandleImport(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		format, ok := FileFormats[r.URL.Query().Get("format")]
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "unknown file format", errUnknownFormat)
+			return
+		}
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		var todoID, name string
+		if r.PathValue("id") != "" {
+			todo, ok := ownedTodo(logger, w, r, repository)
+			if !ok {
+				return
+			}
+			todoID = todo.ID
+		} else if name = r.URL.Query().Get("name"); name == "" {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "the new todo list needs a name", web.ErrInvalidValue)
+			return
+		}
+		dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+		body := http.MaxBytesReader(w, r.Body, maxImportSize)
+		result, err := repository.Import(ctx, userID, todoID, name, format.NewReader(body), dryRun)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			switch {
+			case errors.As(err, &tooLarge):
+				web.ErrorResponse(logger, w, r, http.StatusRequestEntityTooLarge, "the file is too large", err)
+				return
+			case errors.Is(err, errInvalidImport):
+				web.ErrorResponse(logger, w, r, http.StatusBadRequest, "the file cannot be read", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to import tasks", err)
+				return
+			}
+		}
+
+		status := http.StatusOK
+		if todoID == "" && !dryRun {
+			status = http.StatusCreated
+		}
+		if err := web.WriteJSON(w, r, status, result); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
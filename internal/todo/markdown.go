@@ -0,0 +1,139 @@
+package todo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Markdown is the GitHub-style checklist format, "- [ ] task" and "- [x] done task", nested items being subtasks.
+// Imported files can hold anything else around their checklists, such as headings and prose, which is left out, as
+// are the items of fenced code blocks. Items are read out of "-", "*", "+" and numbered lists, and nested by their
+// indentation.
+var Markdown = FileFormat{
+	ContentType: "text/markdown; charset=utf-8",
+	Extension:   ".md",
+	NewReader: func(r io.Reader) ImportReader {
+		return &markdownReader{r: bufio.NewReader(r)}
+	},
+	Write: writeMarkdown,
+}
+
+// maxMarkdownLine is the length of the longest line of an imported file a task is read from.
+const maxMarkdownLine = 1 << 20
+
+// checklistItem matches a checklist item, capturing its indentation, its mark and its text.
+var checklistItem = regexp.MustCompile(`^([ \t]*)(?:[-*+]|\d+[.)])[ \t]+\[([ xX])\](?:[ \t]+(.*))?$`)
+
+type markdownReader struct {
+	r    *bufio.Reader
+	err  error
+	line int
+	// indents holds the indentation of the items the next one can be nested under, outermost first.
+	indents []int
+	// fenced is set within a fenced code block.
+	fenced bool
+}
+
+func (r *markdownReader) Next() (FileTask, error) {
+	for r.err == nil {
+		text, tooLong, err := readLine(r.r, maxMarkdownLine)
+		r.err = err
+		if err != nil && (err != io.EOF || (text == "" && !tooLong)) {
+			break
+		}
+		r.line++
+		if tooLong {
+			if r.fenced {
+				continue
+			}
+			return FileTask{}, SkippedLine{Line: r.line, Reason: fmt.Sprintf("the line is longer than %d bytes", maxMarkdownLine)}
+		}
+		text = strings.TrimRight(text, "\r\n")
+
+		trimmed := strings.TrimSpace(text)
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			r.fenced = !r.fenced
+			continue
+		}
+		if r.fenced {
+			continue
+		}
+
+		m := checklistItem.FindStringSubmatch(text)
+		if m == nil {
+			// anything but an indented or blank line ends the lists above it
+			if trimmed != "" && text[0] != ' ' && text[0] != '\t' {
+				r.indents = nil
+			}
+			continue
+		}
+
+		indent := indentWidth(m[1])
+		for len(r.indents) > 0 && r.indents[len(r.indents)-1] >= indent {
+			r.indents = r.indents[:len(r.indents)-1]
+		}
+		r.indents = append(r.indents, indent)
+		return FileTask{
+			Line:    r.line,
+			Depth:   len(r.indents) - 1,
+			Content: strings.TrimSpace(m[3]),
+			Done:    m[2] != " ",
+			Tags:    make([]string, 0),
+		}, nil
+	}
+	return FileTask{}, r.err
+}
+
+// readLine reads the next line of r, line ending included. A line longer than limit is read through, but only
+// reported as too long.
+func readLine(r *bufio.Reader, limit int) (string, bool, error) {
+	var (
+		line    []byte
+		tooLong bool
+	)
+	for {
+		chunk, err := r.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > limit {
+				line, tooLong = nil, true
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), tooLong, err
+		}
+	}
+}
+
+// indentWidth returns how many columns an indentation spans, tabs stopping every 4 columns.
+func indentWidth(indent string) int {
+	width := 0
+	for _, c := range indent {
+		if c == '\t' {
+			width += 4 - width%4
+		} else {
+			width++
+		}
+	}
+	return width
+}
+
+func writeMarkdown(w io.Writer, tasks []FileTask) error {
+	bw := bufio.NewWriter(w)
+	for _, t := range tasks {
+		mark := " "
+		if t.Done {
+			mark = "x"
+		}
+		// an item holds a single line, so the content has to fit in one
+		content := strings.Join(strings.Fields(t.Content), " ")
+		if _, err := fmt.Fprintf(bw, "%s- [%s] %s\n", strings.Repeat("  ", t.Depth), mark, content); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
@@ -1,11 +1,43 @@
 package todo
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akalpaki/todo/internal/tag"
+	"github.com/akalpaki/todo/pkg/ical"
+	"github.com/akalpaki/todo/pkg/patch"
+)
+
 // Todo is the model that represents the Todo list entity.
 type Todo struct {
-	ID       string `json:"id"`
-	AuthorID string `json:"author_id"`
-	Name     string `json:"name"`
-	Tasks    []Task `json:"tasks"`
+	ID       string    `json:"id"`
+	AuthorID string    `json:"author_id"`
+	Name     string    `json:"name"`
+	Tasks    []Task    `json:"tasks"`
+	Tags     []tag.Tag `json:"tags"`
+	// ArchivedAt is set once the list is archived. Archived lists are kept out of the default listing.
+	ArchivedAt *time.Time `json:"archived_at"`
+	// Version changes whenever the list, or anything it contains, changes. It is the list's ETag.
+	Version int64 `json:"version"`
+	// members are the ids of the users the list is shared with. They are only loaded by GetByID.
+	members []string
+}
+
+// Member is a user a todo list is shared with. Members can read and change the list and its tasks like its author,
+// but only the author can share it or stop sharing it.
+type Member struct {
+	TodoID    string    `json:"todo_id"`
+	UserID    string    `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 // TodoRequest is the model containing the minimum required information to create and update a todo list.
@@ -22,13 +54,940 @@ func (r TodoRequest) Valid() bool {
 
 // Task is the model that represents a single Todo list task.
 type Task struct {
-	ID      string `json:"task_id"`
-	TodoID  string `json:"todo_id"`
-	Content string `json:"content"`
-	Done    bool   `json:"done"`
-	Order   int    `json:"order"`
+	ID       string     `json:"task_id"`
+	TodoID   string     `json:"todo_id"`
+	Content  string     `json:"content"`
+	Done     bool       `json:"done"`
+	Order    int        `json:"order"`
+	Priority Priority   `json:"priority"`
+	DueAt    *time.Time `json:"due_at"`
+	// Recurrence is an iCalendar recurrence rule, such as "FREQ=WEEKLY;BYDAY=MO", telling how the task repeats from
+	// DueAt. It is kept for calendars and clients to expand; completing the task does not create the next occurrence.
+	Recurrence *string `json:"recurrence"`
+	// MyDay reports whether the requesting user has put the task on their "My Day" focus list.
+	MyDay    bool      `json:"my_day"`
+	Tags     []tag.Tag `json:"tags"`
+	ParentID *string   `json:"parent_id"`
+	// AutoComplete makes the task done exactly when all of its subtasks are done.
+	AutoComplete bool `json:"auto_complete"`
+	// Progress is the percentage of the task's subtasks, at any depth, which are done.
+	// A task without subtasks is either at 0 or at 100.
+	Progress int    `json:"progress"`
+	Subtasks []Task `json:"subtasks"`
+	// DependsOn holds the ids of the tasks which have to be done before this one can start.
+	DependsOn []string `json:"depends_on"`
+	// Blocked reports whether any of the tasks in DependsOn is not done yet.
+	Blocked bool `json:"blocked"`
+	// Rank is the lexicographic key tasks are sorted by among their siblings. It replaces Order,
+	// which is kept for older clients but no longer affects the position of a task.
+	Rank string `json:"rank"`
+	// Version changes whenever the task, its tags or its dependencies change. It is the task's ETag.
+	Version int64 `json:"version"`
 }
 
 func (r Task) Valid() bool {
-	return r.Content != "" && r.Order >= 0
+	return r.Content != "" && r.Order >= 0 && validRecurrence(r.Recurrence)
+}
+
+// validRecurrence reports whether a task's recurrence, if any, is a recurrence rule.
+func validRecurrence(rule *string) bool {
+	return rule == nil || ical.ValidRecurrence(*rule)
+}
+
+// MoveRequest is the model used to move a task, along with its subtasks, under another parent task.
+// A nil ParentID turns the task into a top-level task.
+type MoveRequest struct {
+	ParentID *string `json:"parent_id"`
+}
+
+func (r MoveRequest) Valid() bool {
+	return r.ParentID == nil || *r.ParentID != ""
+}
+
+// PositionRequest is the model used to reorder a task among its siblings. The task is placed right
+// after AfterID and/or right before BeforeID; when both are missing it is moved to the end.
+type PositionRequest struct {
+	AfterID  *string `json:"after_id"`
+	BeforeID *string `json:"before_id"`
+}
+
+func (r PositionRequest) Valid() bool {
+	return (r.AfterID == nil || *r.AfterID != "") && (r.BeforeID == nil || *r.BeforeID != "")
+}
+
+// TransferRequest is the model used to move a task, along with its subtasks, to another todo list.
+type TransferRequest struct {
+	TodoID string `json:"todo_id"`
+}
+
+func (r TransferRequest) Valid() bool {
+	return r.TodoID != ""
+}
+
+// Batch operations supported by BatchRequest.
+const (
+	BatchOpComplete    = "complete"
+	BatchOpUncomplete  = "uncomplete"
+	BatchOpDelete      = "delete"
+	BatchOpMove        = "move"
+	BatchOpSetPriority = "set_priority"
+	BatchOpSetDueDate  = "set_due_date"
+)
+
+// Batch modes supported by BatchRequest.
+const (
+	BatchAtomic     = "atomic"
+	BatchBestEffort = "best_effort"
+)
+
+// Statuses reported for every operation of a batch.
+const (
+	BatchStatusOK         = "ok"
+	BatchStatusFailed     = "failed"
+	BatchStatusRolledBack = "rolled_back"
+	BatchStatusSkipped    = "skipped"
+)
+
+const maxBatchSize = 100
+
+// BatchRequest is the model used to apply several task operations to a todo list at once.
+// Mode defaults to BatchAtomic.
+type BatchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+func (r BatchRequest) Valid() bool {
+	if r.Mode != "" && r.Mode != BatchAtomic && r.Mode != BatchBestEffort {
+		return false
+	}
+	if len(r.Operations) == 0 || len(r.Operations) > maxBatchSize {
+		return false
+	}
+	for _, op := range r.Operations {
+		if !op.Valid() {
+			return false
+		}
+	}
+	return true
+}
+
+func (r BatchRequest) mode() string {
+	if r.Mode == "" {
+		return BatchAtomic
+	}
+	return r.Mode
+}
+
+// BatchOperation is a single operation of a BatchRequest. Which of the optional fields are used
+// depends on Op: Priority for set_priority, DueAt for set_due_date (null clears the due date),
+// and AfterID/BeforeID for move, with the same meaning as in PositionRequest.
+type BatchOperation struct {
+	Op       string     `json:"op"`
+	TaskID   string     `json:"task_id"`
+	Priority *Priority  `json:"priority,omitempty"`
+	DueAt    *time.Time `json:"due_at,omitempty"`
+	AfterID  *string    `json:"after_id,omitempty"`
+	BeforeID *string    `json:"before_id,omitempty"`
+}
+
+func (o BatchOperation) Valid() bool {
+	if o.TaskID == "" {
+		return false
+	}
+	switch o.Op {
+	case BatchOpComplete, BatchOpUncomplete, BatchOpDelete, BatchOpSetDueDate:
+		return true
+	case BatchOpSetPriority:
+		return o.Priority != nil
+	case BatchOpMove:
+		return PositionRequest{AfterID: o.AfterID, BeforeID: o.BeforeID}.Valid()
+	default:
+		return false
+	}
+}
+
+// BatchResult reports the outcome of a batch. Committed is false when nothing was applied.
+type BatchResult struct {
+	Mode      string            `json:"mode"`
+	Committed bool              `json:"committed"`
+	Results   []BatchItemResult `json:"results"`
+}
+
+// BatchItemResult reports the outcome of one operation, in the order they were given.
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	TaskID string `json:"task_id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// maxTaskDepth is how many levels deep tasks can be nested, top-level tasks being at depth 1.
+const maxTaskDepth = 5
+
+// buildTaskTree nests every task under its parent. Tasks whose parent is not part of the given slice
+// are returned as the roots of the tree. Siblings are sorted and Progress is filled in along the way.
+func buildTaskTree(tasks []Task) []Task {
+	present := make(map[string]bool, len(tasks))
+	for _, t := range tasks {
+		present[t.ID] = true
+	}
+
+	roots := make([]Task, 0)
+	children := make(map[string][]Task)
+	for _, t := range tasks {
+		if t.ParentID != nil && present[*t.ParentID] {
+			children[*t.ParentID] = append(children[*t.ParentID], t)
+		} else {
+			roots = append(roots, t)
+		}
+	}
+
+	var nest func(t *Task) (done, total int)
+	nest = func(t *Task) (done, total int) {
+		t.Subtasks = children[t.ID]
+		if t.Subtasks == nil {
+			t.Subtasks = make([]Task, 0)
+		}
+		sortTasks(t.Subtasks)
+		for i := range t.Subtasks {
+			d, n := nest(&t.Subtasks[i])
+			if t.Subtasks[i].Done {
+				d++
+			}
+			done, total = done+d, total+n+1
+		}
+		t.Progress = progress(t.Done, done, total)
+		return done, total
+	}
+
+	sortTasks(roots)
+	for i := range roots {
+		nest(&roots[i])
+	}
+	return roots
+}
+
+// sortTasks sorts sibling tasks in the order they are displayed.
+func sortTasks(tasks []Task) {
+	slices.SortStableFunc(tasks, func(a, b Task) int {
+		if c := strings.Compare(a.Rank, b.Rank); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+}
+
+// progress returns the completion percentage of a task given how many of its subtasks are done.
+func progress(taskDone bool, done, total int) int {
+	if total == 0 {
+		if taskDone {
+			return 100
+		}
+		return 0
+	}
+	return done * 100 / total
+}
+
+// subtreeDigest returns a digest of the versions of the subtasks of a task, at any depth, which changes whenever one
+// of them changes, is added or is removed.
+func subtreeDigest(t Task) string {
+	h := fnv.New64a()
+	var walk func(tasks []Task)
+	walk = func(tasks []Task) {
+		for _, st := range tasks {
+			fmt.Fprintf(h, "%s:%d;", st.ID, st.Version)
+			walk(st.Subtasks)
+		}
+	}
+	walk(t.Subtasks)
+	return strconv.FormatUint(h.Sum64(), 36)
+}
+
+// Priority is the importance level of a task. It is stored as a number so tasks sort by it,
+// and travels over the wire as one of the names in priorityNames.
+type Priority int
+
+const (
+	PriorityNone Priority = iota
+	PriorityLow
+	PriorityMedium
+	PriorityHigh
+	PriorityUrgent
+)
+
+var priorityNames = []string{"none", "low", "medium", "high", "urgent"}
+
+func (p Priority) String() string {
+	if p < PriorityNone || p > PriorityUrgent {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+func (p Priority) MarshalJSON() ([]byte, error) {
+	if p < PriorityNone || p > PriorityUrgent {
+		return nil, fmt.Errorf("invalid priority %d", int(p))
+	}
+	return json.Marshal(p.String())
+}
+
+// ICalPriority returns the iCalendar priority matching p, 1 being the highest and 0 undefined.
+func (p Priority) ICalPriority() int {
+	switch p {
+	case PriorityUrgent:
+		return 1
+	case PriorityHigh:
+		return 3
+	case PriorityMedium:
+		return 5
+	case PriorityLow:
+		return 9
+	default:
+		return 0
+	}
+}
+
+// PriorityFromICal returns the priority matching an iCalendar one, the way calendar apps split the range: 1 to 4 is
+// high, with 1 being urgent, 5 is medium and 6 to 9 is low.
+func PriorityFromICal(priority int) Priority {
+	switch {
+	case priority == 1:
+		return PriorityUrgent
+	case priority >= 2 && priority <= 4:
+		return PriorityHigh
+	case priority == 5:
+		return PriorityMedium
+	case priority >= 6 && priority <= 9:
+		return PriorityLow
+	default:
+		return PriorityNone
+	}
+}
+
+// UnmarshalJSON accepts a priority name; an empty string or null means PriorityNone.
+func (p *Priority) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return fmt.Errorf("priority: %w", err)
+	}
+	if name == "" {
+		*p = PriorityNone
+		return nil
+	}
+	i := slices.Index(priorityNames, name)
+	if i < 0 {
+		return fmt.Errorf("invalid priority %q", name)
+	}
+	*p = Priority(i)
+	return nil
+}
+
+// todoDocument holds the fields of a todo list which can be changed with a PATCH request.
+// Patches are applied to it and the result is decoded back into it.
+type todoDocument struct {
+	Name string `json:"name"`
+}
+
+func (d todoDocument) Valid() bool {
+	return d.Name != ""
+}
+
+// taskDocument holds the fields of a task which can be changed with a PATCH request.
+type taskDocument struct {
+	Content      string     `json:"content"`
+	Done         bool       `json:"done"`
+	Priority     Priority   `json:"priority"`
+	DueAt        *time.Time `json:"due_at"`
+	Recurrence   *string    `json:"recurrence"`
+	AutoComplete bool       `json:"auto_complete"`
+}
+
+func newTaskDocument(task Task) taskDocument {
+	return taskDocument{
+		Content:      task.Content,
+		Done:         task.Done,
+		Priority:     task.Priority,
+		DueAt:        task.DueAt,
+		Recurrence:   task.Recurrence,
+		AutoComplete: task.AutoComplete,
+	}
+}
+
+func (d taskDocument) Valid() bool {
+	return d.Content != "" && validRecurrence(d.Recurrence)
+}
+
+// applyPatch applies p to doc and decodes the result into a new document. Members which are not part
+// of the document, such as read-only fields, make the result invalid, and so does a failed Valid check.
+func applyPatch[D interface{ Valid() bool }](doc D, p patch.Patch) (D, error) {
+	var patched D
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return patched, fmt.Errorf("encode document: %w", err)
+	}
+
+	data, err = p.Apply(data)
+	if err != nil {
+		return patched, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patched); err != nil {
+		return patched, fmt.Errorf("%w: %w", errInvalidPatchResult, err)
+	}
+	if !patched.Valid() {
+		return patched, errInvalidPatchResult
+	}
+	return patched, nil
+}
+
+// Types of the entries in the trash.
+const (
+	TrashTypeTodo = "todo"
+	TrashTypeTask = "task"
+)
+
+// TrashItem is a todo list or a task waiting in the trash to be restored or purged.
+// Subtasks trashed together with their parent are restored with it and are not listed on their own.
+type TrashItem struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	TodoID    string    `json:"todo_id"`
+	Title     string    `json:"title"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// Filter narrows down the todo lists and tasks returned by the collection endpoints.
+type Filter struct {
+	// Tags holds tag ids; only entries carrying every one of them are returned.
+	Tags []string
+	// MyDay restricts tasks to the ones the caller has put on their "My Day" list.
+	MyDay bool
+	// Archived lists the archived todo lists instead of the active ones.
+	Archived bool
+}
+
+// tags returns the deduplicated tag ids of the filter, never nil, ready to be used as a query parameter.
+func (f Filter) tags() []string {
+	tags := slices.Clone(f.Tags)
+	if tags == nil {
+		tags = make([]string, 0)
+	}
+	slices.Sort(tags)
+	return slices.Compact(tags)
+}
+
+// topologicalOrder sorts tasks so that every task comes after all the tasks it depends on.
+// Among tasks which are free to go next, the display order is kept. Dependencies on tasks
+// outside of the given slice are ignored.
+func topologicalOrder(tasks []Task) []Task {
+	sortTasks(tasks)
+
+	index := make(map[string]int, len(tasks))
+	for i, t := range tasks {
+		index[t.ID] = i
+	}
+
+	pending := make([]int, len(tasks))
+	dependents := make(map[string][]int)
+	for i, t := range tasks {
+		for _, dep := range t.DependsOn {
+			if _, ok := index[dep]; ok {
+				pending[i]++
+				dependents[dep] = append(dependents[dep], i)
+			}
+		}
+	}
+
+	ordered := make([]Task, 0, len(tasks))
+	emitted := make([]bool, len(tasks))
+	for len(ordered) < len(tasks) {
+		next := -1
+		for i := range tasks {
+			if !emitted[i] && pending[i] == 0 {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			// cycles are rejected when dependencies are written, but never loop forever over bad data
+			for i := range tasks {
+				if !emitted[i] {
+					ordered = append(ordered, tasks[i])
+				}
+			}
+			break
+		}
+
+		emitted[next] = true
+		ordered = append(ordered, tasks[next])
+		for _, i := range dependents[tasks[next].ID] {
+			pending[i]--
+		}
+	}
+	return ordered
+}
+
+// Actions recorded in the history of a todo list.
+const (
+	ActionTodoCreated    = "todo.created"
+	ActionTodoUpdated    = "todo.updated"
+	ActionTodoDeleted    = "todo.deleted"
+	ActionTodoRestored   = "todo.restored"
+	ActionTodoArchived   = "todo.archived"
+	ActionTodoUnarchived = "todo.unarchived"
+	ActionTodoReverted   = "todo.reverted"
+	ActionTaskCreated    = "task.created"
+	ActionTaskUpdated    = "task.updated"
+	ActionTaskDeleted    = "task.deleted"
+	ActionTaskRestored   = "task.restored"
+	ActionTaskMoved      = "task.moved"
+	ActionTaskReordered  = "task.reordered"
+	ActionTaskTransfer   = "task.transferred"
+	ActionTaskBatch      = "task.batch"
+	ActionTaskImported   = "task.imported"
+	ActionDependencyAdd  = "dependency.added"
+	ActionDependencyDrop = "dependency.removed"
+)
+
+// Entities a Change can be about.
+const (
+	EntityTodo       = "todo"
+	EntityTask       = "task"
+	EntityDependency = "dependency"
+)
+
+// Revision is an entry of the append-only history of a todo list: one mutation, who made it and when,
+// and how it changed the list. The first revision of a list created before its history was recorded
+// reports the whole list as new.
+type Revision struct {
+	ID        int64     `json:"id"`
+	TodoID    string    `json:"todo_id"`
+	ActorID   *string   `json:"actor_id"`
+	Action    string    `json:"action"`
+	Changes   []Change  `json:"changes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Change is a field-level difference made by a revision. Field is empty when the whole entity was added,
+// in which case Old is null, or removed for good, in which case New is null. For a dependency, ID is the
+// dependent task and Old or New the task it depends on.
+type Change struct {
+	Entity string `json:"entity"`
+	ID     string `json:"id"`
+	Field  string `json:"field,omitempty"`
+	Old    any    `json:"old"`
+	New    any    `json:"new"`
+}
+
+// Kinds of Event.
+const (
+	EventCreated = "created"
+	EventUpdated = "updated"
+	EventDeleted = "deleted"
+)
+
+// EventShared is the type of the Event written to the outbox when a todo list is shared with a user, whose id is
+// its EntityID. It is not part of the history of the list.
+const EventShared = "member.added"
+
+// Event is what a revision did to a single todo list or task, as pushed to the clients following a list.
+// Its Type is the entity and the kind of the event, eg. "task.updated". A restored entity is reported as
+// created and a trashed one as deleted. Events of the same revision share its ID.
+type Event struct {
+	ID        int64     `json:"id"`
+	Type      string    `json:"type"`
+	TodoID    string    `json:"todo_id"`
+	EntityID  string    `json:"entity_id"`
+	ActorID   *string   `json:"actor_id"`
+	Action    string    `json:"action"`
+	Changes   []Change  `json:"changes"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Events splits the changes of the revision into one event per todo list or task they affect.
+// Changes to the dependencies of a task are reported as updates of the task.
+func (rev Revision) Events() []Event {
+	var events []Event
+	index := make(map[string]int)
+	for _, c := range rev.Changes {
+		entity, kind := c.Entity, EventUpdated
+		switch {
+		case entity == EntityDependency:
+			entity = EntityTask
+		case c.Field == "" && c.Old == nil:
+			kind = EventCreated
+		case c.Field == "" && c.New == nil:
+			kind = EventDeleted
+		case c.Field == "deleted_at" && c.New != nil:
+			kind = EventDeleted
+		case c.Field == "deleted_at":
+			kind = EventCreated
+		}
+
+		key := entity + "/" + c.ID
+		if i, ok := index[key]; ok {
+			events[i].Changes = append(events[i].Changes, c)
+			if kind != EventUpdated {
+				events[i].Type = entity + "." + kind
+			}
+			continue
+		}
+		index[key] = len(events)
+		events = append(events, Event{
+			ID:        rev.ID,
+			Type:      entity + "." + kind,
+			TodoID:    rev.TodoID,
+			EntityID:  c.ID,
+			ActorID:   rev.ActorID,
+			Action:    rev.Action,
+			Changes:   []Change{c},
+			CreatedAt: rev.CreatedAt,
+		})
+	}
+	return events
+}
+
+// States of a Presence.
+const (
+	PresenceViewing = "viewing"
+	PresenceEditing = "editing"
+	PresenceLeft    = "left"
+)
+
+// Presence is what a user connected over the sync channel is doing with a todo list. A user has one
+// Presence per connection, and TaskID names the task being edited, if any.
+type Presence struct {
+	TodoID    string    `json:"todo_id"`
+	UserID    string    `json:"user_id"`
+	SessionID string    `json:"session_id"`
+	State     string    `json:"state"`
+	TaskID    *string   `json:"task_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SyncChanges is what changed among the todo lists and tasks of a user since a sync token. Tasks are
+// returned flat, along with their ParentID, and without the fields derived from other tasks (Progress and
+// Blocked). Token is the sync token to ask for the next changes with.
+type SyncChanges struct {
+	Token   string      `json:"token"`
+	Todos   []Todo      `json:"todos"`
+	Tasks   []Task      `json:"tasks"`
+	Deleted []Tombstone `json:"deleted"`
+}
+
+// Tombstone reports a todo list or task which has been moved to the trash or deleted for good.
+// The tasks of a deleted list are not reported on their own.
+type Tombstone struct {
+	Entity    string    `json:"entity"`
+	ID        string    `json:"id"`
+	TodoID    string    `json:"todo_id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// Operations supported by Mutation.
+const (
+	MutationCreateTodo = "create_todo"
+	MutationUpdateTodo = "update_todo"
+	MutationDeleteTodo = "delete_todo"
+	MutationCreateTask = "create_task"
+	MutationUpdateTask = "update_task"
+	MutationDeleteTask = "delete_task"
+)
+
+// Statuses reported for every mutation of a push.
+const (
+	MutationApplied  = "applied"
+	MutationConflict = "conflict"
+	MutationRejected = "rejected"
+	MutationFailed   = "failed"
+)
+
+const maxPushSize = 100
+
+// PushRequest is the model used to upload the mutations an offline client has queued, in the order they were made.
+type PushRequest struct {
+	Mutations []Mutation `json:"mutations"`
+}
+
+func (r PushRequest) Valid() bool {
+	if len(r.Mutations) == 0 || len(r.Mutations) > maxPushSize {
+		return false
+	}
+	for _, m := range r.Mutations {
+		if !m.Valid() {
+			return false
+		}
+	}
+	return true
+}
+
+// Mutation is a single change queued by an offline client. ClientID is chosen by the client to match the
+// result with the mutation; for creates, later mutations of the same push can use it in place of the new id.
+// Name is used by the todo operations and Task by create_task and update_task; an update_task only changes
+// the fields of Task which were sent. BaseVersion is the version of the list or task the client last saw;
+// when it is set, the mutation only applies at that version.
+type Mutation struct {
+	ClientID    string `json:"client_id"`
+	Op          string `json:"op"`
+	TodoID      string `json:"todo_id"`
+	TaskID      string `json:"task_id"`
+	BaseVersion *int64 `json:"base_version"`
+	Name        string `json:"name"`
+	Task        *Task  `json:"task"`
+
+	// task is Task as it was sent.
+	task json.RawMessage
+}
+
+// UnmarshalJSON keeps the task as it was sent next to the decoded one, so that the fields it leaves out can be told apart.
+func (m *Mutation) UnmarshalJSON(data []byte) error {
+	type plain Mutation
+	var v struct {
+		plain
+		Task json.RawMessage `json:"task"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*m = Mutation(v.plain)
+	if len(v.Task) == 0 || string(v.Task) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(v.Task, &m.Task); err != nil {
+		return err
+	}
+	m.task = v.Task
+	return nil
+}
+
+// taskData returns Task as it was sent, or all of its fields when it was not decoded from JSON.
+func (m Mutation) taskData() (json.RawMessage, error) {
+	if m.task != nil {
+		return m.task, nil
+	}
+	return json.Marshal(m.Task)
+}
+
+func (m Mutation) Valid() bool {
+	if m.ClientID == "" {
+		return false
+	}
+	switch m.Op {
+	case MutationCreateTodo:
+		return m.Name != ""
+	case MutationUpdateTodo:
+		return m.TodoID != "" && m.Name != ""
+	case MutationDeleteTodo:
+		return m.TodoID != ""
+	case MutationCreateTask:
+		return m.TodoID != "" && m.Task != nil && m.Task.Valid()
+	case MutationUpdateTask:
+		// what is left out is taken from the current task, so the result is checked once it is applied
+		return m.TodoID != "" && m.TaskID != "" && m.Task != nil
+	case MutationDeleteTask:
+		return m.TodoID != "" && m.TaskID != ""
+	default:
+		return false
+	}
+}
+
+// PushResult reports the outcome of every mutation of a push, in the order they were given.
+type PushResult struct {
+	Results []MutationResult `json:"results"`
+}
+
+// MutationResult reports the outcome of a mutation. When it was applied, ID is the id of the list or task
+// and Todo or Task its new state. On a conflict the server's state wins: Todo or Task is the current state,
+// or neither when the list or task no longer exists. A rejected mutation can never apply, while a failed
+// one can be pushed again later.
+type MutationResult struct {
+	ClientID string `json:"client_id"`
+	Op       string `json:"op"`
+	Status   string `json:"status"`
+	ID       string `json:"id,omitempty"`
+	Todo     *Todo  `json:"todo,omitempty"`
+	Task     *Task  `json:"task,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	err error
+}
+
+// FileTask is a task as kept in the plain files todo lists are imported from and exported to. A list is exported
+// flat, subtasks right after their parent, and formats which have room for it keep the nesting in Depth. Tags are
+// referred to by name.
+type FileTask struct {
+	// Line is the line of the imported file the task was read from.
+	Line int `json:"line,omitempty"`
+	// Depth is how deep the task is nested under the tasks before it, 0 being a top-level task.
+	Depth       int        `json:"depth,omitempty"`
+	Content     string     `json:"content"`
+	Done        bool       `json:"done"`
+	Priority    Priority   `json:"priority"`
+	DueAt       *time.Time `json:"due_at"`
+	CreatedAt   *time.Time `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	Tags        []string   `json:"tags"`
+}
+
+// ImportReader reads the tasks of an imported file one at a time, so that the file never has to be held in memory.
+// Next returns io.EOF after the last task, and a SkippedLine for a line which holds no valid task, past which the
+// import goes on.
+type ImportReader interface {
+	Next() (FileTask, error)
+}
+
+// SkippedLine is a line of an imported file which was left out, and why.
+type SkippedLine struct {
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+}
+
+func (s SkippedLine) Error() string {
+	return fmt.Sprintf("line %d: %s", s.Line, s.Reason)
+}
+
+// maxImportReport is how many of the tasks and of the skipped lines of an import its result lists, so that it stays
+// small whatever the size of the file.
+const maxImportReport = 100
+
+// ImportResult reports what an import did or, on a dry run, what it would have done.
+type ImportResult struct {
+	DryRun bool `json:"dry_run"`
+	// TodoID is the list the tasks were added to. It is empty on a dry run into a new list.
+	TodoID  string `json:"todo_id,omitempty"`
+	Created int    `json:"created"`
+	// Tasks holds the first tasks which would be created, up to maxImportReport. It is only filled on a dry run.
+	Tasks []FileTask `json:"tasks,omitempty"`
+	// NewTags holds the names of the tags which were, or would be, created for the user.
+	NewTags []string `json:"new_tags"`
+	// Skipped holds the first lines left out, up to maxImportReport, out of SkippedCount.
+	Skipped      []SkippedLine `json:"skipped"`
+	SkippedCount int           `json:"skipped_count"`
+}
+
+// skip records a line left out of the import.
+func (res *ImportResult) skip(line SkippedLine) {
+	res.SkippedCount++
+	if len(res.Skipped) < maxImportReport {
+		res.Skipped = append(res.Skipped, line)
+	}
+}
+
+// snapshot is the full state of a todo list stored with each revision. It is built from the one of the previous
+// revision and the tasks which have changed since, as selected by selectChangedSnapshotQuery. Rows are kept as
+// generic column maps so that the diff covers every column without listing them.
+type snapshot struct {
+	Todo         map[string]any            `json:"todo"`
+	Tasks        map[string]map[string]any `json:"tasks"`
+	Dependencies [][2]string               `json:"dependencies"`
+}
+
+// taskRows returns the task rows of the snapshot, ready to be written back with revertTasksQuery.
+func (s snapshot) taskRows() []map[string]any {
+	rows := make([]map[string]any, 0, len(s.Tasks))
+	for _, id := range sortedKeys(s.Tasks, nil) {
+		rows = append(rows, s.Tasks[id])
+	}
+	return rows
+}
+
+// versions returns the version of every task of the snapshot, keyed by id.
+func (s snapshot) versions() map[string]any {
+	versions := make(map[string]any, len(s.Tasks))
+	for id, row := range s.Tasks {
+		versions[id] = row["version"]
+	}
+	return versions
+}
+
+// advance returns the snapshot s turns into once the tasks of changed are written over its own, and the ones
+// missing from ids, the ids of every task the list now has, are dropped, having been purged or moved to another
+// list. It also returns the ids of the tasks which differ between the two, sorted.
+func (s snapshot) advance(changed snapshot, ids []string) (snapshot, []string) {
+	next := snapshot{Todo: changed.Todo, Tasks: make(map[string]map[string]any, len(ids)), Dependencies: changed.Dependencies}
+	for _, id := range ids {
+		if row, ok := s.Tasks[id]; ok {
+			next.Tasks[id] = row
+		}
+	}
+	maps.Copy(next.Tasks, changed.Tasks)
+
+	differ := make([]string, 0, len(changed.Tasks))
+	for id := range s.Tasks {
+		if _, ok := next.Tasks[id]; !ok {
+			differ = append(differ, id)
+		}
+	}
+	for id := range changed.Tasks {
+		differ = append(differ, id)
+	}
+	slices.Sort(differ)
+	return next, differ
+}
+
+// diffSnapshots lists the changes that turned the todo list from old into new. Only the tasks named by ids are
+// compared, the others being at the same version in both.
+func diffSnapshots(todoID string, old, new snapshot, ids []string) []Change {
+	changes := diffRow(EntityTodo, todoID, old.Todo, new.Todo)
+
+	for _, id := range ids {
+		changes = append(changes, diffRow(EntityTask, id, old.Tasks[id], new.Tasks[id])...)
+	}
+
+	for _, d := range old.Dependencies {
+		if !slices.Contains(new.Dependencies, d) {
+			changes = append(changes, Change{Entity: EntityDependency, ID: d[0], Old: d[1]})
+		}
+	}
+	for _, d := range new.Dependencies {
+		if !slices.Contains(old.Dependencies, d) {
+			changes = append(changes, Change{Entity: EntityDependency, ID: d[0], New: d[1]})
+		}
+	}
+	return changes
+}
+
+// diffRow compares two versions of a row, either of which is nil when the row does not exist.
+func diffRow(entity, id string, old, new map[string]any) []Change {
+	switch {
+	case old == nil && new == nil:
+		return nil
+	case old == nil:
+		return []Change{{Entity: entity, ID: id, New: new}}
+	case new == nil:
+		return []Change{{Entity: entity, ID: id, Old: old}}
+	}
+
+	var changes []Change
+	for _, field := range sortedKeys(old, new) {
+		// versions and sync markers change with every revision, and tell nothing about what changed
+		if field == "version" || field == "sync_xid" {
+			continue
+		}
+		if !reflect.DeepEqual(old[field], new[field]) {
+			changes = append(changes, Change{Entity: entity, ID: id, Field: field, Old: old[field], New: new[field]})
+		}
+	}
+	return changes
+}
+
+// sortedKeys returns the keys found in either map, sorted.
+func sortedKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
 }
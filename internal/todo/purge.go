@@ -0,0 +1,45 @@
+package todo
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/akalpaki/todo/pkg/jobs"
+)
+
+// PurgeTrashJob is the kind of the job permanently deleting the todo lists and tasks which have been in the trash
+// for longer than their retention period.
+const PurgeTrashJob = "todo.purge_trash"
+
+// PurgeTrashHandler returns the handler of PurgeTrashJob, purging what has been in the trash for longer than retention.
+func PurgeTrashHandler(logger *slog.Logger, repository *Repository, retention time.Duration) jobs.Handler {
+	return func(ctx context.Context, _ jobs.Job) error {
+		purged, err := repository.PurgeTrash(ctx, time.Now().Add(-retention))
+		if err != nil {
+			return err
+		}
+		if purged > 0 {
+			logger.Info("purged trash", "count", purged)
+		}
+		return nil
+	}
+}
+
+// CompactHistoryJob is the kind of the job dropping the snapshots of the revisions older than their retention period,
+// which keeps the size of the history in check.
+const CompactHistoryJob = "todo.compact_history"
+
+// CompactHistoryHandler returns the handler of CompactHistoryJob, compacting the revisions older than retention.
+func CompactHistoryHandler(logger *slog.Logger, repository *Repository, retention time.Duration) jobs.Handler {
+	return func(ctx context.Context, _ jobs.Job) error {
+		compacted, err := repository.CompactHistory(ctx, time.Now().Add(-retention))
+		if err != nil {
+			return err
+		}
+		if compacted > 0 {
+			logger.Info("compacted history", "count", compacted)
+		}
+		return nil
+	}
+}
@@ -1,18 +1,47 @@
 package todo
 
 import (
+	"cmp"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/noquark/nanoid"
+
+	"github.com/akalpaki/todo/internal/tag"
+	"github.com/akalpaki/todo/pkg/db"
+	"github.com/akalpaki/todo/pkg/outbox"
+	"github.com/akalpaki/todo/pkg/patch"
+	"github.com/akalpaki/todo/pkg/rank"
 )
 
 var (
-	errNotFound       = errors.New("not found")
-	errNoTodosForUser = errors.New("no todos found for user")
+	errNotFound           = errors.New("not found")
+	errNoTodosForUser     = errors.New("no todos found for user")
+	errTagNotFound        = errors.New("tag not found")
+	errInvalidParent      = errors.New("parent task not found in this todo list")
+	errParentCycle        = errors.New("a task cannot be moved under one of its own subtasks")
+	errTaskTooDeep        = errors.New("tasks are nested too deep")
+	errInvalidDep         = errors.New("a task can only depend on another task of the same todo list")
+	errDepCycle           = errors.New("the dependency would create a cycle")
+	errInvalidPosition    = errors.New("the task can only be placed next to its siblings")
+	errInvalidBatchOp     = errors.New("unknown batch operation")
+	errVersionMismatch    = errors.New("the resource is not at any of the expected versions")
+	errInvalidPatchResult = errors.New("the patch does not produce a valid document")
+	errInvalidSyncToken   = errors.New("invalid sync token")
+	errSyncTokenExpired   = errors.New("the sync token has expired, a full sync is required")
+	errRevisionCompacted  = errors.New("the revision is too old to be reverted to")
+	errInvalidImport      = errors.New("the imported file cannot be read")
+	errDAVResourceExists  = errors.New("a task already goes by this resource name")
+	errUserNotFound       = errors.New("user not found")
 )
 
 type Repository struct {
@@ -60,15 +89,19 @@ func (r *Repository) Create(ctx context.Context, data TodoRequest) (Todo, error)
 	}
 
 	if len(t.Tasks) > 0 {
-		for _, v := range t.Tasks {
-			_, err := tx.Exec(ctx, insertTaskQuery, v.ID, t.ID, v.Order, v.Content, v.Done) // note t.ID for the todo_id field because we've just generated it
-			if err != nil {
-				tx.Rollback(ctx)
-				return Todo{}, fmt.Errorf("todo_repo insert task: %w", err)
-			}
+		// note t.ID for the todo_id field because we've just generated it
+		t.Tasks, err = insertTaskTree(ctx, tx, t.ID, nil, t.Tasks, 1)
+		if err != nil {
+			tx.Rollback(ctx)
+			return Todo{}, err
 		}
 	}
 
+	if err := recordRevision(ctx, tx, data.AuthorID, t.ID, ActionTodoCreated); err != nil {
+		tx.Rollback(ctx)
+		return Todo{}, err
+	}
+
 	if err := tx.Commit(ctx); err != nil {
 		tx.Rollback(ctx)
 		return Todo{}, fmt.Errorf("todo_repo commit: %w", err)
@@ -77,72 +110,164 @@ func (r *Repository) Create(ctx context.Context, data TodoRequest) (Todo, error)
 	return t, nil
 }
 
-func (r *Repository) GetByID(ctx context.Context, id string) (Todo, error) {
+func (r *Repository) GetByID(ctx context.Context, userID, id string) (Todo, error) {
 	var t Todo
 
 	tRow := r.pool.QueryRow(ctx, selectTodoQuery, id)
-	if err := tRow.Scan(&t.ID, &t.AuthorID, &t.Name); err != nil {
+	if err := scanTodo(tRow, &t); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Todo{}, errNotFound
+		}
 		return Todo{}, fmt.Errorf("todo_repo get todo: %w", err)
 	}
 
-	iRows, err := r.pool.Query(ctx, selectTaskByTodoIDQuery, t.ID)
+	tasks, err := r.GetTasks(ctx, userID, t.ID, Filter{})
 	if err != nil {
-		return Todo{}, fmt.Errorf("todo_repo get tasks: %w", err)
+		return Todo{}, err
 	}
+	t.Tasks = tasks
 
-	tasks := make([]Task, 0)
-	for iRows.Next() {
-		var task Task
-		if err := iRows.Scan(&task.ID, &task.TodoID, &task.Order, &task.Content, &task.Done); err != nil {
-			return Todo{}, fmt.Errorf("todo_repo scan task: %w", err)
-		}
-		tasks = append(tasks, task)
+	rows, err := r.pool.Query(ctx, selectMemberIDsQuery, t.ID)
+	if err != nil {
+		return Todo{}, fmt.Errorf("todo_repo select members: %w", err)
+	}
+	if t.members, err = pgx.CollectRows(rows, pgx.RowTo[string]); err != nil {
+		return Todo{}, fmt.Errorf("todo_repo scan members: %w", err)
 	}
-	t.Tasks = tasks
 
-	return t, nil
+	todos := []Todo{t}
+	if err := r.loadTodoTags(ctx, todos); err != nil {
+		return Todo{}, err
+	}
+
+	return todos[0], nil
 }
 
-func (r *Repository) GetByUserID(ctx context.Context, userID string, limit, page int) ([]Todo, error) {
-	todos := make([]Todo, 0)
+// GetByUserID returns a page of the user's todo lists along with the total number of matching lists.
+// Archived lists are only returned when the filter asks for them, and trashed lists never are.
+// A user without any lists gets an empty slice, not an error.
+func (r *Repository) GetByUserID(ctx context.Context, userID string, filter Filter, limit, page int) ([]Todo, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countTodosByAuthorIDQuery, userID, filter.tags(), filter.Archived).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("todo_repo count todos by userID: %w", err)
+	}
 
-	offset := (page - 1) * limit
-	rows, err := r.pool.Query(ctx, selectTodosByAuthorIDQuery, userID, limit, offset)
+	rows, err := r.pool.Query(ctx, selectTodosByAuthorIDQuery, userID, limit, db.CalculateOffset(page, limit), filter.tags(), filter.Archived)
 	if err != nil {
-		return nil, fmt.Errorf("todo_repo select todos by userID: %w", err)
+		return nil, 0, fmt.Errorf("todo_repo select todos by userID: %w", err)
 	}
+	defer rows.Close()
 
+	todos := make([]Todo, 0)
 	for rows.Next() {
 		var t Todo
-		if err := rows.Scan(&t.ID, &t.AuthorID, &t.Name); err != nil {
-			return nil, fmt.Errorf("todo_repo scan todo: %w", err)
+		if err := scanTodo(rows, &t); err != nil {
+			return nil, 0, fmt.Errorf("todo_repo scan todo: %w", err)
 		}
 		todos = append(todos, t)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("todo_repo select todos by userID: %w", err)
+	}
 
-	if len(todos) == 0 {
-		return nil, errNoTodosForUser
+	if err := r.loadTodoTags(ctx, todos); err != nil {
+		return nil, 0, err
 	}
 
-	return todos, nil
+	return todos, total, nil
 }
 
-func (r *Repository) Update(ctx context.Context, id string, update TodoRequest) error {
-	if update.Name != "" {
-		_, err := r.pool.Exec(ctx, updateTodoQuery, update.Name, id)
-		if err != nil {
-			return fmt.Errorf("todo_repo update todo: %w", err)
+// Update renames a todo list. When ifMatch is not nil, the list has to be at one of its versions,
+// otherwise errVersionMismatch is returned and nothing changes.
+func (r *Repository) Update(ctx context.Context, userID, id string, update TodoRequest, ifMatch []int64) error {
+	res, err := r.execInList(ctx, userID, id, ActionTodoUpdated, updateTodoQuery, update.Name, id, ifMatch)
+	if err != nil {
+		return fmt.Errorf("todo_repo update todo: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		if ifMatch != nil {
+			return errVersionMismatch
 		}
+		return errNotFound
 	}
 	return nil
 }
 
-func (r *Repository) DeleteTodo(ctx context.Context, id string) error {
-	_, err := r.pool.Exec(ctx, deleteTodoQuery, id)
+// DeleteTodo moves a todo list to the trash, from where it can be restored until it is purged.
+// Its tasks stay as they are and come back with it. When ifMatch is not nil, the list has to be
+// at one of its versions, otherwise errVersionMismatch is returned.
+func (r *Repository) DeleteTodo(ctx context.Context, userID, id string, ifMatch []int64) error {
+	res, err := r.execInList(ctx, userID, id, ActionTodoDeleted, trashTodoQuery, id, ifMatch)
 	if err != nil {
 		return fmt.Errorf("todo_repo delete todo: %w", err)
 	}
+	if res.RowsAffected() == 0 {
+		if ifMatch != nil {
+			return errVersionMismatch
+		}
+		return errNotFound
+	}
+
+	return nil
+}
+
+// SetArchived archives or unarchives a todo list. Lists in the trash are left alone.
+func (r *Repository) SetArchived(ctx context.Context, userID, id string, archived bool) error {
+	action := ActionTodoUnarchived
+	if archived {
+		action = ActionTodoArchived
+	}
+	res, err := r.execInList(ctx, userID, id, action, setTodoArchivedQuery, archived, id)
+	if err != nil {
+		return fmt.Errorf("todo_repo set archived: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// PatchTodo applies a patch to the changeable fields of a todo list. The patch is applied to the list
+// as it is when the transaction holds its lock, so concurrent changes are never lost. When ifMatch is
+// not nil, the list has to be at one of its versions, otherwise errVersionMismatch is returned.
+func (r *Repository) PatchTodo(ctx context.Context, userID, id string, p patch.Patch, ifMatch []int64) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, id); err != nil {
+		return fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	var current Todo
+	if err := scanTodo(tx.QueryRow(ctx, selectTodoQuery, id), &current); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get todo: %w", err)
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, current.Version) {
+		return errVersionMismatch
+	}
+
+	patched, err := applyPatch(todoDocument{Name: current.Name}, p)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, updateTodoQuery, patched.Name, id, []int64(nil)); err != nil {
+		return fmt.Errorf("todo_repo update todo: %w", err)
+	}
+
+	if err := recordRevision(ctx, tx, userID, id, ActionTodoUpdated); err != nil {
+		return err
+	}
 
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
 	return nil
 }
 
@@ -150,51 +275,2318 @@ func (r *Repository) DeleteTodo(ctx context.Context, id string) error {
 //|           TASK CRUD            |
 //|++++++++++++++++++++++++++++++++|
 
-func (r *Repository) CreateTask(ctx context.Context, task Task) error {
+// CreateTask adds a task to a todo list, optionally as a subtask of task.ParentID.
+func (r *Repository) CreateTask(ctx context.Context, userID string, task Task) error {
+	_, err := r.createTask(ctx, userID, task)
+	return err
+}
+
+// createTask adds a task to a todo list and returns its id.
+func (r *Repository) createTask(ctx context.Context, userID string, task Task) (string, error) {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return "", fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	id, err := addTask(ctx, tx, userID, task)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return id, nil
+}
+
+// addTask adds a task to a todo list within tx and returns its id.
+func addTask(ctx context.Context, tx pgx.Tx, userID string, task Task) (string, error) {
 	id, err := nanoid.New(0)
 	if err != nil {
-		return fmt.Errorf("todo_repo generating id: %w", err)
+		return "", fmt.Errorf("todo_repo generating id: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, task.TodoID); err != nil {
+		return "", fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	if task.ParentID != nil {
+		if err := checkParent(ctx, tx, task.TodoID, *task.ParentID, 1); err != nil {
+			return "", err
+		}
 	}
 
-	_, err = r.pool.Exec(ctx, insertTaskQuery, id, task.TodoID, task.Order, task.Content, task.Done)
+	task.ID = id
+	task.Rank, err = lastRank(ctx, tx, task.TodoID, task.ParentID)
 	if err != nil {
-		return fmt.Errorf("todo_repo insert task")
+		return "", err
 	}
+	task.Rank = rank.After(task.Rank)
 
-	return nil
+	if err := insertTask(ctx, tx, task); err != nil {
+		return "", err
+	}
+
+	if err := rollUp(ctx, tx, task.ParentID); err != nil {
+		return "", err
+	}
+
+	if err := recordRevision(ctx, tx, userID, task.TodoID, ActionTaskCreated); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// GetTasks returns the tasks of a todo list as a tree: the top-level tasks matching the filter,
+// each with all of its subtasks nested inside it.
+func (r *Repository) GetTasks(ctx context.Context, userID, todoID string, filter Filter) ([]Task, error) {
+	return r.selectTaskTree(ctx, userID, selectTaskTreeQuery, todoID, nil, 0, filter.tags())
 }
 
-func (r *Repository) GetTasks(ctx context.Context, todoID string) ([]Task, error) {
-	rows, err := r.pool.Query(ctx, selectTaskByTodoIDQuery, todoID)
+// GetTask returns a single task with its subtasks, provided it belongs to the given todo list.
+func (r *Repository) GetTask(ctx context.Context, userID, todoID, taskID string) (Task, error) {
+	tasks, err := r.selectTaskTree(ctx, userID, selectTaskSubtreeQuery, taskID)
+	if err != nil {
+		return Task{}, err
+	}
+	if len(tasks) == 0 || tasks[0].TodoID != todoID {
+		return Task{}, errNotFound
+	}
+
+	return tasks[0], nil
+}
+
+// ListTasks returns a page of a todo list's top-level tasks, each with its subtasks nested inside it,
+// along with the total number of top-level tasks in the list.
+func (r *Repository) ListTasks(ctx context.Context, userID, todoID string, filter Filter, limit, page int) ([]Task, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countTasksByTodoIDQuery, todoID, filter.tags()).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("todo_repo count tasks: %w", err)
+	}
+
+	tasks, err := r.selectTaskTree(ctx, userID, selectTaskTreeQuery, todoID, limit, db.CalculateOffset(page, limit), filter.tags())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return tasks, total, nil
+}
+
+// selectTaskTree runs one of the task tree queries and nests the resulting tasks.
+func (r *Repository) selectTaskTree(ctx context.Context, userID, query string, args ...any) ([]Task, error) {
+	rows, err := r.pool.Query(ctx, query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("todo_repo select tasks: %w", err)
 	}
 
-	tasks := make([]Task, 0)
-	for rows.Next() {
-		var task Task
-		if err := rows.Scan(&task.ID, &task.TodoID, &task.Order, &task.Content, &task.Done); err != nil {
-			return nil, fmt.Errorf("todo_repo scan task: %w", err)
+	tasks, err := scanTasks(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.loadTaskDetails(ctx, userID, tasks); err != nil {
+		return nil, err
+	}
+
+	return buildTaskTree(tasks), nil
+}
+
+// UpdateTask overwrites the fields of a task of the todo list. When ifMatch is not nil, the task has to be at one
+// of its versions, otherwise errVersionMismatch is returned and nothing changes.
+func (r *Repository) UpdateTask(ctx context.Context, userID, todoID string, update Task, ifMatch []int64) error {
+	return r.updateTask(ctx, userID, todoID, update.ID, ifMatch, func(Task) (Task, error) {
+		return update, nil
+	})
+}
+
+// MergeTask decodes data over the current state of a task of the todo list and saves the result, so the fields
+// data leaves out keep their values. errInvalidPatchResult is returned when the result is not a valid task.
+func (r *Repository) MergeTask(ctx context.Context, userID, todoID, id string, data json.RawMessage, ifMatch []int64) error {
+	return r.updateTask(ctx, userID, todoID, id, ifMatch, func(current Task) (Task, error) {
+		update := current
+		if err := json.Unmarshal(data, &update); err != nil {
+			return update, errInvalidPatchResult
 		}
-		tasks = append(tasks, task)
+		update.ID, update.TodoID = current.ID, current.TodoID
+		if !update.Valid() {
+			return update, errInvalidPatchResult
+		}
+		return update, nil
+	})
+}
+
+// updateTask saves the task apply makes of the current state of a task, read under the lock of its todo list.
+func (r *Repository) updateTask(ctx context.Context, userID, todoID, id string, ifMatch []int64, apply func(current Task) (Task, error)) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
 	}
+	defer tx.Rollback(ctx)
 
-	return tasks, nil
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	var current Task
+	if err := scanTask(tx.QueryRow(ctx, selectTaskByTaskIDQuery, id), &current); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get task: %w", err)
+	}
+	if current.TodoID != todoID {
+		return errNotFound
+	}
+
+	update, err := apply(current)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(ctx, updateTaskQuery, update.Content, update.Done, update.Priority, update.DueAt, update.Recurrence, update.AutoComplete, id, ifMatch)
+	if err != nil {
+		return fmt.Errorf("todo_repo update task: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		if ifMatch != nil {
+			return errVersionMismatch
+		}
+		return errNotFound
+	}
+
+	// rolling up from the task itself keeps an auto-completing task consistent with its own subtasks
+	if err := rollUp(ctx, tx, &id); err != nil {
+		return err
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, ActionTaskUpdated); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return nil
+}
+
+// DeleteTask moves a task of the todo list, along with all of its subtasks, to the trash.
+// When ifMatch is not nil, the task has to be at one of its versions, otherwise errVersionMismatch is returned.
+func (r *Repository) DeleteTask(ctx context.Context, userID, todoID, id string, ifMatch []int64) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repository begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return fmt.Errorf("todo_repository lock task tree: %w", err)
+	}
+
+	var parentID *string
+	if err := tx.QueryRow(ctx, trashTaskQuery, id, todoID, ifMatch).Scan(&parentID); err != nil {
+		if !errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("todo_repository delete task: %w", err)
+		}
+		if ifMatch != nil {
+			return errVersionMismatch
+		}
+		return errNotFound
+	}
+
+	if err := rollUp(ctx, tx, parentID); err != nil {
+		return err
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, ActionTaskDeleted); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repository commit: %w", err)
+	}
+	return nil
 }
 
-func (r *Repository) UpdateTask(ctx context.Context, update Task) error {
-	_, err := r.pool.Exec(ctx, updateTaskQuery, update.Content, update.Done, update.ID)
+// PatchTask applies a patch to the changeable fields of a task of the todo list, the same way PatchTodo does.
+func (r *Repository) PatchTask(ctx context.Context, userID, todoID, id string, p patch.Patch, ifMatch []int64) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	var current Task
+	if err := scanTask(tx.QueryRow(ctx, selectTaskByTaskIDQuery, id), &current); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get task: %w", err)
+	}
+	if current.TodoID != todoID {
+		return errNotFound
+	}
+	if ifMatch != nil && !slices.Contains(ifMatch, current.Version) {
+		return errVersionMismatch
+	}
+
+	patched, err := applyPatch(newTaskDocument(current), p)
 	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, updateTaskQuery, patched.Content, patched.Done, patched.Priority, patched.DueAt, patched.Recurrence, patched.AutoComplete, id, []int64(nil)); err != nil {
 		return fmt.Errorf("todo_repo update task: %w", err)
 	}
+
+	if err := rollUp(ctx, tx, &id); err != nil {
+		return err
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, ActionTaskUpdated); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|            SUBTASKS            |
+//|++++++++++++++++++++++++++++++++|
+
+// MoveTask moves a task, along with all of its subtasks, under parentID within the same todo list.
+// A nil parentID turns it into a top-level task. The done state of both the old and the new
+// ancestors is rolled up in the same transaction.
+func (r *Repository) MoveTask(ctx context.Context, userID, todoID, taskID string, parentID *string) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	var task Task
+	if err := scanTask(tx.QueryRow(ctx, selectTaskByTaskIDQuery, taskID), &task); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get task: %w", err)
+	}
+	if task.TodoID != todoID {
+		return errNotFound
+	}
+
+	if parentID != nil {
+		subtree, height, err := selectSubtree(ctx, tx, taskID)
+		if err != nil {
+			return err
+		}
+		if slices.Contains(subtree, *parentID) {
+			return errParentCycle
+		}
+		if err := checkParent(ctx, tx, todoID, *parentID, height); err != nil {
+			return err
+		}
+	}
+
+	last, err := lastRank(ctx, tx, todoID, parentID)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, updateTaskParentQuery, parentID, rank.After(last), taskID); err != nil {
+		return fmt.Errorf("todo_repo move task: %w", err)
+	}
+
+	if err := rollUp(ctx, tx, task.ParentID); err != nil {
+		return err
+	}
+	if err := rollUp(ctx, tx, parentID); err != nil {
+		return err
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, ActionTaskMoved); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return nil
+}
+
+// insertTaskTree inserts tasks, and recursively their subtasks, under parentID.
+// It returns the tasks as they were stored, with their generated ids.
+func insertTaskTree(ctx context.Context, tx pgx.Tx, todoID string, parentID *string, tasks []Task, depth int) ([]Task, error) {
+	if depth > maxTaskDepth {
+		return nil, errTaskTooDeep
+	}
+
+	stored := make([]Task, 0, len(tasks))
+	prevRank := ""
+	for _, v := range tasks {
+		id, err := nanoid.New(21)
+		if err != nil {
+			return nil, fmt.Errorf("todo_repo generating id: %w", err)
+		}
+		v.ID, v.TodoID, v.ParentID = id, todoID, parentID
+		v.Rank = rank.After(prevRank)
+		prevRank = v.Rank
+
+		if err := insertTask(ctx, tx, v); err != nil {
+			return nil, err
+		}
+
+		v.Subtasks, err = insertTaskTree(ctx, tx, todoID, &v.ID, v.Subtasks, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		stored = append(stored, v)
+	}
+
+	if err := rollUp(ctx, tx, parentID); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+func insertTask(ctx context.Context, tx pgx.Tx, t Task) error {
+	_, err := tx.Exec(ctx, insertTaskQuery, t.ID, t.TodoID, t.Order, t.Content, t.Done, t.Priority, t.DueAt, t.Recurrence, t.ParentID, t.AutoComplete, t.Rank)
+	if err != nil {
+		return fmt.Errorf("todo_repo insert task: %w", err)
+	}
+	return nil
+}
+
+// checkParent makes sure parentID is a task of the todo list which can take a subtree of the given height beneath it.
+func checkParent(ctx context.Context, tx pgx.Tx, todoID, parentID string, height int) error {
+	var parentTodoID *string
+	var depth *int
+	if err := tx.QueryRow(ctx, selectTaskDepthQuery, parentID).Scan(&parentTodoID, &depth); err != nil {
+		return fmt.Errorf("todo_repo get parent depth: %w", err)
+	}
+	if parentTodoID == nil || *parentTodoID != todoID {
+		return errInvalidParent
+	}
+	if *depth+height > maxTaskDepth {
+		return errTaskTooDeep
+	}
+	return nil
+}
+
+// selectSubtree returns the ids of a task and all of its subtasks, and the height of that subtree.
+func selectSubtree(ctx context.Context, tx pgx.Tx, taskID string) ([]string, int, error) {
+	rows, err := tx.Query(ctx, selectSubtreeIDsQuery, taskID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("todo_repo select subtree: %w", err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	var height int
+	for rows.Next() {
+		var id string
+		var depth int
+		if err := rows.Scan(&id, &depth); err != nil {
+			return nil, 0, fmt.Errorf("todo_repo scan subtree: %w", err)
+		}
+		ids = append(ids, id)
+		height = max(height, depth)
+	}
+	return ids, height, rows.Err()
+}
+
+// rollUp recomputes the done state of taskID and each of its ancestors in turn, so that
+// auto-completing tasks are done exactly when all of their subtasks are.
+func rollUp(ctx context.Context, tx pgx.Tx, taskID *string) error {
+	for taskID != nil {
+		var parentID *string
+		if err := tx.QueryRow(ctx, rollUpTaskQuery, *taskID).Scan(&parentID); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return nil
+			}
+			return fmt.Errorf("todo_repo roll up task: %w", err)
+		}
+		taskID = parentID
+	}
 	return nil
 }
 
-func (r *Repository) DeleteTask(ctx context.Context, id string) error {
-	_, err := r.pool.Exec(ctx, deleteTaskQuery, id)
+//|++++++++++++++++++++++++++++++++|
+//|            ORDERING            |
+//|++++++++++++++++++++++++++++++++|
+
+// SetTaskPosition reorders a task among its siblings. Only the moved task gets a new rank,
+// unless its neighbours share a rank, in which case the siblings are re-ranked first.
+func (r *Repository) SetTaskPosition(ctx context.Context, userID, todoID, taskID string, pos PositionRequest) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
 	if err != nil {
-		return fmt.Errorf("todo_repository delete task: %w", err)
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	if err := setTaskPosition(ctx, tx, todoID, taskID, pos); err != nil {
+		return err
 	}
 
+	if err := recordRevision(ctx, tx, userID, todoID, ActionTaskReordered); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
 	return nil
 }
+
+// setTaskPosition does the work of SetTaskPosition within tx, which must hold the list's task tree lock.
+func setTaskPosition(ctx context.Context, tx pgx.Tx, todoID, taskID string, pos PositionRequest) error {
+	var task Task
+	if err := scanTask(tx.QueryRow(ctx, selectTaskByTaskIDQuery, taskID), &task); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get task: %w", err)
+	}
+	if task.TodoID != todoID {
+		return errNotFound
+	}
+
+	siblings, err := selectSiblings(ctx, tx, task)
+	if err != nil {
+		return err
+	}
+
+	newRank, err := rankFor(siblings, pos)
+	if errors.Is(err, rank.ErrInvalidRange) {
+		if siblings, err = rerank(ctx, tx, siblings); err != nil {
+			return err
+		}
+		newRank, err = rankFor(siblings, pos)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, updateTaskRankQuery, newRank, taskID); err != nil {
+		return fmt.Errorf("todo_repo update task rank: %w", err)
+	}
+	return nil
+}
+
+// TransferTask moves a task and all of its subtasks to the end of another todo list, as a top-level task.
+// Dependencies between the moved tasks and the tasks left behind are dropped, since they can only
+// exist within a list.
+func (r *Repository) TransferTask(ctx context.Context, userID, fromTodoID, taskID, toTodoID string) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// always lock in the same order so that two opposite transfers cannot deadlock
+	locks := []string{fromTodoID, toTodoID}
+	slices.Sort(locks)
+	for _, id := range slices.Compact(locks) {
+		if _, err := tx.Exec(ctx, lockTaskTreeQuery, id); err != nil {
+			return fmt.Errorf("todo_repo lock task tree: %w", err)
+		}
+	}
+
+	var task Task
+	if err := scanTask(tx.QueryRow(ctx, selectTaskByTaskIDQuery, taskID), &task); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get task: %w", err)
+	}
+	if task.TodoID != fromTodoID {
+		return errNotFound
+	}
+
+	subtree, _, err := selectSubtree(ctx, tx, taskID)
+	if err != nil {
+		return err
+	}
+
+	last, err := lastRank(ctx, tx, toTodoID, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, deleteCrossingDependenciesQuery, subtree); err != nil {
+		return fmt.Errorf("todo_repo delete crossing dependencies: %w", err)
+	}
+	if _, err := tx.Exec(ctx, updateSubtreeTodoQuery, toTodoID, subtree); err != nil {
+		return fmt.Errorf("todo_repo transfer tasks: %w", err)
+	}
+	if _, err := tx.Exec(ctx, updateTaskPlacementQuery, rank.After(last), taskID); err != nil {
+		return fmt.Errorf("todo_repo place task: %w", err)
+	}
+
+	if err := rollUp(ctx, tx, task.ParentID); err != nil {
+		return err
+	}
+
+	for _, id := range []string{fromTodoID, toTodoID} {
+		if err := recordRevision(ctx, tx, userID, id, ActionTaskTransfer); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return nil
+}
+
+// sibling is the part of a task needed to position it among the other children of its parent.
+type sibling struct {
+	id   string
+	rank string
+}
+
+// selectSiblings returns the other children of the task's parent, sorted by rank.
+func selectSiblings(ctx context.Context, tx pgx.Tx, task Task) ([]sibling, error) {
+	rows, err := tx.Query(ctx, selectSiblingRanksQuery, task.TodoID, task.ParentID, task.ID)
+	if err != nil {
+		return nil, fmt.Errorf("todo_repo select siblings: %w", err)
+	}
+	defer rows.Close()
+
+	var siblings []sibling
+	for rows.Next() {
+		var s sibling
+		if err := rows.Scan(&s.id, &s.rank); err != nil {
+			return nil, fmt.Errorf("todo_repo scan sibling: %w", err)
+		}
+		siblings = append(siblings, s)
+	}
+	return siblings, rows.Err()
+}
+
+// rankFor computes the rank which places a task at the requested position among its siblings.
+func rankFor(siblings []sibling, pos PositionRequest) (string, error) {
+	find := func(id *string) (int, error) {
+		if id == nil {
+			return -1, nil
+		}
+		i := slices.IndexFunc(siblings, func(s sibling) bool { return s.id == *id })
+		if i < 0 {
+			return -1, errInvalidPosition
+		}
+		return i, nil
+	}
+
+	after, err := find(pos.AfterID)
+	if err != nil {
+		return "", err
+	}
+	before, err := find(pos.BeforeID)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case after >= 0 && before >= 0:
+		if before != after+1 {
+			return "", errInvalidPosition
+		}
+	case after >= 0:
+		before = after + 1
+	case before >= 0:
+		after = before - 1
+	default:
+		after, before = len(siblings)-1, len(siblings)
+	}
+
+	var lower, upper string
+	if after >= 0 {
+		lower = siblings[after].rank
+	}
+	if before < len(siblings) {
+		upper = siblings[before].rank
+	}
+	return rank.Between(lower, upper)
+}
+
+// rerank gives every sibling a fresh, distinct rank, keeping their current order.
+func rerank(ctx context.Context, tx pgx.Tx, siblings []sibling) ([]sibling, error) {
+	prev := ""
+	for i := range siblings {
+		siblings[i].rank = rank.After(prev)
+		prev = siblings[i].rank
+		if _, err := tx.Exec(ctx, updateTaskRankQuery, siblings[i].rank, siblings[i].id); err != nil {
+			return nil, fmt.Errorf("todo_repo rerank task: %w", err)
+		}
+	}
+	return siblings, nil
+}
+
+// lastRank returns the highest rank among the children of parentID, or among the top-level tasks
+// of the list when parentID is nil. It is empty when there are no such tasks.
+func lastRank(ctx context.Context, tx pgx.Tx, todoID string, parentID *string) (string, error) {
+	var last string
+	if err := tx.QueryRow(ctx, selectLastRankQuery, todoID, parentID).Scan(&last); err != nil {
+		return "", fmt.Errorf("todo_repo select last rank: %w", err)
+	}
+	return last, nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|         BATCH UPDATES          |
+//|++++++++++++++++++++++++++++++++|
+
+// Batch applies a list of task operations to a todo list within a single transaction.
+// In BatchAtomic mode the first failing operation rolls back the whole batch. In BatchBestEffort
+// mode every operation runs in its own savepoint, so a failure only undoes that operation.
+func (r *Repository) Batch(ctx context.Context, userID, todoID string, batch BatchRequest) (BatchResult, error) {
+	result := BatchResult{
+		Mode:    batch.mode(),
+		Results: make([]BatchItemResult, len(batch.Operations)),
+	}
+	for i, op := range batch.Operations {
+		result.Results[i] = BatchItemResult{Index: i, Op: op.Op, TaskID: op.TaskID, Status: BatchStatusSkipped}
+	}
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return BatchResult{}, fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return BatchResult{}, fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	for i, op := range batch.Operations {
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return BatchResult{}, fmt.Errorf("todo_repo savepoint: %w", err)
+		}
+
+		if err := applyBatchOperation(ctx, sp, todoID, op); err != nil {
+			if rbErr := sp.Rollback(ctx); rbErr != nil {
+				return BatchResult{}, fmt.Errorf("todo_repo rollback savepoint: %w", rbErr)
+			}
+			result.Results[i].Status = BatchStatusFailed
+			result.Results[i].Error = batchError(err)
+
+			if result.Mode == BatchAtomic {
+				for j := range i {
+					result.Results[j].Status = BatchStatusRolledBack
+				}
+				return result, nil
+			}
+			continue
+		}
+
+		if err := sp.Commit(ctx); err != nil {
+			return BatchResult{}, fmt.Errorf("todo_repo release savepoint: %w", err)
+		}
+		result.Results[i].Status = BatchStatusOK
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, ActionTaskBatch); err != nil {
+		return BatchResult{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return BatchResult{}, fmt.Errorf("todo_repo commit: %w", err)
+	}
+	result.Committed = true
+	return result, nil
+}
+
+func applyBatchOperation(ctx context.Context, tx pgx.Tx, todoID string, op BatchOperation) error {
+	switch op.Op {
+	case BatchOpComplete, BatchOpUncomplete:
+		return execOnTask(ctx, tx, setTaskDoneQuery, op.TaskID, todoID, op.Op == BatchOpComplete)
+	case BatchOpSetPriority:
+		return execOnTask(ctx, tx, setTaskPriorityQuery, op.TaskID, todoID, *op.Priority)
+	case BatchOpSetDueDate:
+		return execOnTask(ctx, tx, setTaskDueAtQuery, op.TaskID, todoID, op.DueAt)
+	case BatchOpMove:
+		return setTaskPosition(ctx, tx, todoID, op.TaskID, PositionRequest{AfterID: op.AfterID, BeforeID: op.BeforeID})
+	case BatchOpDelete:
+		var parentID *string
+		if err := tx.QueryRow(ctx, trashTaskQuery, op.TaskID, todoID, []int64(nil)).Scan(&parentID); err != nil {
+			if errors.Is(err, pgx.ErrNoRows) {
+				return errNotFound
+			}
+			return fmt.Errorf("todo_repo delete task: %w", err)
+		}
+		return rollUp(ctx, tx, parentID)
+	default:
+		return errInvalidBatchOp
+	}
+}
+
+// execOnTask runs one of the single-column task updates, which take the new value, the task id and
+// the todo id, and then rolls up the done state of the task's ancestors.
+func execOnTask(ctx context.Context, tx pgx.Tx, query, taskID, todoID string, value any) error {
+	var parentID *string
+	if err := tx.QueryRow(ctx, query, value, taskID, todoID).Scan(&parentID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo update task: %w", err)
+	}
+	return rollUp(ctx, tx, parentID)
+}
+
+// batchError turns the error of a failed operation into the message reported back to the client.
+func batchError(err error) string {
+	switch err {
+	case errNotFound:
+		return "task not found"
+	case errInvalidPosition, errInvalidBatchOp:
+		return err.Error()
+	default:
+		return "failed to apply operation"
+	}
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|          DEPENDENCIES          |
+//|++++++++++++++++++++++++++++++++|
+
+// AddDependency records that taskID cannot start before dependsOnID is done.
+// Both tasks have to belong to the todo list, and dependencies which would close a cycle are rejected.
+func (r *Repository) AddDependency(ctx context.Context, userID, todoID, taskID, dependsOnID string) error {
+	if taskID == dependsOnID {
+		return errDepCycle
+	}
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	var dep Task
+	if err := scanTask(tx.QueryRow(ctx, selectTaskByTaskIDQuery, dependsOnID), &dep); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errInvalidDep
+		}
+		return fmt.Errorf("todo_repo get dependency: %w", err)
+	}
+	if dep.TodoID != todoID {
+		return errInvalidDep
+	}
+
+	// the new edge closes a cycle if the dependency already depends on the task
+	var cycle bool
+	if err := tx.QueryRow(ctx, dependencyPathExistsQuery, dependsOnID, taskID).Scan(&cycle); err != nil {
+		return fmt.Errorf("todo_repo check dependency cycle: %w", err)
+	}
+	if cycle {
+		return errDepCycle
+	}
+
+	if _, err := tx.Exec(ctx, insertDependencyQuery, taskID, dependsOnID); err != nil {
+		return fmt.Errorf("todo_repo insert dependency: %w", err)
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, ActionDependencyAdd); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) RemoveDependency(ctx context.Context, userID, todoID, taskID, dependsOnID string) error {
+	if _, err := r.execInList(ctx, userID, todoID, ActionDependencyDrop, deleteDependencyQuery, taskID, dependsOnID); err != nil {
+		return fmt.Errorf("todo_repo delete dependency: %w", err)
+	}
+	return nil
+}
+
+// GetReadyTasks returns a page of the open tasks of a todo list which are not blocked by any dependency,
+// most pressing first, along with the total number of such tasks.
+func (r *Repository) GetReadyTasks(ctx context.Context, userID, todoID string, limit, page int) ([]Task, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countReadyTasksQuery, todoID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("todo_repo count ready tasks: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectReadyTasksQuery, todoID, limit, db.CalculateOffset(page, limit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("todo_repo select ready tasks: %w", err)
+	}
+
+	tasks, err := scanTasks(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := r.loadTaskDetails(ctx, userID, tasks); err != nil {
+		return nil, 0, err
+	}
+	if err := r.loadTaskProgress(ctx, tasks); err != nil {
+		return nil, 0, err
+	}
+
+	return tasks, total, nil
+}
+
+// GetTaskOrder returns every task of a todo list, flattened, in an order which respects their dependencies.
+func (r *Repository) GetTaskOrder(ctx context.Context, userID, todoID string) ([]Task, error) {
+	rows, err := r.pool.Query(ctx, selectTasksByTodoIDQuery, todoID)
+	if err != nil {
+		return nil, fmt.Errorf("todo_repo select tasks: %w", err)
+	}
+
+	tasks, err := scanTasks(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := r.loadTaskDetails(ctx, userID, tasks); err != nil {
+		return nil, err
+	}
+	if err := r.loadTaskProgress(ctx, tasks); err != nil {
+		return nil, err
+	}
+
+	return topologicalOrder(tasks), nil
+}
+
+// loadTaskDependencies fills in the DependsOn and Blocked fields of every task in place.
+func (r *Repository) loadTaskDependencies(ctx context.Context, tasks []Task) error {
+	ids := make([]string, len(tasks))
+	for i := range tasks {
+		ids[i] = tasks[i].ID
+		tasks[i].DependsOn = make([]string, 0)
+		tasks[i].Blocked = false
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	rows, err := r.pool.Query(ctx, selectDependenciesQuery, ids)
+	if err != nil {
+		return fmt.Errorf("todo_repo select dependencies: %w", err)
+	}
+	defer rows.Close()
+
+	type dependency struct {
+		id   string
+		done bool
+	}
+	deps := make(map[string][]dependency)
+	for rows.Next() {
+		var taskID string
+		var d dependency
+		if err := rows.Scan(&taskID, &d.id, &d.done); err != nil {
+			return fmt.Errorf("todo_repo scan dependency: %w", err)
+		}
+		deps[taskID] = append(deps[taskID], d)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("todo_repo scan dependency: %w", err)
+	}
+
+	for i := range tasks {
+		for _, d := range deps[tasks[i].ID] {
+			tasks[i].DependsOn = append(tasks[i].DependsOn, d.id)
+			tasks[i].Blocked = tasks[i].Blocked || !d.done
+		}
+	}
+	return nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|             MY DAY             |
+//|++++++++++++++++++++++++++++++++|
+
+// GetOpenTasks returns a page of the unfinished tasks across every todo list of the user, sorted by
+// priority, then due date and then order, along with the total number of matching tasks.
+func (r *Repository) GetOpenTasks(ctx context.Context, userID string, filter Filter, limit, page int) ([]Task, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countOpenTasksByUserIDQuery, userID, filter.MyDay, filter.tags()).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("todo_repo count open tasks: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectOpenTasksByUserIDQuery, userID, filter.MyDay, limit, db.CalculateOffset(page, limit), filter.tags())
+	if err != nil {
+		return nil, 0, fmt.Errorf("todo_repo select open tasks: %w", err)
+	}
+
+	tasks, err := scanTasks(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if err := r.loadTaskDetails(ctx, userID, tasks); err != nil {
+		return nil, 0, err
+	}
+	if err := r.loadTaskProgress(ctx, tasks); err != nil {
+		return nil, 0, err
+	}
+
+	return tasks, total, nil
+}
+
+// SetMyDay adds the task to, or removes it from, the user's "My Day" focus list.
+func (r *Repository) SetMyDay(ctx context.Context, taskID, userID string, focused bool) error {
+	query := deleteTaskFocusQuery
+	if focused {
+		query = insertTaskFocusQuery
+	}
+
+	if _, err := r.pool.Exec(ctx, query, taskID, userID); err != nil {
+		return fmt.Errorf("todo_repo set my day: %w", err)
+	}
+	return nil
+}
+
+// loadTaskFocus fills in the MyDay field of every task for the user making the request.
+func (r *Repository) loadTaskFocus(ctx context.Context, userID string, tasks []Task) error {
+	if userID == "" || len(tasks) == 0 {
+		return nil
+	}
+
+	ids := make([]string, len(tasks))
+	for i := range tasks {
+		ids[i] = tasks[i].ID
+	}
+
+	rows, err := r.pool.Query(ctx, selectFocusedTaskIDsQuery, userID, ids)
+	if err != nil {
+		return fmt.Errorf("todo_repo select focused tasks: %w", err)
+	}
+	focused, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("todo_repo scan focused tasks: %w", err)
+	}
+
+	for i := range tasks {
+		tasks[i].MyDay = slices.Contains(focused, tasks[i].ID)
+	}
+	return nil
+}
+
+// loadTaskProgress fills in the Progress field of tasks returned without their subtasks.
+func (r *Repository) loadTaskProgress(ctx context.Context, tasks []Task) error {
+	ids := make([]string, len(tasks))
+	for i := range tasks {
+		ids[i] = tasks[i].ID
+	}
+
+	rows, err := r.pool.Query(ctx, selectTaskProgressQuery, ids)
+	if err != nil {
+		return fmt.Errorf("todo_repo select task progress: %w", err)
+	}
+	defer rows.Close()
+
+	type count struct{ done, total int }
+	counts := make(map[string]count)
+	for rows.Next() {
+		var id string
+		var c count
+		if err := rows.Scan(&id, &c.done, &c.total); err != nil {
+			return fmt.Errorf("todo_repo scan task progress: %w", err)
+		}
+		counts[id] = c
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("todo_repo scan task progress: %w", err)
+	}
+
+	for i := range tasks {
+		c := counts[tasks[i].ID]
+		tasks[i].Progress = progress(tasks[i].Done, c.done, c.total)
+	}
+	return nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|             TRASH              |
+//|++++++++++++++++++++++++++++++++|
+
+// GetTrash returns a page of the user's trashed todo lists and tasks, most recently deleted first,
+// along with the total number of entries in the trash.
+func (r *Repository) GetTrash(ctx context.Context, userID string, limit, page int) ([]TrashItem, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countTrashQuery, userID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("todo_repo count trash: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectTrashQuery, userID, limit, db.CalculateOffset(page, limit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("todo_repo select trash: %w", err)
+	}
+	defer rows.Close()
+
+	items := make([]TrashItem, 0)
+	for rows.Next() {
+		var item TrashItem
+		if err := rows.Scan(&item.Type, &item.ID, &item.TodoID, &item.Title, &item.DeletedAt); err != nil {
+			return nil, 0, fmt.Errorf("todo_repo scan trash: %w", err)
+		}
+		items = append(items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("todo_repo select trash: %w", err)
+	}
+
+	return items, total, nil
+}
+
+// RestoreTodo takes a todo list the user is the author or a member of out of the trash.
+func (r *Repository) RestoreTodo(ctx context.Context, userID, id string) error {
+	res, err := r.execInList(ctx, userID, id, ActionTodoRestored, restoreTodoQuery, id, userID)
+	if err != nil {
+		return fmt.Errorf("todo_repo restore todo: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+// RestoreTask takes a task of the todo list out of the trash, along with the subtasks trashed with it.
+// If its parent is still in the trash, or gone for good, it is restored as a top-level task at the end of the list.
+func (r *Repository) RestoreTask(ctx context.Context, userID, todoID, taskID string) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	var parentID *string
+	var deletedAt time.Time
+	if err := tx.QueryRow(ctx, selectTrashedTaskQuery, taskID, todoID).Scan(&parentID, &deletedAt); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get trashed task: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, restoreTaskQuery, taskID, deletedAt); err != nil {
+		return fmt.Errorf("todo_repo restore task: %w", err)
+	}
+
+	if parentID != nil {
+		var parent Task
+		err := scanTask(tx.QueryRow(ctx, selectTaskByTaskIDQuery, *parentID), &parent)
+		if errors.Is(err, pgx.ErrNoRows) {
+			last, err := lastRank(ctx, tx, todoID, nil)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(ctx, updateTaskPlacementQuery, rank.After(last), taskID); err != nil {
+				return fmt.Errorf("todo_repo place task: %w", err)
+			}
+			parentID = nil
+		} else if err != nil {
+			return fmt.Errorf("todo_repo get parent task: %w", err)
+		}
+	}
+
+	if err := rollUp(ctx, tx, parentID); err != nil {
+		return err
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, ActionTaskRestored); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return nil
+}
+
+// PurgeTrash permanently deletes the todo lists and tasks which were moved to the trash before the given time,
+// and forgets the deletions delta sync clients were told about before then.
+// It returns how many lists and tasks were deleted, not counting the tasks deleted along with their list.
+func (r *Repository) PurgeTrash(ctx context.Context, before time.Time) (int64, error) {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	todos, err := tx.Exec(ctx, purgeTodosQuery, before)
+	if err != nil {
+		return 0, fmt.Errorf("todo_repo purge todos: %w", err)
+	}
+	tasks, err := tx.Exec(ctx, purgeTasksQuery, before)
+	if err != nil {
+		return 0, fmt.Errorf("todo_repo purge tasks: %w", err)
+	}
+	if _, err := tx.Exec(ctx, purgeTombstonesQuery, before); err != nil {
+		return 0, fmt.Errorf("todo_repo purge tombstones: %w", err)
+	}
+	if _, err := tx.Exec(ctx, purgeDAVResourcesQuery); err != nil {
+		return 0, fmt.Errorf("todo_repo purge dav resources: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return todos.RowsAffected() + tasks.RowsAffected(), nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|            HISTORY             |
+//|++++++++++++++++++++++++++++++++|
+
+// CompactHistory drops the snapshots of the revisions recorded before the given time, but for the last revision of each
+// list. The revisions stay in the history, but the lists can no longer be reverted to them. It returns how many
+// revisions were compacted.
+func (r *Repository) CompactHistory(ctx context.Context, before time.Time) (int64, error) {
+	res, err := r.pool.Exec(ctx, compactRevisionsQuery, before)
+	if err != nil {
+		return 0, fmt.Errorf("todo_repo compact revisions: %w", err)
+	}
+	return res.RowsAffected(), nil
+}
+
+// GetHistory returns a page of the revisions of a todo list, newest first, along with the total number of revisions.
+func (r *Repository) GetHistory(ctx context.Context, todoID string, limit, page int) ([]Revision, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countRevisionsQuery, todoID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("todo_repo count revisions: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectRevisionsQuery, todoID, limit, db.CalculateOffset(page, limit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("todo_repo select revisions: %w", err)
+	}
+	defer rows.Close()
+
+	revisions := make([]Revision, 0)
+	for rows.Next() {
+		var rev Revision
+		if err := scanRevision(rows, &rev); err != nil {
+			return nil, 0, fmt.Errorf("todo_repo scan revision: %w", err)
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("todo_repo select revisions: %w", err)
+	}
+
+	return revisions, total, nil
+}
+
+// GetRevisionsSince passes the revisions recorded from the since cursor on to fn, oldest transaction first, either of
+// the todo list or, when todoID is empty, of every list of the user, and returns the cursor to read the next ones
+// from. Revisions are numbered as they are recorded but can be committed in another order, so a cursor is a delta
+// sync token rather than a revision id: a revision can be passed again from the next cursor, but is never missed.
+// An empty cursor passes nothing and only returns the current one. Revisions are read limit at a time.
+func (r *Repository) GetRevisionsSince(ctx context.Context, todoID, userID, since string, limit int, fn func(Revision) error) (string, error) {
+	// everything recorded before the token has been committed by the time the revisions are read
+	var next string
+	if err := r.pool.QueryRow(ctx, selectSyncTokenQuery).Scan(&next); err != nil {
+		return "", fmt.Errorf("todo_repo get sync token: %w", err)
+	}
+	if since == "" {
+		return next, nil
+	}
+
+	afterXID, afterID := "0", int64(0)
+	for {
+		rows, err := r.pool.Query(ctx, selectRevisionsSinceQuery, since, todoID, userID, afterXID, afterID, limit)
+		if err != nil {
+			return "", fmt.Errorf("todo_repo select revisions: %w", err)
+		}
+		revisions := make([]Revision, 0, limit)
+		for rows.Next() {
+			var rev Revision
+			if err := rows.Scan(&rev.ID, &rev.TodoID, &rev.ActorID, &rev.Action, &rev.Changes, &rev.CreatedAt, &afterXID); err != nil {
+				rows.Close()
+				return "", fmt.Errorf("todo_repo scan revision: %w", err)
+			}
+			afterID = rev.ID
+			revisions = append(revisions, rev)
+		}
+		if err := rows.Err(); err != nil {
+			return "", fmt.Errorf("todo_repo select revisions: %w", err)
+		}
+
+		for _, rev := range revisions {
+			if err := fn(rev); err != nil {
+				return "", err
+			}
+		}
+		if len(revisions) < limit {
+			return next, nil
+		}
+	}
+}
+
+// RevertTo brings a todo list and its tasks back to the state they were in right after the given revision.
+// Tasks created since are moved to the trash rather than deleted, and the revert is itself recorded as
+// a new revision, so it can be undone in turn. errRevisionCompacted is returned for a revision whose snapshot
+// has been dropped by CompactHistory.
+func (r *Repository) RevertTo(ctx context.Context, userID, todoID string, revisionID int64) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+
+	var snap *snapshot
+	if err := tx.QueryRow(ctx, selectSnapshotQuery, revisionID, todoID).Scan(&snap); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get revision: %w", err)
+	}
+	if snap == nil {
+		return errRevisionCompacted
+	}
+
+	ids := make([]string, 0, len(snap.Tasks))
+	for id := range snap.Tasks {
+		ids = append(ids, id)
+	}
+
+	if _, err := tx.Exec(ctx, revertTodoQuery, todoID, snap.Todo); err != nil {
+		return fmt.Errorf("todo_repo revert todo: %w", err)
+	}
+	if _, err := tx.Exec(ctx, trashTasksNotInQuery, todoID, ids); err != nil {
+		return fmt.Errorf("todo_repo trash new tasks: %w", err)
+	}
+	if _, err := tx.Exec(ctx, revertTasksQuery, snap.taskRows()); err != nil {
+		return fmt.Errorf("todo_repo revert tasks: %w", err)
+	}
+	if _, err := tx.Exec(ctx, deleteListDependencyQuery, todoID); err != nil {
+		return fmt.Errorf("todo_repo delete dependencies: %w", err)
+	}
+	if _, err := tx.Exec(ctx, revertDependenciesQuery, todoID, snap.Dependencies); err != nil {
+		return fmt.Errorf("todo_repo revert dependencies: %w", err)
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, ActionTodoReverted); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return nil
+}
+
+// execInList runs a single statement against a todo list in a transaction holding the list's task tree lock,
+// and records the change in the list's history.
+func (r *Repository) execInList(ctx context.Context, userID, todoID, action, query string, args ...any) (pgconn.CommandTag, error) {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return pgconn.CommandTag{}, fmt.Errorf("begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+		return pgconn.CommandTag{}, fmt.Errorf("lock task tree: %w", err)
+	}
+
+	res, err := tx.Exec(ctx, query, args...)
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, action); err != nil {
+		return pgconn.CommandTag{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return pgconn.CommandTag{}, fmt.Errorf("commit: %w", err)
+	}
+	return res, nil
+}
+
+// recordRevision appends a revision to the history of the todo list, made by the caller, describing how tx
+// changed the list since its previous revision. Nothing is recorded when the list did not change.
+// The caller must hold the list's task tree lock, so that revisions are recorded in the order they are made.
+// The events of the revision are written to the outbox along with it.
+func recordRevision(ctx context.Context, tx pgx.Tx, userID, todoID, action string) error {
+	var prev snapshot
+	if err := tx.QueryRow(ctx, selectLastSnapshotQuery, todoID).Scan(&prev); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return fmt.Errorf("todo_repo get last revision: %w", err)
+	}
+
+	// only the tasks whose version moved since the previous revision are read and compared
+	var (
+		changed snapshot
+		ids     []string
+	)
+	if err := tx.QueryRow(ctx, selectChangedSnapshotQuery, todoID, prev.versions()).Scan(&changed, &ids); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("todo_repo snapshot todo: %w", err)
+	}
+	cur, differ := prev.advance(changed, ids)
+
+	changes := diffSnapshots(todoID, prev, cur, differ)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	var actorID *string
+	if userID != "" {
+		actorID = &userID
+	}
+	rev := Revision{TodoID: todoID, ActorID: actorID, Action: action, Changes: changes}
+	if err := tx.QueryRow(ctx, insertRevisionQuery, todoID, actorID, action, changes, cur).Scan(&rev.ID, &rev.CreatedAt); err != nil {
+		return fmt.Errorf("todo_repo insert revision: %w", err)
+	}
+
+	authorID, _ := cur.Todo["author_id"].(string)
+	for _, e := range rev.Events() {
+		event, err := outbox.NewEvent(e.Type, e.EntityID, authorID, e)
+		if err != nil {
+			return fmt.Errorf("todo_repo: %w", err)
+		}
+		if err := outbox.Write(ctx, tx, event); err != nil {
+			return fmt.Errorf("todo_repo write event: %w", err)
+		}
+	}
+
+	if _, err := tx.Exec(ctx, notifyRevisionQuery, rev.ID, todoID); err != nil {
+		return fmt.Errorf("todo_repo notify revision: %w", err)
+	}
+	return nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|           DELTA SYNC           |
+//|++++++++++++++++++++++++++++++++|
+
+// GetChanges returns the user's todo lists and tasks changed since the given sync token, along with the ones
+// deleted since, and the token to ask for the next changes with. An empty token asks for every list and task
+// the user has. A change can be returned more than once, but is never missed. errSyncTokenExpired is returned
+// when deletions made after the token have already been forgotten.
+func (r *Repository) GetChanges(ctx context.Context, userID, since string) (SyncChanges, error) {
+	var token *string
+	if since != "" {
+		if _, err := strconv.ParseUint(since, 10, 64); err != nil {
+			return SyncChanges{}, errInvalidSyncToken
+		}
+		token = &since
+	}
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return SyncChanges{}, fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	changes := SyncChanges{Todos: make([]Todo, 0), Tasks: make([]Task, 0), Deleted: make([]Tombstone, 0)}
+	if err := tx.QueryRow(ctx, selectSyncTokenQuery).Scan(&changes.Token); err != nil {
+		return SyncChanges{}, fmt.Errorf("todo_repo get sync token: %w", err)
+	}
+
+	if token != nil {
+		var expired bool
+		if err := tx.QueryRow(ctx, syncTokenExpiredQuery, since).Scan(&expired); err != nil {
+			return SyncChanges{}, fmt.Errorf("todo_repo check sync token: %w", err)
+		}
+		if expired {
+			return SyncChanges{}, errSyncTokenExpired
+		}
+	}
+
+	rows, err := tx.Query(ctx, selectChangedTodosQuery, userID, token)
+	if err != nil {
+		return SyncChanges{}, fmt.Errorf("todo_repo select changed todos: %w", err)
+	}
+	for rows.Next() {
+		t := Todo{Tasks: make([]Task, 0)}
+		var deletedAt *time.Time
+		if err := rows.Scan(&t.ID, &t.AuthorID, &t.Name, &t.ArchivedAt, &t.Version, &deletedAt); err != nil {
+			rows.Close()
+			return SyncChanges{}, fmt.Errorf("todo_repo scan todo: %w", err)
+		}
+		if deletedAt != nil {
+			changes.Deleted = append(changes.Deleted, Tombstone{Entity: EntityTodo, ID: t.ID, TodoID: t.ID, DeletedAt: *deletedAt})
+			continue
+		}
+		changes.Todos = append(changes.Todos, t)
+	}
+	if err := rows.Err(); err != nil {
+		return SyncChanges{}, fmt.Errorf("todo_repo select changed todos: %w", err)
+	}
+
+	rows, err = tx.Query(ctx, selectChangedTasksQuery, userID, token)
+	if err != nil {
+		return SyncChanges{}, fmt.Errorf("todo_repo select changed tasks: %w", err)
+	}
+	for rows.Next() {
+		t := Task{Subtasks: make([]Task, 0)}
+		var deletedAt *time.Time
+		if err := rows.Scan(&t.ID, &t.TodoID, &t.Order, &t.Content, &t.Done, &t.Priority, &t.DueAt, &t.Recurrence, &t.ParentID, &t.AutoComplete, &t.Rank, &t.Version, &deletedAt); err != nil {
+			rows.Close()
+			return SyncChanges{}, fmt.Errorf("todo_repo scan task: %w", err)
+		}
+		if deletedAt != nil {
+			changes.Deleted = append(changes.Deleted, Tombstone{Entity: EntityTask, ID: t.ID, TodoID: t.TodoID, DeletedAt: *deletedAt})
+			continue
+		}
+		changes.Tasks = append(changes.Tasks, t)
+	}
+	if err := rows.Err(); err != nil {
+		return SyncChanges{}, fmt.Errorf("todo_repo select changed tasks: %w", err)
+	}
+
+	if token != nil {
+		rows, err = tx.Query(ctx, selectTombstonesQuery, userID, token)
+		if err != nil {
+			return SyncChanges{}, fmt.Errorf("todo_repo select tombstones: %w", err)
+		}
+		for rows.Next() {
+			var t Tombstone
+			if err := rows.Scan(&t.Entity, &t.ID, &t.TodoID, &t.DeletedAt); err != nil {
+				rows.Close()
+				return SyncChanges{}, fmt.Errorf("todo_repo scan tombstone: %w", err)
+			}
+			changes.Deleted = append(changes.Deleted, t)
+		}
+		if err := rows.Err(); err != nil {
+			return SyncChanges{}, fmt.Errorf("todo_repo select tombstones: %w", err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return SyncChanges{}, fmt.Errorf("todo_repo commit: %w", err)
+	}
+
+	// tags and dependencies bump the version of what they belong to, so they are sent again whenever they change
+	if err := r.loadTodoTags(ctx, changes.Todos); err != nil {
+		return SyncChanges{}, err
+	}
+	if err := r.loadTaskDetails(ctx, userID, changes.Tasks); err != nil {
+		return SyncChanges{}, err
+	}
+	return changes, nil
+}
+
+// Push applies the mutations queued by an offline client of the user, in order and each on its own, so that
+// a mutation which cannot be applied does not hold back the others. Mutations can name a list or task created
+// earlier in the same push by the ClientID of its create. See MutationResult for how conflicts are resolved.
+func (r *Repository) Push(ctx context.Context, userID string, req PushRequest) PushResult {
+	result := PushResult{Results: make([]MutationResult, len(req.Mutations))}
+	created := make(map[string]string)
+
+	for i, m := range req.Mutations {
+		m.TodoID = cmp.Or(created[m.TodoID], m.TodoID)
+		m.TaskID = cmp.Or(created[m.TaskID], m.TaskID)
+		if m.Task != nil && m.Task.ParentID != nil {
+			parentID := cmp.Or(created[*m.Task.ParentID], *m.Task.ParentID)
+			m.Task.ParentID = &parentID
+		}
+
+		result.Results[i] = r.applyMutation(ctx, userID, m)
+		if result.Results[i].Status == MutationApplied && (m.Op == MutationCreateTodo || m.Op == MutationCreateTask) {
+			created[m.ClientID] = result.Results[i].ID
+		}
+	}
+	return result
+}
+
+func (r *Repository) applyMutation(ctx context.Context, userID string, m Mutation) MutationResult {
+	res := MutationResult{ClientID: m.ClientID, Op: m.Op, Status: MutationApplied}
+	var ifMatch []int64
+	if m.BaseVersion != nil {
+		ifMatch = []int64{*m.BaseVersion}
+	}
+
+	var err error
+	switch m.Op {
+	case MutationCreateTodo:
+		var todo Todo
+		todo, err = r.Create(ctx, TodoRequest{AuthorID: userID, Name: m.Name, Tasks: []Task{}})
+		res.ID = todo.ID
+	case MutationUpdateTodo:
+		res.ID = m.TodoID
+		if err = r.checkTodoAccess(ctx, m.TodoID, userID); err == nil {
+			err = r.Update(ctx, userID, m.TodoID, TodoRequest{Name: m.Name}, ifMatch)
+		}
+	case MutationDeleteTodo:
+		res.ID = m.TodoID
+		if err = r.checkTodoAccess(ctx, m.TodoID, userID); err == nil {
+			err = r.DeleteTodo(ctx, userID, m.TodoID, ifMatch)
+		}
+	case MutationCreateTask:
+		if err = r.checkTodoAccess(ctx, m.TodoID, userID); err == nil {
+			task := *m.Task
+			task.TodoID = m.TodoID
+			res.ID, err = r.createTask(ctx, userID, task)
+		}
+	case MutationUpdateTask:
+		res.ID = m.TaskID
+		if err = r.checkTaskAccess(ctx, m.TodoID, m.TaskID, userID); err == nil {
+			var data json.RawMessage
+			if data, err = m.taskData(); err == nil {
+				err = r.MergeTask(ctx, userID, m.TodoID, m.TaskID, data, ifMatch)
+			}
+		}
+	case MutationDeleteTask:
+		res.ID = m.TaskID
+		if err = r.checkTaskAccess(ctx, m.TodoID, m.TaskID, userID); err == nil {
+			err = r.DeleteTask(ctx, userID, m.TodoID, m.TaskID, ifMatch)
+		}
+	}
+
+	deletion := m.Op == MutationDeleteTodo || m.Op == MutationDeleteTask
+	switch err {
+	case nil:
+		if deletion {
+			return res
+		}
+	case errNotFound:
+		// whatever was deleted on the server stays deleted, and deleting it again changes nothing
+		if !deletion {
+			res.Status = MutationConflict
+			res.Error = "not found or deleted"
+		}
+		return res
+	case errVersionMismatch:
+		res.Status = MutationConflict
+		res.Error = err.Error()
+	case errInvalidParent, errTaskTooDeep, errInvalidPatchResult:
+		res.Status = MutationRejected
+		res.Error = err.Error()
+		return res
+	default:
+		res.Status = MutationFailed
+		res.Error = "failed to apply mutation"
+		res.err = err
+		return res
+	}
+
+	if err := r.loadMutationEntity(ctx, userID, m, &res); err != nil {
+		res.Status = MutationFailed
+		res.Error = "failed to load the current state"
+		res.err = err
+	}
+	return res
+}
+
+// loadMutationEntity fills in the current state of the list or task a mutation was about, unless it no longer exists.
+func (r *Repository) loadMutationEntity(ctx context.Context, userID string, m Mutation, res *MutationResult) error {
+	switch m.Op {
+	case MutationCreateTodo, MutationUpdateTodo, MutationDeleteTodo:
+		todo, err := r.GetByID(ctx, userID, res.ID)
+		if err != nil {
+			if err == errNotFound {
+				return nil
+			}
+			return err
+		}
+		res.Todo = &todo
+	default:
+		task, err := r.GetTask(ctx, userID, m.TodoID, res.ID)
+		if err != nil {
+			if err == errNotFound {
+				return nil
+			}
+			return err
+		}
+		res.Task = &task
+	}
+	return nil
+}
+
+// checkTodoAccess returns errNotFound unless the todo list exists and the user is its author or one of its members.
+func (r *Repository) checkTodoAccess(ctx context.Context, todoID, userID string) error {
+	var todo Todo
+	if err := scanTodo(r.pool.QueryRow(ctx, selectAccessibleTodoQuery, todoID, userID), &todo); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get todo: %w", err)
+	}
+	return nil
+}
+
+// checkTaskAccess returns errNotFound unless the task exists in the todo list, and the user can access the list.
+func (r *Repository) checkTaskAccess(ctx context.Context, todoID, taskID, userID string) error {
+	if err := r.checkTodoAccess(ctx, todoID, userID); err != nil {
+		return err
+	}
+	var task Task
+	if err := scanTask(r.pool.QueryRow(ctx, selectTaskByTaskIDQuery, taskID), &task); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errNotFound
+		}
+		return fmt.Errorf("todo_repo get task: %w", err)
+	}
+	if task.TodoID != todoID {
+		return errNotFound
+	}
+	return nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|             CALDAV             |
+//|++++++++++++++++++++++++++++++++|
+
+// davCalendars returns the active todo lists of the user as calendars, or only the one with todoID when it is not empty.
+func (r *Repository) davCalendars(ctx context.Context, userID, todoID string) ([]davCalendar, error) {
+	var id *string
+	if todoID != "" {
+		id = &todoID
+	}
+
+	rows, err := r.pool.Query(ctx, selectDAVCalendarsQuery, userID, id)
+	if err != nil {
+		return nil, fmt.Errorf("todo_repo select calendars: %w", err)
+	}
+	defer rows.Close()
+
+	calendars := make([]davCalendar, 0)
+	for rows.Next() {
+		var c davCalendar
+		if err := rows.Scan(&c.ID, &c.Name, &c.Version); err != nil {
+			return nil, fmt.Errorf("todo_repo scan calendar: %w", err)
+		}
+		calendars = append(calendars, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("todo_repo select calendars: %w", err)
+	}
+	return calendars, nil
+}
+
+// davCalendar returns a todo list of the user as a calendar, or errNotFound when it is not one of their active lists.
+func (r *Repository) davCalendar(ctx context.Context, userID, todoID string) (davCalendar, error) {
+	calendars, err := r.davCalendars(ctx, userID, todoID)
+	if err != nil {
+		return davCalendar{}, err
+	}
+	if len(calendars) == 0 {
+		return davCalendar{}, errNotFound
+	}
+	return calendars[0], nil
+}
+
+// davSyncToken returns the sync token to ask for the changes made from now on with.
+func (r *Repository) davSyncToken(ctx context.Context) (string, error) {
+	var token string
+	if err := r.pool.QueryRow(ctx, selectSyncTokenQuery).Scan(&token); err != nil {
+		return "", fmt.Errorf("todo_repo get sync token: %w", err)
+	}
+	return token, nil
+}
+
+// davResources returns the tasks of the todo list with the resource names, or all of them when names is nil.
+func (r *Repository) davResources(ctx context.Context, todoID string, names []string) ([]davResource, error) {
+	rows, err := r.pool.Query(ctx, selectDAVResourcesQuery, todoID, names)
+	if err != nil {
+		return nil, fmt.Errorf("todo_repo select dav resources: %w", err)
+	}
+	return scanDAVResources(rows)
+}
+
+// davResource returns the task of the todo list with the resource name, or errNotFound.
+func (r *Repository) davResource(ctx context.Context, todoID, name string) (davResource, error) {
+	resources, err := r.davResources(ctx, todoID, []string{name})
+	if err != nil {
+		return davResource{}, err
+	}
+	if len(resources) == 0 {
+		return davResource{}, errNotFound
+	}
+	return resources[0], nil
+}
+
+// davChanges returns the tasks of the todo list changed since the sync token, the ones deleted since being marked
+// Deleted, along with the token to ask for the next changes with. An empty token asks for every task of the list.
+// Like GetChanges, it returns errInvalidSyncToken and errSyncTokenExpired.
+func (r *Repository) davChanges(ctx context.Context, todoID, since string) ([]davResource, string, error) {
+	var token *string
+	if since != "" {
+		if _, err := strconv.ParseUint(since, 10, 64); err != nil {
+			return nil, "", errInvalidSyncToken
+		}
+		token = &since
+	}
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, "", fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var next string
+	if err := tx.QueryRow(ctx, selectSyncTokenQuery).Scan(&next); err != nil {
+		return nil, "", fmt.Errorf("todo_repo get sync token: %w", err)
+	}
+
+	if token != nil {
+		var expired bool
+		if err := tx.QueryRow(ctx, syncTokenExpiredQuery, since).Scan(&expired); err != nil {
+			return nil, "", fmt.Errorf("todo_repo check sync token: %w", err)
+		}
+		if expired {
+			return nil, "", errSyncTokenExpired
+		}
+	}
+
+	rows, err := tx.Query(ctx, selectChangedDAVResourcesQuery, todoID, token)
+	if err != nil {
+		return nil, "", fmt.Errorf("todo_repo select changed dav resources: %w", err)
+	}
+	resources, err := scanDAVResources(rows)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if token != nil {
+		rows, err := tx.Query(ctx, selectDAVTombstonesQuery, todoID, token)
+		if err != nil {
+			return nil, "", fmt.Errorf("todo_repo select dav tombstones: %w", err)
+		}
+		names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return nil, "", fmt.Errorf("todo_repo select dav tombstones: %w", err)
+		}
+		for _, name := range names {
+			resources = append(resources, davResource{Name: name, Deleted: true})
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, "", fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return resources, next, nil
+}
+
+// createDAVResource adds a task to a todo list under the resource name and UID a CalDAV client chose for it. When
+// parentUID is not empty, the task is added under the task of the list with that UID, if there is one. When a task of
+// the list already goes by the name, as happens when a client retries a request, errDAVResourceExists is returned.
+func (r *Repository) createDAVResource(ctx context.Context, userID string, task Task, name, uid, parentUID string) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	// holding the lock, no other request can take the name until this one is done
+	if _, err := tx.Exec(ctx, lockTaskTreeQuery, task.TodoID); err != nil {
+		return fmt.Errorf("todo_repo lock task tree: %w", err)
+	}
+	var taken bool
+	if err := tx.QueryRow(ctx, selectDAVNameTakenQuery, task.TodoID, name).Scan(&taken); err != nil {
+		return fmt.Errorf("todo_repo check dav resource name: %w", err)
+	}
+	if taken {
+		return errDAVResourceExists
+	}
+	if _, err := tx.Exec(ctx, releaseDAVNameQuery, task.TodoID, name); err != nil {
+		return fmt.Errorf("todo_repo release dav resource name: %w", err)
+	}
+
+	if parentUID != "" {
+		var parentID string
+		err := tx.QueryRow(ctx, selectTaskIDByUIDQuery, task.TodoID, parentUID).Scan(&parentID)
+		switch {
+		case err == nil:
+			task.ParentID = &parentID
+		case !errors.Is(err, pgx.ErrNoRows):
+			return fmt.Errorf("todo_repo select parent task: %w", err)
+		}
+	}
+
+	id, err := addTask(ctx, tx, userID, task)
+	if err != nil {
+		return err
+	}
+
+	var uidValue *string
+	if uid != "" {
+		uidValue = &uid
+	}
+	if _, err := tx.Exec(ctx, insertDAVResourceQuery, id, task.TodoID, name, uidValue); err != nil {
+		return fmt.Errorf("todo_repo insert dav resource: %w", err)
+	}
+
+	if err := recordRevision(ctx, tx, userID, task.TodoID, ActionTaskCreated); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return nil
+}
+
+func scanDAVResources(rows pgx.Rows) ([]davResource, error) {
+	defer rows.Close()
+
+	resources := make([]davResource, 0)
+	for rows.Next() {
+		var res davResource
+		t := &res.Task
+		if err := rows.Scan(&t.ID, &t.TodoID, &t.Order, &t.Content, &t.Done, &t.Priority, &t.DueAt, &t.Recurrence, &t.ParentID, &t.AutoComplete, &t.Rank, &t.Version,
+			&res.CompletedAt, &res.Name, &res.UID, &res.ParentUID, &res.Deleted); err != nil {
+			return nil, fmt.Errorf("todo_repo scan dav resource: %w", err)
+		}
+		resources = append(resources, res)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("todo_repo scan dav resource: %w", err)
+	}
+	return resources, nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|        IMPORT / EXPORT         |
+//|++++++++++++++++++++++++++++++++|
+
+// Import appends the tasks read from tasks to the todo list todoID or, when todoID is empty, to a new list of the
+// user called name, all in a single revision. A task is nested under the last task read at the depth above its own,
+// at most one level deeper than the task before it and no deeper than tasks can go. Tags are looked up by name among
+// the user's tags and created when missing. A dry run goes through the whole import and rolls it back, reporting the
+// first tasks it would have created.
+func (r *Repository) Import(ctx context.Context, userID, todoID, name string, tasks ImportReader, dryRun bool) (ImportResult, error) {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return ImportResult{}, fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	action, prevRank := ActionTaskImported, ""
+	if todoID == "" {
+		if todoID, err = nanoid.New(21); err != nil {
+			return ImportResult{}, fmt.Errorf("todo_repo generating id: %w", err)
+		}
+		if _, err := tx.Exec(ctx, insertTodoQuery, todoID, userID, name); err != nil {
+			return ImportResult{}, fmt.Errorf("todo_repo insert todo: %w", err)
+		}
+		action = ActionTodoCreated
+	} else {
+		if _, err := tx.Exec(ctx, lockTaskTreeQuery, todoID); err != nil {
+			return ImportResult{}, fmt.Errorf("todo_repo lock task tree: %w", err)
+		}
+		if prevRank, err = lastRank(ctx, tx, todoID, nil); err != nil {
+			return ImportResult{}, err
+		}
+	}
+
+	res := ImportResult{DryRun: dryRun, TodoID: todoID, NewTags: make([]string, 0), Skipped: make([]SkippedLine, 0)}
+	tagIDs := make(map[string]string)
+	// parents holds the ids of the last tasks read at each depth, and ranks the last rank given under each parent
+	var parents []string
+	ranks := map[string]string{"": prevRank}
+	for {
+		t, err := tasks.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var skipped SkippedLine
+		if errors.As(err, &skipped) {
+			res.skip(skipped)
+			continue
+		}
+		if err != nil {
+			return ImportResult{}, fmt.Errorf("%w: %w", errInvalidImport, err)
+		}
+		if t.Content == "" {
+			res.skip(SkippedLine{Line: t.Line, Reason: "the task has no content"})
+			continue
+		}
+
+		id, err := nanoid.New(21)
+		if err != nil {
+			return ImportResult{}, fmt.Errorf("todo_repo generating id: %w", err)
+		}
+		t.Depth = min(max(t.Depth, 0), len(parents), maxTaskDepth-1)
+		parentID := ""
+		if t.Depth > 0 {
+			parentID = parents[t.Depth-1]
+		}
+		parents = append(parents[:t.Depth], id)
+		ranks[parentID] = rank.After(ranks[parentID])
+
+		task := Task{ID: id, TodoID: todoID, Content: t.Content, Done: t.Done, Priority: t.Priority, DueAt: t.DueAt, Rank: ranks[parentID]}
+		if parentID != "" {
+			task.ParentID = &parentID
+		}
+		if _, err := tx.Exec(ctx, insertImportedTaskQuery, task.ID, task.TodoID, task.Order, task.Content, task.Done, task.Priority,
+			task.DueAt, task.Recurrence, task.ParentID, task.AutoComplete, task.Rank, t.CreatedAt, t.CompletedAt); err != nil {
+			return ImportResult{}, fmt.Errorf("todo_repo insert task: %w", err)
+		}
+
+		for _, name := range t.Tags {
+			tagID, ok := tagIDs[name]
+			if !ok {
+				var created bool
+				if tagID, created, err = importTag(ctx, tx, userID, name); err != nil {
+					return ImportResult{}, err
+				}
+				if created {
+					res.NewTags = append(res.NewTags, name)
+				}
+				tagIDs[name] = tagID
+			}
+			if _, err := tx.Exec(ctx, insertTaskTagQuery, task.ID, tagID); err != nil {
+				return ImportResult{}, fmt.Errorf("todo_repo tag task: %w", err)
+			}
+		}
+
+		res.Created++
+		if dryRun && len(res.Tasks) < maxImportReport {
+			res.Tasks = append(res.Tasks, t)
+		}
+	}
+
+	if dryRun {
+		if action == ActionTodoCreated {
+			res.TodoID = ""
+		}
+		return res, nil
+	}
+
+	if err := recordRevision(ctx, tx, userID, todoID, action); err != nil {
+		return ImportResult{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return ImportResult{}, fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return res, nil
+}
+
+// importTag returns the id of the user's tag called name, creating the tag when the user has none by that name.
+func importTag(ctx context.Context, tx pgx.Tx, userID, name string) (string, bool, error) {
+	var id string
+	err := tx.QueryRow(ctx, selectTagIDByNameQuery, userID, name).Scan(&id)
+	if err == nil {
+		return id, false, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return "", false, fmt.Errorf("todo_repo select tag: %w", err)
+	}
+
+	if id, err = nanoid.New(21); err != nil {
+		return "", false, fmt.Errorf("todo_repo generating id: %w", err)
+	}
+	if _, err := tx.Exec(ctx, insertImportedTagQuery, id, userID, name, tag.DefaultColor); err != nil {
+		return "", false, fmt.Errorf("todo_repo insert tag: %w", err)
+	}
+	return id, true, nil
+}
+
+// ExportTasks returns the tasks of a todo list in display order, each subtask right after its parent.
+func (r *Repository) ExportTasks(ctx context.Context, todoID string) ([]FileTask, error) {
+	tasks, err := r.GetTasks(ctx, "", todoID, Filter{})
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := r.pool.Query(ctx, selectTaskDatesQuery, todoID)
+	if err != nil {
+		return nil, fmt.Errorf("todo_repo select task dates: %w", err)
+	}
+	defer rows.Close()
+
+	created := make(map[string]*time.Time)
+	completed := make(map[string]*time.Time)
+	for rows.Next() {
+		var id string
+		var createdAt time.Time
+		var completedAt *time.Time
+		if err := rows.Scan(&id, &createdAt, &completedAt); err != nil {
+			return nil, fmt.Errorf("todo_repo scan task dates: %w", err)
+		}
+		created[id], completed[id] = &createdAt, completedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("todo_repo select task dates: %w", err)
+	}
+
+	files := make([]FileTask, 0, len(created))
+	var flatten func(tasks []Task, depth int)
+	flatten = func(tasks []Task, depth int) {
+		for _, t := range tasks {
+			f := FileTask{
+				Depth:       depth,
+				Content:     t.Content,
+				Done:        t.Done,
+				Priority:    t.Priority,
+				DueAt:       t.DueAt,
+				CreatedAt:   created[t.ID],
+				CompletedAt: completed[t.ID],
+				Tags:        make([]string, 0, len(t.Tags)),
+			}
+			for _, tg := range t.Tags {
+				f.Tags = append(f.Tags, tg.Name)
+			}
+			files = append(files, f)
+			flatten(t.Subtasks, depth+1)
+		}
+	}
+	flatten(tasks, 0)
+	return files, nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|            MEMBERS             |
+//|++++++++++++++++++++++++++++++++|
+
+// AddMember shares the todo list with the user memberID on behalf of userID, who is told about it through the outbox.
+// Sharing a list twice with the same user is a no-op.
+func (r *Repository) AddMember(ctx context.Context, userID, todoID, memberID string) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("todo_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	res, err := tx.Exec(ctx, insertMemberQuery, todoID, memberID)
+	if err != nil {
+		return fmt.Errorf("todo_repo add member: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		var exists bool
+		if err := tx.QueryRow(ctx, selectUserExistsQuery, memberID).Scan(&exists); err != nil {
+			return fmt.Errorf("todo_repo select user: %w", err)
+		}
+		if !exists {
+			return errUserNotFound
+		}
+		return nil
+	}
+
+	e := Event{Type: EventShared, TodoID: todoID, EntityID: memberID, ActorID: &userID, CreatedAt: time.Now().UTC()}
+	event, err := outbox.NewEvent(e.Type, todoID, memberID, e)
+	if err != nil {
+		return fmt.Errorf("todo_repo: %w", err)
+	}
+	if err := outbox.Write(ctx, tx, event); err != nil {
+		return fmt.Errorf("todo_repo write event: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("todo_repo commit: %w", err)
+	}
+	return nil
+}
+
+// RemoveMember stops sharing the todo list with the user. Removing a user who is not a member is a no-op.
+func (r *Repository) RemoveMember(ctx context.Context, todoID, memberID string) error {
+	if _, err := r.pool.Exec(ctx, deleteMemberQuery, todoID, memberID); err != nil {
+		return fmt.Errorf("todo_repo remove member: %w", err)
+	}
+	return nil
+}
+
+// GetMembers returns the users the todo list is shared with, in the order it was shared with them.
+func (r *Repository) GetMembers(ctx context.Context, todoID string) ([]Member, error) {
+	rows, err := r.pool.Query(ctx, selectMembersQuery, todoID)
+	if err != nil {
+		return nil, fmt.Errorf("todo_repo select members: %w", err)
+	}
+	defer rows.Close()
+
+	members := make([]Member, 0)
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.TodoID, &m.UserID, &m.CreatedAt); err != nil {
+			return nil, fmt.Errorf("todo_repo scan members: %w", err)
+		}
+		members = append(members, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("todo_repo select members: %w", err)
+	}
+	return members, nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|              TAGS              |
+//|++++++++++++++++++++++++++++++++|
+
+// AttachTodoTag labels a todo list with one of the user's tags. Attaching a tag twice is a no-op.
+func (r *Repository) AttachTodoTag(ctx context.Context, todoID, tagID, userID string) error {
+	if err := r.checkTagOwner(ctx, tagID, userID); err != nil {
+		return err
+	}
+
+	if _, err := r.pool.Exec(ctx, insertTodoTagQuery, todoID, tagID); err != nil {
+		return fmt.Errorf("todo_repo attach todo tag: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) DetachTodoTag(ctx context.Context, todoID, tagID string) error {
+	if _, err := r.pool.Exec(ctx, deleteTodoTagQuery, todoID, tagID); err != nil {
+		return fmt.Errorf("todo_repo detach todo tag: %w", err)
+	}
+	return nil
+}
+
+// AttachTaskTag labels a task with one of the user's tags. Attaching a tag twice is a no-op.
+func (r *Repository) AttachTaskTag(ctx context.Context, taskID, tagID, userID string) error {
+	if err := r.checkTagOwner(ctx, tagID, userID); err != nil {
+		return err
+	}
+
+	if _, err := r.pool.Exec(ctx, insertTaskTagQuery, taskID, tagID); err != nil {
+		return fmt.Errorf("todo_repo attach task tag: %w", err)
+	}
+	return nil
+}
+
+func (r *Repository) DetachTaskTag(ctx context.Context, taskID, tagID string) error {
+	if _, err := r.pool.Exec(ctx, deleteTaskTagQuery, taskID, tagID); err != nil {
+		return fmt.Errorf("todo_repo detach task tag: %w", err)
+	}
+	return nil
+}
+
+// checkTagOwner returns errTagNotFound unless the tag exists and belongs to the user.
+func (r *Repository) checkTagOwner(ctx context.Context, tagID, userID string) error {
+	var ownerID string
+	if err := r.pool.QueryRow(ctx, selectTagOwnerQuery, tagID).Scan(&ownerID); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return errTagNotFound
+		}
+		return fmt.Errorf("todo_repo get tag owner: %w", err)
+	}
+	if ownerID != userID {
+		return errTagNotFound
+	}
+	return nil
+}
+
+// loadTodoTags fills in the Tags field of every todo in place.
+func (r *Repository) loadTodoTags(ctx context.Context, todos []Todo) error {
+	ids := make([]string, len(todos))
+	for i := range todos {
+		ids[i] = todos[i].ID
+		todos[i].Tags = make([]tag.Tag, 0)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tags, err := r.selectTags(ctx, selectTagsByTodoIDsQuery, ids)
+	if err != nil {
+		return fmt.Errorf("todo_repo select todo tags: %w", err)
+	}
+	for i := range todos {
+		todos[i].Tags = append(todos[i].Tags, tags[todos[i].ID]...)
+	}
+	return nil
+}
+
+// loadTaskDetails fills in the fields of every task that are not stored in the tasks table.
+func (r *Repository) loadTaskDetails(ctx context.Context, userID string, tasks []Task) error {
+	if err := r.loadTaskTags(ctx, tasks); err != nil {
+		return err
+	}
+	if err := r.loadTaskDependencies(ctx, tasks); err != nil {
+		return err
+	}
+	return r.loadTaskFocus(ctx, userID, tasks)
+}
+
+// loadTaskTags fills in the Tags field of every task in place.
+func (r *Repository) loadTaskTags(ctx context.Context, tasks []Task) error {
+	ids := make([]string, len(tasks))
+	for i := range tasks {
+		ids[i] = tasks[i].ID
+		tasks[i].Tags = make([]tag.Tag, 0)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	tags, err := r.selectTags(ctx, selectTagsByTaskIDsQuery, ids)
+	if err != nil {
+		return fmt.Errorf("todo_repo select task tags: %w", err)
+	}
+	for i := range tasks {
+		tasks[i].Tags = append(tasks[i].Tags, tags[tasks[i].ID]...)
+	}
+	return nil
+}
+
+// selectTags runs one of the tag lookup queries and groups the resulting tags by the id they are attached to.
+func (r *Repository) selectTags(ctx context.Context, query string, ids []string) (map[string][]tag.Tag, error) {
+	rows, err := r.pool.Query(ctx, query, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]tag.Tag)
+	for rows.Next() {
+		var ownerID string
+		var t tag.Tag
+		if err := rows.Scan(&ownerID, &t.ID, &t.UserID, &t.Name, &t.Color); err != nil {
+			return nil, err
+		}
+		tags[ownerID] = append(tags[ownerID], t)
+	}
+	return tags, rows.Err()
+}
+
+func scanTasks(rows pgx.Rows) ([]Task, error) {
+	defer rows.Close()
+
+	tasks := make([]Task, 0)
+	for rows.Next() {
+		task := Task{Subtasks: make([]Task, 0)}
+		if err := scanTask(rows, &task); err != nil {
+			return nil, fmt.Errorf("todo_repo scan task: %w", err)
+		}
+		tasks = append(tasks, task)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("todo_repo scan task: %w", err)
+	}
+
+	return tasks, nil
+}
+
+// scanTodo scans a row selected with todoColumns into todo.
+func scanTodo(row pgx.Row, todo *Todo) error {
+	return row.Scan(&todo.ID, &todo.AuthorID, &todo.Name, &todo.ArchivedAt, &todo.Version)
+}
+
+// scanRevision scans a row selected from todo_revisions without its snapshot into rev.
+func scanRevision(row pgx.Row, rev *Revision) error {
+	return row.Scan(&rev.ID, &rev.TodoID, &rev.ActorID, &rev.Action, &rev.Changes, &rev.CreatedAt)
+}
+
+// scanTask scans a row selected with taskColumns into task.
+func scanTask(row pgx.Row, task *Task) error {
+	return row.Scan(&task.ID, &task.TodoID, &task.Order, &task.Content, &task.Done, &task.Priority, &task.DueAt, &task.Recurrence, &task.ParentID, &task.AutoComplete, &task.Rank, &task.Version)
+}
@@ -1,30 +1,121 @@
 package todo
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"mime"
 	"net/http"
+	"slices"
 	"strconv"
+	"time"
 
+	"github.com/akalpaki/todo/pkg/patch"
 	"github.com/akalpaki/todo/pkg/web"
 )
 
-func Routes(logger *slog.Logger, repository *Repository) http.Handler {
+// Routes returns the v1 todo API. Its collection endpoints keep the original
+// contract: a bare JSON array, and a 404 when the user has no todo lists.
+func Routes(logger *slog.Logger, repository *Repository, broker *Broker, idempotency web.IdempotencyStore) http.Handler {
 	mux := http.NewServeMux()
 
-	// TODO routes
-	mux.HandleFunc("POST /", web.Access(web.Auth(HandleCreate(logger, repository)), logger))
 	mux.HandleFunc("GET /", web.Access(web.Auth(HandleGetForUser(logger, repository)), logger))
+	mux.HandleFunc("GET /{id}/items", web.Access(web.Auth(HandleGetTasks(logger, repository)), logger))
+	registerRoutes(mux, logger, repository, broker, idempotency)
+
+	return mux
+}
+
+// RoutesV2 returns the v2 todo API. Its collection endpoints always respond with
+// a web.Page, so an empty collection is a 200 with an empty items array.
+func RoutesV2(logger *slog.Logger, repository *Repository, broker *Broker, idempotency web.IdempotencyStore) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /", web.Access(web.Auth(HandleGetForUserV2(logger, repository)), logger))
+	mux.HandleFunc("GET /{id}/items", web.Access(web.Auth(HandleGetTasksV2(logger, repository)), logger))
+	registerRoutes(mux, logger, repository, broker, idempotency)
+
+	return mux
+}
+
+// registerRoutes registers the routes that behave the same in every API version.
+// POST and PATCH requests can be retried safely with an Idempotency-Key.
+func registerRoutes(mux *http.ServeMux, logger *slog.Logger, repository *Repository, broker *Broker, idempotency web.IdempotencyStore) {
+	idempotent := func(next http.HandlerFunc) http.HandlerFunc {
+		return web.Idempotent(next, idempotency, logger)
+	}
+
+	// TODO routes
+	mux.HandleFunc("POST /", web.Access(web.Auth(idempotent(HandleCreate(logger, repository))), logger))
 	mux.HandleFunc("GET /{id}", web.Access(web.Auth(HandleGetByID(logger, repository)), logger))
 	mux.HandleFunc("PUT /{id}", web.Access(web.Auth(HandleUpdate(logger, repository)), logger))
+	mux.HandleFunc("PATCH /{id}", web.Access(web.Auth(idempotent(HandlePatch(logger, repository))), logger))
 	mux.HandleFunc("DELETE /{id}", web.Access(web.Auth(HandleDelete(logger, repository)), logger))
 
 	// TASK routes
-	mux.HandleFunc("POST /{id}/items", web.Access(web.Auth(HandleCreateTask(logger, repository)), logger))
-	mux.HandleFunc("GET /{id}/items", web.Access(web.Auth(HandleGetTasks(logger, repository)), logger))
-	mux.HandleFunc("PUT /{todo_id}/items/{task_id}", web.Access(web.Auth(HandleUpdateTask(logger, repository)), logger))
-	mux.HandleFunc("DELETE /{todo_id}/items/{task_id}", web.Access(web.Auth(HandleDeleteTask(logger, repository)), logger))
+	mux.HandleFunc("POST /{id}/items", web.Access(web.Auth(idempotent(HandleCreateTask(logger, repository))), logger))
+	mux.HandleFunc("GET /{id}/items/{task_id}", web.Access(web.Auth(HandleGetTask(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}/items/{task_id}", web.Access(web.Auth(HandleUpdateTask(logger, repository)), logger))
+	mux.HandleFunc("PATCH /{id}/items/{task_id}", web.Access(web.Auth(idempotent(HandlePatchTask(logger, repository))), logger))
+	mux.HandleFunc("DELETE /{id}/items/{task_id}", web.Access(web.Auth(HandleDeleteTask(logger, repository)), logger))
 
-	return mux
+	// SUBTASK routes
+	mux.HandleFunc("PUT /{id}/items/{task_id}/parent", web.Access(web.Auth(HandleMoveTask(logger, repository)), logger))
+
+	// ORDERING routes
+	mux.HandleFunc("PUT /{id}/items/{task_id}/position", web.Access(web.Auth(HandleSetTaskPosition(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}/items/{task_id}/list", web.Access(web.Auth(HandleTransferTask(logger, repository)), logger))
+
+	// BATCH routes
+	mux.HandleFunc("POST /{id}/items/batch", web.Access(web.Auth(idempotent(HandleBatch(logger, repository))), logger))
+
+	// DEPENDENCY routes
+	mux.HandleFunc("GET /{id}/ready", web.Access(web.Auth(HandleGetReadyTasks(logger, repository)), logger))
+	mux.HandleFunc("GET /{id}/order", web.Access(web.Auth(HandleGetTaskOrder(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}/items/{task_id}/dependencies/{depends_on_id}", web.Access(web.Auth(HandleAddDependency(logger, repository)), logger))
+	mux.HandleFunc("DELETE /{id}/items/{task_id}/dependencies/{depends_on_id}", web.Access(web.Auth(HandleRemoveDependency(logger, repository)), logger))
+
+	// MY DAY routes
+	mux.HandleFunc("GET /tasks", web.Access(web.Auth(HandleGetOpenTasks(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}/items/{task_id}/my-day", web.Access(web.Auth(HandleSetMyDay(logger, repository, true)), logger))
+	mux.HandleFunc("DELETE /{id}/items/{task_id}/my-day", web.Access(web.Auth(HandleSetMyDay(logger, repository, false)), logger))
+
+	// TRASH routes
+	mux.HandleFunc("GET /trash", web.Access(web.Auth(HandleGetTrash(logger, repository)), logger))
+	mux.HandleFunc("POST /{id}/restore", web.Access(web.Auth(idempotent(HandleRestore(logger, repository))), logger))
+	mux.HandleFunc("POST /{id}/items/{task_id}/restore", web.Access(web.Auth(idempotent(HandleRestoreTask(logger, repository))), logger))
+	mux.HandleFunc("PUT /{id}/archive", web.Access(web.Auth(HandleSetArchived(logger, repository, true)), logger))
+	mux.HandleFunc("DELETE /{id}/archive", web.Access(web.Auth(HandleSetArchived(logger, repository, false)), logger))
+
+	// HISTORY routes
+	mux.HandleFunc("GET /{id}/history", web.Access(web.Auth(HandleGetHistory(logger, repository)), logger))
+	mux.HandleFunc("POST /{id}/history/{revision_id}/restore", web.Access(web.Auth(idempotent(HandleRevert(logger, repository))), logger))
+
+	// EVENT routes
+	mux.HandleFunc("GET /events", web.Access(web.Auth(HandleUserEvents(logger, repository, broker)), logger))
+	mux.HandleFunc("GET /{id}/events", web.Access(web.Auth(HandleTodoEvents(logger, repository, broker)), logger))
+
+	// SYNC routes
+	// the sync channel authenticates by itself, since browsers cannot send the token header with a WebSocket handshake
+	mux.HandleFunc("GET /sync", web.Access(HandleSync(logger, repository, broker), logger))
+
+	// IMPORT and EXPORT routes
+	mux.HandleFunc("GET /{id}/export", web.Access(web.Auth(HandleExport(logger, repository)), logger))
+	mux.HandleFunc("POST /{id}/import", web.Access(web.Auth(idempotent(HandleImport(logger, repository))), logger))
+	mux.HandleFunc("POST /import", web.Access(web.Auth(idempotent(HandleImport(logger, repository))), logger))
+
+	// TAG routes
+	mux.HandleFunc("PUT /{id}/tags/{tag_id}", web.Access(web.Auth(HandleAttachTodoTag(logger, repository)), logger))
+	mux.HandleFunc("DELETE /{id}/tags/{tag_id}", web.Access(web.Auth(HandleDetachTodoTag(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}/items/{task_id}/tags/{tag_id}", web.Access(web.Auth(HandleAttachTaskTag(logger, repository)), logger))
+	mux.HandleFunc("DELETE /{id}/items/{task_id}/tags/{tag_id}", web.Access(web.Auth(HandleDetachTaskTag(logger, repository)), logger))
+
+	// MEMBER routes
+	mux.HandleFunc("GET /{id}/members", web.Access(web.Auth(HandleGetMembers(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}/members/{user_id}", web.Access(web.Auth(HandleAddMember(logger, repository)), logger))
+	mux.HandleFunc("DELETE /{id}/members/{user_id}", web.Access(web.Auth(HandleRemoveMember(logger, repository)), logger))
 }
 
 func HandleCreate(logger *slog.Logger, repository *Repository) http.HandlerFunc {
@@ -63,6 +154,7 @@ func HandleGetForUser(logger *slog.Logger, repository *Repository) http.HandlerF
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
+		// unlike web.ReadPagination, v1 never capped the limit and clients may rely on large ones.
 		queryParams := r.URL.Query()
 		page, err := strconv.Atoi(queryParams.Get("page"))
 		if err != nil {
@@ -79,16 +171,16 @@ func HandleGetForUser(logger *slog.Logger, repository *Repository) http.HandlerF
 			return
 		}
 
-		todos, err := repository.GetByUserID(ctx, userID, limit, page)
+		todos, _, err := repository.GetByUserID(ctx, userID, readFilter(r), limit, page)
 		if err != nil {
-			switch err {
-			case errNoTodosForUser:
-				web.ErrorResponse(logger, w, r, http.StatusNotFound, "no todos found for user", err)
-				return
-			default:
-				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve todo lists", err)
-				return
-			}
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve todo lists", err)
+			return
+		}
+
+		// v1 clients rely on an empty result being reported as a 404.
+		if len(todos) == 0 {
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "no todos found for user", errNoTodosForUser)
+			return
 		}
 
 		if err := web.WriteJSON(w, r, http.StatusOK, todos); err != nil {
@@ -98,6 +190,32 @@ func HandleGetForUser(logger *slog.Logger, repository *Repository) http.HandlerF
 	}
 }
 
+func HandleGetForUserV2(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 10
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		todos, total, err := repository.GetByUserID(ctx, userID, readFilter(r), limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve todo lists", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(todos, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
 func HandleGetByID(logger *slog.Logger, repository *Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
@@ -108,7 +226,7 @@ func HandleGetByID(logger *slog.Logger, repository *Repository) http.HandlerFunc
 			return
 		}
 
-		todo, err := repository.GetByID(ctx, id)
+		todo, err := repository.GetByID(ctx, userID, id)
 		if err != nil {
 			switch err {
 			case errNotFound:
@@ -120,11 +238,18 @@ func HandleGetByID(logger *slog.Logger, repository *Repository) http.HandlerFunc
 			}
 		}
 
-		if userID != todo.AuthorID {
+		if !canEdit(todo, userID) {
 			web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", err)
 			return
 		}
 
+		etag := web.ETag(todo.Version)
+		if web.NotModified(r, etag) {
+			web.WriteNotModified(w, etag)
+			return
+		}
+		w.Header().Set("ETag", etag)
+
 		if err := web.WriteJSON(w, r, http.StatusOK, todo); err != nil {
 			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
 			return
@@ -142,7 +267,7 @@ func HandleUpdate(logger *slog.Logger, repository *Repository) http.HandlerFunc
 			return
 		}
 
-		todo, err := repository.GetByID(ctx, todoID)
+		todo, err := repository.GetByID(ctx, userID, todoID)
 		if err != nil {
 			switch err {
 			case errNotFound:
@@ -154,7 +279,7 @@ func HandleUpdate(logger *slog.Logger, repository *Repository) http.HandlerFunc
 			}
 		}
 
-		if userID != todo.AuthorID {
+		if !canEdit(todo, userID) {
 			web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", err)
 			return
 		}
@@ -165,9 +290,18 @@ func HandleUpdate(logger *slog.Logger, repository *Repository) http.HandlerFunc
 			return
 		}
 
-		if err := repository.Update(ctx, todoID, update); err != nil {
-			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update todo", err)
-			return
+		if err := repository.Update(ctx, userID, todoID, update, web.IfMatch(r)); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "todo not found", err)
+				return
+			case errVersionMismatch:
+				web.ErrorResponse(logger, w, r, http.StatusPreconditionFailed, "the todo has been modified", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update todo", err)
+				return
+			}
 		}
 
 		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
@@ -187,7 +321,7 @@ func HandleDelete(logger *slog.Logger, repository *Repository) http.HandlerFunc
 			return
 		}
 
-		todo, err := repository.GetByID(ctx, todoID)
+		todo, err := repository.GetByID(ctx, userID, todoID)
 		if err != nil {
 			switch err {
 			case errNotFound:
@@ -199,13 +333,47 @@ func HandleDelete(logger *slog.Logger, repository *Repository) http.HandlerFunc
 			}
 		}
 
-		if userID != todo.AuthorID {
+		if !canEdit(todo, userID) {
 			web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", err)
 			return
 		}
 
-		if err := repository.DeleteTodo(ctx, todoID); err != nil {
-			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to delete todo", err)
+		if err := repository.DeleteTodo(ctx, userID, todoID, web.IfMatch(r)); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "todo not found", err)
+				return
+			case errVersionMismatch:
+				web.ErrorResponse(logger, w, r, http.StatusPreconditionFailed, "the todo has been modified", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to delete todo", err)
+				return
+			}
+		}
+	}
+}
+
+// HandlePatch applies a JSON Merge Patch or a JSON Patch, depending on the Content-Type, to a todo list.
+func HandlePatch(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		p, ok := readPatch(logger, w, r)
+		if !ok {
+			return
+		}
+
+		if err := repository.PatchTodo(r.Context(), requestUserID(r), todo.ID, p, web.IfMatch(r)); err != nil {
+			patchErrorResponse(logger, w, r, "todo", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
 			return
 		}
 	}
@@ -215,15 +383,28 @@ func HandleCreateTask(logger *slog.Logger, repository *Repository) http.HandlerF
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
 		task, err := web.ReadJSON[Task](r)
 		if err != nil {
 			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
 			return
 		}
+		// the task goes to the list named by the path, whatever the body says
+		task.TodoID = todo.ID
 
-		if err := repository.CreateTask(ctx, task); err != nil {
-			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to create task", err)
-			return
+		if err := repository.CreateTask(ctx, requestUserID(r), task); err != nil {
+			switch err {
+			case errInvalidParent, errTaskTooDeep:
+				web.ErrorResponse(logger, w, r, http.StatusBadRequest, err.Error(), err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to create task", err)
+				return
+			}
 		}
 
 		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
@@ -237,9 +418,12 @@ func HandleGetTasks(logger *slog.Logger, repository *Repository) http.HandlerFun
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 
-		todoID := r.PathValue("id")
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
 
-		tasks, err := repository.GetTasks(ctx, todoID)
+		tasks, err := repository.GetTasks(ctx, requestUserID(r), todo.ID, readFilter(r))
 		if err != nil {
 			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
 			return
@@ -252,20 +436,94 @@ func HandleGetTasks(logger *slog.Logger, repository *Repository) http.HandlerFun
 	}
 }
 
-func HandleUpdateTask(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+func HandleGetTasksV2(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 50
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		// every change to the tasks of a list moves the list to a new version
+		etag := web.ETag(todo.Version)
+		if web.NotModified(r, etag) {
+			web.WriteNotModified(w, etag)
+			return
+		}
+		w.Header().Set("ETag", etag)
 
-		update, err := web.ReadJSON[Task](r)
+		tasks, total, err := repository.ListTasks(ctx, requestUserID(r), todo.ID, readFilter(r), limit, page)
 		if err != nil {
-			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(tasks, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
 			return
 		}
+	}
+}
+
+// HandleGetTask returns a single task, with its subtasks. The ETag is its version along with a digest of the versions
+// of its subtasks, which make up its progress.
+func HandleGetTask(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		etag := web.DigestETag(task.Version, subtreeDigest(task))
+		if web.NotModified(r, etag) {
+			web.WriteNotModified(w, etag)
+			return
+		}
+		w.Header().Set("ETag", etag)
+
+		if err := web.WriteJSON(w, r, http.StatusOK, task); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
 
-		if err := repository.UpdateTask(ctx, update); err != nil {
-			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update task", err)
+// HandleUpdateTask overwrites the fields of a task with the ones of the request body. The fields the body leaves out
+// keep their current value, and setting due_at or recurrence to null clears them.
+func HandleUpdateTask(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		update := task
+		if err := web.ReadJSONInto(r, &update); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
 			return
 		}
+		// the task is the one named by the path, whatever the body says
+		update.ID, update.TodoID = task.ID, task.TodoID
+
+		if err := repository.UpdateTask(ctx, requestUserID(r), todo.ID, update, web.IfMatch(r)); err != nil {
+			switch err {
+			case errVersionMismatch:
+				web.ErrorResponse(logger, w, r, http.StatusPreconditionFailed, "the task has been modified", err)
+				return
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update task", err)
+				return
+			}
+		}
 
 		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
 			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce repsonse", err)
@@ -274,19 +532,1047 @@ func HandleUpdateTask(logger *slog.Logger, repository *Repository) http.HandlerF
 	}
 }
 
+// HandlePatchTask applies a JSON Merge Patch or a JSON Patch, depending on the Content-Type, to a task.
+func HandlePatchTask(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		todo, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		p, ok := readPatch(logger, w, r)
+		if !ok {
+			return
+		}
+
+		if err := repository.PatchTask(r.Context(), requestUserID(r), todo.ID, task.ID, p, web.IfMatch(r)); err != nil {
+			patchErrorResponse(logger, w, r, "task", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
 func HandleDeleteTask(logger *slog.Logger, repository *Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
-		id := r.PathValue("task_id")
 
-		if err := repository.DeleteTask(ctx, id); err != nil {
-			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to delete task", err)
+		todo, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
 			return
 		}
 
+		if err := repository.DeleteTask(ctx, requestUserID(r), todo.ID, task.ID, web.IfMatch(r)); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+				return
+			case errVersionMismatch:
+				web.ErrorResponse(logger, w, r, http.StatusPreconditionFailed, "the task has been modified", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to delete task", err)
+				return
+			}
+		}
+
 		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
 			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "produce response", err)
 			return
 		}
 	}
 }
+
+// HandleTodoEvents streams the changes made to a todo list and its tasks as Server-Sent Events.
+func HandleTodoEvents(logger *slog.Logger, repository *Repository, broker *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		streamEvents(logger, w, r, repository, broker, todo.ID, "")
+	}
+}
+
+// HandleUserEvents streams the changes made to any of the caller's todo lists as Server-Sent Events.
+func HandleUserEvents(logger *slog.Logger, repository *Repository, broker *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID, ok := r.Context().Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		streamEvents(logger, w, r, repository, broker, "", userID)
+	}
+}
+
+func HandleAttachTodoTag(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.AttachTodoTag(ctx, todo.ID, r.PathValue("tag_id"), todo.AuthorID); err != nil {
+			switch err {
+			case errTagNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "tag not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to attach tag", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleDetachTodoTag(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.DetachTodoTag(ctx, todo.ID, r.PathValue("tag_id")); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to detach tag", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleAttachTaskTag(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.AttachTaskTag(ctx, task.ID, r.PathValue("tag_id"), todo.AuthorID); err != nil {
+			switch err {
+			case errTagNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "tag not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to attach tag", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleDetachTaskTag(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		_, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.DetachTaskTag(ctx, task.ID, r.PathValue("tag_id")); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to detach tag", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetMembers returns the users the todo list is shared with.
+func HandleGetMembers(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		members, err := repository.GetMembers(r.Context(), todo.ID)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve members", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, members); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleAddMember shares the todo list with the user named by the user_id path value. Only the author of the list
+// can share it.
+func HandleAddMember(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		userID := requestUserID(r)
+		if userID != todo.AuthorID {
+			web.ErrorResponse(logger, w, r, http.StatusForbidden, "only the author can share the todo list", web.ErrInvalidUserID)
+			return
+		}
+		memberID := r.PathValue("user_id")
+		if memberID == todo.AuthorID {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "the todo list cannot be shared with its author", web.ErrInvalidUserID)
+			return
+		}
+
+		if err := repository.AddMember(r.Context(), userID, todo.ID, memberID); err != nil {
+			switch err {
+			case errUserNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "user not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to share todo", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleRemoveMember stops sharing the todo list with the user named by the user_id path value. The author of the list
+// can remove anyone, and members can remove themselves.
+func HandleRemoveMember(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		userID, memberID := requestUserID(r), r.PathValue("user_id")
+		if userID != todo.AuthorID && userID != memberID {
+			web.ErrorResponse(logger, w, r, http.StatusForbidden, "only the author can stop sharing the todo list", web.ErrInvalidUserID)
+			return
+		}
+
+		if err := repository.RemoveMember(r.Context(), todo.ID, memberID); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to stop sharing todo", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleMoveTask moves a task, together with its subtasks, under another task of the same todo list.
+func HandleMoveTask(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		move, err := web.ReadJSON[MoveRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		if err := repository.MoveTask(ctx, requestUserID(r), todo.ID, task.ID, move.ParentID); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+				return
+			case errInvalidParent, errParentCycle, errTaskTooDeep:
+				web.ErrorResponse(logger, w, r, http.StatusBadRequest, err.Error(), err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to move task", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleSetTaskPosition moves a task right after and/or right before some of its siblings.
+func HandleSetTaskPosition(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		pos, err := web.ReadJSON[PositionRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		if err := repository.SetTaskPosition(ctx, requestUserID(r), todo.ID, task.ID, pos); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+				return
+			case errInvalidPosition:
+				web.ErrorResponse(logger, w, r, http.StatusBadRequest, err.Error(), err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to reorder task", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleTransferTask moves a task, together with its subtasks, to another todo list the caller can edit.
+func HandleTransferTask(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		transfer, err := web.ReadJSON[TransferRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		target, err := repository.GetByID(ctx, requestUserID(r), transfer.TodoID)
+		if err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "todo not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve todo", err)
+				return
+			}
+		}
+
+		userID, _ := ctx.Value(web.UserID).(string)
+		if !canEdit(target, userID) {
+			web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", web.ErrInvalidUserID)
+			return
+		}
+
+		if err := repository.TransferTask(ctx, requestUserID(r), todo.ID, task.ID, target.ID); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to move task", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleBatch applies several task operations to a todo list in one transaction and reports the
+// outcome of each of them. A rolled back atomic batch is still a 200; see BatchResult.Committed.
+func HandleBatch(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		batch, err := web.ReadJSON[BatchRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		result, err := repository.Batch(ctx, requestUserID(r), todo.ID, batch)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to apply batch", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, result); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleAddDependency makes the task wait on the task named by the depends_on_id path value.
+func HandleAddDependency(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.AddDependency(ctx, requestUserID(r), todo.ID, task.ID, r.PathValue("depends_on_id")); err != nil {
+			switch err {
+			case errInvalidDep:
+				web.ErrorResponse(logger, w, r, http.StatusBadRequest, err.Error(), err)
+				return
+			case errDepCycle:
+				web.ErrorResponse(logger, w, r, http.StatusConflict, err.Error(), err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to add dependency", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleRemoveDependency(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.RemoveDependency(ctx, requestUserID(r), todo.ID, task.ID, r.PathValue("depends_on_id")); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to remove dependency", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetReadyTasks lists the open tasks of a todo list that are not blocked by any dependency.
+func HandleGetReadyTasks(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 50
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		tasks, total, err := repository.GetReadyTasks(ctx, requestUserID(r), todo.ID, limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(tasks, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetTaskOrder lists every task of a todo list in an order that respects their dependencies.
+// The order is only meaningful as a whole, so the result is always a single page.
+func HandleGetTaskOrder(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		tasks, err := repository.GetTaskOrder(ctx, requestUserID(r), todo.ID)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(tasks, 1, len(tasks), len(tasks))); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetOpenTasks lists the caller's unfinished tasks across all of their todo lists,
+// most pressing first. Passing my_day=true limits the result to the caller's "My Day" list.
+func HandleGetOpenTasks(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 50
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		tasks, total, err := repository.GetOpenTasks(ctx, userID, readFilter(r), limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve tasks", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(tasks, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleSetMyDay adds a task to the caller's "My Day" list when focused is true, and removes it otherwise.
+func HandleSetMyDay(logger *slog.Logger, repository *Repository, focused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		_, task, ok := ownedTask(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.SetMyDay(ctx, task.ID, requestUserID(r), focused); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update my day", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetTrash lists the caller's trashed todo lists and tasks, most recently deleted first.
+func HandleGetTrash(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 50
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		items, total, err := repository.GetTrash(ctx, userID, limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve trash", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(items, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleRestore takes a todo list the caller can access out of the trash.
+func HandleRestore(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		if err := repository.RestoreTodo(ctx, userID, r.PathValue("id")); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "todo not found in trash", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to restore todo", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleRestoreTask takes a task, together with the subtasks deleted along with it, out of the trash.
+func HandleRestoreTask(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.RestoreTask(ctx, requestUserID(r), todo.ID, r.PathValue("task_id")); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found in trash", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to restore task", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleSetArchived archives a todo list when archived is true, and brings it back to the active lists otherwise.
+func HandleSetArchived(logger *slog.Logger, repository *Repository, archived bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.SetArchived(ctx, requestUserID(r), todo.ID, archived); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "todo not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update todo", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetHistory lists the revisions of a todo list, newest first, each with who made it and what it changed.
+func HandleGetHistory(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 20
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		revisions, total, err := repository.GetHistory(ctx, todo.ID, limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve history", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(revisions, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleRevert restores a todo list to the state it was in right after the revision named by the revision_id path value.
+func HandleRevert(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		revisionID, err := strconv.ParseInt(r.PathValue("revision_id"), 10, 64)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid revision id", err)
+			return
+		}
+
+		todo, ok := ownedTodo(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.RevertTo(ctx, requestUserID(r), todo.ID, revisionID); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "revision not found", err)
+				return
+			case errRevisionCompacted:
+				web.ErrorResponse(logger, w, r, http.StatusGone, err.Error(), err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to restore revision", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetChanges returns the changes to the caller's todo lists and tasks since the sync token given
+// in the since query parameter, or all of them when there is none.
+func HandleGetChanges(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		changes, err := repository.GetChanges(ctx, userID, r.URL.Query().Get("since"))
+		if err != nil {
+			switch err {
+			case errInvalidSyncToken:
+				web.ErrorResponse(logger, w, r, http.StatusBadRequest, err.Error(), err)
+				return
+			case errSyncTokenExpired:
+				web.ErrorResponse(logger, w, r, http.StatusGone, err.Error(), err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to get changes", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, changes); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandlePushChanges applies the mutations an offline client has queued for the caller's todo lists.
+func HandlePushChanges(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		req, err := web.ReadJSON[PushRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		result := repository.Push(ctx, userID, req)
+		for _, res := range result.Results {
+			if res.err != nil {
+				logger.Error("failed to apply mutation", "client_id", res.ClientID, "op", res.Op, "error", res.err)
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, result); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// ownedTodo loads the todo list named by the id path value and makes sure the caller can edit it.
+// When it returns false an error response has already been written.
+func ownedTodo(logger *slog.Logger, w http.ResponseWriter, r *http.Request, repository *Repository) (Todo, bool) {
+	ctx := r.Context()
+	userID, ok := ctx.Value(web.UserID).(string)
+	if !ok {
+		web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+		return Todo{}, false
+	}
+
+	todo, err := repository.GetByID(ctx, userID, r.PathValue("id"))
+	if err != nil {
+		switch err {
+		case errNotFound:
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "todo not found", err)
+			return Todo{}, false
+		default:
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve todo", err)
+			return Todo{}, false
+		}
+	}
+
+	if !canEdit(todo, userID) {
+		web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", web.ErrInvalidUserID)
+		return Todo{}, false
+	}
+
+	return todo, true
+}
+
+// requestUserID returns the id of the authenticated user making the request, as set by web.Auth.
+func requestUserID(r *http.Request) string {
+	userID, _ := r.Context().Value(web.UserID).(string)
+	return userID
+}
+
+// canEdit reports whether the user is allowed to read and change the todo list and its tasks: its author and the
+// members it is shared with are.
+func canEdit(todo Todo, userID string) bool {
+	return userID == todo.AuthorID || slices.Contains(todo.members, userID)
+}
+
+// ownedTask loads the task named by the task_id path value, making sure it belongs to a todo list owned by the caller.
+// When it returns false an error response has already been written.
+func ownedTask(logger *slog.Logger, w http.ResponseWriter, r *http.Request, repository *Repository) (Todo, Task, bool) {
+	todo, ok := ownedTodo(logger, w, r, repository)
+	if !ok {
+		return Todo{}, Task{}, false
+	}
+
+	task, err := repository.GetTask(r.Context(), requestUserID(r), todo.ID, r.PathValue("task_id"))
+	if err != nil {
+		switch err {
+		case errNotFound:
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "task not found", err)
+			return Todo{}, Task{}, false
+		default:
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve task", err)
+			return Todo{}, Task{}, false
+		}
+	}
+
+	return todo, task, true
+}
+
+const (
+	// eventsBacklogLimit is how many revisions are read at once when a stream catches up.
+	eventsBacklogLimit = 100
+	// eventsHeartbeat is how often an idle stream sends a comment, so that proxies keep it open.
+	eventsHeartbeat = 15 * time.Second
+)
+
+// streamEvents writes the events of the todo list, or of every list of the user when todoID is empty, until
+// the client goes away. Events are read from the history, from the cursor the stream is at, whenever the broker
+// announces a revision, so that those committed out of the order of their ids are not missed. The cursor is sent as
+// the event id after every read, and a client reconnecting with it as its Last-Event-ID first receives the events
+// it has missed. Events can be sent again after a reconnection; they are told apart by the id of their revision.
+func streamEvents(logger *slog.Logger, w http.ResponseWriter, r *http.Request, repository *Repository, broker *Broker, todoID, userID string) {
+	ctx := r.Context()
+
+	cursor := r.Header.Get("Last-Event-ID")
+	if cursor != "" {
+		if _, err := strconv.ParseUint(cursor, 10, 64); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid Last-Event-ID", err)
+			return
+		}
+	}
+
+	// subscribing before reading the backlog makes sure no revision falls in between
+	sub := broker.Subscribe(todoID, userID)
+	defer broker.Unsubscribe(sub)
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.Error("event stream not supported", "error", err)
+		return
+	}
+
+	// sent holds the revisions read from the current cursor, which are read again until the cursor moves past them
+	sent := make(map[int64]bool)
+	catchUp := func() error {
+		read := make(map[int64]bool)
+		next, err := repository.GetRevisionsSince(ctx, todoID, userID, cursor, eventsBacklogLimit, func(rev Revision) error {
+			read[rev.ID] = true
+			if sent[rev.ID] {
+				return nil
+			}
+			return writeEvents(w, rev)
+		})
+		if err != nil {
+			return err
+		}
+		cursor, sent = next, read
+		// an event without data only moves the client's Last-Event-ID
+		if _, err := fmt.Fprintf(w, "id: %s\n\n", cursor); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	if err := catchUp(); err != nil {
+		if ctx.Err() == nil {
+			logger.Error("failed to read missed events", "error", err)
+		}
+		return
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case _, ok := <-sub.Revisions:
+			if !ok {
+				// the stream fell behind; the client catches up by reconnecting with its Last-Event-ID
+				return
+			}
+			if err := catchUp(); err != nil {
+				if ctx.Err() == nil {
+					logger.Error("failed to read events", "error", err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// writeEvents writes the events of a revision in the Server-Sent Events format.
+func writeEvents(w io.Writer, rev Revision) error {
+	for _, e := range rev.Events() {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxPatchSize is the largest patch document accepted by the PATCH endpoints.
+const maxPatchSize = 1 << 20
+
+// readPatch reads and parses the patch document of a PATCH request according to its Content-Type.
+// When it returns false an error response has already been written.
+func readPatch(logger *slog.Logger, w http.ResponseWriter, r *http.Request) (patch.Patch, bool) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		web.ErrorResponse(logger, w, r, http.StatusUnsupportedMediaType, "the patch document needs a content type", err)
+		return nil, false
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPatchSize))
+	if err != nil {
+		web.ErrorResponse(logger, w, r, http.StatusBadRequest, "failed to read the patch document", err)
+		return nil, false
+	}
+
+	p, err := patch.Parse(mediaType, body)
+	if err != nil {
+		switch {
+		case errors.Is(err, patch.ErrUnsupportedType):
+			w.Header().Set("Accept-Patch", patch.MergePatchType+", "+patch.JSONPatchType)
+			web.ErrorResponse(logger, w, r, http.StatusUnsupportedMediaType, "supported patch types are "+patch.MergePatchType+" and "+patch.JSONPatchType, err)
+		default:
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, err.Error(), err)
+		}
+		return nil, false
+	}
+
+	return p, true
+}
+
+// patchErrorResponse writes the error response for a patch of the given resource which could not be applied.
+func patchErrorResponse(logger *slog.Logger, w http.ResponseWriter, r *http.Request, resource string, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		web.ErrorResponse(logger, w, r, http.StatusNotFound, resource+" not found", err)
+	case errors.Is(err, errVersionMismatch):
+		web.ErrorResponse(logger, w, r, http.StatusPreconditionFailed, "the "+resource+" has been modified", err)
+	case errors.Is(err, patch.ErrTestFailed):
+		web.ErrorResponse(logger, w, r, http.StatusConflict, err.Error(), err)
+	case errors.Is(err, patch.ErrInvalidPath), errors.Is(err, errInvalidPatchResult):
+		web.ErrorResponse(logger, w, r, http.StatusUnprocessableEntity, err.Error(), err)
+	default:
+		web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to patch "+resource, err)
+	}
+}
+
+// readFilter reads the collection filters from the query string.
+// Every "tag" parameter is a tag id the returned entries must carry, my_day=true keeps only "My Day" tasks
+// and archived=true lists the archived todo lists instead of the active ones.
+func readFilter(r *http.Request) Filter {
+	queryParams := r.URL.Query()
+	myDay, _ := strconv.ParseBool(queryParams.Get("my_day"))
+	archived, _ := strconv.ParseBool(queryParams.Get("archived"))
+	return Filter{
+		Tags:     queryParams["tag"],
+		MyDay:    myDay,
+		Archived: archived,
+	}
+}
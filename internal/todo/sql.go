@@ -1,14 +1,451 @@
 package todo
 
+// Queries taking a text[] of tag ids only return rows carrying every one of those tags.
+// An empty array disables the filter, but a NULL one matches nothing, so never pass a nil slice.
 const (
-	selectTodoQuery            = "SELECT id, author_id, name FROM todos WHERE id = $1"
-	selectTaskByTaskIDQuery    = "SELECT id, todo_id, task_order, content, done FROM tasks WHERE id = $1"
-	selectTaskByTodoIDQuery    = "SELECT id, todo_id, task_order, content, done FROM tasks WHERE todo_id = $1"
-	selectTodosByAuthorIDQuery = "SELECT id, author_id, name FROM todos WHERE author_id = $1 ORDER BY id LIMIT $2 OFFSET $3"
-	insertTodoQuery            = "INSERT INTO todos (id, author_id, name) VALUES ($1, $2, $3)"
-	insertTaskQuery            = "INSERT INTO tasks (id, todo_id, task_order, content, done) VALUES ($1, $2, $3, $4, $5)"
-	updateTodoQuery            = "UPDATE todos SET name = $1 WHERE id = $2"
-	updateTaskQuery            = "UPDATE tasks SET content = $1, done = $2 WHERE id = $3"
-	deleteTodoQuery            = "DELETE FROM todos WHERE id = $1"
-	deleteTaskQuery            = "DELETE FROM tasks WHERE id = $1"
+	todoColumns         = "id, author_id, name, archived_at, version"
+	taskColumns         = "id, todo_id, task_order, content, done, priority, due_at, recurrence, parent_id, auto_complete, rank, version"
+	prefixedTaskColumns = "t.id, t.todo_id, t.task_order, t.content, t.done, t.priority, t.due_at, t.recurrence, t.parent_id, t.auto_complete, t.rank, t.version"
+	// insertTaskColumns are the columns written when a task is created; its version starts at the column default.
+	insertTaskColumns = "id, todo_id, task_order, content, done, priority, due_at, recurrence, parent_id, auto_complete, rank"
+
+	selectTodoQuery         = "SELECT " + todoColumns + " FROM todos WHERE id = $1 AND deleted_at IS NULL"
+	selectTaskByTaskIDQuery = "SELECT " + taskColumns + " FROM tasks WHERE id = $1 AND deleted_at IS NULL"
+	// selectTaskTreeQuery selects a page of a list's top-level tasks matching the tag filter,
+	// followed by every one of their subtasks. A NULL limit selects all top-level tasks.
+	selectTaskTreeQuery = `
+	WITH RECURSIVE tree AS (
+		(SELECT ` + taskColumns + ` FROM tasks
+		WHERE todo_id = $1 AND parent_id IS NULL AND deleted_at IS NULL
+			AND (cardinality($4::text[]) = 0 OR id IN (
+				SELECT task_id FROM task_tags WHERE tag_id = ANY($4) GROUP BY task_id HAVING COUNT(*) = cardinality($4)))
+		ORDER BY rank, id LIMIT $2 OFFSET $3)
+		UNION ALL
+		SELECT ` + prefixedTaskColumns + ` FROM tasks t JOIN tree ON t.parent_id = tree.id WHERE t.deleted_at IS NULL
+	)
+	SELECT ` + taskColumns + ` FROM tree`
+	// selectTaskSubtreeQuery selects a task followed by every one of its subtasks.
+	selectTaskSubtreeQuery = `
+	WITH RECURSIVE tree AS (
+		SELECT ` + taskColumns + ` FROM tasks WHERE id = $1 AND deleted_at IS NULL
+		UNION ALL
+		SELECT ` + prefixedTaskColumns + ` FROM tasks t JOIN tree ON t.parent_id = tree.id WHERE t.deleted_at IS NULL
+	)
+	SELECT ` + taskColumns + ` FROM tree`
+	// selectTodosByAuthorIDQuery lists either the active or, when $5 is true, the archived lists of a user, along with
+	// the ones shared with them.
+	selectTodosByAuthorIDQuery = `
+	SELECT ` + todoColumns + ` FROM todos
+	WHERE id IN (SELECT todo_id FROM todo_access WHERE user_id = $1) AND deleted_at IS NULL AND (archived_at IS NOT NULL) = $5
+		AND (cardinality($4::text[]) = 0 OR id IN (
+			SELECT todo_id FROM todo_tags WHERE tag_id = ANY($4) GROUP BY todo_id HAVING COUNT(*) = cardinality($4)))
+	ORDER BY id LIMIT $2 OFFSET $3`
+	countTodosByAuthorIDQuery = `
+	SELECT COUNT(*) FROM todos
+	WHERE id IN (SELECT todo_id FROM todo_access WHERE user_id = $1)
+		AND deleted_at IS NULL AND (archived_at IS NOT NULL) = $3
+		AND (cardinality($2::text[]) = 0 OR id IN (
+			SELECT todo_id FROM todo_tags WHERE tag_id = ANY($2) GROUP BY todo_id HAVING COUNT(*) = cardinality($2)))`
+	countTasksByTodoIDQuery = `
+	SELECT COUNT(*) FROM tasks
+	WHERE todo_id = $1 AND parent_id IS NULL AND deleted_at IS NULL
+		AND (cardinality($2::text[]) = 0 OR id IN (
+			SELECT task_id FROM task_tags WHERE tag_id = ANY($2) GROUP BY task_id HAVING COUNT(*) = cardinality($2)))`
+	insertTodoQuery = "INSERT INTO todos (id, author_id, name) VALUES ($1, $2, $3)"
+	insertTaskQuery = "INSERT INTO tasks (" + insertTaskColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"
+	// Conditional writes take the versions listed in If-Match as their last parameter; NULL makes them unconditional.
+	updateTodoQuery = "UPDATE todos SET name = COALESCE(NULLIF($1, ''), name) WHERE id = $2 AND deleted_at IS NULL AND ($3::bigint[] IS NULL OR version = ANY($3))"
+	updateTaskQuery = `
+	UPDATE tasks SET content = $1, done = $2, priority = $3, due_at = $4, recurrence = $5, auto_complete = $6
+	WHERE id = $7 AND deleted_at IS NULL AND ($8::bigint[] IS NULL OR version = ANY($8))`
+)
+
+// selectOpenTasksByUserIDQuery lists the open tasks of every list the user owns or is a member of, most pressing first.
+const (
+	selectOpenTasksByUserIDQuery = `
+	SELECT ` + prefixedTaskColumns + `
+	FROM tasks t JOIN todos td ON td.id = t.todo_id
+	WHERE td.id IN (SELECT todo_id FROM todo_access WHERE user_id = $1)
+		AND t.done IS NOT TRUE
+		AND t.deleted_at IS NULL AND td.deleted_at IS NULL AND td.archived_at IS NULL
+		AND (NOT $2 OR EXISTS (SELECT 1 FROM task_focus f WHERE f.task_id = t.id AND f.user_id = $1))
+		AND (cardinality($5::text[]) = 0 OR t.id IN (
+			SELECT task_id FROM task_tags WHERE tag_id = ANY($5) GROUP BY task_id HAVING COUNT(*) = cardinality($5)))
+	ORDER BY t.priority DESC, t.due_at ASC NULLS LAST, t.rank, t.id
+	LIMIT $3 OFFSET $4`
+	countOpenTasksByUserIDQuery = `
+	SELECT COUNT(*)
+	FROM tasks t JOIN todos td ON td.id = t.todo_id
+	WHERE td.id IN (SELECT todo_id FROM todo_access WHERE user_id = $1)
+		AND t.done IS NOT TRUE
+		AND t.deleted_at IS NULL AND td.deleted_at IS NULL AND td.archived_at IS NULL
+		AND (NOT $2 OR EXISTS (SELECT 1 FROM task_focus f WHERE f.task_id = t.id AND f.user_id = $1))
+		AND (cardinality($3::text[]) = 0 OR t.id IN (
+			SELECT task_id FROM task_tags WHERE tag_id = ANY($3) GROUP BY task_id HAVING COUNT(*) = cardinality($3)))`
+	insertTaskFocusQuery      = "INSERT INTO task_focus (task_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	deleteTaskFocusQuery      = "DELETE FROM task_focus WHERE task_id = $1 AND user_id = $2"
+	selectFocusedTaskIDsQuery = "SELECT task_id FROM task_focus WHERE user_id = $1 AND task_id = ANY($2)"
+)
+
+// SUBTASK queries
+const (
+	// lockTaskTreeQuery serializes changes to the shape of a list's task tree and dependency graph
+	// for the rest of the transaction.
+	lockTaskTreeQuery = "SELECT pg_advisory_xact_lock(hashtext($1))"
+	// selectTaskDepthQuery returns the todo list of a task and how deep it is nested, 1 being a top-level task.
+	selectTaskDepthQuery = `
+	WITH RECURSIVE ancestors AS (
+		SELECT id, todo_id, parent_id, 1 AS depth FROM tasks WHERE id = $1
+		UNION ALL
+		SELECT t.id, t.todo_id, t.parent_id, a.depth + 1 FROM tasks t JOIN ancestors a ON t.id = a.parent_id
+	)
+	SELECT (SELECT todo_id FROM tasks WHERE id = $1 AND deleted_at IS NULL), MAX(depth) FROM ancestors`
+	// selectSubtreeIDsQuery returns the ids of a task and all of its subtasks, with their depth below it.
+	selectSubtreeIDsQuery = `
+	WITH RECURSIVE tree AS (
+		SELECT id, 1 AS depth FROM tasks WHERE id = $1
+		UNION ALL
+		SELECT t.id, tree.depth + 1 FROM tasks t JOIN tree ON t.parent_id = tree.id
+	)
+	SELECT id, depth FROM tree`
+	updateTaskParentQuery = "UPDATE tasks SET parent_id = $1, rank = $2 WHERE id = $3"
+	// rollUpTaskQuery recomputes the done state of an auto-completing task from its subtasks and returns its parent.
+	rollUpTaskQuery = `
+	UPDATE tasks p SET done = CASE
+		WHEN p.auto_complete AND EXISTS (SELECT 1 FROM tasks c WHERE c.parent_id = p.id AND c.deleted_at IS NULL)
+			THEN NOT EXISTS (SELECT 1 FROM tasks c WHERE c.parent_id = p.id AND c.deleted_at IS NULL AND c.done IS NOT TRUE)
+		ELSE p.done END
+	WHERE p.id = $1
+	RETURNING p.parent_id`
+	// selectTaskProgressQuery counts the done and total subtasks, at any depth, of each given task.
+	selectTaskProgressQuery = `
+	WITH RECURSIVE tree AS (
+		SELECT id AS root_id, id FROM tasks WHERE id = ANY($1)
+		UNION ALL
+		SELECT tree.root_id, t.id FROM tasks t JOIN tree ON t.parent_id = tree.id WHERE t.deleted_at IS NULL
+	)
+	SELECT tree.root_id, COUNT(*) FILTER (WHERE t.done), COUNT(*)
+	FROM tree JOIN tasks t ON t.id = tree.id
+	WHERE tree.id <> tree.root_id
+	GROUP BY tree.root_id`
+)
+
+// ORDERING queries
+const (
+	// selectLastRankQuery returns the highest rank among the children of a parent task, or among the
+	// top-level tasks of the list when the parent is NULL.
+	selectLastRankQuery      = "SELECT COALESCE(MAX(rank), '') FROM tasks WHERE todo_id = $1 AND parent_id IS NOT DISTINCT FROM $2"
+	selectSiblingRanksQuery  = "SELECT id, rank FROM tasks WHERE todo_id = $1 AND parent_id IS NOT DISTINCT FROM $2 AND id <> $3 AND deleted_at IS NULL ORDER BY rank, id"
+	updateTaskRankQuery      = "UPDATE tasks SET rank = $1 WHERE id = $2"
+	updateSubtreeTodoQuery   = "UPDATE tasks SET todo_id = $1 WHERE id = ANY($2)"
+	updateTaskPlacementQuery = "UPDATE tasks SET parent_id = NULL, rank = $1 WHERE id = $2"
+	// deleteCrossingDependenciesQuery drops the dependencies with exactly one end among the given tasks.
+	deleteCrossingDependenciesQuery = "DELETE FROM task_dependencies WHERE (task_id = ANY($1)) <> (depends_on_id = ANY($1))"
+)
+
+// BATCH queries take the new value, the task id and the todo id, and return the task's parent.
+const (
+	setTaskDoneQuery     = "UPDATE tasks SET done = $1 WHERE id = $2 AND todo_id = $3 AND deleted_at IS NULL RETURNING parent_id"
+	setTaskPriorityQuery = "UPDATE tasks SET priority = $1 WHERE id = $2 AND todo_id = $3 AND deleted_at IS NULL RETURNING parent_id"
+	setTaskDueAtQuery    = "UPDATE tasks SET due_at = $1 WHERE id = $2 AND todo_id = $3 AND deleted_at IS NULL RETURNING parent_id"
+)
+
+// DEPENDENCY queries
+const (
+	insertDependencyQuery = "INSERT INTO task_dependencies (task_id, depends_on_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	deleteDependencyQuery = "DELETE FROM task_dependencies WHERE task_id = $1 AND depends_on_id = $2"
+	// dependencyPathExistsQuery reports whether task $1 depends, directly or transitively, on task $2.
+	dependencyPathExistsQuery = `
+	WITH RECURSIVE deps AS (
+		SELECT depends_on_id FROM task_dependencies WHERE task_id = $1
+		UNION
+		SELECT d.depends_on_id FROM task_dependencies d JOIN deps ON d.task_id = deps.depends_on_id
+	)
+	SELECT EXISTS (SELECT 1 FROM deps WHERE depends_on_id = $2)`
+	selectDependenciesQuery = `
+	SELECT d.task_id, d.depends_on_id, dep.done IS TRUE
+	FROM task_dependencies d JOIN tasks dep ON dep.id = d.depends_on_id
+	WHERE d.task_id = ANY($1) AND dep.deleted_at IS NULL
+	ORDER BY d.depends_on_id`
+	selectTasksByTodoIDQuery = "SELECT " + taskColumns + " FROM tasks WHERE todo_id = $1 AND deleted_at IS NULL"
+	// selectReadyTasksQuery lists the open tasks of a list whose dependencies are all done.
+	selectReadyTasksQuery = `
+	SELECT ` + prefixedTaskColumns + ` FROM tasks t
+	WHERE t.todo_id = $1
+		AND t.done IS NOT TRUE
+		AND t.deleted_at IS NULL
+		AND NOT EXISTS (
+			SELECT 1 FROM task_dependencies d JOIN tasks dep ON dep.id = d.depends_on_id
+			WHERE d.task_id = t.id AND dep.done IS NOT TRUE AND dep.deleted_at IS NULL)
+	ORDER BY t.priority DESC, t.due_at ASC NULLS LAST, t.rank, t.id
+	LIMIT $2 OFFSET $3`
+	countReadyTasksQuery = `
+	SELECT COUNT(*) FROM tasks t
+	WHERE t.todo_id = $1
+		AND t.done IS NOT TRUE
+		AND t.deleted_at IS NULL
+		AND NOT EXISTS (
+			SELECT 1 FROM task_dependencies d JOIN tasks dep ON dep.id = d.depends_on_id
+			WHERE d.task_id = t.id AND dep.done IS NOT TRUE AND dep.deleted_at IS NULL)`
+)
+
+// TRASH queries
+const (
+	trashTodoQuery = "UPDATE todos SET deleted_at = now() WHERE id = $1 AND deleted_at IS NULL AND ($2::bigint[] IS NULL OR version = ANY($2))"
+	// restoreTodoQuery takes a list out of the trash, and marks its tasks as changed, since delta sync clients
+	// dropped them along with the list.
+	restoreTodoQuery = `
+	WITH restored AS (
+		UPDATE todos SET deleted_at = NULL WHERE id = $1 AND id IN (SELECT todo_id FROM todo_access WHERE user_id = $2) AND deleted_at IS NOT NULL RETURNING id
+	), resent AS (
+		UPDATE tasks SET sync_xid = pg_current_xact_id() WHERE todo_id IN (SELECT id FROM restored) AND deleted_at IS NULL
+	)
+	SELECT id FROM restored`
+	// trashTaskQuery moves a task of the list, along with its subtasks which are not in the trash yet,
+	// to the trash. They all get the same timestamp, so they can be restored together. It returns the task's parent.
+	// The task has to be at one of the versions in $3, unless it is NULL.
+	trashTaskQuery = `
+	WITH RECURSIVE tree AS (
+		SELECT id FROM tasks WHERE id = $1 AND todo_id = $2 AND deleted_at IS NULL AND ($3::bigint[] IS NULL OR version = ANY($3))
+		UNION ALL
+		SELECT t.id FROM tasks t JOIN tree ON t.parent_id = tree.id WHERE t.deleted_at IS NULL
+	), trashed AS (
+		UPDATE tasks SET deleted_at = now() WHERE id IN (SELECT id FROM tree) RETURNING id, parent_id
+	)
+	SELECT parent_id FROM trashed WHERE id = $1`
+	selectTrashedTaskQuery = "SELECT parent_id, deleted_at FROM tasks WHERE id = $1 AND todo_id = $2 AND deleted_at IS NOT NULL"
+	// restoreTaskQuery takes a task out of the trash along with the subtasks that were trashed with it at $2.
+	restoreTaskQuery = `
+	WITH RECURSIVE tree AS (
+		SELECT id FROM tasks WHERE id = $1
+		UNION ALL
+		SELECT t.id FROM tasks t JOIN tree ON t.parent_id = tree.id WHERE t.deleted_at = $2
+	)
+	UPDATE tasks SET deleted_at = NULL WHERE id IN (SELECT id FROM tree)`
+	// trashQuery lists the trashed todo lists the user can access, and the trashed tasks of their other lists.
+	// Subtasks trashed along with their parent are left out, since they are restored with it.
+	trashQuery = `
+	SELECT 'todo' AS type, id, id AS todo_id, name AS title, deleted_at FROM todos
+	WHERE id IN (SELECT todo_id FROM todo_access WHERE user_id = $1) AND deleted_at IS NOT NULL
+	UNION ALL
+	SELECT 'task', t.id, t.todo_id, COALESCE(t.content, ''), t.deleted_at
+	FROM tasks t
+		JOIN todos td ON td.id = t.todo_id
+		LEFT JOIN tasks p ON p.id = t.parent_id
+	WHERE td.id IN (SELECT todo_id FROM todo_access WHERE user_id = $1) AND td.deleted_at IS NULL AND t.deleted_at IS NOT NULL
+		AND (p.deleted_at IS NULL OR p.deleted_at <> t.deleted_at)`
+	selectTrashQuery = "SELECT type, id, todo_id, title, deleted_at FROM (" + trashQuery + ") trash ORDER BY deleted_at DESC, id LIMIT $2 OFFSET $3"
+	countTrashQuery  = "SELECT COUNT(*) FROM (" + trashQuery + ") trash"
+	purgeTodosQuery  = "DELETE FROM todos WHERE deleted_at < $1"
+	purgeTasksQuery  = "DELETE FROM tasks WHERE deleted_at < $1"
+	// purgeTombstonesQuery forgets the deletions older than $1, and moves the sync horizon past them.
+	purgeTombstonesQuery = `
+	WITH purged AS (
+		DELETE FROM sync_tombstones WHERE deleted_at < $1 RETURNING sync_xid
+	)
+	INSERT INTO sync_horizon (xid)
+	SELECT sync_xid FROM purged ORDER BY sync_xid DESC LIMIT 1
+	ON CONFLICT (id) DO UPDATE SET xid = GREATEST(sync_horizon.xid, EXCLUDED.xid)`
+
+	// setTodoArchivedQuery archives the list when $1 is true, keeping the original timestamp of an archived one,
+	// and unarchives it otherwise. Lists in the trash are left alone.
+	setTodoArchivedQuery = "UPDATE todos SET archived_at = CASE WHEN $1 THEN COALESCE(archived_at, now()) END WHERE id = $2 AND deleted_at IS NULL"
+)
+
+// HISTORY queries
+const (
+	// selectChangedSnapshotQuery captures what changed in a todo list since its tasks were at the versions keyed by
+	// id in $2: its own row, the tasks at another version keyed by id, including the trashed ones, and the
+	// dependencies between its tasks, along with the ids of every one of its tasks.
+	selectChangedSnapshotQuery = `
+	SELECT jsonb_build_object(
+		'todo', to_jsonb(td),
+		'tasks', COALESCE((
+			SELECT jsonb_object_agg(t.id, to_jsonb(t)) FROM tasks t
+			WHERE t.todo_id = td.id AND ($2::jsonb ->> t.id::text) IS DISTINCT FROM t.version::text), '{}'),
+		'dependencies', COALESCE((
+			SELECT jsonb_agg(jsonb_build_array(d.task_id, d.depends_on_id) ORDER BY d.task_id, d.depends_on_id)
+			FROM task_dependencies d JOIN tasks t ON t.id = d.task_id
+			WHERE t.todo_id = td.id), '[]')),
+		ARRAY(SELECT t.id FROM tasks t WHERE t.todo_id = td.id)
+	FROM todos td WHERE td.id = $1`
+	selectLastSnapshotQuery = "SELECT snapshot FROM todo_revisions WHERE todo_id = $1 ORDER BY id DESC LIMIT 1"
+	selectSnapshotQuery     = "SELECT snapshot FROM todo_revisions WHERE id = $1 AND todo_id = $2"
+	insertRevisionQuery     = "INSERT INTO todo_revisions (todo_id, actor_id, action, changes, snapshot) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at"
+	selectRevisionsQuery    = "SELECT id, todo_id, actor_id, action, changes, created_at FROM todo_revisions WHERE todo_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3"
+	countRevisionsQuery     = "SELECT COUNT(*) FROM todo_revisions WHERE todo_id = $1"
+	selectRevisionQuery     = "SELECT id, todo_id, actor_id, action, changes, created_at FROM todo_revisions WHERE id = $1"
+	// compactRevisionsQuery drops the snapshots of the revisions recorded before $1, but for the last one of each list,
+	// which the next revision is compared with. Their changes stay in the history.
+	compactRevisionsQuery = `
+	UPDATE todo_revisions r SET snapshot = NULL
+	WHERE r.created_at < $1 AND r.snapshot IS NOT NULL
+		AND r.id < (SELECT MAX(id) FROM todo_revisions l WHERE l.todo_id = r.todo_id)`
+	// notifyRevisionQuery announces a revision to the event brokers once the transaction recording it commits, along
+	// with the users who can access its todo list.
+	notifyRevisionQuery = `
+	SELECT pg_notify('` + revisionsChannel + `', json_build_object(
+		'id', $1::bigint, 'todo_id', $2::text, 'user_ids', ARRAY(SELECT user_id FROM todo_access WHERE todo_id = $2))::text)`
+	notifyPresenceQuery = "SELECT pg_notify($1, $2)"
+	// selectRevisionsSinceQuery returns the revisions recorded by the transactions from the one in $1 on, either of a
+	// single todo list or, when $2 is empty, of every list the user can access, in the order of their transaction and
+	// id, from after the one in $4 and $5. See the DELTA SYNC queries for how transactions are used as a cursor.
+	selectRevisionsSinceQuery = `
+	SELECT r.id, r.todo_id, r.actor_id, r.action, r.changes, r.created_at, r.sync_xid::text
+	FROM todo_revisions r JOIN todos t ON t.id = r.todo_id
+	WHERE r.sync_xid >= $1::text::xid8 AND (r.sync_xid, r.id) > ($4::text::xid8, $5::bigint)
+		AND (($2 <> '' AND r.todo_id = $2) OR ($2 = '' AND t.id IN (SELECT todo_id FROM todo_access WHERE user_id = $3)))
+	ORDER BY r.sync_xid, r.id LIMIT $6`
+	revertTodoQuery           = "UPDATE todos SET name = s.name, archived_at = s.archived_at FROM jsonb_populate_record(NULL::todos, $2) s WHERE todos.id = $1"
+	trashTasksNotInQuery      = "UPDATE tasks SET deleted_at = now() WHERE todo_id = $1 AND deleted_at IS NULL AND NOT (id = ANY($2))"
+	deleteListDependencyQuery = "DELETE FROM task_dependencies d USING tasks t WHERE t.id = d.task_id AND t.todo_id = $1"
+	// revertTasksQuery writes back the tasks of a snapshot, recreating the purged ones.
+	// Tasks which have been moved to another list since are left alone.
+	revertTasksQuery = `
+	INSERT INTO tasks (` + insertTaskColumns + `, deleted_at)
+	SELECT ` + insertTaskColumns + `, deleted_at FROM jsonb_populate_recordset(NULL::tasks, $1)
+	ON CONFLICT (id) DO UPDATE SET
+		task_order = EXCLUDED.task_order, content = EXCLUDED.content, done = EXCLUDED.done,
+		priority = EXCLUDED.priority, due_at = EXCLUDED.due_at, recurrence = EXCLUDED.recurrence, parent_id = EXCLUDED.parent_id,
+		auto_complete = EXCLUDED.auto_complete, rank = EXCLUDED.rank, deleted_at = EXCLUDED.deleted_at
+	WHERE tasks.todo_id = EXCLUDED.todo_id`
+	// revertDependenciesQuery writes back the dependencies of a snapshot between tasks which are still in the list.
+	revertDependenciesQuery = `
+	INSERT INTO task_dependencies (task_id, depends_on_id)
+	SELECT d->>0, d->>1 FROM jsonb_array_elements($2::jsonb) d
+	WHERE EXISTS (SELECT 1 FROM tasks WHERE id = d->>0 AND todo_id = $1)
+		AND EXISTS (SELECT 1 FROM tasks WHERE id = d->>1 AND todo_id = $1)
+	ON CONFLICT DO NOTHING`
+)
+
+// DELTA SYNC queries
+//
+// Every row carries sync_xid, the id of the last transaction that changed it. A sync token is the oldest
+// transaction still running when the changes were read: everything changed before it was part of the read,
+// so the next read only needs the rows changed by it or any later transaction. Queries taking a token
+// take it as text in $2; NULL asks for everything that exists rather than for changes.
+const (
+	// selectSyncTokenQuery has to be the first statement of the transaction, which takes its snapshot.
+	selectSyncTokenQuery  = "SELECT pg_snapshot_xmin(pg_current_snapshot())::text"
+	syncTokenExpiredQuery = "SELECT EXISTS (SELECT 1 FROM sync_horizon WHERE xid >= $1::text::xid8)"
+	// selectChangedTodosQuery also selects the lists shared with the user since the token, which are new to them
+	// however long ago they last changed.
+	selectChangedTodosQuery = `
+	SELECT ` + todoColumns + `, deleted_at FROM todos
+	WHERE id IN (SELECT todo_id FROM todo_access WHERE user_id = $1)
+		AND (($2::text IS NULL AND deleted_at IS NULL) OR sync_xid >= $2::text::xid8
+			OR id IN (SELECT todo_id FROM todo_members WHERE user_id = $1 AND sync_xid >= $2::text::xid8))
+	ORDER BY id`
+	// selectChangedTasksQuery leaves out the tasks of trashed lists, which are deleted along with their list.
+	// Like their list, the tasks of a list shared with the user since the token are all new to them.
+	selectChangedTasksQuery = `
+	SELECT ` + prefixedTaskColumns + `, t.deleted_at
+	FROM tasks t JOIN todos td ON td.id = t.todo_id
+	WHERE td.id IN (SELECT todo_id FROM todo_access WHERE user_id = $1) AND td.deleted_at IS NULL
+		AND (($2::text IS NULL AND t.deleted_at IS NULL) OR t.sync_xid >= $2::text::xid8
+			OR (t.deleted_at IS NULL AND td.id IN (SELECT todo_id FROM todo_members WHERE user_id = $1 AND sync_xid >= $2::text::xid8)))
+	ORDER BY t.todo_id, t.rank, t.id`
+	// selectTombstonesQuery selects the tombstones of the user, and those of the tasks deleted from the lists shared
+	// with them, which are recorded for the author of the list.
+	selectTombstonesQuery = `
+	SELECT DISTINCT ON (entity, id) entity, id, todo_id, deleted_at FROM sync_tombstones
+	WHERE (user_id = $1 OR (entity = 'task' AND todo_id IN (SELECT todo_id FROM todo_access WHERE user_id = $1)))
+		AND sync_xid >= $2::text::xid8
+	ORDER BY entity DESC, id, deleted_at DESC`
+)
+
+// CALDAV queries
+//
+// A task is a resource named and identified the way the CalDAV client which created it chose, or after its id
+// otherwise. The names are those of the list the task was created in, and a task moved to another list goes by its
+// id there. Changes are read with the same sync tokens as delta sync.
+const (
+	davNameColumn = "COALESCE(d.name, t.id || '.ics')"
+	davUIDColumn  = "COALESCE(d.uid, t.id || '" + davUIDDomain + "')"
+	// selectDAVCalendarsQuery selects the active lists a user can access, or only the one with the id $2 when it is
+	// not NULL.
+	selectDAVCalendarsQuery = `
+	SELECT id, name, version FROM todos
+	WHERE id IN (SELECT todo_id FROM todo_access WHERE user_id = $1) AND deleted_at IS NULL AND archived_at IS NULL AND ($2::text IS NULL OR id = $2)
+	ORDER BY name, id`
+	davResourceColumns = prefixedTaskColumns + ", t.completed_at, " + davNameColumn + ", " + davUIDColumn + `,
+		(SELECT COALESCE(pd.uid, p.id || '` + davUIDDomain + `') FROM tasks p LEFT JOIN dav_resources pd ON pd.task_id = p.id AND pd.todo_id = p.todo_id WHERE p.id = t.parent_id),
+		t.deleted_at IS NOT NULL`
+	// selectDAVResourcesQuery selects the tasks of a list with the names in $2, or all of them when $2 is NULL.
+	selectDAVResourcesQuery = `
+	SELECT ` + davResourceColumns + `
+	FROM tasks t LEFT JOIN dav_resources d ON d.task_id = t.id AND d.todo_id = t.todo_id
+	WHERE t.todo_id = $1 AND t.deleted_at IS NULL AND ($2::text[] IS NULL OR ` + davNameColumn + ` = ANY($2))
+	ORDER BY t.rank, t.id`
+	selectChangedDAVResourcesQuery = `
+	SELECT ` + davResourceColumns + `
+	FROM tasks t LEFT JOIN dav_resources d ON d.task_id = t.id AND d.todo_id = t.todo_id
+	WHERE t.todo_id = $1 AND (($2::text IS NULL AND t.deleted_at IS NULL) OR t.sync_xid >= $2::text::xid8)
+	ORDER BY t.rank, t.id`
+	selectDAVTombstonesQuery = `
+	SELECT COALESCE(d.name, s.id || '.ics') FROM sync_tombstones s LEFT JOIN dav_resources d ON d.task_id = s.id AND d.todo_id = s.todo_id
+	WHERE s.entity = 'task' AND s.todo_id = $1 AND s.sync_xid >= $2::text::xid8`
+	selectTaskIDByUIDQuery = `
+	SELECT t.id FROM tasks t LEFT JOIN dav_resources d ON d.task_id = t.id AND d.todo_id = t.todo_id
+	WHERE t.todo_id = $1 AND t.deleted_at IS NULL AND ` + davUIDColumn + ` = $2`
+	// selectDAVNameTakenQuery reports whether a task of the list $1 goes by the resource name $2.
+	selectDAVNameTakenQuery = `
+	SELECT EXISTS (
+		SELECT 1 FROM tasks t LEFT JOIN dav_resources d ON d.task_id = t.id AND d.todo_id = t.todo_id
+		WHERE t.todo_id = $1 AND t.deleted_at IS NULL AND ` + davNameColumn + ` = $2)`
+	// releaseDAVNameQuery frees the resource name $2 of the list $1 from the task which is in the trash or gone.
+	releaseDAVNameQuery = `
+	DELETE FROM dav_resources d
+	WHERE d.todo_id = $1 AND d.name = $2
+		AND NOT EXISTS (SELECT 1 FROM tasks WHERE id = d.task_id AND todo_id = d.todo_id AND deleted_at IS NULL)`
+	insertDAVResourceQuery = "INSERT INTO dav_resources (task_id, todo_id, name, uid) VALUES ($1, $2, $3, $4)"
+	// purgeDAVResourcesQuery forgets the names of the tasks which are gone, once delta sync has forgotten them too.
+	purgeDAVResourcesQuery = `
+	DELETE FROM dav_resources d
+	WHERE NOT EXISTS (SELECT 1 FROM tasks WHERE id = d.task_id)
+		AND NOT EXISTS (SELECT 1 FROM sync_tombstones WHERE entity = 'task' AND id = d.task_id)`
+)
+
+// IMPORT and EXPORT queries
+const (
+	// insertImportedTaskQuery creates a task keeping the creation and completion times read from a file, falling
+	// back to the column default and to the completion trigger when they are not known.
+	insertImportedTaskQuery = `
+	INSERT INTO tasks (` + insertTaskColumns + `, created_at, completed_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, COALESCE($12, now()), $13)`
+	selectTagIDByNameQuery = "SELECT id FROM tags WHERE user_id = $1 AND name = $2"
+	insertImportedTagQuery = "INSERT INTO tags (id, user_id, name, color) VALUES ($1, $2, $3, $4)"
+	selectTaskDatesQuery   = "SELECT id, created_at, completed_at FROM tasks WHERE todo_id = $1 AND deleted_at IS NULL"
+)
+
+// MEMBER queries
+const (
+	memberColumns = "todo_id, user_id, created_at"
+	// insertMemberQuery shares the todo list $1 with the user $2, unless the user does not exist or already is a member.
+	insertMemberQuery     = "INSERT INTO todo_members (todo_id, user_id) SELECT $1, id FROM users WHERE id = $2 ON CONFLICT DO NOTHING"
+	selectUserExistsQuery = "SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)"
+	deleteMemberQuery     = "DELETE FROM todo_members WHERE todo_id = $1 AND user_id = $2"
+	selectMembersQuery    = "SELECT " + memberColumns + " FROM todo_members WHERE todo_id = $1 ORDER BY created_at, user_id"
+	selectMemberIDsQuery  = "SELECT user_id FROM todo_members WHERE todo_id = $1"
+	// selectAccessibleTodoQuery selects the todo list $1 if the user $2 is its author or one of its members.
+	selectAccessibleTodoQuery = "SELECT " + todoColumns + " FROM todos WHERE id = $1 AND deleted_at IS NULL AND id IN (SELECT todo_id FROM todo_access WHERE user_id = $2)"
+)
+
+// TAG queries
+const (
+	selectTagOwnerQuery      = "SELECT user_id FROM tags WHERE id = $1"
+	insertTodoTagQuery       = "INSERT INTO todo_tags (todo_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	insertTaskTagQuery       = "INSERT INTO task_tags (task_id, tag_id) VALUES ($1, $2) ON CONFLICT DO NOTHING"
+	deleteTodoTagQuery       = "DELETE FROM todo_tags WHERE todo_id = $1 AND tag_id = $2"
+	deleteTaskTagQuery       = "DELETE FROM task_tags WHERE task_id = $1 AND tag_id = $2"
+	selectTagsByTodoIDsQuery = `
+	SELECT tt.todo_id, t.id, t.user_id, t.name, t.color
+	FROM todo_tags tt JOIN tags t ON t.id = tt.tag_id
+	WHERE tt.todo_id = ANY($1)
+	ORDER BY t.name`
+	selectTagsByTaskIDsQuery = `
+	SELECT tt.task_id, t.id, t.user_id, t.name, t.color
+	FROM task_tags tt JOIN tags t ON t.id = tt.tag_id
+	WHERE tt.task_id = ANY($1)
+	ORDER BY t.name`
 )
@@ -0,0 +1,530 @@
+package todo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/noquark/nanoid"
+
+	"github.com/akalpaki/todo/pkg/web"
+	"github.com/akalpaki/todo/pkg/ws"
+)
+
+const (
+	// syncAuthTimeout is how long a connection may take to authenticate when its handshake carried no token.
+	syncAuthTimeout = 10 * time.Second
+	// syncPingInterval is how often the server pings the client and refreshes its presences.
+	syncPingInterval = 30 * time.Second
+	// syncIdleTimeout closes connections which have not answered a ping in time.
+	syncIdleTimeout = 2 * syncPingInterval
+	// syncSendBuffer is how many messages a client can fall behind before it is disconnected.
+	syncSendBuffer = 256
+	// syncReadLimit is the largest message a client may send.
+	syncReadLimit = 64 << 10
+)
+
+// Types of the messages sent by sync clients.
+const (
+	SyncAuth        = "auth"
+	SyncSubscribe   = "subscribe"
+	SyncUnsubscribe = "unsubscribe"
+	SyncPresence    = "presence"
+	SyncMutate      = "mutate"
+)
+
+// Types of the messages sent by the server.
+const (
+	SyncAck    = "ack"
+	SyncError  = "error"
+	SyncEvent  = "event"
+	SyncResync = "resync"
+)
+
+// Mutations a sync client can make with a SyncMutate message.
+const (
+	SyncOpCreateTask = "create_task"
+	SyncOpUpdateTask = "update_task"
+	SyncOpDeleteTask = "delete_task"
+)
+
+// SyncRequest is a message sent by a sync client. ID is chosen by the client and echoed in the
+// acknowledgement or error answering the message.
+type SyncRequest struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Token  string `json:"token,omitempty"`
+	TodoID string `json:"todo_id,omitempty"`
+	TaskID string `json:"task_id,omitempty"`
+	// State is the Presence state announced by a SyncPresence message.
+	State string `json:"state,omitempty"`
+	// Op is the mutation made by a SyncMutate message, applied to Task and/or TaskID. An update only
+	// changes the fields of Task which were sent.
+	Op   string `json:"op,omitempty"`
+	Task *Task  `json:"task,omitempty"`
+	// IfMatch makes an update or delete conditional on the version of the task.
+	IfMatch *int64 `json:"if_match,omitempty"`
+
+	// task is Task as it was sent.
+	task json.RawMessage
+}
+
+// UnmarshalJSON keeps the task as it was sent next to the decoded one, so that the fields it leaves out can be told apart.
+func (req *SyncRequest) UnmarshalJSON(data []byte) error {
+	type plain SyncRequest
+	var v struct {
+		plain
+		Task json.RawMessage `json:"task"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+
+	*req = SyncRequest(v.plain)
+	if len(v.Task) == 0 || string(v.Task) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(v.Task, &req.Task); err != nil {
+		return err
+	}
+	req.task = v.Task
+	return nil
+}
+
+// taskData returns Task as it was sent, or all of its fields when it was not decoded from JSON.
+func (req SyncRequest) taskData() (json.RawMessage, error) {
+	if req.task != nil {
+		return req.task, nil
+	}
+	return json.Marshal(req.Task)
+}
+
+// SyncMessage is a message sent by the server: an acknowledgement or error answering a request,
+// an Event or the Presence list of a subscribed todo list, or a request to resync a todo list
+// whose events could not all be delivered.
+type SyncMessage struct {
+	Type   string `json:"type"`
+	ID     string `json:"id,omitempty"`
+	TodoID string `json:"todo_id,omitempty"`
+	// Code is the HTTP status code matching an error.
+	Code  int    `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+	Data  any    `json:"data,omitempty"`
+}
+
+// HandleSync upgrades the request to a WebSocket sync channel. Clients authenticate with the usual
+// x-jwt-token header or, when they cannot set headers, with a SyncAuth message sent first.
+func HandleSync(logger *slog.Logger, repository *Repository, broker *Broker) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var userID string
+		if token := r.Header.Get("x-jwt-token"); token != "" {
+			id, err := web.ParseAccessToken(token)
+			if err != nil {
+				web.ErrorResponse(logger, w, r, http.StatusUnauthorized, "missing or invalid token", err)
+				return
+			}
+			userID = id
+		}
+
+		conn, err := ws.Upgrade(w, r)
+		if err != nil {
+			logger.Error("failed to upgrade sync connection", "error", err)
+			return
+		}
+		conn.SetReadLimit(syncReadLimit)
+
+		if userID == "" {
+			if userID, err = authenticateSync(conn); err != nil {
+				conn.Close(ws.ClosePolicyViolation, "missing or invalid token")
+				return
+			}
+		}
+
+		sessionID, err := nanoid.New(0)
+		if err != nil {
+			conn.Close(ws.CloseInternalError, "")
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.WithValue(r.Context(), web.UserID, userID))
+		s := &syncSession{
+			id:            sessionID,
+			userID:        userID,
+			conn:          conn,
+			logger:        logger,
+			repository:    repository,
+			broker:        broker,
+			ctx:           ctx,
+			cancel:        cancel,
+			out:           make(chan SyncMessage, syncSendBuffer),
+			subscriptions: make(map[string]*syncSubscription),
+		}
+		s.run()
+	}
+}
+
+// authenticateSync reads the SyncAuth message a client without a token in its handshake has to start with.
+func authenticateSync(conn *ws.Conn) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(syncAuthTimeout))
+	data, err := conn.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	var req SyncRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.Type != SyncAuth {
+		return "", web.ErrInvalidToken
+	}
+	return web.ParseAccessToken(req.Token)
+}
+
+// syncSession is a single sync connection. Requests are handled one at a time, in the order they are read,
+// while everything sent to the client goes through out, so that a client which does not keep up is
+// disconnected instead of holding up the broker or growing the server's memory.
+type syncSession struct {
+	id         string
+	userID     string
+	conn       *ws.Conn
+	logger     *slog.Logger
+	repository *Repository
+	broker     *Broker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	out    chan SyncMessage
+
+	mu            sync.Mutex
+	subscriptions map[string]*syncSubscription
+	closeCode     int
+}
+
+// syncSubscription is a todo list a session follows, along with the session's presence on it.
+type syncSubscription struct {
+	sub      *Subscription
+	stop     context.CancelFunc
+	presence Presence
+}
+
+func (s *syncSession) run() {
+	go s.write()
+	defer s.close()
+
+	s.conn.SetIdleTimeout(syncIdleTimeout)
+	for {
+		data, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var req SyncRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			s.fail(req, http.StatusBadRequest, "malformed json")
+			continue
+		}
+		s.handle(req)
+	}
+}
+
+// write sends the queued messages and pings the client, until the session ends.
+func (s *syncSession) write() {
+	ticker := time.NewTicker(syncPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			s.mu.Lock()
+			code := s.closeCode
+			s.mu.Unlock()
+			if code == 0 {
+				code = ws.CloseGoingAway
+			}
+			s.conn.Close(code, "")
+			return
+		case msg := <-s.out:
+			data, err := json.Marshal(msg)
+			if err != nil {
+				s.logger.Error("failed to encode sync message", "error", err)
+				continue
+			}
+			if err := s.conn.WriteMessage(data); err != nil {
+				s.cancel()
+				continue
+			}
+		case <-ticker.C:
+			if err := s.conn.Ping(); err != nil {
+				s.cancel()
+				continue
+			}
+			s.refreshPresence()
+		}
+	}
+}
+
+// send queues a message for the client, disconnecting it when its queue is full.
+func (s *syncSession) send(msg SyncMessage) {
+	select {
+	case s.out <- msg:
+	default:
+		s.mu.Lock()
+		if s.closeCode == 0 {
+			s.closeCode = ws.CloseTryAgainLater
+		}
+		s.mu.Unlock()
+		s.cancel()
+	}
+}
+
+func (s *syncSession) ack(req SyncRequest) {
+	s.send(SyncMessage{Type: SyncAck, ID: req.ID, TodoID: req.TodoID})
+}
+
+func (s *syncSession) fail(req SyncRequest, code int, detail string) {
+	s.send(SyncMessage{Type: SyncError, ID: req.ID, TodoID: req.TodoID, Code: code, Error: detail})
+}
+
+func (s *syncSession) handle(req SyncRequest) {
+	switch req.Type {
+	case SyncSubscribe:
+		s.subscribe(req)
+	case SyncUnsubscribe:
+		s.unsubscribe(req.TodoID)
+		s.ack(req)
+	case SyncPresence:
+		s.setPresence(req)
+	case SyncMutate:
+		s.mutate(req)
+	default:
+		s.fail(req, http.StatusBadRequest, "unknown message type")
+	}
+}
+
+// ownedTodo checks that the caller can edit the todo list, answering the request otherwise.
+func (s *syncSession) ownedTodo(req SyncRequest) bool {
+	todo, err := s.repository.GetByID(s.ctx, s.userID, req.TodoID)
+	if err != nil {
+		switch err {
+		case errNotFound:
+			s.fail(req, http.StatusNotFound, "todo not found")
+			return false
+		default:
+			s.logger.Error("failed to retrieve todo", "error", err)
+			s.fail(req, http.StatusInternalServerError, "failed to retrieve todo")
+			return false
+		}
+	}
+	if !canEdit(todo, s.userID) {
+		s.fail(req, http.StatusForbidden, "you do not have access to this resource")
+		return false
+	}
+	return true
+}
+
+// subscribe starts forwarding the events and presences of a todo list, and marks the caller as viewing it.
+func (s *syncSession) subscribe(req SyncRequest) {
+	if !s.ownedTodo(req) {
+		return
+	}
+
+	s.mu.Lock()
+	_, ok := s.subscriptions[req.TodoID]
+	s.mu.Unlock()
+	if ok {
+		s.ack(req)
+		return
+	}
+
+	ctx, stop := context.WithCancel(s.ctx)
+	sub := &syncSubscription{
+		sub:      s.broker.Subscribe(req.TodoID, ""),
+		stop:     stop,
+		presence: Presence{TodoID: req.TodoID, UserID: s.userID, SessionID: s.id, State: PresenceViewing},
+	}
+	s.mu.Lock()
+	s.subscriptions[req.TodoID] = sub
+	s.mu.Unlock()
+	go s.forward(ctx, req.TodoID, sub.sub)
+
+	s.ack(req)
+	s.send(SyncMessage{Type: SyncPresence, TodoID: req.TodoID, Data: s.broker.PresenceOf(req.TodoID)})
+	s.announce(sub.presence)
+}
+
+// forward passes the events and presences of a subscribed todo list to the client.
+func (s *syncSession) forward(ctx context.Context, todoID string, sub *Subscription) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rev, ok := <-sub.Revisions:
+			if !ok {
+				if ctx.Err() == nil {
+					s.send(SyncMessage{Type: SyncResync, TodoID: todoID})
+					s.unsubscribe(todoID)
+				}
+				return
+			}
+			for _, e := range rev.Events() {
+				s.send(SyncMessage{Type: SyncEvent, TodoID: todoID, Data: e})
+			}
+		case presence := <-sub.Presence:
+			s.send(SyncMessage{Type: SyncPresence, TodoID: todoID, Data: presence})
+		}
+	}
+}
+
+func (s *syncSession) unsubscribe(todoID string) {
+	s.mu.Lock()
+	sub, ok := s.subscriptions[todoID]
+	delete(s.subscriptions, todoID)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	sub.stop()
+	s.broker.Unsubscribe(sub.sub)
+	sub.presence.State = PresenceLeft
+	s.announce(sub.presence)
+}
+
+// setPresence changes what the caller is doing with a subscribed todo list.
+func (s *syncSession) setPresence(req SyncRequest) {
+	if req.State != PresenceViewing && req.State != PresenceEditing {
+		s.fail(req, http.StatusBadRequest, "invalid presence state")
+		return
+	}
+
+	s.mu.Lock()
+	sub, ok := s.subscriptions[req.TodoID]
+	var presence Presence
+	if ok {
+		sub.presence.State = req.State
+		sub.presence.TaskID = nil
+		if req.State == PresenceEditing && req.TaskID != "" {
+			taskID := req.TaskID
+			sub.presence.TaskID = &taskID
+		}
+		presence = sub.presence
+	}
+	s.mu.Unlock()
+	if !ok {
+		s.fail(req, http.StatusBadRequest, "not subscribed to this todo")
+		return
+	}
+
+	s.announce(presence)
+	s.ack(req)
+}
+
+// refreshPresence announces the presences of the session again, so that they do not expire.
+func (s *syncSession) refreshPresence() {
+	s.mu.Lock()
+	presences := make([]Presence, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		presences = append(presences, sub.presence)
+	}
+	s.mu.Unlock()
+
+	for _, p := range presences {
+		s.announce(p)
+	}
+}
+
+func (s *syncSession) announce(p Presence) {
+	// the session context may already be cancelled when announcing that the caller left
+	if err := s.broker.Announce(context.WithoutCancel(s.ctx), p); err != nil {
+		s.logger.Error("failed to announce presence", "error", err)
+	}
+}
+
+// mutate applies a change to the tasks of a todo list. The change reaches every subscriber, the caller
+// included, as events once it is committed.
+func (s *syncSession) mutate(req SyncRequest) {
+	switch req.Op {
+	case SyncOpCreateTask, SyncOpUpdateTask, SyncOpDeleteTask:
+	default:
+		s.fail(req, http.StatusBadRequest, "unknown mutation")
+		return
+	}
+	if !s.ownedTodo(req) {
+		return
+	}
+
+	var ifMatch []int64
+	if req.IfMatch != nil {
+		ifMatch = []int64{*req.IfMatch}
+	}
+
+	if req.Op != SyncOpCreateTask {
+		if _, err := s.repository.GetTask(s.ctx, s.userID, req.TodoID, req.TaskID); err != nil {
+			s.mutateError(req, err)
+			return
+		}
+	}
+
+	var err error
+	switch req.Op {
+	case SyncOpCreateTask:
+		if req.Task == nil || !req.Task.Valid() {
+			s.fail(req, http.StatusBadRequest, "invalid task")
+			return
+		}
+		task := *req.Task
+		task.TodoID = req.TodoID
+		err = s.repository.CreateTask(s.ctx, s.userID, task)
+	case SyncOpUpdateTask:
+		if req.Task == nil {
+			s.fail(req, http.StatusBadRequest, "invalid task")
+			return
+		}
+		var data json.RawMessage
+		if data, err = req.taskData(); err == nil {
+			err = s.repository.MergeTask(s.ctx, s.userID, req.TodoID, req.TaskID, data, ifMatch)
+		}
+	case SyncOpDeleteTask:
+		err = s.repository.DeleteTask(s.ctx, s.userID, req.TodoID, req.TaskID, ifMatch)
+	}
+	if err != nil {
+		s.mutateError(req, err)
+		return
+	}
+
+	s.ack(req)
+}
+
+func (s *syncSession) mutateError(req SyncRequest, err error) {
+	switch {
+	case errors.Is(err, errNotFound):
+		s.fail(req, http.StatusNotFound, "task not found")
+	case errors.Is(err, errVersionMismatch):
+		s.fail(req, http.StatusPreconditionFailed, "the task has been modified")
+	case errors.Is(err, errInvalidPatchResult):
+		s.fail(req, http.StatusBadRequest, "invalid task")
+	case errors.Is(err, errInvalidParent), errors.Is(err, errTaskTooDeep):
+		s.fail(req, http.StatusBadRequest, err.Error())
+	default:
+		s.logger.Error("failed to apply sync mutation", "error", err)
+		s.fail(req, http.StatusInternalServerError, "failed to apply mutation")
+	}
+}
+
+// close ends the session, leaving every todo list it was subscribed to.
+func (s *syncSession) close() {
+	s.mu.Lock()
+	todoIDs := make([]string, 0, len(s.subscriptions))
+	for todoID := range s.subscriptions {
+		todoIDs = append(todoIDs, todoID)
+	}
+	s.mu.Unlock()
+
+	for _, todoID := range todoIDs {
+		s.unsubscribe(todoID)
+	}
+	s.cancel()
+}
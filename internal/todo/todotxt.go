@@ -0,0 +1,135 @@
+package todo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/akalpaki/todo/pkg/todotxt"
+)
+
+// TodoTxt is the todo.txt format. Tasks keep their priority, their creation and completion dates, and their due date
+// as a "due:" pair. Tags become +project tags, except for the ones whose name starts with "@", which are written as
+// @context tags, and the other way round on import.
+var TodoTxt = FileFormat{
+	ContentType: todotxt.ContentType,
+	Extension:   ".txt",
+	NewReader: func(r io.Reader) ImportReader {
+		return todoTxtReader{todotxt.NewScanner(r)}
+	},
+	Write: writeTodoTxt,
+}
+
+type todoTxtReader struct {
+	s *todotxt.Scanner
+}
+
+func (r todoTxtReader) Next() (FileTask, error) {
+	if !r.s.Scan() {
+		if err := r.s.Err(); err != nil {
+			return FileTask{}, err
+		}
+		return FileTask{}, io.EOF
+	}
+
+	if r.s.TooLong() {
+		return FileTask{}, SkippedLine{Line: r.s.Line(), Reason: fmt.Sprintf("the line is longer than %d bytes", todotxt.MaxLineLength)}
+	}
+
+	t := r.s.Task()
+	task := FileTask{
+		Line:        r.s.Line(),
+		Content:     t.Text("due", "pri"),
+		Done:        t.Done,
+		Priority:    priorityFromTodoTxt(t.Priority),
+		CreatedAt:   t.CreatedAt,
+		CompletedAt: t.CompletedAt,
+		Tags:        make([]string, 0),
+	}
+	task.Tags = append(task.Tags, t.Projects()...)
+	for _, c := range t.Contexts() {
+		task.Tags = append(task.Tags, "@"+c)
+	}
+	if due, ok := t.Value("due"); ok {
+		d, err := time.Parse(todotxt.DateLayout, due)
+		if err != nil {
+			return FileTask{}, SkippedLine{Line: task.Line, Reason: fmt.Sprintf("invalid due date %q", due)}
+		}
+		task.DueAt = &d
+	}
+	return task, nil
+}
+
+func writeTodoTxt(w io.Writer, tasks []FileTask) error {
+	bw := bufio.NewWriter(w)
+	for _, t := range tasks {
+		// a line holds a single task, so the content has to fit in one
+		words := strings.Fields(t.Content)
+		for _, name := range t.Tags {
+			if rest, ok := strings.CutPrefix(name, "@"); ok {
+				words = append(words, "@"+strings.Join(strings.Fields(rest), "_"))
+			} else {
+				words = append(words, "+"+strings.Join(strings.Fields(name), "_"))
+			}
+		}
+		if t.DueAt != nil {
+			words = append(words, "due:"+t.DueAt.UTC().Format(todotxt.DateLayout))
+		}
+
+		line := todotxt.Task{
+			Done:        t.Done,
+			Priority:    todoTxtPriority(t.Priority),
+			CreatedAt:   utcDate(t.CreatedAt),
+			CompletedAt: utcDate(t.CompletedAt),
+			Description: strings.Join(words, " "),
+		}
+		if _, err := fmt.Fprintln(bw, line); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// utcDate returns the time, if any, in UTC, which is the time zone of the dates of exported files.
+func utcDate(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+// todoTxtPriority returns the todo.txt priority letter matching p, or 0 when p is PriorityNone.
+func todoTxtPriority(p Priority) byte {
+	switch p {
+	case PriorityUrgent:
+		return 'A'
+	case PriorityHigh:
+		return 'B'
+	case PriorityMedium:
+		return 'C'
+	case PriorityLow:
+		return 'D'
+	default:
+		return 0
+	}
+}
+
+// priorityFromTodoTxt returns the priority matching a todo.txt one: A is urgent, B high, C medium and anything
+// lower is low.
+func priorityFromTodoTxt(letter byte) Priority {
+	switch {
+	case letter == 'A':
+		return PriorityUrgent
+	case letter == 'B':
+		return PriorityHigh
+	case letter == 'C':
+		return PriorityMedium
+	case letter >= 'D' && letter <= 'Z':
+		return PriorityLow
+	default:
+		return PriorityNone
+	}
+}
@@ -4,6 +4,15 @@ import (
 	"net/mail"
 )
 
+// EventRegistered is the type of the domain event written when a user registers. Its payload is a Registered.
+const EventRegistered = "user.registered"
+
+// Registered is the payload of an EventRegistered event.
+type Registered struct {
+	ID    string `json:"id"`
+	Email string `json:"email"`
+}
+
 // User is the model representing the User entity
 type User struct {
 	ID       string `json:"id"`
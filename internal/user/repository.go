@@ -4,8 +4,12 @@ import (
 	"context"
 	"errors"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/noquark/nanoid"
+
+	"github.com/akalpaki/todo/pkg/outbox"
+	"github.com/akalpaki/todo/pkg/web"
 )
 
 var (
@@ -39,13 +43,31 @@ func (r *Repository) Register(ctx context.Context, data UserRequest) (User, erro
 	u.Email = data.Email
 	u.Password = data.Password
 
-	res, err := r.pool.Exec(ctx, insert, u.ID, u.Email, u.Password)
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	res, err := tx.Exec(ctx, insert, u.ID, u.Email, u.Password)
 	if res.RowsAffected() == 0 {
 		return User{}, errInsertFailed
 	}
 	if err != nil {
 		return User{}, err
 	}
+
+	event, err := outbox.NewEvent(EventRegistered, u.ID, u.ID, Registered{ID: u.ID, Email: u.Email})
+	if err != nil {
+		return User{}, err
+	}
+	if err := outbox.Write(ctx, tx, event); err != nil {
+		return User{}, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return User{}, err
+	}
 	return u, nil
 }
 
@@ -70,3 +92,18 @@ func (r *Repository) GetByID(ctx context.Context, id string) (User, error) {
 	}
 	return u, nil
 }
+
+// Authenticate returns the id of the user with the email and password, or ErrInvalidCredentials.
+func (r *Repository) Authenticate(ctx context.Context, email, password string) (string, error) {
+	u, err := r.GetByEmail(ctx, email)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", web.ErrInvalidCredentials
+		}
+		return "", err
+	}
+	if !passwordMatches(password, u.Password) {
+		return "", web.ErrInvalidCredentials
+	}
+	return u.ID, nil
+}
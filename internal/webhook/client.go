@@ -0,0 +1,76 @@
+package webhook
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+var errNonPublicAddress = errors.New("webhooks can only be sent to public addresses")
+
+// nonPublicPrefixes are the special-purpose ranges which netip.Addr does not already tell apart from public addresses.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// NewClient returns the client webhooks are sent with. Since any user can point a webhook anywhere, it only connects
+// to public addresses, and never to the loopback interface, private and link-local networks, where the metadata
+// endpoints of cloud providers live, or other special-purpose ranges. Addresses are checked once resolved, as they
+// are dialed, so that a host name cannot resolve to a forbidden one, and redirects are not followed, the response
+// to the webhook being the redirect itself. Proxies from the environment are ignored, since they would be dialed
+// instead of the webhook.
+func NewClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   publicOnly,
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// publicOnly refuses connections to addresses which are not public.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublic(ip.Unmap()) {
+		return fmt.Errorf("%w: %s", errNonPublicAddress, ip)
+	}
+	return nil
+}
+
+// isPublic reports whether the address is a unicast address of the public internet.
+func isPublic(ip netip.Addr) bool {
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
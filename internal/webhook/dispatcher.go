@@ -0,0 +1,165 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers sent along with every payload.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	EventHeader     = "X-Webhook-Event"
+	DeliveryHeader  = "X-Webhook-Delivery"
+)
+
+const (
+	// dispatchInterval is how often due deliveries are checked for.
+	dispatchInterval = time.Second
+	// deliveryBatch is how many deliveries are attempted at once.
+	deliveryBatch = 10
+	// deliveryTimeout is how long a webhook has to answer.
+	deliveryTimeout = 10 * time.Second
+	// deliveryLease is how long a claimed delivery is left alone by the other dispatchers.
+	deliveryLease = time.Minute
+	// maxAttempts is how many times a delivery is attempted before it fails.
+	maxAttempts = 8
+	// baseBackoff and maxBackoff bound the delay before retrying a delivery, which doubles with every attempt.
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+)
+
+// Sign returns the signature of a payload sent at the given time, as found in the X-Webhook-Signature header:
+// "t=<unix timestamp>,v1=<hex HMAC-SHA256 of "<unix timestamp>.<payload>" keyed with the webhook secret>".
+func Sign(secret string, timestamp time.Time, payload []byte) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(payload)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher sends the deliveries queued by Repository.Enqueue to their webhooks. Every replica can run one:
+// deliveries are claimed with row locks, and each is attempted by a single dispatcher at a time.
+type Dispatcher struct {
+	repository *Repository
+	client     *http.Client
+	logger     *slog.Logger
+}
+
+func NewDispatcher(repository *Repository, client *http.Client, logger *slog.Logger) *Dispatcher {
+	return &Dispatcher{
+		repository: repository,
+		client:     client,
+		logger:     logger,
+	}
+}
+
+// Run dispatches deliveries every dispatchInterval until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.Dispatch(ctx); err != nil && ctx.Err() == nil {
+			d.logger.Error("failed to dispatch webhooks", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch attempts the deliveries which are due.
+func (d *Dispatcher) Dispatch(ctx context.Context) error {
+	jobs, err := d.repository.claim(ctx, deliveryBatch, deliveryLease)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.deliver(ctx, j)
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+// deliver attempts a claimed delivery and records the outcome. A delivery succeeds when the webhook
+// answers with a 2xx status; it is retried with an exponential backoff otherwise.
+func (d *Dispatcher) deliver(ctx context.Context, j job) {
+	start := time.Now()
+	status, err := d.post(ctx, j, start)
+	attempt := Attempt{DurationMS: int(time.Since(start).Milliseconds())}
+	if status != 0 {
+		attempt.StatusCode = &status
+	}
+	if err != nil {
+		msg := err.Error()
+		attempt.Error = &msg
+	}
+
+	succeeded := err == nil
+	var retryAt *time.Time
+	if !succeeded && j.attempts+1 < maxAttempts {
+		at := time.Now().Add(backoff(j.attempts + 1))
+		retryAt = &at
+	}
+
+	if err := d.repository.recordAttempt(context.WithoutCancel(ctx), j, attempt, succeeded, retryAt); err != nil {
+		d.logger.Error("failed to record webhook delivery", "delivery_id", j.id, "error", err)
+	}
+}
+
+// post sends the payload of a delivery to its webhook, returning the response status, if any.
+func (d *Dispatcher) post(ctx context.Context, j job, now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, j.url, bytes.NewReader(j.payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, j.event)
+	req.Header.Set(DeliveryHeader, strconv.FormatInt(j.id, 10))
+	req.Header.Set(SignatureHeader, Sign(j.secret, now, j.payload))
+
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// draining the body lets the connection be reused
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook answered with status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// backoff returns how long to wait before the attempt following the given number of failed ones.
+func backoff(failed int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < failed && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
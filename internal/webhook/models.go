@@ -0,0 +1,113 @@
+package webhook
+
+import (
+	"encoding/json"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/akalpaki/todo/internal/todo"
+)
+
+// EventTaskCompleted is sent, on top of task.updated, when a task is marked as done.
+const EventTaskCompleted = "task.completed"
+
+// EventTypes are the events a webhook can subscribe to.
+var EventTypes = []string{
+	"todo.created", "todo.updated", "todo.deleted",
+	"task.created", "task.updated", "task.deleted", EventTaskCompleted,
+}
+
+// Statuses of a Delivery.
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Webhook is the model that represents an endpoint of a user which is notified of the events it subscribes to,
+// for every todo list of the user. Secret signs the payloads, and is only returned when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"user_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookRequest is the model containing the information required to create and update a webhook.
+// Requests should always be validated with the Valid method before being accepted. Active defaults to true.
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+}
+
+// Valid reports whether the request has an absolute http(s) URL and subscribes to known events only.
+func (r WebhookRequest) Valid() bool {
+	u, err := url.Parse(r.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return false
+	}
+	if len(r.Events) == 0 {
+		return false
+	}
+	for _, e := range r.Events {
+		if !slices.Contains(EventTypes, e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r WebhookRequest) active() bool {
+	return r.Active == nil || *r.Active
+}
+
+// Payload is the body POSTed to a webhook.
+type Payload struct {
+	Type      string     `json:"type"`
+	WebhookID string     `json:"webhook_id"`
+	CreatedAt time.Time  `json:"created_at"`
+	Event     todo.Event `json:"event"`
+}
+
+// Delivery is an event on its way to a webhook, or which already got there. Log holds every attempt
+// to deliver it, and is only returned along with the payload for a single delivery.
+type Delivery struct {
+	ID            int64           `json:"id"`
+	WebhookID     string          `json:"webhook_id"`
+	Event         string          `json:"event"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at"`
+	Payload       json.RawMessage `json:"payload,omitempty"`
+	Log           []Attempt       `json:"log,omitempty"`
+}
+
+// Attempt is a single try to deliver an event. StatusCode is missing when no response was received,
+// and Error when the webhook answered with a 2xx status.
+type Attempt struct {
+	StatusCode  *int      `json:"status_code"`
+	Error       *string   `json:"error"`
+	DurationMS  int       `json:"duration_ms"`
+	AttemptedAt time.Time `json:"attempted_at"`
+}
+
+// eventTypes returns the webhook events an event of a todo list is sent as.
+func eventTypes(e todo.Event) []string {
+	types := []string{e.Type}
+	if e.Type == "task.updated" {
+		for _, c := range e.Changes {
+			if c.Field == "done" && c.New == true {
+				types = append(types, EventTaskCompleted)
+				break
+			}
+		}
+	}
+	return types
+}
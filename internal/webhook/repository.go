@@ -0,0 +1,328 @@
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/noquark/nanoid"
+
+	"github.com/akalpaki/todo/internal/todo"
+	"github.com/akalpaki/todo/pkg/db"
+	"github.com/akalpaki/todo/pkg/outbox"
+)
+
+var errNotFound = errors.New("not found")
+
+type Repository struct {
+	pool *pgxpool.Pool
+}
+
+func NewRepository(pool *pgxpool.Pool) *Repository {
+	return &Repository{
+		pool: pool,
+	}
+}
+
+// Create registers a webhook for the user, along with a new random secret to sign its payloads with.
+func (r *Repository) Create(ctx context.Context, userID string, data WebhookRequest) (Webhook, error) {
+	id, err := nanoid.New(21)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("webhook_repo generating id: %w", err)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return Webhook{}, fmt.Errorf("webhook_repo generating secret: %w", err)
+	}
+
+	w := Webhook{
+		ID:     id,
+		UserID: userID,
+		URL:    data.URL,
+		Events: data.Events,
+		Active: data.active(),
+		Secret: hex.EncodeToString(secret),
+	}
+	if err := r.pool.QueryRow(ctx, insertWebhookQuery, w.ID, w.UserID, w.URL, w.Secret, w.Events, w.Active).Scan(&w.CreatedAt); err != nil {
+		return Webhook{}, fmt.Errorf("webhook_repo insert webhook: %w", err)
+	}
+
+	return w, nil
+}
+
+func (r *Repository) GetByID(ctx context.Context, id string) (Webhook, error) {
+	var w Webhook
+	if err := scanWebhook(r.pool.QueryRow(ctx, selectWebhookQuery, id), &w); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Webhook{}, errNotFound
+		}
+		return Webhook{}, fmt.Errorf("webhook_repo get webhook: %w", err)
+	}
+	return w, nil
+}
+
+// GetByUserID returns a page of the user's webhooks along with the total number of webhooks the user has.
+func (r *Repository) GetByUserID(ctx context.Context, userID string, limit, page int) ([]Webhook, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countWebhooksQuery, userID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("webhook_repo count webhooks: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectWebhooksQuery, userID, limit, db.CalculateOffset(page, limit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("webhook_repo select webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	webhooks := make([]Webhook, 0)
+	for rows.Next() {
+		var w Webhook
+		if err := scanWebhook(rows, &w); err != nil {
+			return nil, 0, fmt.Errorf("webhook_repo scan webhook: %w", err)
+		}
+		webhooks = append(webhooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("webhook_repo select webhooks: %w", err)
+	}
+
+	return webhooks, total, nil
+}
+
+func (r *Repository) Update(ctx context.Context, id string, update WebhookRequest) error {
+	if _, err := r.pool.Exec(ctx, updateWebhookQuery, update.URL, update.Events, update.active(), id); err != nil {
+		return fmt.Errorf("webhook_repo update webhook: %w", err)
+	}
+	return nil
+}
+
+// Delete removes a webhook along with its deliveries.
+func (r *Repository) Delete(ctx context.Context, id string) error {
+	if _, err := r.pool.Exec(ctx, deleteWebhookQuery, id); err != nil {
+		return fmt.Errorf("webhook_repo delete webhook: %w", err)
+	}
+	return nil
+}
+
+// GetDeliveries returns a page of the deliveries to a webhook, newest first, along with their total number.
+func (r *Repository) GetDeliveries(ctx context.Context, webhookID string, limit, page int) ([]Delivery, int, error) {
+	var total int
+	if err := r.pool.QueryRow(ctx, countDeliveriesQuery, webhookID).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("webhook_repo count deliveries: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectDeliveriesQuery, webhookID, limit, db.CalculateOffset(page, limit))
+	if err != nil {
+		return nil, 0, fmt.Errorf("webhook_repo select deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	deliveries := make([]Delivery, 0)
+	for rows.Next() {
+		var d Delivery
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt); err != nil {
+			return nil, 0, fmt.Errorf("webhook_repo scan delivery: %w", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("webhook_repo select deliveries: %w", err)
+	}
+
+	return deliveries, total, nil
+}
+
+// GetDelivery returns a delivery to the webhook with its payload and the log of its attempts.
+func (r *Repository) GetDelivery(ctx context.Context, webhookID string, id int64) (Delivery, error) {
+	var d Delivery
+	row := r.pool.QueryRow(ctx, selectDeliveryQuery, id, webhookID)
+	if err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &d.NextAttemptAt, &d.CreatedAt, &d.DeliveredAt, &d.Payload); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return Delivery{}, errNotFound
+		}
+		return Delivery{}, fmt.Errorf("webhook_repo get delivery: %w", err)
+	}
+
+	rows, err := r.pool.Query(ctx, selectAttemptsQuery, id)
+	if err != nil {
+		return Delivery{}, fmt.Errorf("webhook_repo select attempts: %w", err)
+	}
+	defer rows.Close()
+
+	d.Log = make([]Attempt, 0)
+	for rows.Next() {
+		var a Attempt
+		if err := rows.Scan(&a.StatusCode, &a.Error, &a.DurationMS, &a.AttemptedAt); err != nil {
+			return Delivery{}, fmt.Errorf("webhook_repo scan attempt: %w", err)
+		}
+		d.Log = append(d.Log, a)
+	}
+	if err := rows.Err(); err != nil {
+		return Delivery{}, fmt.Errorf("webhook_repo select attempts: %w", err)
+	}
+
+	return d, nil
+}
+
+// Redeliver makes a delivery to the webhook due right away, with a fresh set of attempts, whatever its status.
+func (r *Repository) Redeliver(ctx context.Context, webhookID string, id int64) error {
+	res, err := r.pool.Exec(ctx, redeliverQuery, id, webhookID)
+	if err != nil {
+		return fmt.Errorf("webhook_repo redeliver: %w", err)
+	}
+	if res.RowsAffected() == 0 {
+		return errNotFound
+	}
+	return nil
+}
+
+//|++++++++++++++++++++++++++++++++|
+//|            OUTBOX              |
+//|++++++++++++++++++++++++++++++++|
+
+// Enqueue turns a todo list or task event from the outbox into deliveries to the webhooks of the list's author.
+// It is meant to be subscribed to an outbox.Dispatcher: an event handled twice is only queued once.
+func (r *Repository) Enqueue(ctx context.Context, e outbox.Event) error {
+	if entity, _, _ := strings.Cut(e.Type, "."); entity != todo.EntityTodo && entity != todo.EntityTask {
+		return nil
+	}
+	var event todo.Event
+	if err := e.Decode(&event); err != nil {
+		return fmt.Errorf("webhook_repo: %w", err)
+	}
+
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("webhook_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	hooks, err := selectUserWebhooks(ctx, tx, e.UserID)
+	if err != nil {
+		return err
+	}
+	for _, eventType := range eventTypes(event) {
+		for _, hook := range hooks {
+			if err := insertDelivery(ctx, tx, hook, e.ID, eventType, event); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("webhook_repo commit: %w", err)
+	}
+	return nil
+}
+
+func selectUserWebhooks(ctx context.Context, tx pgx.Tx, userID string) ([]Webhook, error) {
+	rows, err := tx.Query(ctx, selectUserWebhooksQuery, userID)
+	if err != nil {
+		return nil, fmt.Errorf("webhook_repo select user webhooks: %w", err)
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var w Webhook
+		if err := rows.Scan(&w.ID, &w.Events); err != nil {
+			return nil, fmt.Errorf("webhook_repo scan webhook: %w", err)
+		}
+		hooks = append(hooks, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("webhook_repo select user webhooks: %w", err)
+	}
+	return hooks, nil
+}
+
+// insertDelivery queues the event for the webhook, if it subscribes to eventType and the outbox event
+// it comes from has not been queued yet.
+func insertDelivery(ctx context.Context, tx pgx.Tx, hook Webhook, eventID int64, eventType string, event todo.Event) error {
+	if !slices.Contains(hook.Events, eventType) {
+		return nil
+	}
+
+	payload, err := json.Marshal(Payload{Type: eventType, WebhookID: hook.ID, CreatedAt: event.CreatedAt, Event: event})
+	if err != nil {
+		return fmt.Errorf("webhook_repo encode payload: %w", err)
+	}
+	if _, err := tx.Exec(ctx, insertDeliveryQuery, hook.ID, eventID, eventType, payload); err != nil {
+		return fmt.Errorf("webhook_repo insert delivery: %w", err)
+	}
+	return nil
+}
+
+// job is a delivery claimed by a dispatcher, along with where to deliver it.
+type job struct {
+	id        int64
+	webhookID string
+	event     string
+	payload   []byte
+	attempts  int
+	url       string
+	secret    string
+}
+
+// claim leases up to limit due deliveries for the length of lease.
+func (r *Repository) claim(ctx context.Context, limit int, lease time.Duration) ([]job, error) {
+	rows, err := r.pool.Query(ctx, claimDeliveriesQuery, limit, int(lease.Seconds()))
+	if err != nil {
+		return nil, fmt.Errorf("webhook_repo claim deliveries: %w", err)
+	}
+	defer rows.Close()
+
+	var jobs []job
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.id, &j.webhookID, &j.event, &j.payload, &j.attempts, &j.url, &j.secret); err != nil {
+			return nil, fmt.Errorf("webhook_repo scan delivery: %w", err)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("webhook_repo claim deliveries: %w", err)
+	}
+	return jobs, nil
+}
+
+// recordAttempt logs an attempt to deliver a claimed delivery, and either completes the delivery or schedules
+// it for retryAt. A nil retryAt means there are no attempts left, and the delivery has failed.
+func (r *Repository) recordAttempt(ctx context.Context, j job, attempt Attempt, succeeded bool, retryAt *time.Time) error {
+	tx, err := r.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("webhook_repo begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, insertAttemptQuery, j.id, attempt.StatusCode, attempt.Error, attempt.DurationMS); err != nil {
+		return fmt.Errorf("webhook_repo insert attempt: %w", err)
+	}
+
+	if succeeded {
+		_, err = tx.Exec(ctx, deliverySucceededQuery, j.id)
+	} else {
+		_, err = tx.Exec(ctx, deliveryFailedQuery, j.id, retryAt == nil, retryAt)
+	}
+	if err != nil {
+		return fmt.Errorf("webhook_repo update delivery: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("webhook_repo commit: %w", err)
+	}
+	return nil
+}
+
+// scanWebhook scans a row selected with webhookColumns into w.
+func scanWebhook(row pgx.Row, w *Webhook) error {
+	return row.Scan(&w.ID, &w.UserID, &w.URL, &w.Events, &w.Active, &w.CreatedAt)
+}
@@ -0,0 +1,273 @@
+package webhook
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/akalpaki/todo/pkg/web"
+)
+
+// Routes returns the webhook API. Creating a webhook and redelivering can be retried safely with an Idempotency-Key.
+func Routes(logger *slog.Logger, repository *Repository, idempotency web.IdempotencyStore) http.Handler {
+	mux := http.NewServeMux()
+	idempotent := func(next http.HandlerFunc) http.HandlerFunc {
+		return web.Idempotent(next, idempotency, logger)
+	}
+
+	mux.HandleFunc("POST /", web.Access(web.Auth(idempotent(HandleCreate(logger, repository))), logger))
+	mux.HandleFunc("GET /", web.Access(web.Auth(HandleGetForUser(logger, repository)), logger))
+	mux.HandleFunc("GET /{id}", web.Access(web.Auth(HandleGetByID(logger, repository)), logger))
+	mux.HandleFunc("PUT /{id}", web.Access(web.Auth(HandleUpdate(logger, repository)), logger))
+	mux.HandleFunc("DELETE /{id}", web.Access(web.Auth(HandleDelete(logger, repository)), logger))
+
+	// DELIVERY routes
+	mux.HandleFunc("GET /{id}/deliveries", web.Access(web.Auth(HandleGetDeliveries(logger, repository)), logger))
+	mux.HandleFunc("GET /{id}/deliveries/{delivery_id}", web.Access(web.Auth(HandleGetDelivery(logger, repository)), logger))
+	mux.HandleFunc("POST /{id}/deliveries/{delivery_id}/redeliver", web.Access(web.Auth(idempotent(HandleRedeliver(logger, repository))), logger))
+
+	return mux
+}
+
+// HandleCreate registers a webhook for the caller. The response is the only one carrying the webhook's secret.
+func HandleCreate(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		data, err := web.ReadJSON[WebhookRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		webhook, err := repository.Create(ctx, userID, data)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to create webhook", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusCreated, webhook); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleGetForUser(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 50
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		userID, ok := ctx.Value(web.UserID).(string)
+		if !ok {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+			return
+		}
+
+		webhooks, total, err := repository.GetByUserID(ctx, userID, limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve webhooks", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(webhooks, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleGetByID(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		webhook, ok := ownedWebhook(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, webhook); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleUpdate(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		webhook, ok := ownedWebhook(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		update, err := web.ReadJSON[WebhookRequest](r)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid data or malformed json", err)
+			return
+		}
+
+		if err := repository.Update(ctx, webhook.ID, update); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to update webhook", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+func HandleDelete(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		webhook, ok := ownedWebhook(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.Delete(ctx, webhook.ID); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to delete webhook", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetDeliveries lists the deliveries to a webhook, newest first.
+func HandleGetDeliveries(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	const defaultLimit = 50
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		page, limit := web.ReadPagination(r, defaultLimit)
+
+		webhook, ok := ownedWebhook(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		deliveries, total, err := repository.GetDeliveries(ctx, webhook.ID, limit, page)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve deliveries", err)
+			return
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, web.NewPage(deliveries, page, limit, total)); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleGetDelivery returns a delivery with its payload and every attempt made to deliver it.
+func HandleGetDelivery(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		deliveryID, err := strconv.ParseInt(r.PathValue("delivery_id"), 10, 64)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid delivery id", err)
+			return
+		}
+
+		webhook, ok := ownedWebhook(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		delivery, err := repository.GetDelivery(ctx, webhook.ID, deliveryID)
+		if err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "delivery not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve delivery", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusOK, delivery); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// HandleRedeliver queues a delivery to be sent again right away, whether it succeeded or failed before.
+func HandleRedeliver(logger *slog.Logger, repository *Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		deliveryID, err := strconv.ParseInt(r.PathValue("delivery_id"), 10, 64)
+		if err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid delivery id", err)
+			return
+		}
+
+		webhook, ok := ownedWebhook(logger, w, r, repository)
+		if !ok {
+			return
+		}
+
+		if err := repository.Redeliver(ctx, webhook.ID, deliveryID); err != nil {
+			switch err {
+			case errNotFound:
+				web.ErrorResponse(logger, w, r, http.StatusNotFound, "delivery not found", err)
+				return
+			default:
+				web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to redeliver", err)
+				return
+			}
+		}
+
+		if err := web.WriteJSON(w, r, http.StatusAccepted, ""); err != nil {
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to produce response", err)
+			return
+		}
+	}
+}
+
+// ownedWebhook loads the webhook named by the id path value and makes sure it belongs to the caller.
+// When it returns false an error response has already been written.
+func ownedWebhook(logger *slog.Logger, w http.ResponseWriter, r *http.Request, repository *Repository) (Webhook, bool) {
+	ctx := r.Context()
+	userID, ok := ctx.Value(web.UserID).(string)
+	if !ok {
+		web.ErrorResponse(logger, w, r, http.StatusBadRequest, "invalid user id", web.ErrInvalidUserID)
+		return Webhook{}, false
+	}
+
+	webhook, err := repository.GetByID(ctx, r.PathValue("id"))
+	if err != nil {
+		switch err {
+		case errNotFound:
+			web.ErrorResponse(logger, w, r, http.StatusNotFound, "webhook not found", err)
+			return Webhook{}, false
+		default:
+			web.ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to retrieve webhook", err)
+			return Webhook{}, false
+		}
+	}
+
+	if userID != webhook.UserID {
+		web.ErrorResponse(logger, w, r, http.StatusForbidden, "you do not have access to this resource", web.ErrInvalidUserID)
+		return Webhook{}, false
+	}
+
+	return webhook, true
+}
@@ -0,0 +1,37 @@
+package webhook
+
+const (
+	webhookColumns          = "id, user_id, url, events, active, created_at"
+	insertWebhookQuery      = "INSERT INTO webhooks (id, user_id, url, secret, events, active) VALUES ($1, $2, $3, $4, $5, $6) RETURNING created_at"
+	selectWebhookQuery      = "SELECT " + webhookColumns + " FROM webhooks WHERE id = $1"
+	selectWebhooksQuery     = "SELECT " + webhookColumns + " FROM webhooks WHERE user_id = $1 ORDER BY created_at, id LIMIT $2 OFFSET $3"
+	countWebhooksQuery      = "SELECT COUNT(*) FROM webhooks WHERE user_id = $1"
+	updateWebhookQuery      = "UPDATE webhooks SET url = $1, events = $2, active = $3 WHERE id = $4"
+	deleteWebhookQuery      = "DELETE FROM webhooks WHERE id = $1"
+	selectUserWebhooksQuery = "SELECT id, events FROM webhooks WHERE user_id = $1 AND active"
+	deliveryColumns         = "id, webhook_id, event_type, status, attempts, CASE WHEN status = 'pending' THEN next_attempt_at END, created_at, delivered_at"
+	selectDeliveriesQuery   = "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY id DESC LIMIT $2 OFFSET $3"
+	countDeliveriesQuery    = "SELECT COUNT(*) FROM webhook_deliveries WHERE webhook_id = $1"
+	selectDeliveryQuery     = "SELECT " + deliveryColumns + ", payload FROM webhook_deliveries WHERE id = $1 AND webhook_id = $2"
+	selectAttemptsQuery     = "SELECT status_code, error, duration_ms, attempted_at FROM webhook_attempts WHERE delivery_id = $1 ORDER BY id"
+	redeliverQuery          = "UPDATE webhook_deliveries SET status = 'pending', attempts = 0, next_attempt_at = now() WHERE id = $1 AND webhook_id = $2"
+	insertDeliveryQuery     = "INSERT INTO webhook_deliveries (webhook_id, event_id, event_type, payload) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING"
+	insertAttemptQuery      = "INSERT INTO webhook_attempts (delivery_id, status_code, error, duration_ms) VALUES ($1, $2, $3, $4)"
+	deliverySucceededQuery  = "UPDATE webhook_deliveries SET status = 'succeeded', attempts = attempts + 1, delivered_at = now() WHERE id = $1"
+	deliveryFailedQuery     = "UPDATE webhook_deliveries SET status = CASE WHEN $2 THEN 'failed' ELSE 'pending' END, attempts = attempts + 1, next_attempt_at = COALESCE($3, next_attempt_at) WHERE id = $1"
+	// claimDeliveriesQuery leases the deliveries due to active webhooks to a single dispatcher: they are not due again
+	// until the lease of $2 seconds runs out, so a dispatcher dying in the middle of a delivery only delays it.
+	claimDeliveriesQuery = `
+	WITH claimed AS (
+		UPDATE webhook_deliveries SET next_attempt_at = now() + $2::float8 * interval '1 second'
+		WHERE id IN (
+			SELECT d.id FROM webhook_deliveries d JOIN webhooks w ON w.id = d.webhook_id
+			WHERE d.status = 'pending' AND d.next_attempt_at <= now() AND w.active
+			ORDER BY d.next_attempt_at
+			LIMIT $1
+			FOR UPDATE OF d SKIP LOCKED)
+		RETURNING id, webhook_id, event_type, payload, attempts
+	)
+	SELECT c.id, c.webhook_id, c.event_type, c.payload, c.attempts, w.url, w.secret
+	FROM claimed c JOIN webhooks w ON w.id = c.webhook_id`
+)
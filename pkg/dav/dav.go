@@ -0,0 +1,255 @@
+// Package dav implements the parts of WebDAV (RFC 4918) that CalDAV (RFC 4791) and collection synchronization
+// (RFC 6578) are built on: reading PROPFIND and REPORT bodies, and writing multistatus responses.
+package dav
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Namespaces of the properties and reports in use.
+const (
+	NS               = "DAV:"
+	CalDAVNS         = "urn:ietf:params:xml:ns:caldav"
+	CalendarServerNS = "http://calendarserver.org/ns/"
+)
+
+// prefixes are declared on the root of every multistatus, so that markup can use them.
+var prefixes = map[string]string{
+	NS:               "d",
+	CalDAVNS:         "c",
+	CalendarServerNS: "cs",
+}
+
+// maxBody bounds the size of the request bodies read.
+const maxBody = 1 << 20
+
+var ErrInvalidBody = errors.New("invalid xml body")
+
+// Names is a list of elements, such as the properties asked for in a prop element. Their content is ignored.
+type Names []xml.Name
+
+func (n *Names) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			*n = append(*n, tok.Name)
+			if err := d.Skip(); err != nil {
+				return err
+			}
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// Contains reports whether name is in the list.
+func (n Names) Contains(name xml.Name) bool {
+	for _, m := range n {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CompFilter is a CalDAV comp-filter, naming the calendar components a calendar-query is about.
+type CompFilter struct {
+	Name  string       `xml:"name,attr"`
+	Comps []CompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+}
+
+// Request is the body of a PROPFIND request, or of a calendar-query, calendar-multiget or sync-collection REPORT.
+// Name tells which of them it is.
+type Request struct {
+	XMLName   xml.Name
+	AllProp   *struct{} `xml:"DAV: allprop"`
+	Prop      Names     `xml:"DAV: prop"`
+	Hrefs     []string  `xml:"DAV: href"`
+	SyncToken string    `xml:"DAV: sync-token"`
+	Filter    *struct {
+		Comp CompFilter `xml:"urn:ietf:params:xml:ns:caldav comp-filter"`
+	} `xml:"urn:ietf:params:xml:ns:caldav filter"`
+}
+
+// Wants reports whether the request asks for the property.
+func (r Request) Wants(name xml.Name) bool {
+	return r.AllProp != nil || r.Prop.Contains(name)
+}
+
+// ReadRequest reads the body of a PROPFIND or REPORT request. A PROPFIND without a body asks for every property.
+func ReadRequest(r *http.Request) (Request, error) {
+	var req Request
+	err := xml.NewDecoder(io.LimitReader(r.Body, maxBody)).Decode(&req)
+	switch {
+	case errors.Is(err, io.EOF):
+		return Request{XMLName: xml.Name{Space: NS, Local: "propfind"}, AllProp: &struct{}{}}, nil
+	case err != nil:
+		return Request{}, fmt.Errorf("%w: %w", ErrInvalidBody, err)
+	}
+	return req, nil
+}
+
+// Depth returns the Depth header of the request, 0 or 1. A missing header or "infinity" counts as 1, as deeper
+// listings are not supported.
+func Depth(r *http.Request) int {
+	if r.Header.Get("Depth") == "0" {
+		return 0
+	}
+	return 1
+}
+
+// Property is a property of a resource, along with its value as XML markup, which may use the prefixes d, c and cs.
+type Property struct {
+	Name  xml.Name
+	Value string
+}
+
+// Text returns a property holding text.
+func Text(name xml.Name, s string) Property {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return Property{Name: name, Value: b.String()}
+}
+
+// Href returns a property holding hrefs, such as current-user-principal.
+func Href(name xml.Name, hrefs ...string) Property {
+	var b strings.Builder
+	for _, h := range hrefs {
+		b.WriteString("<d:href>")
+		xml.EscapeText(&b, []byte(h))
+		b.WriteString("</d:href>")
+	}
+	return Property{Name: name, Value: b.String()}
+}
+
+// Empty returns a property holding empty elements, such as resourcetype.
+func Empty(name xml.Name, elements ...xml.Name) Property {
+	var b strings.Builder
+	for _, e := range elements {
+		open, _ := tag(e)
+		b.WriteString("<" + open + "/>")
+	}
+	return Property{Name: name, Value: b.String()}
+}
+
+// Response is the part of a multistatus about a single resource: either the properties asked for, split into the
+// ones found and the ones the resource does not have, or only a Status, as for resources removed since a sync token.
+type Response struct {
+	Href    string
+	Props   []Property
+	Missing []xml.Name
+	Status  int
+}
+
+// Select returns the response for a resource with the properties all, keeping the ones asked for by req.
+func Select(href string, all []Property, req Request) Response {
+	res := Response{Href: href}
+	if req.AllProp != nil {
+		res.Props = all
+		return res
+	}
+	for _, name := range req.Prop {
+		found := false
+		for _, p := range all {
+			if p.Name == name {
+				res.Props = append(res.Props, p)
+				found = true
+				break
+			}
+		}
+		if !found {
+			res.Missing = append(res.Missing, name)
+		}
+	}
+	return res
+}
+
+// Multistatus is a 207 Multi-Status response. SyncToken is set in response to a sync-collection report.
+type Multistatus struct {
+	Responses []Response
+	SyncToken string
+}
+
+// Write writes the multistatus as the response.
+func (m Multistatus) Write(w http.ResponseWriter) error {
+	var b strings.Builder
+	b.WriteString(xml.Header)
+	b.WriteString(`<d:multistatus xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav" xmlns:cs="http://calendarserver.org/ns/">`)
+	for _, res := range m.Responses {
+		b.WriteString("<d:response><d:href>")
+		xml.EscapeText(&b, []byte(res.Href))
+		b.WriteString("</d:href>")
+		if res.Status != 0 {
+			b.WriteString("<d:status>" + status(res.Status) + "</d:status>")
+		} else {
+			writePropstat(&b, res.Props, nil, http.StatusOK)
+			writePropstat(&b, nil, res.Missing, http.StatusNotFound)
+		}
+		b.WriteString("</d:response>")
+	}
+	if m.SyncToken != "" {
+		b.WriteString("<d:sync-token>")
+		xml.EscapeText(&b, []byte(m.SyncToken))
+		b.WriteString("</d:sync-token>")
+	}
+	b.WriteString("</d:multistatus>")
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteError responds with status and a DAV error element naming the precondition which failed, such as valid-sync-token.
+func WriteError(w http.ResponseWriter, status int, condition xml.Name) error {
+	open, _ := tag(condition)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	_, err := io.WriteString(w, xml.Header+`<d:error xmlns:d="DAV:" xmlns:c="urn:ietf:params:xml:ns:caldav"><`+open+`/></d:error>`)
+	return err
+}
+
+func writePropstat(b *strings.Builder, props []Property, missing []xml.Name, code int) {
+	if len(props) == 0 && len(missing) == 0 {
+		return
+	}
+	b.WriteString("<d:propstat><d:prop>")
+	for _, p := range props {
+		open, close := tag(p.Name)
+		if p.Value == "" {
+			b.WriteString("<" + open + "/>")
+			continue
+		}
+		b.WriteString("<" + open + ">" + p.Value + "</" + close + ">")
+	}
+	for _, name := range missing {
+		open, _ := tag(name)
+		b.WriteString("<" + open + "/>")
+	}
+	b.WriteString("</d:prop><d:status>" + status(code) + "</d:status></d:propstat>")
+}
+
+// tag returns the opening and closing tag names of an element, declaring its namespace when it has no known prefix.
+func tag(name xml.Name) (string, string) {
+	var local strings.Builder
+	xml.EscapeText(&local, []byte(name.Local))
+	if prefix, ok := prefixes[name.Space]; ok {
+		return prefix + ":" + local.String(), prefix + ":" + local.String()
+	}
+	var space strings.Builder
+	xml.EscapeText(&space, []byte(name.Space))
+	return "x:" + local.String() + ` xmlns:x="` + space.String() + `"`, "x:" + local.String()
+}
+
+func status(code int) string {
+	return fmt.Sprintf("HTTP/1.1 %d %s", code, http.StatusText(code))
+}
@@ -0,0 +1,152 @@
+// Package ical reads and writes iCalendar (RFC 5545) data, and validates the recurrence rules found in it.
+package ical
+
+import (
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ContentType is the media type of iCalendar data.
+const ContentType = "text/calendar; charset=utf-8"
+
+// lineLimit is how many octets a content line holds before it is folded.
+const lineLimit = 75
+
+// Writer writes the content lines of iCalendar data, escaping and folding them as needed. Errors are kept until Err
+// is called, so that components can be written without checking every line.
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Begin opens a component, such as "VCALENDAR" or "VTODO".
+func (w *Writer) Begin(component string) {
+	w.line("BEGIN:" + component)
+}
+
+// End closes a component opened with Begin.
+func (w *Writer) End(component string) {
+	w.line("END:" + component)
+}
+
+// Prop writes a property whose value is already in its iCalendar form, such as a date-time or a recurrence rule.
+// params, if any, are written as they are, eg. "VALUE=DATE".
+func (w *Writer) Prop(name, value string, params ...string) {
+	for _, p := range params {
+		name += ";" + p
+	}
+	w.line(name + ":" + value)
+}
+
+// Text writes a property of type TEXT, escaping its value.
+func (w *Writer) Text(name, value string) {
+	w.Prop(name, escape(value))
+}
+
+// Time writes a property of type DATE-TIME, in UTC.
+func (w *Writer) Time(name string, t time.Time) {
+	w.Prop(name, FormatTime(t))
+}
+
+// Err returns the first error met while writing.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+// line writes a content line, folded after lineLimit octets without splitting a UTF-8 sequence.
+func (w *Writer) line(s string) {
+	if w.err != nil {
+		return
+	}
+	var b strings.Builder
+	limit := lineLimit
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		b.WriteString(s[:cut])
+		b.WriteString("\r\n ")
+		s = s[cut:]
+		// continuation lines start with a space, which counts towards their length
+		limit = lineLimit - 1
+	}
+	b.WriteString(s)
+	b.WriteString("\r\n")
+	_, w.err = io.WriteString(w.w, b.String())
+}
+
+// FormatTime formats t as an iCalendar DATE-TIME in UTC.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+func escape(s string) string {
+	return escaper.Replace(s)
+}
+
+// frequencies are the values FREQ takes in a recurrence rule.
+var frequencies = []string{"SECONDLY", "MINUTELY", "HOURLY", "DAILY", "WEEKLY", "MONTHLY", "YEARLY"}
+
+// ValidRecurrence reports whether rule is a recurrence rule, the value of an RRULE property, such as
+// "FREQ=WEEKLY;BYDAY=MO,WE". Only its structure is checked: FREQ is required, every part is known and appears once,
+// and UNTIL and COUNT are not both set.
+func ValidRecurrence(rule string) bool {
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(rule, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" || seen[key] {
+			return false
+		}
+		seen[key] = true
+
+		switch key {
+		case "FREQ":
+			if !slices.Contains(frequencies, value) {
+				return false
+			}
+		case "UNTIL":
+			if _, err := time.Parse("20060102T150405Z", value); err != nil {
+				if _, err := time.Parse("20060102", value); err != nil {
+					return false
+				}
+			}
+		case "COUNT", "INTERVAL":
+			if n, err := strconv.Atoi(value); err != nil || n < 1 {
+				return false
+			}
+		case "WKST":
+			if !slices.Contains(weekdays, value) {
+				return false
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(value, ",") {
+				day = strings.TrimLeft(day, "+-0123456789")
+				if !slices.Contains(weekdays, day) {
+					return false
+				}
+			}
+		case "BYSECOND", "BYMINUTE", "BYHOUR", "BYMONTHDAY", "BYYEARDAY", "BYWEEKNO", "BYMONTH", "BYSETPOS":
+			for _, n := range strings.Split(value, ",") {
+				if _, err := strconv.Atoi(n); err != nil {
+					return false
+				}
+			}
+		default:
+			return false
+		}
+	}
+	return seen["FREQ"] && !(seen["UNTIL"] && seen["COUNT"])
+}
+
+var weekdays = []string{"MO", "TU", "WE", "TH", "FR", "SA", "SU"}
@@ -0,0 +1,187 @@
+package ical
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+var ErrInvalid = errors.New("invalid icalendar data")
+
+// maxData bounds the size of the iCalendar data read.
+const maxData = 1 << 20
+
+// Property is a content line: a property with its parameters, whose names are upper case, and its raw value.
+type Property struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// Text returns the value of a property of type TEXT, unescaped.
+func (p Property) Text() string {
+	return unescaper.Replace(p.Value)
+}
+
+// Time returns the value of a property of type DATE-TIME or DATE. Times in UTC, with a time zone identifier known to
+// the system, or floating are supported; floating times and unknown time zones are read as UTC. Dates are read as
+// midnight UTC.
+func (p Property) Time() (time.Time, error) {
+	if p.Params["VALUE"] == "DATE" || len(p.Value) == len("20060102") {
+		t, err := time.Parse("20060102", p.Value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: %s: %w", ErrInvalid, p.Name, err)
+		}
+		return t, nil
+	}
+	if strings.HasSuffix(p.Value, "Z") {
+		t, err := time.Parse("20060102T150405Z", p.Value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("%w: %s: %w", ErrInvalid, p.Name, err)
+		}
+		return t, nil
+	}
+	loc := time.UTC
+	if tzid := p.Params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(strings.TrimPrefix(tzid, "/")); err == nil {
+			loc = l
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", p.Value, loc)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%w: %s: %w", ErrInvalid, p.Name, err)
+	}
+	return t, nil
+}
+
+// Component is a component, such as VCALENDAR or VTODO, with its properties and the components nested in it.
+type Component struct {
+	Name       string
+	Props      []Property
+	Components []Component
+}
+
+// Prop returns the first property of the component with the name.
+func (c Component) Prop(name string) (Property, bool) {
+	for _, p := range c.Props {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return Property{}, false
+}
+
+// Find returns the first component nested in c with the name.
+func (c Component) Find(name string) (Component, bool) {
+	for _, sub := range c.Components {
+		if sub.Name == name {
+			return sub, true
+		}
+	}
+	return Component{}, false
+}
+
+// Parse reads iCalendar data holding a single component, usually a VCALENDAR. Lines are unfolded and split into
+// properties, but values are kept as they are; see Property.Text and Property.Time.
+func Parse(r io.Reader) (Component, error) {
+	lines, err := unfold(io.LimitReader(r, maxData))
+	if err != nil {
+		return Component{}, err
+	}
+
+	var stack []Component
+	var root *Component
+	for _, line := range lines {
+		p, err := parseLine(line)
+		if err != nil {
+			return Component{}, err
+		}
+		switch p.Name {
+		case "BEGIN":
+			if root != nil {
+				return Component{}, fmt.Errorf("%w: data after %s", ErrInvalid, root.Name)
+			}
+			stack = append(stack, Component{Name: strings.ToUpper(p.Value)})
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1].Name != strings.ToUpper(p.Value) {
+				return Component{}, fmt.Errorf("%w: unexpected END:%s", ErrInvalid, p.Value)
+			}
+			c := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if len(stack) == 0 {
+				root = &c
+				continue
+			}
+			parent := &stack[len(stack)-1]
+			parent.Components = append(parent.Components, c)
+		default:
+			if len(stack) == 0 {
+				return Component{}, fmt.Errorf("%w: property %s outside a component", ErrInvalid, p.Name)
+			}
+			c := &stack[len(stack)-1]
+			c.Props = append(c.Props, p)
+		}
+	}
+	if root == nil || len(stack) > 0 {
+		return Component{}, fmt.Errorf("%w: unterminated component", ErrInvalid)
+	}
+	return *root, nil
+}
+
+// unfold returns the content lines of the data, joining the ones folded over several lines.
+func unfold(r io.Reader) ([]string, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, maxData)
+	for sc.Scan() {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		switch {
+		case line == "":
+		case (line[0] == ' ' || line[0] == '\t') && len(lines) > 0:
+			lines[len(lines)-1] += line[1:]
+		default:
+			lines = append(lines, line)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	return lines, nil
+}
+
+// parseLine splits a content line, "NAME;PARAM=value:value", into a property. Parameter values may be quoted, so
+// that they hold colons and semicolons.
+func parseLine(line string) (Property, error) {
+	p := Property{Params: make(map[string]string)}
+	quoted := false
+	start := 0
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+		case c == ';' || c == ':':
+			part := line[start:i]
+			if p.Name == "" {
+				p.Name = strings.ToUpper(part)
+			} else {
+				key, value, _ := strings.Cut(part, "=")
+				p.Params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+			}
+			start = i + 1
+			if c == ':' {
+				if p.Name == "" {
+					return Property{}, fmt.Errorf("%w: line without a name", ErrInvalid)
+				}
+				p.Value = line[i+1:]
+				return p, nil
+			}
+		}
+	}
+	return Property{}, fmt.Errorf("%w: line without a value: %q", ErrInvalid, line)
+}
+
+var unescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
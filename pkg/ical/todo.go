@@ -0,0 +1,111 @@
+package ical
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Todo holds the properties of a VTODO component in use.
+type Todo struct {
+	UID        string
+	Summary    string
+	Categories []string
+	Due        *time.Time
+	// Priority goes from 1, the highest, to 9, the lowest; 0 leaves it undefined.
+	Priority    int
+	Completed   bool
+	CompletedAt *time.Time
+	// Recurrence is the value of the RRULE property, if any.
+	Recurrence string
+	// RelatedTo is the UID of the parent to-do, if any.
+	RelatedTo string
+	Sequence  int64
+}
+
+// Todo writes t as a VTODO component, stamped with the time it was written at.
+func (w *Writer) Todo(t Todo, stamp time.Time) {
+	w.Begin("VTODO")
+	w.Text("UID", t.UID)
+	w.Time("DTSTAMP", stamp)
+	w.Prop("SEQUENCE", strconv.FormatInt(t.Sequence, 10))
+	w.Text("SUMMARY", t.Summary)
+	if len(t.Categories) > 0 {
+		categories := make([]string, len(t.Categories))
+		for i, c := range t.Categories {
+			categories[i] = escape(c)
+		}
+		w.Prop("CATEGORIES", strings.Join(categories, ","))
+	}
+	if t.Recurrence != "" {
+		w.Prop("RRULE", t.Recurrence)
+		if t.Due != nil {
+			// a recurring to-do needs a start for its occurrences to be counted from
+			w.Time("DTSTART", *t.Due)
+		}
+	}
+	if t.Due != nil {
+		w.Time("DUE", *t.Due)
+	}
+	if t.Priority != 0 {
+		w.Prop("PRIORITY", strconv.Itoa(t.Priority))
+	}
+	if t.RelatedTo != "" {
+		w.Text("RELATED-TO", t.RelatedTo)
+	}
+	if t.Completed {
+		w.Prop("STATUS", "COMPLETED")
+		w.Prop("PERCENT-COMPLETE", "100")
+		if t.CompletedAt != nil {
+			w.Time("COMPLETED", *t.CompletedAt)
+		}
+	} else {
+		w.Prop("STATUS", "NEEDS-ACTION")
+	}
+	w.End("VTODO")
+}
+
+// ParseTodo reads the properties in use of a VTODO component. The to-do is completed when its status says so, or,
+// without a status, when it carries a completion time. Recurrence rules which are not valid are left out.
+func ParseTodo(c Component) (Todo, error) {
+	var t Todo
+	if p, ok := c.Prop("UID"); ok {
+		t.UID = p.Text()
+	}
+	if p, ok := c.Prop("SUMMARY"); ok {
+		t.Summary = p.Text()
+	}
+	if p, ok := c.Prop("DUE"); ok {
+		due, err := p.Time()
+		if err != nil {
+			return Todo{}, err
+		}
+		t.Due = &due
+	}
+	if p, ok := c.Prop("PRIORITY"); ok {
+		priority, err := strconv.Atoi(p.Value)
+		if err != nil || priority < 0 || priority > 9 {
+			return Todo{}, ErrInvalid
+		}
+		t.Priority = priority
+	}
+	if p, ok := c.Prop("RRULE"); ok && ValidRecurrence(p.Value) {
+		t.Recurrence = p.Value
+	}
+	if p, ok := c.Prop("RELATED-TO"); ok && strings.ToUpper(p.Params["RELTYPE"]) != "CHILD" && strings.ToUpper(p.Params["RELTYPE"]) != "SIBLING" {
+		t.RelatedTo = p.Text()
+	}
+	if p, ok := c.Prop("COMPLETED"); ok {
+		completed, err := p.Time()
+		if err != nil {
+			return Todo{}, err
+		}
+		t.CompletedAt = &completed
+	}
+	if p, ok := c.Prop("STATUS"); ok {
+		t.Completed = strings.ToUpper(p.Value) == "COMPLETED"
+	} else {
+		t.Completed = t.CompletedAt != nil
+	}
+	return t, nil
+}
@@ -0,0 +1,112 @@
+// Package jobs runs background work out of a Postgres-backed queue. Jobs are enqueued to run right away or at
+// a later time, either by hand or from recurring schedules, and are shared between every replica running a Queue:
+// each job is claimed with SKIP LOCKED by a single worker at a time. Failed jobs are retried with a backoff, and
+// the ones out of attempts are moved to the jobs_dead table.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Job is a unit of background work of a given kind, with the payload it was enqueued with.
+type Job struct {
+	ID      int64           `json:"id"`
+	Kind    string          `json:"kind"`
+	Payload json.RawMessage `json:"payload"`
+	// Attempt is 1 on the first run of the job, 2 on its first retry, and so on.
+	Attempt   int       `json:"attempt"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Decode unmarshals the payload of the job into v.
+func (j Job) Decode(v any) error {
+	if err := json.Unmarshal(j.Payload, v); err != nil {
+		return fmt.Errorf("jobs decode %s payload: %w", j.Kind, err)
+	}
+	return nil
+}
+
+// Handler runs a job. A job whose handler returns an error, panics or runs out of time is retried, so handlers
+// must be safe to run more than once for the same job.
+type Handler func(ctx context.Context, j Job) error
+
+// Options tune how the jobs of a kind are run. Zero values are replaced with the defaults.
+type Options struct {
+	// Concurrency is how many jobs of the kind a Queue runs at the same time, 1 by default.
+	Concurrency int
+	// MaxAttempts is how many times a job is run before it is moved to the dead letters, 5 by default.
+	MaxAttempts int
+	// Timeout is how long a job can run for, 5 minutes by default.
+	Timeout time.Duration
+}
+
+func (o Options) withDefaults() Options {
+	if o.Concurrency <= 0 {
+		o.Concurrency = 1
+	}
+	if o.MaxAttempts <= 0 {
+		o.MaxAttempts = 5
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = 5 * time.Minute
+	}
+	return o
+}
+
+// DB is what jobs can be enqueued with: a pool, or a transaction so that the job only exists once it commits.
+type DB interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Enqueue adds a job of the given kind, carrying payload encoded as JSON, to run at runAt or right away
+// if runAt is zero. It returns the id of the job.
+func Enqueue(ctx context.Context, db DB, kind string, payload any, runAt time.Time) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, fmt.Errorf("jobs encode %s payload: %w", kind, err)
+	}
+	var runAtArg *time.Time
+	if !runAt.IsZero() {
+		runAtArg = &runAt
+	}
+
+	var id int64
+	if err := db.QueryRow(ctx, insertJobQuery, kind, data, runAtArg).Scan(&id); err != nil {
+		return 0, fmt.Errorf("jobs insert job: %w", err)
+	}
+	return id, nil
+}
+
+const (
+	insertJobQuery = "INSERT INTO jobs (kind, payload, run_at) VALUES ($1, $2, COALESCE($3, now())) RETURNING id"
+	// claimJobsQuery leases up to $2 due jobs of kind $1 to a single worker: they are not due again until the lease
+	// of $3 seconds runs out, so a worker dying in the middle of a job only delays it. Claiming counts as an attempt.
+	claimJobsQuery = `
+	UPDATE jobs SET attempts = attempts + 1, run_at = now() + $3::float8 * interval '1 second'
+	WHERE id IN (
+		SELECT id FROM jobs
+		WHERE kind = $1 AND run_at <= now()
+		ORDER BY run_at, id
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED)
+	RETURNING id, kind, payload, attempts, created_at`
+	deleteJobQuery = "DELETE FROM jobs WHERE id = $1"
+	retryJobQuery  = "UPDATE jobs SET run_at = $2, last_error = $3 WHERE id = $1"
+	// buryJobQuery moves a job out of attempts to the dead letters.
+	buryJobQuery = `
+	WITH dead AS (DELETE FROM jobs WHERE id = $1 RETURNING id, kind, payload, attempts, created_at)
+	INSERT INTO jobs_dead (id, kind, payload, attempts, last_error, created_at)
+	SELECT id, kind, payload, attempts, $2, created_at FROM dead`
+	// upsertScheduleQuery registers a schedule, keeping its next run unless the spec changed.
+	upsertScheduleQuery = `
+	INSERT INTO job_schedules (name, spec, kind, payload, next_run_at) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (name) DO UPDATE SET spec = EXCLUDED.spec, kind = EXCLUDED.kind, payload = EXCLUDED.payload,
+		next_run_at = CASE WHEN job_schedules.spec = EXCLUDED.spec THEN job_schedules.next_run_at ELSE EXCLUDED.next_run_at END`
+	selectDueSchedulesQuery = "SELECT name FROM job_schedules WHERE name = ANY($1) AND next_run_at <= now() FOR UPDATE SKIP LOCKED"
+	updateScheduleQuery     = "UPDATE job_schedules SET next_run_at = $2 WHERE name = $1"
+)
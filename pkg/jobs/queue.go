@@ -0,0 +1,303 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// pollInterval is how often due jobs and schedules are checked for.
+	pollInterval = time.Second
+	// leaseMargin is how much longer than its timeout a claimed job is left alone by the other workers.
+	leaseMargin = time.Minute
+	// drainTimeout is how long running jobs are given to finish on shutdown before being cancelled.
+	drainTimeout = 30 * time.Second
+	// baseBackoff and maxBackoff bound the delay before retrying a job, which doubles with every attempt.
+	baseBackoff = 10 * time.Second
+	maxBackoff  = time.Hour
+)
+
+type registration struct {
+	handler Handler
+	options Options
+	// slots holds a value for every job of the kind running.
+	slots chan struct{}
+}
+
+type recurring struct {
+	spec     string
+	kind     string
+	payload  json.RawMessage
+	schedule Schedule
+}
+
+// Queue runs the jobs of the kinds registered with it, and enqueues the jobs of its schedules when they are due.
+// Every replica can run one: jobs and schedules are claimed with row locks, so each runs on a single replica.
+// Jobs of a kind no replica has registered stay queued.
+type Queue struct {
+	pool   *pgxpool.Pool
+	logger *slog.Logger
+
+	mu        sync.Mutex
+	kinds     map[string]*registration
+	schedules map[string]recurring
+	// registered is true once the schedules have been recorded.
+	registered bool
+}
+
+func NewQueue(pool *pgxpool.Pool, logger *slog.Logger) *Queue {
+	return &Queue{
+		pool:      pool,
+		logger:    logger,
+		kinds:     make(map[string]*registration),
+		schedules: make(map[string]recurring),
+	}
+}
+
+// Register runs the jobs of the given kind with handler. It must be called before Run.
+func (q *Queue) Register(kind string, handler Handler, options Options) {
+	options = options.withDefaults()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.kinds[kind] = &registration{handler: handler, options: options, slots: make(chan struct{}, options.Concurrency)}
+}
+
+// Schedule enqueues a job of the given kind, carrying payload, whenever spec is due (see ParseSchedule). The name
+// identifies the schedule across replicas and restarts: its next run is kept unless spec changes, and runs missed
+// while no replica was up are made up for with a single job. It must be called before Run.
+func (q *Queue) Schedule(name, spec, kind string, payload any) error {
+	schedule, err := ParseSchedule(spec)
+	if err != nil {
+		return err
+	}
+	if schedule.Next(time.Now()).IsZero() {
+		return fmt.Errorf("%w: %q never runs", errInvalidSchedule, spec)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("jobs encode %s payload: %w", kind, err)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.schedules[name] = recurring{spec: spec, kind: kind, payload: data, schedule: schedule}
+	return nil
+}
+
+// Run claims and runs due jobs every pollInterval until ctx is cancelled. It then stops claiming jobs and
+// waits for the running ones, cancelling them if they do not finish within drainTimeout, before returning.
+// Jobs cut short are retried.
+func (q *Queue) Run(ctx context.Context) {
+	// jobs get a context of their own so that they are not cancelled as soon as ctx is
+	jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	var running sync.WaitGroup
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := q.poll(ctx, jobCtx, &running); err != nil && ctx.Err() == nil {
+			q.logger.Error("failed to poll jobs", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			q.drain(&running, cancel)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Work enqueues the jobs of the due schedules and runs the due jobs once, waiting for them to finish.
+func (q *Queue) Work(ctx context.Context) error {
+	var running sync.WaitGroup
+	err := q.poll(ctx, ctx, &running)
+	running.Wait()
+	return err
+}
+
+// poll enqueues the jobs of the due schedules, and starts as many due jobs as there are free slots to run them.
+func (q *Queue) poll(ctx, jobCtx context.Context, running *sync.WaitGroup) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.registered {
+		if err := q.registerSchedules(ctx); err != nil {
+			return err
+		}
+		q.registered = true
+	}
+	if err := q.enqueueScheduled(ctx); err != nil {
+		return err
+	}
+	return q.claim(ctx, jobCtx, running)
+}
+
+// drain waits for the running jobs, and cancels them after drainTimeout.
+func (q *Queue) drain(running *sync.WaitGroup, cancel context.CancelFunc) {
+	done := make(chan struct{})
+	go func() {
+		running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		q.logger.Warn("cancelling jobs still running after the drain timeout")
+		cancel()
+		<-done
+	}
+}
+
+// registerSchedules records the schedules of the queue, so that every replica shares their next runs.
+// The caller must hold q.mu.
+func (q *Queue) registerSchedules(ctx context.Context) error {
+	now := time.Now()
+	for name, r := range q.schedules {
+		if _, err := q.pool.Exec(ctx, upsertScheduleQuery, name, r.spec, r.kind, r.payload, r.schedule.Next(now)); err != nil {
+			return fmt.Errorf("jobs register schedule %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// enqueueScheduled enqueues a job for every due schedule, and moves the schedule to its next run.
+// The caller must hold q.mu.
+func (q *Queue) enqueueScheduled(ctx context.Context) error {
+	if len(q.schedules) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(q.schedules))
+	for name := range q.schedules {
+		names = append(names, name)
+	}
+
+	tx, err := q.pool.BeginTx(ctx, pgx.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("jobs begin tx: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, selectDueSchedulesQuery, names)
+	if err != nil {
+		return fmt.Errorf("jobs select due schedules: %w", err)
+	}
+	due, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return fmt.Errorf("jobs select due schedules: %w", err)
+	}
+
+	now := time.Now()
+	for _, name := range due {
+		r := q.schedules[name]
+		if _, err := Enqueue(ctx, tx, r.kind, r.payload, time.Time{}); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, updateScheduleQuery, name, r.schedule.Next(now)); err != nil {
+			return fmt.Errorf("jobs update schedule %s: %w", name, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("jobs commit: %w", err)
+	}
+	return nil
+}
+
+// claim claims as many due jobs of every kind as there are free slots to run them, and starts them.
+// The caller must hold q.mu.
+func (q *Queue) claim(ctx, jobCtx context.Context, running *sync.WaitGroup) error {
+	for kind, reg := range q.kinds {
+		free := cap(reg.slots) - len(reg.slots)
+		if free == 0 {
+			continue
+		}
+		jobs, err := q.claimKind(ctx, kind, free, reg.options.Timeout+leaseMargin)
+		if err != nil {
+			return err
+		}
+
+		for _, j := range jobs {
+			reg.slots <- struct{}{}
+			running.Add(1)
+			go func() {
+				defer running.Done()
+				defer func() { <-reg.slots }()
+				q.run(jobCtx, reg, j)
+			}()
+		}
+	}
+	return nil
+}
+
+func (q *Queue) claimKind(ctx context.Context, kind string, limit int, lease time.Duration) ([]Job, error) {
+	rows, err := q.pool.Query(ctx, claimJobsQuery, kind, limit, lease.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("jobs claim %s: %w", kind, err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		var j Job
+		if err := rows.Scan(&j.ID, &j.Kind, &j.Payload, &j.Attempt, &j.CreatedAt); err != nil {
+			return nil, fmt.Errorf("jobs scan job: %w", err)
+		}
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("jobs claim %s: %w", kind, err)
+	}
+	return jobs, nil
+}
+
+// run runs a claimed job, and either removes it, schedules a retry, or moves it to the dead letters.
+func (q *Queue) run(ctx context.Context, reg *registration, j Job) {
+	ctx, cancel := context.WithTimeout(ctx, reg.options.Timeout)
+	defer cancel()
+
+	err := handle(ctx, reg.handler, j)
+	ctx = context.WithoutCancel(ctx)
+	switch {
+	case err == nil:
+		_, err = q.pool.Exec(ctx, deleteJobQuery, j.ID)
+	case j.Attempt >= reg.options.MaxAttempts:
+		q.logger.Error("job failed for the last time", "kind", j.Kind, "job_id", j.ID, "attempt", j.Attempt, "error", err)
+		_, err = q.pool.Exec(ctx, buryJobQuery, j.ID, err.Error())
+	default:
+		q.logger.Warn("job failed", "kind", j.Kind, "job_id", j.ID, "attempt", j.Attempt, "error", err)
+		_, err = q.pool.Exec(ctx, retryJobQuery, j.ID, time.Now().Add(backoff(j.Attempt)), err.Error())
+	}
+	if err != nil {
+		q.logger.Error("failed to record job outcome", "kind", j.Kind, "job_id", j.ID, "error", err)
+	}
+}
+
+// handle calls the handler, turning a panic into an error so that a single bad job cannot stop the queue.
+func handle(ctx context.Context, handler Handler, j Job) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return handler(ctx, j)
+}
+
+// backoff returns how long to wait before the attempt following the given number of failed ones.
+func backoff(failed int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < failed && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
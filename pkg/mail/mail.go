@@ -0,0 +1,126 @@
+// Package mail sends emails through a pluggable Mailer.
+package mail
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"time"
+)
+
+// Message is an email with a plain text body and, optionally, an HTML alternative.
+type Message struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// Mailer sends emails.
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// SMTPMailer sends emails through an SMTP server, authenticating with PLAIN auth when a username is set.
+type SMTPMailer struct {
+	addr     string
+	from     string
+	username string
+	password string
+}
+
+func NewSMTPMailer(addr, from, username, password string) *SMTPMailer {
+	return &SMTPMailer{
+		addr:     addr,
+		from:     from,
+		username: username,
+		password: password,
+	}
+}
+
+// Send sends the message. net/smtp does not take a context, so ctx is only checked before sending.
+func (s *SMTPMailer) Send(ctx context.Context, m Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	body, err := m.encode(s.from, time.Now())
+	if err != nil {
+		return fmt.Errorf("mail encode message: %w", err)
+	}
+
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, err := net.SplitHostPort(s.addr)
+		if err != nil {
+			return fmt.Errorf("mail invalid smtp address: %w", err)
+		}
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	if err := smtp.SendMail(s.addr, auth, s.from, []string{m.To}, body); err != nil {
+		return fmt.Errorf("mail send: %w", err)
+	}
+	return nil
+}
+
+// encode returns the message in the RFC 5322 format, as a multipart/alternative message when it has an HTML body.
+func (m Message) encode(from string, date time.Time) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", m.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	if m.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\nContent-Transfer-Encoding: quoted-printable\r\n\r\n")
+		return buf.Bytes(), writeQuotedPrintable(&buf, m.Text)
+	}
+
+	parts := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", parts.Boundary())
+	for _, p := range []struct{ contentType, body string }{{"text/plain", m.Text}, {"text/html", m.HTML}} {
+		w, err := parts.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {p.contentType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, p.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := parts.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w interface{ Write([]byte) (int, error) }, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// LogMailer logs emails instead of sending them, for when no SMTP server is configured.
+type LogMailer struct {
+	logger *slog.Logger
+}
+
+func NewLogMailer(logger *slog.Logger) *LogMailer {
+	return &LogMailer{logger: logger}
+}
+
+func (l *LogMailer) Send(ctx context.Context, m Message) error {
+	l.logger.Info("email not sent, no smtp server configured", "to", m.To, "subject", m.Subject)
+	return nil
+}
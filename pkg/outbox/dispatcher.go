@@ -0,0 +1,191 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// dispatchInterval is how often the outbox is checked for due events.
+	dispatchInterval = time.Second
+	// dispatchBatch is how many events are claimed at once.
+	dispatchBatch = 100
+	// dispatchLease is how long claimed events are left alone by the other dispatchers.
+	dispatchLease = time.Minute
+	// baseBackoff and maxBackoff bound the delay before retrying an event, which doubles with every attempt.
+	baseBackoff = 5 * time.Second
+	maxBackoff  = time.Hour
+	// retention is how long dispatched events are kept, and purgeInterval how often the older ones are removed.
+	retention     = 7 * 24 * time.Hour
+	purgeInterval = time.Hour
+)
+
+// Handler reacts to an event. An event is delivered to a handler at least once: it is delivered again, later,
+// whenever the handler returns an error, and may be delivered twice if the dispatcher stops in the middle of it.
+type Handler func(ctx context.Context, e Event) error
+
+type subscriber struct {
+	name    string
+	handler Handler
+}
+
+// Dispatcher delivers the events of the outbox to its subscribers, in the order they were written except for the
+// retries. Every replica can run one: events are claimed with row locks, and each is handled by a single dispatcher
+// at a time. The outbox remembers which subscribers handled an event, so a retry only goes to those which failed.
+type Dispatcher struct {
+	pool   *pgxpool.Pool
+	logger *slog.Logger
+
+	mu          sync.Mutex
+	subscribers []subscriber
+}
+
+func NewDispatcher(pool *pgxpool.Pool, logger *slog.Logger) *Dispatcher {
+	return &Dispatcher{
+		pool:   pool,
+		logger: logger,
+	}
+}
+
+// Subscribe registers a handler for every event. The name is recorded along with the events the handler went
+// through, so it has to be unique and stay the same across restarts. Handlers filter the event types they need.
+func (d *Dispatcher) Subscribe(name string, handler Handler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.subscribers = append(d.subscribers, subscriber{name: name, handler: handler})
+}
+
+// Run dispatches events every dispatchInterval, and purges the ones dispatched more than retention ago every
+// purgeInterval, until ctx is cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(dispatchInterval)
+	defer ticker.Stop()
+	var purgedAt time.Time
+
+	for {
+		if err := d.Dispatch(ctx); err != nil && ctx.Err() == nil {
+			d.logger.Error("failed to dispatch events", "error", err)
+		}
+		if time.Since(purgedAt) > purgeInterval {
+			if _, err := d.pool.Exec(ctx, purgeEventsQuery, time.Now().Add(-retention)); err != nil && ctx.Err() == nil {
+				d.logger.Error("failed to purge events", "error", err)
+			}
+			purgedAt = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Dispatch delivers the events which are due until there are none left.
+func (d *Dispatcher) Dispatch(ctx context.Context) error {
+	d.mu.Lock()
+	subscribers := slices.Clone(d.subscribers)
+	d.mu.Unlock()
+
+	for {
+		n, err := d.dispatchBatch(ctx, subscribers)
+		if err != nil {
+			return err
+		}
+		if n < dispatchBatch {
+			return nil
+		}
+	}
+}
+
+// dispatchBatch claims up to dispatchBatch due events and delivers them, returning how many were claimed.
+func (d *Dispatcher) dispatchBatch(ctx context.Context, subscribers []subscriber) (int, error) {
+	rows, err := d.pool.Query(ctx, claimEventsQuery, dispatchBatch, dispatchLease.Seconds())
+	if err != nil {
+		return 0, fmt.Errorf("outbox claim events: %w", err)
+	}
+	type claimed struct {
+		event       Event
+		deliveredTo []string
+		attempts    int
+	}
+	var events []claimed
+	for rows.Next() {
+		var c claimed
+		if err := rows.Scan(&c.event.ID, &c.event.Type, &c.event.AggregateID, &c.event.UserID, &c.event.Payload, &c.event.CreatedAt, &c.deliveredTo, &c.attempts); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("outbox scan event: %w", err)
+		}
+		events = append(events, c)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("outbox claim events: %w", err)
+	}
+
+	for _, c := range events {
+		deliveredTo, err := d.deliver(ctx, subscribers, c.event, c.deliveredTo)
+		if err := d.record(context.WithoutCancel(ctx), c.event.ID, deliveredTo, c.attempts, err); err != nil {
+			return 0, err
+		}
+	}
+	return len(events), nil
+}
+
+// deliver hands the event to the subscribers which have not handled it yet, and returns the names of those which
+// have by now, along with the first error returned by the others.
+func (d *Dispatcher) deliver(ctx context.Context, subscribers []subscriber, e Event, deliveredTo []string) ([]string, error) {
+	var firstErr error
+	for _, s := range subscribers {
+		if slices.Contains(deliveredTo, s.name) {
+			continue
+		}
+		if err := handle(ctx, s.handler, e); err != nil {
+			d.logger.Error("failed to handle event", "subscriber", s.name, "event_id", e.ID, "type", e.Type, "error", err)
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", s.name, err)
+			}
+			continue
+		}
+		deliveredTo = append(deliveredTo, s.name)
+	}
+	return deliveredTo, firstErr
+}
+
+// handle calls the handler, turning a panic into an error so that a single bad event cannot stop the dispatcher.
+func handle(ctx context.Context, handler Handler, e Event) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("panic: %v", v)
+		}
+	}()
+	return handler(ctx, e)
+}
+
+// record marks the event as dispatched, or schedules a retry for the subscribers which failed to handle it.
+func (d *Dispatcher) record(ctx context.Context, id int64, deliveredTo []string, attempts int, deliverErr error) error {
+	var err error
+	if deliverErr == nil {
+		_, err = d.pool.Exec(ctx, eventDispatchedQuery, id, deliveredTo)
+	} else {
+		_, err = d.pool.Exec(ctx, eventFailedQuery, id, deliveredTo, time.Now().Add(backoff(attempts+1)), deliverErr.Error())
+	}
+	if err != nil {
+		return fmt.Errorf("outbox update event: %w", err)
+	}
+	return nil
+}
+
+// backoff returns how long to wait before the attempt following the given number of failed ones.
+func backoff(failed int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < failed && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxBackoff)
+}
@@ -0,0 +1,73 @@
+// Package outbox carries domain events from the transactions making them to the subscribers reacting to them.
+// Events are written to the outbox_events table within the transaction of the change they describe, so an event
+// exists if and only if its change was committed, and a Dispatcher then hands them to its subscribers.
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Event is a domain event: something which happened to an aggregate, such as a todo list, a task or a user.
+// Types are named "<aggregate>.<what happened>", e.g. "task.updated" or "user.registered".
+type Event struct {
+	ID          int64  `json:"id"`
+	Type        string `json:"type"`
+	AggregateID string `json:"aggregate_id"`
+	// UserID is the user the aggregate belongs to.
+	UserID    string          `json:"user_id"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// NewEvent returns an event carrying payload encoded as JSON.
+func NewEvent(eventType, aggregateID, userID string, payload any) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, fmt.Errorf("outbox encode %s payload: %w", eventType, err)
+	}
+	return Event{Type: eventType, AggregateID: aggregateID, UserID: userID, Payload: data}, nil
+}
+
+// Decode unmarshals the payload of the event into v.
+func (e Event) Decode(v any) error {
+	if err := json.Unmarshal(e.Payload, v); err != nil {
+		return fmt.Errorf("outbox decode %s payload: %w", e.Type, err)
+	}
+	return nil
+}
+
+// Write adds the events to the outbox as part of tx. They are only dispatched once tx commits, and never if it is rolled back.
+func Write(ctx context.Context, tx pgx.Tx, events ...Event) error {
+	for _, e := range events {
+		if _, err := tx.Exec(ctx, insertEventQuery, e.Type, e.AggregateID, e.UserID, e.Payload); err != nil {
+			return fmt.Errorf("outbox insert event: %w", err)
+		}
+	}
+	return nil
+}
+
+const (
+	insertEventQuery = "INSERT INTO outbox_events (type, aggregate_id, user_id, payload) VALUES ($1, $2, $3, $4)"
+	// claimEventsQuery leases the events due to a single dispatcher, oldest first: they are not due again until the
+	// lease of $2 seconds runs out, so a dispatcher dying in the middle of an event only delays it.
+	claimEventsQuery = `
+	WITH claimed AS (
+		UPDATE outbox_events SET next_attempt_at = now() + $2::float8 * interval '1 second'
+		WHERE id IN (
+			SELECT id FROM outbox_events
+			WHERE dispatched_at IS NULL AND next_attempt_at <= now()
+			ORDER BY id
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED)
+		RETURNING id, type, aggregate_id, user_id, payload, created_at, delivered_to, attempts
+	)
+	SELECT * FROM claimed ORDER BY id`
+	eventDispatchedQuery = "UPDATE outbox_events SET delivered_to = COALESCE($2::text[], '{}'), attempts = attempts + 1, dispatched_at = now(), last_error = NULL WHERE id = $1"
+	eventFailedQuery     = "UPDATE outbox_events SET delivered_to = COALESCE($2::text[], '{}'), attempts = attempts + 1, next_attempt_at = $3, last_error = $4 WHERE id = $1"
+	purgeEventsQuery     = "DELETE FROM outbox_events WHERE dispatched_at < $1"
+)
@@ -0,0 +1,348 @@
+// Package patch implements the two JSON patch formats accepted by PATCH endpoints:
+// JSON Merge Patch (RFC 7396) and JSON Patch (RFC 6902).
+package patch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Media types of the supported patch documents.
+const (
+	MergePatchType = "application/merge-patch+json"
+	JSONPatchType  = "application/json-patch+json"
+)
+
+var (
+	ErrUnsupportedType = errors.New("unsupported patch media type")
+	ErrInvalidPatch    = errors.New("invalid patch document")
+	ErrInvalidPath     = errors.New("path does not exist in the document")
+	ErrTestFailed      = errors.New("test operation failed")
+)
+
+// Patch is a parsed and validated patch document.
+type Patch interface {
+	// Apply returns the JSON document doc with the patch applied. The patch is applied as a whole or not at all.
+	Apply(doc []byte) ([]byte, error)
+}
+
+// Parse parses a patch document of the given media type.
+func Parse(mediaType string, body []byte) (Patch, error) {
+	switch mediaType {
+	case MergePatchType:
+		var v any
+		if err := json.Unmarshal(body, &v); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+		}
+		return MergePatch{value: v}, nil
+	case JSONPatchType:
+		var ops JSONPatch
+		if err := json.Unmarshal(body, &ops); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPatch, err)
+		}
+		for i := range ops {
+			if err := ops[i].parse(); err != nil {
+				return nil, fmt.Errorf("%w: operation %d: %w", ErrInvalidPatch, i, err)
+			}
+		}
+		return ops, nil
+	default:
+		return nil, ErrUnsupportedType
+	}
+}
+
+// MergePatch is a JSON Merge Patch: objects are merged recursively, a null member removes
+// the member from the target, and any other value replaces the target.
+type MergePatch struct {
+	value any
+}
+
+func (p MergePatch) Apply(doc []byte) ([]byte, error) {
+	var target any
+	if err := json.Unmarshal(doc, &target); err != nil {
+		return nil, fmt.Errorf("patch: decode document: %w", err)
+	}
+	return json.Marshal(merge(target, p.value))
+}
+
+func merge(target, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = make(map[string]any)
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = merge(t[k], v)
+		}
+	}
+	return t
+}
+
+// JSONPatch is a JSON Patch: a sequence of operations applied in order.
+type JSONPatch []Operation
+
+// Operation is a single JSON Patch operation. Paths are JSON Pointers (RFC 6901).
+type Operation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+
+	path  []string
+	from  []string
+	value any
+}
+
+// parse validates the operation and decodes its pointers and value.
+func (o *Operation) parse() error {
+	var err error
+	if o.path, err = parsePointer(o.Path); err != nil {
+		return err
+	}
+
+	switch o.Op {
+	case "add", "replace", "test":
+		if o.Value == nil {
+			return fmt.Errorf("%q operation without a value", o.Op)
+		}
+		if err := json.Unmarshal(o.Value, &o.value); err != nil {
+			return err
+		}
+	case "move", "copy":
+		if o.from, err = parsePointer(o.From); err != nil {
+			return err
+		}
+		if o.Op == "move" && len(o.from) < len(o.path) && slices.Equal(o.from, o.path[:len(o.from)]) {
+			return errors.New("cannot move a value into one of its own children")
+		}
+	case "remove":
+	default:
+		return fmt.Errorf("unknown operation %q", o.Op)
+	}
+	return nil
+}
+
+func (p JSONPatch) Apply(doc []byte) ([]byte, error) {
+	var v any
+	if err := json.Unmarshal(doc, &v); err != nil {
+		return nil, fmt.Errorf("patch: decode document: %w", err)
+	}
+
+	for i, op := range p {
+		var err error
+		if v, err = op.apply(v); err != nil {
+			return nil, fmt.Errorf("operation %d: %w", i, err)
+		}
+	}
+	return json.Marshal(v)
+}
+
+func (o Operation) apply(doc any) (any, error) {
+	switch o.Op {
+	case "add":
+		return add(doc, o.path, deepCopy(o.value))
+	case "remove":
+		doc, _, err := remove(doc, o.path)
+		return doc, err
+	case "replace":
+		doc, _, err := remove(doc, o.path)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, o.path, deepCopy(o.value))
+	case "move":
+		doc, v, err := remove(doc, o.from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, o.path, v)
+	case "copy":
+		v, err := get(doc, o.from)
+		if err != nil {
+			return nil, err
+		}
+		return add(doc, o.path, deepCopy(v))
+	case "test":
+		v, err := get(doc, o.path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(v, o.value) {
+			return nil, fmt.Errorf("%w: %s", ErrTestFailed, o.Path)
+		}
+		return doc, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown operation %q", ErrInvalidPatch, o.Op)
+	}
+}
+
+// parsePointer splits a JSON Pointer into its unescaped reference tokens. The empty pointer is the whole document.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// index parses an array index, which has to be below max.
+func index(token string, max int) (int, error) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, ErrInvalidPath
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i >= max {
+		return 0, ErrInvalidPath
+	}
+	return i, nil
+}
+
+func get(doc any, path []string) (any, error) {
+	for _, token := range path {
+		switch c := doc.(type) {
+		case map[string]any:
+			v, ok := c[token]
+			if !ok {
+				return nil, ErrInvalidPath
+			}
+			doc = v
+		case []any:
+			i, err := index(token, len(c))
+			if err != nil {
+				return nil, err
+			}
+			doc = c[i]
+		default:
+			return nil, ErrInvalidPath
+		}
+	}
+	return doc, nil
+}
+
+// add returns doc with value added at path. The parent of path has to exist.
+func add(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	token, rest := path[0], path[1:]
+	switch c := doc.(type) {
+	case map[string]any:
+		if len(rest) == 0 {
+			c[token] = value
+			return c, nil
+		}
+		child, ok := c[token]
+		if !ok {
+			return nil, ErrInvalidPath
+		}
+		child, err := add(child, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		c[token] = child
+		return c, nil
+	case []any:
+		if len(rest) == 0 {
+			if token == "-" {
+				return append(c, value), nil
+			}
+			i, err := index(token, len(c)+1)
+			if err != nil {
+				return nil, err
+			}
+			return slices.Insert(c, i, value), nil
+		}
+		i, err := index(token, len(c))
+		if err != nil {
+			return nil, err
+		}
+		child, err := add(c[i], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		c[i] = child
+		return c, nil
+	default:
+		return nil, ErrInvalidPath
+	}
+}
+
+// remove returns doc without the value at path, which has to exist, along with the removed value.
+func remove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	token, rest := path[0], path[1:]
+	switch c := doc.(type) {
+	case map[string]any:
+		child, ok := c[token]
+		if !ok {
+			return nil, nil, ErrInvalidPath
+		}
+		if len(rest) == 0 {
+			delete(c, token)
+			return c, child, nil
+		}
+		child, removed, err := remove(child, rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		c[token] = child
+		return c, removed, nil
+	case []any:
+		i, err := index(token, len(c))
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) == 0 {
+			removed := c[i]
+			return slices.Delete(c, i, i+1), removed, nil
+		}
+		child, removed, err := remove(c[i], rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		c[i] = child
+		return c, removed, nil
+	default:
+		return nil, nil, ErrInvalidPath
+	}
+}
+
+func deepCopy(v any) any {
+	switch c := v.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(c))
+		for k, v := range c {
+			m[k] = deepCopy(v)
+		}
+		return m
+	case []any:
+		s := make([]any, len(c))
+		for i, v := range c {
+			s[i] = deepCopy(v)
+		}
+		return s
+	default:
+		return v
+	}
+}
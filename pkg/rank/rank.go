@@ -0,0 +1,89 @@
+// Package rank generates lexicographic ranking keys. A key can always be generated between
+// any two others, so moving one item in an ordered list only ever rewrites that item.
+//
+// Keys are made of base-62 digits whose byte order matches their numeric order, so they must be
+// compared byte-wise (in Postgres, with the "C" collation). Keys never end with the zero digit,
+// which guarantees there is always room before any of them.
+package rank
+
+import (
+	"errors"
+	"strings"
+)
+
+const digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var ErrInvalidRange = errors.New("rank: lower bound is not below upper bound")
+
+// Between returns a key that sorts strictly after a and strictly before b.
+// An empty a means "before everything" and an empty b means "after everything".
+func Between(a, b string) (string, error) {
+	if b != "" && a >= b {
+		return "", ErrInvalidRange
+	}
+	if !valid(a) || !valid(b) {
+		return "", ErrInvalidRange
+	}
+	return midpoint(a, b), nil
+}
+
+// After returns a key that sorts after a.
+func After(a string) string {
+	return midpoint(a, "")
+}
+
+// midpoint assumes a < b, or b == "" meaning no upper bound.
+func midpoint(a, b string) string {
+	if b != "" {
+		// skip the common prefix, reading missing digits of a as zeros
+		n := 0
+		for n < len(b) && digitAt(a, n) == strings.IndexByte(digits, b[n]) {
+			n++
+		}
+		if n > 0 {
+			return b[:n] + midpoint(suffix(a, n), b[n:])
+		}
+	}
+
+	lo := digitAt(a, 0)
+	hi := len(digits)
+	if b != "" {
+		hi = strings.IndexByte(digits, b[0])
+	} else if a != "" && lo+1 < hi {
+		// appending is by far the most common case, so keep keys short by stepping
+		// a single digit instead of halving the remaining space
+		return string(digits[lo+1])
+	}
+
+	if hi-lo > 1 {
+		return string(digits[(lo+hi+1)/2])
+	}
+	// the first digits are adjacent
+	if len(b) > 1 {
+		return b[:1]
+	}
+	return string(digits[lo]) + midpoint(suffix(a, 1), "")
+}
+
+func digitAt(s string, i int) int {
+	if i >= len(s) {
+		return 0
+	}
+	return strings.IndexByte(digits, s[i])
+}
+
+func suffix(s string, n int) string {
+	if n >= len(s) {
+		return ""
+	}
+	return s[n:]
+}
+
+func valid(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if strings.IndexByte(digits, key[i]) < 0 {
+			return false
+		}
+	}
+	return !strings.HasSuffix(key, digits[:1])
+}
@@ -0,0 +1,232 @@
+// Package todotxt reads and writes the todo.txt format (https://github.com/todotxt/todo.txt): one task per line,
+// marked "x" when done, with an optional priority, completion and creation dates, and a description carrying
+// +project and @context tags and key:value pairs.
+package todotxt
+
+import (
+	"bufio"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ContentType is the media type todo.txt files are served as.
+const ContentType = "text/plain; charset=utf-8"
+
+// DateLayout is the layout of the dates in a todo.txt line, including the values of date keys such as "due:".
+const DateLayout = "2006-01-02"
+
+// Task is a single line of a todo.txt file.
+type Task struct {
+	Done bool
+	// Priority is an upper case letter from 'A', the highest, to 'Z', or 0 when the task has none. Done tasks keep
+	// their priority in a "pri:" pair, since the format has no room for it on completed lines.
+	Priority byte
+	// CompletedAt is only set on done tasks, and CreatedAt only along with it on those.
+	CompletedAt *time.Time
+	CreatedAt   *time.Time
+	Description string
+}
+
+// Parse reads a todo.txt line. Any line is a valid task: whatever does not read as a marker, a priority or a date
+// is part of the description, but for a backslash at its start, which String writes to escape it.
+func Parse(line string) Task {
+	var t Task
+	rest := strings.TrimSpace(line)
+	if s, ok := strings.CutPrefix(rest, "x "); ok {
+		t.Done, rest = true, strings.TrimLeft(s, " ")
+	}
+	if len(rest) >= 4 && rest[0] == '(' && rest[1] >= 'A' && rest[1] <= 'Z' && rest[2] == ')' && rest[3] == ' ' {
+		t.Priority, rest = rest[1], strings.TrimLeft(rest[4:], " ")
+	}
+
+	first, rest := cutDate(rest)
+	if t.Done && first != nil {
+		t.CompletedAt = first
+		t.CreatedAt, rest = cutDate(rest)
+	} else {
+		t.CreatedAt = first
+	}
+	// a description which would otherwise read as a marker, a priority or a date is escaped by a backslash
+	t.Description = strings.TrimPrefix(rest, `\`)
+
+	if t.Priority == 0 {
+		if p, ok := t.Value("pri"); ok && len(p) == 1 && p[0] >= 'A' && p[0] <= 'Z' {
+			t.Priority = p[0]
+		}
+	}
+	return t
+}
+
+// cutDate reads a date off the start of s, returning it and the rest of s, or nil and s when s does not start with one.
+func cutDate(s string) (*time.Time, string) {
+	word, rest, _ := strings.Cut(s, " ")
+	d, err := time.Parse(DateLayout, word)
+	if err != nil {
+		return nil, s
+	}
+	return &d, strings.TrimLeft(rest, " ")
+}
+
+// Projects returns the names of the +project tags of the task, without the plus sign.
+func (t Task) Projects() []string {
+	return t.tags('+')
+}
+
+// Contexts returns the names of the @context tags of the task, without the at sign.
+func (t Task) Contexts() []string {
+	return t.tags('@')
+}
+
+func (t Task) tags(sign byte) []string {
+	var tags []string
+	for _, word := range strings.Fields(t.Description) {
+		if len(word) > 1 && word[0] == sign {
+			tags = append(tags, word[1:])
+		}
+	}
+	return tags
+}
+
+// Value returns the value of the first key:value pair of the task with the given key.
+func (t Task) Value(key string) (string, bool) {
+	for _, word := range strings.Fields(t.Description) {
+		if k, v, ok := strings.Cut(word, ":"); ok && k == key && v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Text returns the description of the task without its tags and without the key:value pairs of the given keys.
+func (t Task) Text(keys ...string) string {
+	var words []string
+	for _, word := range strings.Fields(t.Description) {
+		if len(word) > 1 && (word[0] == '+' || word[0] == '@') {
+			continue
+		}
+		if k, v, ok := strings.Cut(word, ":"); ok && v != "" && slices.Contains(keys, k) {
+			continue
+		}
+		words = append(words, word)
+	}
+	return strings.Join(words, " ")
+}
+
+// String returns the task as a todo.txt line. The creation date of a done task is only written along with its
+// completion date, which the format requires to come first. A description starting with what Parse would read as
+// a marker, a priority or a date, or with a backslash, is escaped by a backslash, so that it reads back the same.
+func (t Task) String() string {
+	var b strings.Builder
+	if t.Done {
+		b.WriteString("x ")
+		if t.CompletedAt != nil {
+			b.WriteString(t.CompletedAt.Format(DateLayout) + " ")
+			if t.CreatedAt != nil {
+				b.WriteString(t.CreatedAt.Format(DateLayout) + " ")
+			}
+		}
+	} else {
+		if t.Priority != 0 {
+			b.WriteString("(" + string(t.Priority) + ") ")
+		}
+		if t.CreatedAt != nil {
+			b.WriteString(t.CreatedAt.Format(DateLayout) + " ")
+		}
+	}
+	if desc := strings.TrimSpace(t.Description); strings.HasPrefix(desc, `\`) || Parse(b.String()+desc).Description != desc {
+		b.WriteString(`\`)
+	}
+	b.WriteString(t.Description)
+	if t.Done && t.Priority != 0 {
+		if _, ok := t.Value("pri"); !ok {
+			b.WriteString(" pri:" + string(t.Priority))
+		}
+	}
+	return b.String()
+}
+
+// MaxLineLength is the length of the longest line a Scanner reads a task from.
+const MaxLineLength = 1 << 20
+
+// Scanner reads the tasks of a todo.txt file one line at a time, skipping blank lines. Lines longer than
+// MaxLineLength are skipped too, which TooLong reports.
+type Scanner struct {
+	r       *bufio.Reader
+	task    Task
+	line    int
+	tooLong bool
+	err     error
+}
+
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{r: bufio.NewReader(r)}
+}
+
+// Scan advances to the next task, reporting whether there is one. Err tells why there is not.
+func (s *Scanner) Scan() bool {
+	for s.err == nil {
+		text, tooLong, err := s.readLine()
+		s.err = err
+		if err != nil && (err != io.EOF || (text == "" && !tooLong)) {
+			return false
+		}
+		s.line++
+
+		s.task, s.tooLong = Task{}, tooLong
+		if tooLong {
+			return true
+		}
+		if text = strings.TrimSpace(text); text != "" {
+			s.task = Parse(text)
+			return true
+		}
+	}
+	return false
+}
+
+// readLine reads the next line. A line longer than MaxLineLength is read through, but only reported as too long.
+func (s *Scanner) readLine() (string, bool, error) {
+	var (
+		line    []byte
+		tooLong bool
+	)
+	for {
+		chunk, err := s.r.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > MaxLineLength {
+				line, tooLong = nil, true
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err != bufio.ErrBufferFull {
+			return string(line), tooLong, err
+		}
+	}
+}
+
+// Task returns the task read by the last call to Scan.
+func (s *Scanner) Task() Task {
+	return s.task
+}
+
+// Line returns the number of the line the last task was read from, starting at 1.
+func (s *Scanner) Line() int {
+	return s.line
+}
+
+// TooLong reports whether the line the last call to Scan stopped at is longer than MaxLineLength, in which case
+// it was skipped, and Task is empty.
+func (s *Scanner) TooLong() bool {
+	return s.tooLong
+}
+
+// Err returns the error that stopped the scanner, or nil if it reached the end of the file.
+func (s *Scanner) Err() error {
+	if s.err == io.EOF {
+		return nil
+	}
+	return s.err
+}
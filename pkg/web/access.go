@@ -3,6 +3,7 @@ package web
 import (
 	"log/slog"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -16,7 +17,22 @@ func (rw *loggingResponseWritter) WriteHeader(s int) {
 	rw.ResponseWriter.WriteHeader(s)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer, eg. to flush streamed responses.
+func (rw *loggingResponseWritter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func Access(next http.HandlerFunc, logger *slog.Logger) http.HandlerFunc {
+	return access(next, logger, nil)
+}
+
+// AccessRedacted is Access for the routes authenticated by a secret in their path, such as a token, the path
+// values named by secrets being left out of the logged endpoint.
+func AccessRedacted(next http.HandlerFunc, logger *slog.Logger, secrets ...string) http.HandlerFunc {
+	return access(next, logger, secrets)
+}
+
+func access(next http.HandlerFunc, logger *slog.Logger, secrets []string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 		lrw := loggingResponseWritter{
@@ -24,6 +40,13 @@ func Access(next http.HandlerFunc, logger *slog.Logger) http.HandlerFunc {
 			Status:         http.StatusOK,
 		}
 		next(&lrw, r)
-		logger.Info("access", "endpoint", r.URL.Path, "method", r.Method, "status", lrw.Status, "latency", time.Since(start))
+
+		endpoint := r.URL.Path
+		for _, name := range secrets {
+			if value := r.PathValue(name); value != "" {
+				endpoint = strings.ReplaceAll(endpoint, value, "[redacted]")
+			}
+		}
+		logger.Info("access", "endpoint", endpoint, "method", r.Method, "status", lrw.Status, "latency", time.Since(start))
 	}
 }
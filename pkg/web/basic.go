@@ -0,0 +1,50 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator returns the id of the user with the username and password, or ErrInvalidCredentials.
+type Authenticator func(ctx context.Context, username, password string) (string, error)
+
+// BasicAuth returns a middleware authenticating requests with HTTP Basic credentials instead of a token, for
+// clients which cannot do otherwise, such as calendar apps. Like Auth, it puts the id of the user in the context.
+// The credentials are checked on every request, so a changed password or a deleted user takes effect at once.
+func BasicAuth(authenticate Authenticator, realm string) func(next http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			username, password, ok := r.BasicAuth()
+			if !ok {
+				unauthorized(w, realm)
+				return
+			}
+
+			userID, err := authenticate(r.Context(), username, password)
+			if err != nil {
+				if !errors.Is(err, ErrInvalidCredentials) {
+					WriteJSON(w, r, http.StatusInternalServerError, ApiError{
+						Status:     http.StatusInternalServerError,
+						Title:      InternalErrorTitle,
+						Detail:     "failed to authenticate",
+						underlying: err,
+					})
+					return
+				}
+				unauthorized(w, realm)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), UserID, userID)
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+func unauthorized(w http.ResponseWriter, realm string) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="`+realm+`", charset="UTF-8"`)
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
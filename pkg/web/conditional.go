@@ -0,0 +1,74 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ETag formats the version of a resource as a strong entity tag.
+func ETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// DigestETag formats the version of a resource made of other ones, such as a task with its subtasks, as a strong
+// entity tag: the version followed by a digest of the other resources, so that the tag changes whenever any of them
+// does. IfMatch reads the version back out of it.
+func DigestETag(version int64, digest string) string {
+	return `"` + strconv.FormatInt(version, 10) + "-" + digest + `"`
+}
+
+// NotModified reports whether the If-None-Match header of the request matches etag, in which case
+// the response should be a 304 Not Modified instead of the representation. As required for
+// If-None-Match, weak and strong entity tags are compared alike.
+func NotModified(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteNotModified responds with a 304 Not Modified carrying the current entity tag.
+func WriteNotModified(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// IfMatch returns the resource versions listed in the If-Match header of the request, which a
+// conditional write must find the resource at. It returns nil when the write is unconditional,
+// that is without the header or with "*". Weak entity tags, and tags not produced by ETag or DigestETag,
+// never match, so a header made only of those yields an empty, non-nil slice.
+func IfMatch(r *http.Request) []int64 {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return nil
+	}
+
+	versions := make([]int64, 0)
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return nil
+		}
+		unquoted, ok := strings.CutPrefix(tag, `"`)
+		if !ok {
+			continue
+		}
+		unquoted, ok = strings.CutSuffix(unquoted, `"`)
+		if !ok {
+			continue
+		}
+		unquoted, _, _ = strings.Cut(unquoted, "-")
+		if version, err := strconv.ParseInt(unquoted, 10, 64); err == nil {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
@@ -13,6 +13,11 @@ const (
 	ForbiddenTitle        = "httperror:forbidden"
 	InternalErrorTitle    = "httperror:internalerror"
 	NotFoundTitle         = "httperror:notfound"
+	ConflictTitle         = "httperror:conflict"
+	GoneTitle             = "httperror:gone"
+	PreconditionTitle     = "httperror:preconditionfailed"
+	UnsupportedMediaTitle = "httperror:unsupportedmediatype"
+	UnprocessableTitle    = "httperror:unprocessableentity"
 	UnspecifiedErrorTitle = "httperror:unspecifiederror"
 )
 
@@ -69,6 +74,41 @@ func ErrorResponse(
 			Detail:     detail,
 			underlying: err,
 		}
+	case http.StatusConflict:
+		apiError = ApiError{
+			Status:     status,
+			Title:      ConflictTitle,
+			Detail:     detail,
+			underlying: err,
+		}
+	case http.StatusGone:
+		apiError = ApiError{
+			Status:     status,
+			Title:      GoneTitle,
+			Detail:     detail,
+			underlying: err,
+		}
+	case http.StatusPreconditionFailed:
+		apiError = ApiError{
+			Status:     status,
+			Title:      PreconditionTitle,
+			Detail:     detail,
+			underlying: err,
+		}
+	case http.StatusUnsupportedMediaType:
+		apiError = ApiError{
+			Status:     status,
+			Title:      UnsupportedMediaTitle,
+			Detail:     detail,
+			underlying: err,
+		}
+	case http.StatusUnprocessableEntity:
+		apiError = ApiError{
+			Status:     status,
+			Title:      UnprocessableTitle,
+			Detail:     detail,
+			underlying: err,
+		}
 	case http.StatusInternalServerError:
 		apiError = ApiError{
 			Status:     status,
@@ -0,0 +1,240 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// IdempotencyKeyHeader is the request header carrying the client-chosen key of a retriable request.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength is the longest idempotency key accepted.
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBodySize is the largest body of a request carrying an idempotency key, which is read in full to be
+// told apart from the other requests using the key.
+const maxIdempotentBodySize = 1 << 20
+
+var (
+	ErrIdempotencyKeyReused   = errors.New("idempotency key already used for a different request")
+	ErrIdempotencyKeyInFlight = errors.New("a request with this idempotency key is still being processed")
+)
+
+// StoredResponse is a response kept to be replayed to the retries of the request which produced it.
+type StoredResponse struct {
+	Status int
+	Header http.Header
+	Body   []byte
+}
+
+// IdempotencyStore keeps the first response to every idempotency key of a user.
+type IdempotencyStore interface {
+	// Reserve claims the key for a request with the given fingerprint. It returns the stored response when
+	// the key has already been answered, ErrIdempotencyKeyReused when it was used for a request with a
+	// different fingerprint and ErrIdempotencyKeyInFlight when that request has not been answered yet.
+	Reserve(ctx context.Context, userID, key, fingerprint string) (*StoredResponse, error)
+	// Save stores the response to a reserved key.
+	Save(ctx context.Context, userID, key string, response StoredResponse) error
+	// Release gives up a reserved key, so that the request can be retried.
+	Release(ctx context.Context, userID, key string) error
+}
+
+// Idempotent makes POST and PATCH requests carrying an Idempotency-Key header safe to retry: the first
+// response to a key is stored and replayed to every retry, while reusing the key for a different request
+// is rejected. Keys are scoped to the caller, so Idempotent must run after Auth. Server errors are not
+// stored, and the request can be retried with the same key after them.
+func Idempotent(next http.HandlerFunc, store IdempotencyStore, logger *slog.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		userID, ok := r.Context().Value(UserID).(string)
+		if store == nil || key == "" || !ok || (r.Method != http.MethodPost && r.Method != http.MethodPatch) {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			ErrorResponse(logger, w, r, http.StatusBadRequest, "the idempotency key is too long", ErrInvalidValue)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodySize))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				ErrorResponse(logger, w, r, http.StatusRequestEntityTooLarge, "the request body is too large to be retried with an idempotency key", err)
+				return
+			}
+			ErrorResponse(logger, w, r, http.StatusBadRequest, "failed to read request body", err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		stored, err := store.Reserve(r.Context(), userID, key, fingerprint(r, body))
+		if err != nil {
+			switch err {
+			case ErrIdempotencyKeyReused:
+				ErrorResponse(logger, w, r, http.StatusUnprocessableEntity, err.Error(), err)
+				return
+			case ErrIdempotencyKeyInFlight:
+				ErrorResponse(logger, w, r, http.StatusConflict, err.Error(), err)
+				return
+			default:
+				ErrorResponse(logger, w, r, http.StatusInternalServerError, "failed to check idempotency key", err)
+				return
+			}
+		}
+		if stored != nil {
+			for name, values := range stored.Header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.Status)
+			w.Write(stored.Body)
+			return
+		}
+
+		rec := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		saved := false
+		defer func() {
+			// the key must not stay reserved when the handler fails or panics
+			if !saved {
+				if err := store.Release(context.WithoutCancel(r.Context()), userID, key); err != nil {
+					logger.Error("failed to release idempotency key", "error", err)
+				}
+			}
+		}()
+
+		next(rec, r)
+
+		if rec.status >= http.StatusInternalServerError {
+			return
+		}
+		response := StoredResponse{Status: rec.status, Header: w.Header().Clone(), Body: rec.body.Bytes()}
+		if err := store.Save(context.WithoutCancel(r.Context()), userID, key, response); err != nil {
+			logger.Error("failed to store idempotent response", "error", err)
+			return
+		}
+		saved = true
+	}
+}
+
+// fingerprint identifies a request by its method, target and body.
+func fingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", r.Method, r.URL.RequestURI())
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recordingResponseWriter passes a response through while keeping a copy of its status and body.
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rw *recordingResponseWriter) WriteHeader(s int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.status = s
+	rw.wroteHeader = true
+	rw.ResponseWriter.WriteHeader(s)
+}
+
+func (rw *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+func (rw *recordingResponseWriter) Write(b []byte) (int, error) {
+	rw.WriteHeader(http.StatusOK)
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+const (
+	// reserveIdempotencyKeyQuery claims a key unless it is still within the window, and drops the other expired keys.
+	reserveIdempotencyKeyQuery = `
+	WITH expired AS (
+		DELETE FROM idempotency_keys WHERE created_at < $4 AND NOT (user_id = $1 AND key = $2)
+	)
+	INSERT INTO idempotency_keys (user_id, key, fingerprint) VALUES ($1, $2, $3)
+	ON CONFLICT (user_id, key) DO UPDATE
+		SET fingerprint = EXCLUDED.fingerprint, status = NULL, header = NULL, body = NULL, created_at = now()
+		WHERE idempotency_keys.created_at < $4
+	RETURNING key`
+	selectIdempotencyKeyQuery  = "SELECT fingerprint, status, header, body FROM idempotency_keys WHERE user_id = $1 AND key = $2"
+	saveIdempotencyKeyQuery    = "UPDATE idempotency_keys SET status = $3, header = $4, body = $5 WHERE user_id = $1 AND key = $2"
+	releaseIdempotencyKeyQuery = "DELETE FROM idempotency_keys WHERE user_id = $1 AND key = $2 AND status IS NULL"
+)
+
+// PostgresIdempotencyStore is an IdempotencyStore keeping responses in the idempotency_keys table
+// for the length of its window.
+type PostgresIdempotencyStore struct {
+	pool   *pgxpool.Pool
+	window time.Duration
+}
+
+func NewIdempotencyStore(pool *pgxpool.Pool, window time.Duration) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{
+		pool:   pool,
+		window: window,
+	}
+}
+
+func (s *PostgresIdempotencyStore) Reserve(ctx context.Context, userID, key, fingerprint string) (*StoredResponse, error) {
+	var reserved string
+	err := s.pool.QueryRow(ctx, reserveIdempotencyKeyQuery, userID, key, fingerprint, time.Now().Add(-s.window)).Scan(&reserved)
+	if err == nil {
+		return nil, nil
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("idempotency reserve key: %w", err)
+	}
+
+	var (
+		storedFingerprint string
+		status            *int
+		response          StoredResponse
+	)
+	if err := s.pool.QueryRow(ctx, selectIdempotencyKeyQuery, userID, key).Scan(&storedFingerprint, &status, &response.Header, &response.Body); err != nil {
+		// the request holding the key has just released it
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, ErrIdempotencyKeyInFlight
+		}
+		return nil, fmt.Errorf("idempotency get key: %w", err)
+	}
+	if storedFingerprint != fingerprint {
+		return nil, ErrIdempotencyKeyReused
+	}
+	if status == nil {
+		return nil, ErrIdempotencyKeyInFlight
+	}
+	response.Status = *status
+	return &response, nil
+}
+
+func (s *PostgresIdempotencyStore) Save(ctx context.Context, userID, key string, response StoredResponse) error {
+	if _, err := s.pool.Exec(ctx, saveIdempotencyKeyQuery, userID, key, response.Status, response.Header, response.Body); err != nil {
+		return fmt.Errorf("idempotency save response: %w", err)
+	}
+	return nil
+}
+
+func (s *PostgresIdempotencyStore) Release(ctx context.Context, userID, key string) error {
+	if _, err := s.pool.Exec(ctx, releaseIdempotencyKeyQuery, userID, key); err != nil {
+		return fmt.Errorf("idempotency release key: %w", err)
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
@@ -12,6 +13,8 @@ import (
 
 type contextKey string
 
+var ErrInvalidToken = errors.New("missing or invalid token")
+
 const UserID contextKey = "userID"
 
 func CreateAccessToken(userID string) (string, error) {
@@ -31,9 +34,8 @@ func CreateAccessToken(userID string) (string, error) {
 // auth is the middleware that validates jwt tokens.
 func Auth(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		tokenStr := r.Header.Get("x-jwt-token")
-		token, err := jwt.Parse(tokenStr, defaultKeyFunc)
-		if err != nil || token == nil || !token.Valid {
+		userID, err := ParseAccessToken(r.Header.Get("x-jwt-token"))
+		if err != nil {
 			WriteJSON(
 				w,
 				r,
@@ -47,57 +49,32 @@ func Auth(next http.HandlerFunc) http.HandlerFunc {
 			)
 			return
 		}
+		ctx := context.WithValue(r.Context(), UserID, userID)
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			WriteJSON(
-				w,
-				r,
-				http.StatusUnauthorized,
-				ApiError{
-					Status:     http.StatusUnauthorized,
-					Title:      UnauthorizedTitle,
-					Detail:     "missing or invalid token",
-					underlying: err,
-				},
-			)
-			return
-		}
+		next(w, r.WithContext(ctx))
+	}
+}
 
-		if !claimsAreValid(claims) {
-			WriteJSON(
-				w,
-				r,
-				http.StatusUnauthorized,
-				ApiError{
-					Status:     http.StatusUnauthorized,
-					Title:      UnauthorizedTitle,
-					Detail:     "missing or invalid token",
-					underlying: err,
-				},
-			)
-			return
-		}
+// ParseAccessToken validates an access token created by CreateAccessToken and returns the id of its user.
+func ParseAccessToken(tokenStr string) (string, error) {
+	token, err := jwt.Parse(tokenStr, defaultKeyFunc)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
+	if token == nil || !token.Valid {
+		return "", ErrInvalidToken
+	}
 
-		userID, ok := claims["sub"].(string)
-		if !ok {
-			WriteJSON(
-				w,
-				r,
-				http.StatusUnauthorized,
-				ApiError{
-					Status:     http.StatusUnauthorized,
-					Title:      UnauthorizedTitle,
-					Detail:     "missing or invalid token",
-					underlying: err,
-				},
-			)
-			return
-		}
-		ctx := context.WithValue(r.Context(), UserID, userID)
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !claimsAreValid(claims) {
+		return "", ErrInvalidToken
+	}
 
-		next(w, r.WithContext(ctx))
+	userID, ok := claims["sub"].(string)
+	if !ok {
+		return "", ErrInvalidToken
 	}
+	return userID, nil
 }
 
 func isExpired(expiresAt time.Time) bool {
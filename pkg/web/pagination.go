@@ -0,0 +1,63 @@
+package web
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultPage = 1
+	maxLimit    = 100
+)
+
+// Page is the response envelope used by every v2 collection endpoint.
+// An empty collection is returned as an empty Items array, never as an error.
+type Page[T any] struct {
+	Items      []T        `json:"items"`
+	Pagination Pagination `json:"pagination"`
+}
+
+// Pagination describes the position of a Page within the whole collection.
+type Pagination struct {
+	Page       int `json:"page"`
+	Limit      int `json:"limit"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+func NewPage[T any](items []T, page, limit, total int) Page[T] {
+	if items == nil {
+		items = make([]T, 0)
+	}
+	totalPages := 0
+	if limit > 0 {
+		totalPages = (total + limit - 1) / limit
+	}
+	return Page[T]{
+		Items: items,
+		Pagination: Pagination{
+			Page:       page,
+			Limit:      limit,
+			Total:      total,
+			TotalPages: totalPages,
+		},
+	}
+}
+
+// ReadPagination reads the page and limit query parameters of a request.
+// Missing or invalid values fall back to the first page and defaultLimit.
+func ReadPagination(r *http.Request, defaultLimit int) (page, limit int) {
+	queryParams := r.URL.Query()
+	page, err := strconv.Atoi(queryParams.Get("page"))
+	if err != nil || page < 1 {
+		page = defaultPage
+	}
+	limit, err = strconv.Atoi(queryParams.Get("limit"))
+	if err != nil || limit < 1 {
+		limit = defaultLimit
+	}
+	if limit > maxLimit {
+		limit = maxLimit
+	}
+	return page, limit
+}
@@ -28,19 +28,24 @@ func WriteJSON[T any](w http.ResponseWriter, r *http.Request, status int, v T) e
 
 func ReadJSON[T Validator](r *http.Request) (T, error) {
 	var v T
+	err := ReadJSONInto(r, &v)
+	return v, err
+}
 
+// ReadJSONInto decodes the JSON body of the request over v, so that the fields the body leaves out keep their value.
+func ReadJSONInto[T Validator](r *http.Request, v *T) error {
 	contentType := r.Header.Get("Content-Type")
 	if strings.ToLower(contentType) != "application/json" {
-		return v, fmt.Errorf("ReadJSON: %w", ErrInvalidContentType)
+		return fmt.Errorf("ReadJSON: %w", ErrInvalidContentType)
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
-		return v, fmt.Errorf("ReadJSON: %w", err)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("ReadJSON: %w", err)
 	}
 
-	if !v.Valid() {
-		return v, fmt.Errorf("ReadJSON: %w", ErrInvalidValue)
+	if !(*v).Valid() {
+		return fmt.Errorf("ReadJSON: %w", ErrInvalidValue)
 	}
 
-	return v, nil
+	return nil
 }
@@ -0,0 +1,450 @@
+// Package ws implements the parts of the WebSocket protocol (RFC 6455) the API needs: upgrading
+// a request on the server, dialing a server, and exchanging messages over the resulting connection.
+// Extensions and subprotocols are not supported.
+package ws
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Close codes defined by RFC 6455.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseUnsupportedData = 1003
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+	CloseInternalError   = 1011
+	CloseTryAgainLater   = 1013
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// acceptGUID is appended to the client's key to compute the Sec-WebSocket-Accept header.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// writeTimeout bounds how long a single frame may take to be written, so that a client which stopped
+// reading cannot hold up the server.
+const writeTimeout = 10 * time.Second
+
+// defaultReadLimit is the largest message accepted unless SetReadLimit says otherwise.
+const defaultReadLimit = 1 << 20
+
+var (
+	ErrBadHandshake = errors.New("ws: bad handshake")
+	ErrClosed       = errors.New("ws: connection closed")
+)
+
+// CloseError is returned by ReadMessage once the peer has closed the connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("ws: closed with code %d: %s", e.Code, e.Reason)
+}
+
+// protocolError fails the connection with the given close code.
+type protocolError struct {
+	code int
+	msg  string
+}
+
+func (e *protocolError) Error() string {
+	return "ws: " + e.msg
+}
+
+// Conn is a WebSocket connection. ReadMessage must only be called from one goroutine at a time,
+// while writes can be made from any goroutine.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool
+
+	readLimit   int64
+	idleTimeout time.Duration
+
+	wmu       sync.Mutex
+	closeSent bool
+}
+
+// Upgrade turns the request into a WebSocket connection. On failure an error response has already been written.
+// The API authenticates with tokens rather than cookies, so requests from any origin are accepted.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "not a websocket handshake", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+
+	netConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, fmt.Errorf("ws: hijack: %w", err)
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + acceptKey(key) + "\r\n\r\n"
+	netConn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := netConn.Write([]byte(response)); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("ws: write handshake: %w", err)
+	}
+	netConn.SetDeadline(time.Time{})
+
+	return newConn(netConn, brw.Reader, false), nil
+}
+
+// Dial opens a WebSocket connection to a ws:// or wss:// URL, sending the extra header with the handshake.
+func Dial(ctx context.Context, rawURL string, header http.Header) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("ws: parse url: %w", err)
+	}
+
+	host := u.Host
+	switch u.Scheme {
+	case "ws", "http":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss", "https":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("ws: unsupported scheme %q", u.Scheme)
+	}
+
+	var d net.Dialer
+	netConn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, fmt.Errorf("ws: dial: %w", err)
+	}
+	if u.Scheme == "wss" || u.Scheme == "https" {
+		tlsConn := tls.Client(netConn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			netConn.Close()
+			return nil, fmt.Errorf("ws: tls handshake: %w", err)
+		}
+		netConn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		netConn.SetDeadline(deadline)
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("ws: generate key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{Method: http.MethodGet, URL: u, Host: u.Host, Header: make(http.Header)}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(netConn); err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("ws: write handshake: %w", err)
+	}
+
+	br := bufio.NewReader(netConn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		netConn.Close()
+		return nil, fmt.Errorf("ws: read handshake: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		netConn.Close()
+		return nil, fmt.Errorf("%w: status %s", ErrBadHandshake, resp.Status)
+	}
+	netConn.SetDeadline(time.Time{})
+
+	return newConn(netConn, br, true), nil
+}
+
+func newConn(netConn net.Conn, br *bufio.Reader, client bool) *Conn {
+	return &Conn{
+		conn:      netConn,
+		br:        br,
+		client:    client,
+		readLimit: defaultReadLimit,
+	}
+}
+
+// SetReadLimit sets the size of the largest message the peer may send. Larger messages close the connection.
+func (c *Conn) SetReadLimit(limit int64) {
+	c.readLimit = limit
+}
+
+// SetIdleTimeout makes reads fail once the peer has not sent anything, not even a pong, for d.
+func (c *Conn) SetIdleTimeout(d time.Duration) {
+	c.idleTimeout = d
+}
+
+// SetReadDeadline sets the deadline of the next reads, overriding the idle timeout until then.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// ReadMessage returns the next text or binary message, answering pings and reassembling fragments along the way.
+// Once the peer closes the connection it returns a *CloseError.
+func (c *Conn) ReadMessage() ([]byte, error) {
+	var (
+		message []byte
+		opcode  byte
+	)
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			var perr *protocolError
+			if errors.As(err, &perr) {
+				c.Close(perr.code, perr.msg)
+			}
+			return nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			closeErr := &CloseError{Code: CloseNormal}
+			if len(payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(payload))
+				closeErr.Reason = string(payload[2:])
+			}
+			c.Close(closeErr.Code, "")
+			return nil, closeErr
+		case opText, opBinary:
+			if opcode != 0 {
+				c.Close(CloseProtocolError, "expected a continuation frame")
+				return nil, &protocolError{CloseProtocolError, "expected a continuation frame"}
+			}
+			opcode = op
+			message = payload
+		case opContinuation:
+			if opcode == 0 {
+				c.Close(CloseProtocolError, "unexpected continuation frame")
+				return nil, &protocolError{CloseProtocolError, "unexpected continuation frame"}
+			}
+			if int64(len(message)+len(payload)) > c.readLimit {
+				c.Close(CloseMessageTooBig, "message too big")
+				return nil, &protocolError{CloseMessageTooBig, "message too big"}
+			}
+			message = append(message, payload...)
+		}
+
+		if !fin {
+			continue
+		}
+		if opcode == opText && !utf8.Valid(message) {
+			c.Close(CloseInvalidPayload, "invalid utf-8")
+			return nil, &protocolError{CloseInvalidPayload, "invalid utf-8"}
+		}
+		return message, nil
+	}
+}
+
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	if c.idleTimeout > 0 {
+		c.conn.SetReadDeadline(time.Now().Add(c.idleTimeout))
+	}
+
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin := head[0]&0x80 != 0
+	op := head[0] & 0x0f
+	masked := head[1]&0x80 != 0
+
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, &protocolError{CloseProtocolError, "reserved bits set"}
+	}
+	if masked == c.client {
+		return false, 0, nil, &protocolError{CloseProtocolError, "invalid masking"}
+	}
+	switch op {
+	case opContinuation, opText, opBinary:
+	case opClose, opPing, opPong:
+		if !fin || head[1]&0x7f > 125 {
+			return false, 0, nil, &protocolError{CloseProtocolError, "invalid control frame"}
+		}
+	default:
+		return false, 0, nil, &protocolError{CloseProtocolError, "unknown opcode"}
+	}
+
+	length := int64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = int64(binary.BigEndian.Uint64(ext[:]))
+	}
+	if length < 0 || length > c.readLimit {
+		return false, 0, nil, &protocolError{CloseMessageTooBig, "message too big"}
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, op, payload, nil
+}
+
+// WriteMessage sends a text message.
+func (c *Conn) WriteMessage(data []byte) error {
+	return c.writeFrame(opText, data)
+}
+
+// Ping sends a ping, which the peer answers with a pong.
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+// Close sends a close frame with the given code and reason, unless one has been sent already, and closes the connection.
+func (c *Conn) Close(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > 125 {
+		payload = payload[:125]
+	}
+
+	c.writeFrame(opClose, payload)
+	return c.conn.Close()
+}
+
+func (c *Conn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if c.closeSent {
+		return ErrClosed
+	}
+	if op == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|op)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if c.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return fmt.Errorf("ws: generate mask: %w", err)
+		}
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.conn.Write(frame); err != nil {
+		return fmt.Errorf("ws: write: %w", err)
+	}
+	return nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value answering a Sec-WebSocket-Key.
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// headerContains reports whether the comma-separated header contains the token, ignoring case.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}